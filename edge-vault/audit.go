@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var audit_log = component_logger("audit")
+
+// Outcomes of an audited action.
+const (
+	audit_ok     = "ok"
+	audit_failed = "failed"
+)
+
+// The actor and source of actions sync-tower asks for. Who asked sync-tower
+// cannot be verified here, that goes into the entry's values instead.
+const audit_sync_tower = "sync-tower"
+
+const audit_page_size = 100
+
+// Audit_Entry is one row of AUDIT_LOG. Before and After are JSON, empty
+// when the action has nothing to show.
+type Audit_Entry struct {
+	Id      int64
+	Time    time.Time
+	Actor   string
+	Source  string
+	Action  string
+	Target  string
+	Before  string
+	After   string
+	Outcome string
+	Error   string
+}
+
+// record_audit appends an entry. An action that happened is not undone
+// when its entry cannot be written, that only gets logged.
+func record_audit(actor string, source string, action string, target string, before any, after any, action_err error) {
+	e := Audit_Entry{
+		Time:    time.Now(),
+		Actor:   actor,
+		Source:  source,
+		Action:  action,
+		Target:  target,
+		Before:  audit_json(before),
+		After:   audit_json(after),
+		Outcome: audit_ok,
+	}
+	if action_err != nil {
+		e.Outcome = audit_failed
+		e.Error = action_err.Error()
+	}
+	_, err := db.Exec(`INSERT INTO AUDIT_LOG (time, actor, source, action, target, before, after, outcome, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`,
+		e.Time.Unix(), e.Actor, e.Source, e.Action, e.Target, e.Before, e.After, e.Outcome, e.Error)
+	if err != nil {
+		audit_log.Error("Failed to record audit entry", "actor", actor, "action", action, "target", target, "err", err)
+	}
+}
+
+// audit_request records an action of the web console, by the user of the
+// session and from the address of the request.
+func audit_request(r *http.Request, action string, target string, before any, after any, action_err error) {
+	actor := ""
+	if s := current_session(r); s != nil {
+		actor = s.Username
+	}
+	record_audit(actor, request_ip(r), action, target, before, after, action_err)
+}
+
+func audit_json(v any) string {
+	if v == nil {
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%q", fmt.Sprint(v))
+	}
+	return string(b)
+}
+
+// Audit_Query filters the audit log, Actor and Action match exactly, Action
+// also as a prefix such as "queue.".
+type Audit_Query struct {
+	Actor  string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Page   int
+}
+
+func parse_audit_query(form url.Values, loc *time.Location) (*Audit_Query, error) {
+	q := &Audit_Query{
+		Actor:  strings.TrimSpace(form.Get("actor")),
+		Action: strings.TrimSpace(form.Get("action")),
+		Page:   1,
+	}
+	var err error
+	if s := form.Get("since"); s != "" {
+		if q.Since, err = parse_trace_time(s, loc); err != nil {
+			return nil, fmt.Errorf("since: %w", err)
+		}
+	}
+	if s := form.Get("until"); s != "" {
+		if q.Until, err = parse_trace_time(s, loc); err != nil {
+			return nil, fmt.Errorf("until: %w", err)
+		}
+	}
+	if s := form.Get("page"); s != "" {
+		if q.Page, err = strconv.Atoi(s); err != nil || q.Page < 1 {
+			return nil, fmt.Errorf("page %q is not a positive number", s)
+		}
+	}
+	return q, nil
+}
+
+func (q *Audit_Query) where() (string, []any) {
+	where := []string{"1 = 1"}
+	args := []any{}
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if q.Actor != "" {
+		add("actor = $%d", q.Actor)
+	}
+	if strings.HasSuffix(q.Action, ".") {
+		add("substr(action, 1, length($%[1]d)) = $%[1]d", q.Action)
+	} else if q.Action != "" {
+		add("action = $%d", q.Action)
+	}
+	if !q.Since.IsZero() {
+		add("time >= $%d", q.Since.Unix())
+	}
+	if !q.Until.IsZero() {
+		add("time < $%d", q.Until.Unix())
+	}
+	return strings.Join(where, " AND "), args
+}
+
+func (q *Audit_Query) values() url.Values {
+	v := url.Values{}
+	if q.Actor != "" {
+		v.Set("actor", q.Actor)
+	}
+	if q.Action != "" {
+		v.Set("action", q.Action)
+	}
+	if !q.Since.IsZero() {
+		v.Set("since", q.Since.Format("2006-01-02T15:04:05"))
+	}
+	if !q.Until.IsZero() {
+		v.Set("until", q.Until.Format("2006-01-02T15:04:05"))
+	}
+	return v
+}
+
+const audit_columns = `id, time, actor, source, action, target, before, after, outcome, error`
+
+func scan_audit_entry(scan func(dest ...any) error, loc *time.Location) (Audit_Entry, error) {
+	var e Audit_Entry
+	var t int64
+	err := scan(&e.Id, &t, &e.Actor, &e.Source, &e.Action, &e.Target, &e.Before, &e.After, &e.Outcome, &e.Error)
+	e.Time = time.Unix(t, 0).In(loc)
+	return e, err
+}
+
+// db_audit_page reads one page of the audit log, newest first, more tells
+// whether another page follows.
+func db_audit_page(ctx context.Context, q *Audit_Query, loc *time.Location) (entries []Audit_Entry, more bool, err error) {
+	where, args := q.where()
+	args = append(args, audit_page_size+1, (q.Page-1)*audit_page_size)
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM AUDIT_LOG WHERE %s ORDER BY id DESC LIMIT $%d OFFSET $%d;",
+		audit_columns, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	entries = []Audit_Entry{}
+	for rows.Next() {
+		e, err := scan_audit_entry(rows.Scan, loc)
+		if err != nil {
+			return nil, false, err
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) > audit_page_size {
+		return entries[:audit_page_size], true, rows.Err()
+	}
+	return entries, false, rows.Err()
+}
+
+var audit_export_columns = []string{"id", "time", "actor", "source", "action", "target", "before", "after", "outcome", "error"}
+
+// audit_export_source reads the matching entries oldest first in batches,
+// like the queue export, so the SQLite connection is not held.
+func audit_export_source(q *Audit_Query, loc *time.Location) export_source {
+	return func(ctx context.Context, fn func(Export_Row) error) error {
+		where, args := q.where()
+		last := int64(0)
+		for {
+			batch_args := append(slices.Clone(args), last)
+			rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM AUDIT_LOG WHERE %s AND id > $%d ORDER BY id LIMIT 500;",
+				audit_columns, where, len(batch_args)), batch_args...)
+			if err != nil {
+				return err
+			}
+			batch := []Audit_Entry{}
+			for rows.Next() {
+				e, err := scan_audit_entry(rows.Scan, loc)
+				if err != nil {
+					rows.Close()
+					return err
+				}
+				batch = append(batch, e)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil || len(batch) == 0 {
+				return err
+			}
+			for _, e := range batch {
+				row := Export_Row{Fields: []any{e.Id, e.Time, e.Actor, e.Source, e.Action, e.Target, e.Before, e.After, e.Outcome, e.Error}}
+				if err := fn(row); err != nil {
+					return err
+				}
+			}
+			last = batch[len(batch)-1].Id
+		}
+	}
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	loc, _ := time.LoadLocation(current_config().TracerTimezone)
+	data := struct {
+		Entries   []Audit_Entry
+		Query     *Audit_Query
+		Error     string
+		Since     string
+		Until     string
+		Timezone  string
+		Retention int
+		Prev_Page string
+		Next_Page string
+		Exports   map[string]string
+	}{
+		Timezone:  loc.String(),
+		Retention: current_config().AuditRetentionDays,
+	}
+	q, err := parse_audit_query(r.URL.Query(), loc)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		data.Error = err.Error()
+		data.Query = &Audit_Query{}
+		render(w, r, "audit.html", data)
+		return
+	}
+	data.Query = q
+	if !q.Since.IsZero() {
+		data.Since = q.Since.Format("2006-01-02T15:04")
+	}
+	if !q.Until.IsZero() {
+		data.Until = q.Until.Format("2006-01-02T15:04")
+	}
+	var more bool
+	data.Entries, more, err = db_audit_page(r.Context(), q, loc)
+	if err != nil {
+		audit_log.Warn("Failed to read audit log", "err", err)
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	page_url := func(page int) string {
+		v := q.values()
+		if page > 1 {
+			v.Set("page", strconv.Itoa(page))
+		}
+		return "/audit?" + v.Encode()
+	}
+	if q.Page > 1 {
+		data.Prev_Page = page_url(q.Page - 1)
+	}
+	if more {
+		data.Next_Page = page_url(q.Page + 1)
+	}
+	data.Exports = map[string]string{}
+	for _, format := range export_formats {
+		export := q.values()
+		export.Set("format", format)
+		data.Exports[format] = "/audit_export?" + export.Encode()
+	}
+	render(w, r, "audit.html", data)
+}
+
+func auditExportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if !slices.Contains(export_formats, format) {
+		http.Error(w, "format must be one of "+strings.Join(export_formats, ", "), http.StatusBadRequest)
+		return
+	}
+	loc, _ := time.LoadLocation(current_config().TracerTimezone)
+	q, err := parse_audit_query(query, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start_export(w, format, "audit-"+time.Now().In(loc).Format("20060102-1504")+"."+format)
+	count, err := write_export(r.Context(), w, format, audit_export_columns, audit_export_source(q, loc))
+	audit_request(r, "audit.export", "", nil, map[string]any{"format": format, "filter": q.values().Encode(), "rows": count}, err)
+	if err != nil {
+		audit_log.Warn("Audit export failed", "format", format, "rows", count, "err", err)
+	}
+}
+
+func spawn_audit_worker() {
+	go audit_retention_worker()
+	audit_log.Info("Successfully spawned audit retention worker")
+}
+
+// audit_retention_worker deletes entries older than audit_retention_days
+// once an hour, 0 keeps them forever.
+func audit_retention_worker() {
+	for {
+		if days := current_config().AuditRetentionDays; days > 0 {
+			cutoff := time.Now().AddDate(0, 0, -days)
+			res, err := db.Exec(`DELETE FROM AUDIT_LOG WHERE time < $1;`, cutoff.Unix())
+			if err != nil {
+				audit_log.Warn("Failed to apply audit retention", "err", err)
+			} else if n, _ := res.RowsAffected(); n > 0 {
+				audit_log.Info("Deleted old audit entries", "entries", n, "retention_days", days)
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
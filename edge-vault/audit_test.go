@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditJson(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+		want string
+	}{
+		{"nil", nil, ""},
+		{"map", map[string]any{"ttl": "24h", "ids": []int64{1, 2}}, `{"ids":[1,2],"ttl":"24h"}`},
+		{"string", "queue", `"queue"`},
+		{"not json", math.Inf(1), `"+Inf"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := audit_json(tt.v); got != tt.want {
+				t.Errorf("audit_json() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestIp(t *testing.T) {
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{"192.0.2.10:51234", "192.0.2.10"},
+		{"[2001:db8::1]:51234", "2001:db8::1"},
+		{"192.0.2.10", "192.0.2.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remote, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/audit", nil)
+			r.RemoteAddr = tt.remote
+			if got := request_ip(r); got != tt.want {
+				t.Errorf("request_ip() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAuditQuery(t *testing.T) {
+	kl, _ := time.LoadLocation("Asia/Kuala_Lumpur")
+	tests := []struct {
+		name    string
+		query   string
+		want    *Audit_Query
+		wantErr string
+	}{
+		{"defaults", "", &Audit_Query{Page: 1}, ""},
+		{"filters", "actor=+operator+&action=queue.&since=2025-01-31T13:45&until=2025-02-01T00:00&page=3",
+			&Audit_Query{Actor: "operator", Action: "queue.", Since: time.Date(2025, 1, 31, 13, 45, 0, 0, kl),
+				Until: time.Date(2025, 2, 1, 0, 0, 0, 0, kl), Page: 3}, ""},
+		{"bad since", "since=yesterday", nil, `since: "yesterday" is not a date and time`},
+		{"bad until", "until=31/01/2025", nil, "until:"},
+		{"page zero", "page=0", nil, `page "0" is not a positive number`},
+		{"page not a number", "page=two", nil, `page "two" is not a positive number`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parse_audit_query(form, kl)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parse_audit_query() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parse_audit_query() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditQueryWhere(t *testing.T) {
+	since, until := time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC), time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		q      Audit_Query
+		where  string
+		args   []any
+		values string
+	}{
+		{"everything", Audit_Query{}, "1 = 1", []any{}, ""},
+		{"exact action", Audit_Query{Actor: "operator", Action: "queue.retry"},
+			"1 = 1 AND actor = $1 AND action = $2", []any{"operator", "queue.retry"}, "action=queue.retry&actor=operator"},
+		{"action prefix", Audit_Query{Action: "queue."},
+			"1 = 1 AND substr(action, 1, length($1)) = $1", []any{"queue."}, "action=queue."},
+		{"time range", Audit_Query{Since: since, Until: until},
+			"1 = 1 AND time >= $1 AND time < $2", []any{since.Unix(), until.Unix()}, "since=2025-01-31T13%3A45%3A00&until=2025-02-01T00%3A00%3A00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, args := tt.q.where()
+			if where != tt.where || !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("where() = %q, %v, want %q, %v", where, args, tt.where, tt.args)
+			}
+			if got := tt.q.values().Encode(); got != tt.values {
+				t.Errorf("values() = %q, want %q", got, tt.values)
+			}
+		})
+	}
+}
+
+func TestRecordAudit(t *testing.T) {
+	test := test_db(t)
+	record_audit(audit_sync_tower, "192.0.2.1", "queue.retry", "1,2", nil, map[string]any{"ids": []int64{1, 2}}, nil)
+	r := httptest.NewRequest(http.MethodPost, "/queue_action", nil)
+	r.RemoteAddr = "192.0.2.10:51234"
+	r = r.WithContext(context.WithValue(r.Context(), web_session_key{}, &Web_Session{Username: "operator", Role: role_operator}))
+	audit_request(r, "queue.move", "3", "queue", "dead", errors.New("no such message"))
+
+	rows, err := test.Query(`SELECT actor, source, action, target, before, after, outcome, error FROM AUDIT_LOG ORDER BY id;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := [][]string{}
+	for rows.Next() {
+		e := make([]string, 8)
+		if err := rows.Scan(&e[0], &e[1], &e[2], &e[3], &e[4], &e[5], &e[6], &e[7]); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e)
+	}
+	want := [][]string{
+		{"sync-tower", "192.0.2.1", "queue.retry", "1,2", "", `{"ids":[1,2]}`, audit_ok, ""},
+		{"operator", "192.0.2.10", "queue.move", "3", `"queue"`, `"dead"`, audit_failed, "no such message"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AUDIT_LOG = %q, want %q", got, want)
+	}
+	if _, err := test.Exec(`UPDATE AUDIT_LOG SET actor = 'someone else';`); err == nil {
+		t.Error("AUDIT_LOG entries can be changed")
+	}
+}
+
+func TestDbAuditPage(t *testing.T) {
+	test_db(t)
+	for i := range audit_page_size + 1 {
+		record_audit("operator", "192.0.2.10", "queue.retry", fmt.Sprint(i+1), nil, nil, nil)
+	}
+	record_audit("operator", "192.0.2.10", "queue.move", "7", nil, nil, nil)
+	record_audit("admin", "192.0.2.11", "config.reload", "", nil, nil, nil)
+
+	tests := []struct {
+		name      string
+		q         Audit_Query
+		count     int
+		more      bool
+		newest_id int64
+	}{
+		{"first page", Audit_Query{Page: 1}, audit_page_size, true, 103},
+		{"last page", Audit_Query{Page: 2}, 3, false, 3},
+		{"actor", Audit_Query{Actor: "admin", Page: 1}, 1, false, 103},
+		{"action prefix", Audit_Query{Action: "queue.", Page: 2}, 2, false, 2},
+		{"exact action", Audit_Query{Action: "queue.move", Page: 1}, 1, false, 102},
+		{"prefix needs the dot", Audit_Query{Action: "queue", Page: 1}, 0, false, 0},
+		{"until before everything", Audit_Query{Until: time.Now().Add(-time.Hour), Page: 1}, 0, false, 0},
+		{"since", Audit_Query{Action: "config.", Since: time.Now().Add(-time.Hour), Page: 1}, 1, false, 103},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, more, err := db_audit_page(context.Background(), &tt.q, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.count || more != tt.more {
+				t.Fatalf("db_audit_page() = %d entries, more %v, want %d, %v", len(entries), more, tt.count, tt.more)
+			}
+			if len(entries) > 0 && entries[0].Id != tt.newest_id {
+				t.Errorf("newest entry %d, want %d", entries[0].Id, tt.newest_id)
+			}
+		})
+	}
+}
+
+func TestAuditExportSource(t *testing.T) {
+	test_db(t)
+	for i := range 1200 {
+		action := "queue.retry"
+		if i%2 == 1 {
+			action = "config.reload"
+		}
+		record_audit("operator", "192.0.2.10", action, "", nil, nil, nil)
+	}
+	tests := []struct {
+		name  string
+		q     Audit_Query
+		count int
+	}{
+		{"everything in batches", Audit_Query{Page: 1}, 1200},
+		{"filtered", Audit_Query{Action: "config.", Page: 1}, 600},
+		{"nothing", Audit_Query{Actor: "nobody", Page: 1}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := []int64{}
+			err := audit_export_source(&tt.q, time.UTC)(context.Background(), func(row Export_Row) error {
+				ids = append(ids, row.Fields[0].(int64))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != tt.count {
+				t.Fatalf("exported %d entries, want %d", len(ids), tt.count)
+			}
+			for i := 1; i < len(ids); i++ {
+				if ids[i] <= ids[i-1] {
+					t.Fatalf("entry %d exported after %d", ids[i], ids[i-1])
+				}
+			}
+		})
+	}
+}
+
+func TestAuditHandler(t *testing.T) {
+	test_web_config(t)
+	if err := test_web_files(t, ""); err != nil {
+		t.Fatal(err)
+	}
+	test_db(t)
+	record_audit("operator", "192.0.2.10", "queue.retry", "4", nil, nil, nil)
+
+	tests := []struct {
+		name   string
+		url    string
+		status int
+		body   string
+	}{
+		{"list", "/audit?action=queue.", http.StatusOK, "queue.retry"},
+		{"bad since", "/audit?since=yesterday", http.StatusBadRequest, "since:"},
+		{"bad page", "/audit?page=-1", http.StatusBadRequest, "is not a positive number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			auditHandler(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("status %d, want %d, body lacks %q:\n%s", w.Code, tt.status, tt.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuditExportHandler(t *testing.T) {
+	test_web_config(t)
+	test := test_db(t)
+	record_audit("operator", "192.0.2.10", "queue.retry", "4", nil, nil, nil)
+
+	tests := []struct {
+		name   string
+		url    string
+		status int
+		body   string
+	}{
+		{"csv", "/audit_export?format=csv&action=queue.", http.StatusOK, "id,time,actor,source,action,target,before,after,outcome,error\n"},
+		{"unknown format", "/audit_export?format=pdf", http.StatusBadRequest, "format must be one of"},
+		{"bad until", "/audit_export?format=csv&until=tomorrow", http.StatusBadRequest, "until:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			auditExportHandler(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("status %d, want %d, body lacks %q:\n%s", w.Code, tt.status, tt.body, w.Body.String())
+			}
+		})
+	}
+	// Only the export that ran is audited.
+	var after string
+	if err := test.QueryRow(`SELECT after FROM AUDIT_LOG WHERE action = 'audit.export';`).Scan(&after); err != nil {
+		t.Fatal(err)
+	}
+	if after != `{"filter":"action=queue.","format":"csv","rows":1}` {
+		t.Errorf("audit.export entry = %s", after)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Command types sent by sync-tower.
+const (
+	command_downlink = "downlink"
+	command_purge    = "purge"
+	command_resync   = "resync"
+	// Fetch the latest remote config now instead of on the next poll.
+	command_reconfigure = "reconfigure"
+)
+
+// Command is queued for this gateway on sync-tower and arrives either with
+// an uplink response or from the long-poll on command_endpoint.
+type Command struct {
+	Id         int64
+	Type       string
+	Payload    json.RawMessage
+	Created_By string
+}
+
+// Downlink is published on application/{Application}/device/{Dev_Eui}/command/down.
+type Downlink struct {
+	Application string
+	Dev_Eui     string
+	FPort       int
+	Data        string // base64
+	Confirmed   bool
+}
+
+// Purge drops queued uplinks older than Older_Than_Seconds, or all of them.
+type Purge struct {
+	Older_Than_Seconds int64
+}
+
+// The downlink topic is built from the application id and dev_eui_pattern,
+// so they must not carry MQTT separators or wildcards. sync-tower checks
+// them too.
+var application_id_pattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+var mqtt_client mqtt.Client
+
+var command_log = component_logger("command")
+
+var command_queue = make(chan Command, 100)
+
+// queue_commands hands commands to the command worker without blocking the
+// caller. Dropped commands are redelivered by sync-tower since they are
+// never acknowledged.
+func queue_commands(commands []Command) {
+	for _, c := range commands {
+		select {
+		case command_queue <- c:
+		default:
+			command_log.Warn("Queue full, dropped command", "command_id", c.Id, "type", c.Type, "outcome", "dropped")
+		}
+	}
+}
+
+func spawn_command_workers() {
+	go command_worker()
+	command_log.Info("Successfully spawned command worker")
+
+	if current_config().CommandEndpoint == "" {
+		command_log.Info("Command long-poll idle until a command_endpoint is configured")
+	}
+	go command_poll_worker()
+	command_log.Info("Successfully spawned command poll worker")
+}
+
+func command_poll_worker() {
+	command_log.Debug("Entering poll loop")
+	client := &http.Client{Timeout: 45 * time.Second}
+	failing := false
+	for {
+		appConfig := current_config()
+		if appConfig.CommandEndpoint == "" {
+			time.Sleep(30 * time.Second)
+			continue
+		}
+		commands, err := poll_commands(client, appConfig)
+		// Only log transitions, like the heartbeat.
+		if err != nil && !failing {
+			command_log.Warn("Failed to poll sync-tower", "err", err)
+		} else if err == nil && failing {
+			command_log.Info("Successfully reached sync-tower again")
+		}
+		failing = err != nil
+		if err != nil {
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		queue_commands(commands)
+	}
+}
+
+func poll_commands(client *http.Client, appConfig *AppConfig) ([]Command, error) {
+	req, err := http.NewRequest("GET", appConfig.CommandEndpoint+"/poll?wait=30s&gateway_id="+url.QueryEscape(gateway_id(appConfig)), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(sync_tower_request(req, appConfig))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("command poll rejected with status %d", resp.StatusCode)
+	}
+	var commands []Command
+	if err := json.NewDecoder(resp.Body).Decode(&commands); err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+func command_worker() {
+	command_log.Debug("Entering event loop")
+	client := &http.Client{Timeout: 10 * time.Second}
+	for c := range command_queue {
+		appConfig := current_config()
+		success, result, err := command_result(c.Id)
+		if errors.Is(err, sql.ErrNoRows) {
+			command_log.Debug("Executing command", "command_id", c.Id, "type", c.Type)
+			success, result = execute_command(appConfig, c)
+			var command_err error
+			if !success {
+				command_err = errors.New(result)
+			}
+			// Created_By is the api token sync-tower authenticated, which
+			// this gateway cannot check, so it is only kept as what
+			// sync-tower reported.
+			record_audit(audit_sync_tower, audit_sync_tower, "command."+c.Type, fmt.Sprintf("command %d", c.Id),
+				nil, map[string]any{"payload": c.Payload, "result": result, "requested_by": c.Created_By}, command_err)
+			_, err = db.Exec(`INSERT INTO COMMAND_LOG (command_id, type, success, result, executed_at) VALUES ($1, $2, $3, $4, $5);`,
+				c.Id, c.Type, success, result, time.Now().Unix())
+		}
+		if err != nil {
+			command_log.Warn("Failed to record command", "command_id", c.Id, "type", c.Type, "err", err)
+			continue
+		}
+		if success {
+			command_log.Info("Executed command", "command_id", c.Id, "type", c.Type, "outcome", "succeeded", "result", result)
+		} else {
+			command_log.Warn("Executed command", "command_id", c.Id, "type", c.Type, "outcome", "failed", "result", result)
+		}
+
+		if err := ack_command(client, appConfig, c.Id, success, result); err != nil {
+			// sync-tower redelivers it and we acknowledge from the log then.
+			command_log.Warn("Failed to acknowledge command", "command_id", c.Id, "err", err)
+			continue
+		}
+		db.Exec(`UPDATE COMMAND_LOG SET acked = 1 WHERE command_id = $1;`, c.Id)
+	}
+}
+
+func command_result(id int64) (success bool, result string, err error) {
+	err = db.QueryRow(`SELECT success, result FROM COMMAND_LOG WHERE command_id = $1;`, id).Scan(&success, &result)
+	return success, result, err
+}
+
+func execute_command(appConfig *AppConfig, c Command) (success bool, result string) {
+	var err error
+	switch c.Type {
+	case command_downlink:
+		result, err = execute_downlink(c.Payload)
+	case command_purge:
+		result, err = execute_purge(c.Payload)
+	case command_resync:
+		result, err = execute_resync(appConfig)
+	case command_reconfigure:
+		result, err = sync_remote_config()
+	default:
+		err = fmt.Errorf("unsupported command type %q", c.Type)
+	}
+	if err != nil {
+		return false, err.Error()
+	}
+	return true, result
+}
+
+func execute_downlink(payload json.RawMessage) (string, error) {
+	var d Downlink
+	if err := json.Unmarshal(payload, &d); err != nil {
+		return "", err
+	}
+	if !application_id_pattern.MatchString(d.Application) {
+		return "", fmt.Errorf("application %q is not a ChirpStack application id", d.Application)
+	}
+	if !dev_eui_pattern.MatchString(d.Dev_Eui) {
+		return "", fmt.Errorf("dev_eui %q is not 16 hex characters", d.Dev_Eui)
+	}
+	if d.FPort < 1 || d.FPort > 223 {
+		return "", fmt.Errorf("fport %d is not between 1 and 223", d.FPort)
+	}
+	if _, err := base64.StdEncoding.DecodeString(d.Data); err != nil {
+		return "", fmt.Errorf("data is not base64: %w", err)
+	}
+	// ChirpStack v4 downlink queue item.
+	body, err := json.Marshal(map[string]interface{}{
+		"devEui":    d.Dev_Eui,
+		"confirmed": d.Confirmed,
+		"fPort":     d.FPort,
+		"data":      d.Data,
+	})
+	if err != nil {
+		return "", err
+	}
+	topic := "application/" + d.Application + "/device/" + d.Dev_Eui + "/command/down"
+	reload_mu.Lock()
+	defer reload_mu.Unlock()
+	token := mqtt_client.Publish(topic, 1, false, body)
+	if !token.WaitTimeout(30 * time.Second) {
+		return "", errors.New("timed out publishing to " + topic)
+	}
+	if err := token.Error(); err != nil {
+		return "", err
+	}
+	return "published to " + topic, nil
+}
+
+func execute_purge(payload json.RawMessage) (string, error) {
+	var p Purge
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return "", err
+		}
+	}
+	// Not while a batch is being uploaded, it would delete rows the uplink
+	// worker is about to remove itself.
+	upload_mu.Lock()
+	defer upload_mu.Unlock()
+	var res sql.Result
+	var err error
+	if p.Older_Than_Seconds > 0 {
+		res, err = db.Exec(`DELETE FROM UPLINK_QUEUE WHERE received_at < $1;`, time.Now().Unix()-p.Older_Than_Seconds)
+	} else {
+		res, err = db.Exec(`DELETE FROM UPLINK_QUEUE;`)
+	}
+	if err != nil {
+		return "", err
+	}
+	n, _ := res.RowsAffected()
+	return fmt.Sprintf("purged %d queued messages", n), nil
+}
+
+// execute_resync reconnects to the MQTT broker, resubscribing on connect,
+// and reports a fresh heartbeat.
+func execute_resync(appConfig *AppConfig) (string, error) {
+	reload_mu.Lock()
+	defer reload_mu.Unlock()
+	mqtt_client.Disconnect(250)
+	mqtt_state.Store(mqtt_connecting)
+	token := mqtt_client.Connect()
+	if !token.WaitTimeout(30 * time.Second) {
+		return "", errors.New("timed out reconnecting to MQTT broker")
+	}
+	if err := token.Error(); err != nil {
+		return "", err
+	}
+	if appConfig.HeartbeatEndpoint != "" {
+		interval := time.Duration(appConfig.HeartbeatInterval)
+		hb := NewHeartbeat(appConfig, interval)
+		if err := send_heartbeat(&http.Client{Timeout: 10 * time.Second}, appConfig, hb); err != nil {
+			return "", fmt.Errorf("reconnected but heartbeat failed: %w", err)
+		}
+		return fmt.Sprintf("reconnected, %d messages queued", hb.Queue_Depth), nil
+	}
+	return "reconnected", nil
+}
+
+func ack_command(client *http.Client, appConfig *AppConfig, id int64, success bool, result string) error {
+	if appConfig.CommandEndpoint == "" {
+		return errors.New("no command_endpoint configured, sync-tower gives up on the command after a few deliveries")
+	}
+	body, err := json.Marshal(struct {
+		Id         int64
+		Gateway_Id string
+		Success    bool
+		Result     string
+	}{
+		Id:         id,
+		Gateway_Id: gateway_id(appConfig),
+		Success:    success,
+		Result:     result,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", appConfig.CommandEndpoint+"/ack", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(sync_tower_request(req, appConfig))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("acknowledgement rejected with status %d", resp.StatusCode)
+	}
+	return nil
+}
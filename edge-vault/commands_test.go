@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecuteDownlinkRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		wantErr string
+	}{
+		{"malformed", `[1]`, "cannot unmarshal"},
+		{"application with wildcard", `{"Application":"#","Dev_Eui":"0004a30b001c0530","FPort":10,"Data":"AQI="}`, "application"},
+		{"dev_eui with topic separator", `{"Application":"5f0c6a4e-8a52-4c8e-9d6c-0f7d3b2a1e90","Dev_Eui":"0004a30b/01c0530","FPort":10,"Data":"AQI="}`, "dev_eui"},
+		{"fport 0 is reserved for MAC commands", `{"Application":"5f0c6a4e-8a52-4c8e-9d6c-0f7d3b2a1e90","Dev_Eui":"0004a30b001c0530","FPort":0,"Data":"AQI="}`, "fport"},
+		{"fport missing", `{"Application":"5f0c6a4e-8a52-4c8e-9d6c-0f7d3b2a1e90","Dev_Eui":"0004a30b001c0530","Data":"AQI="}`, "fport"},
+		{"fport above 223", `{"Application":"5f0c6a4e-8a52-4c8e-9d6c-0f7d3b2a1e90","Dev_Eui":"0004a30b001c0530","FPort":224,"Data":"AQI="}`, "fport"},
+		{"data not base64", `{"Application":"5f0c6a4e-8a52-4c8e-9d6c-0f7d3b2a1e90","Dev_Eui":"0004a30b001c0530","FPort":10,"Data":"%%"}`, "base64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := execute_downlink(json.RawMessage(tt.payload))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("execute_downlink() = %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExecutePurge(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		result  string
+		left    int
+	}{
+		{"everything", ``, "purged 3 queued messages", 0},
+		{"everything with empty payload", `{}`, "purged 3 queued messages", 0},
+		{"older than", `{"Older_Than_Seconds":1800}`, "purged 2 queued messages", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test := test_db(t)
+			for i, age := range []time.Duration{2 * time.Hour, time.Hour, time.Minute} {
+				_, err := test.Exec(`INSERT INTO UPLINK_QUEUE (msg_id, deduplication_id, payload, received_at) VALUES ($1, $1, '{}', $2);`,
+					string(rune('a'+i)), time.Now().Add(-age).Unix())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			result, err := execute_purge(json.RawMessage(tt.payload))
+			if err != nil || result != tt.result {
+				t.Errorf("execute_purge() = %q, %v, want %q", result, err, tt.result)
+			}
+			var left int
+			test.QueryRow(`SELECT count(*) FROM UPLINK_QUEUE;`).Scan(&left)
+			if left != tt.left {
+				t.Errorf("%d messages left, want %d", left, tt.left)
+			}
+		})
+	}
+}
+
+func TestPollAndAckCommands(t *testing.T) {
+	var acked struct {
+		Id         int64
+		Gateway_Id string
+		Success    bool
+		Result     string
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer 4e81b0d9c27a6f35" || r.Header.Get("X-Gateway-Id") != "spectra-gw-01" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/cache-sync/commands/poll":
+			if r.URL.Query().Get("gateway_id") != "spectra-gw-01" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`[{"Id":7,"Type":"purge","Payload":{},"Created_By":"ops"}]`))
+		case "/cache-sync/commands/ack":
+			json.NewDecoder(r.Body).Decode(&acked)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		config  AppConfig
+		wantErr bool
+	}{
+		{"authenticated", AppConfig{GatewayId: "spectra-gw-01", GatewayToken: "4e81b0d9c27a6f35", CommandEndpoint: server.URL + "/cache-sync/commands"}, false},
+		{"wrong token", AppConfig{GatewayId: "spectra-gw-01", GatewayToken: "wrong", CommandEndpoint: server.URL + "/cache-sync/commands"}, true},
+		{"no token", AppConfig{GatewayId: "spectra-gw-01", CommandEndpoint: server.URL + "/cache-sync/commands"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands, err := poll_commands(server.Client(), &tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("poll_commands() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (len(commands) != 1 || commands[0].Id != 7 || commands[0].Created_By != "ops") {
+				t.Errorf("poll_commands() = %+v", commands)
+			}
+			err = ack_command(server.Client(), &tt.config, 7, true, "purged 0 queued messages")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ack_command() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (acked.Id != 7 || acked.Gateway_Id != "spectra-gw-01" || !acked.Success) {
+				t.Errorf("sync-tower received %+v", acked)
+			}
+		})
+	}
+}
+
+func TestAckCommandWithoutEndpoint(t *testing.T) {
+	if err := ack_command(http.DefaultClient, &AppConfig{GatewayId: "spectra-gw-01"}, 7, true, ""); err == nil {
+		t.Error("ack_command() without a command_endpoint succeeded")
+	}
+}
+
+func TestSyncTowerRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		config AppConfig
+		auth   string
+	}{
+		{"with token", AppConfig{GatewayId: "spectra-gw-01", GatewayToken: "4e81b0d9c27a6f35"}, "Bearer 4e81b0d9c27a6f35"},
+		{"without token", AppConfig{GatewayId: "spectra-gw-01"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := sync_tower_request(httptest.NewRequest(http.MethodGet, "/cache-sync/commands/poll", nil), &tt.config)
+			if req.Header.Get("X-Gateway-Id") != "spectra-gw-01" || req.Header.Get("Authorization") != tt.auth {
+				t.Errorf("headers %v", req.Header)
+			}
+		})
+	}
+}
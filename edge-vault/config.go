@@ -0,0 +1,646 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// AppConfig is one environment of config.yaml. The comment on a field is
+// its default, see DefaultConfig.
+type AppConfig struct {
+	// ChirpStack's PostgreSQL integration, read by the Data Tracer and the
+	// LNS page.
+	DatabaseHost     string `yaml:"local_database_host"`     // localhost
+	DatabasePort     int    `yaml:"local_database_port"`     // 5432
+	DatabaseName     string `yaml:"local_database_database"` // cp_integration
+	DatabaseUsername Secret `yaml:"local_database_username"` // required
+	DatabasePassword Secret `yaml:"local_database_password"` // ""
+
+	MqttBrokerAddress  string `yaml:"mqtt_broker_address"`  // required
+	MqttBrokerPort     int    `yaml:"mqtt_broker_port"`     // 1883
+	MqttBrokerUser     Secret `yaml:"mqtt_broker_user"`     // "", anonymous
+	MqttBrokerPassword Secret `yaml:"mqtt_broker_password"` // ""
+	UplinkEndpoint     string `yaml:"uplink_endpoint"`      // required
+	WebPort            int    `yaml:"web_port"`             // 8081
+	WebDir             string `yaml:"web_dir"`              // "", the templates built into the binary
+
+	WebUsers           []Web_User      `yaml:"web_users"`            // none, the console only shows the login page
+	WebApiTokens       []Web_Api_Token `yaml:"web_api_tokens"`       // none
+	WebSessionLifetime Duration        `yaml:"web_session_lifetime"` // 12h
+
+	TracerTimezone string `yaml:"tracer_timezone"`  // Local, e.g. Asia/Kuala_Lumpur
+	TracerPageSize int    `yaml:"tracer_page_size"` // 100
+	TracerMaxRows  int    `yaml:"tracer_max_rows"`  // 1000
+	// Exports are streamed, this only bounds how long one may run.
+	TracerExportMaxRows int    `yaml:"tracer_export_max_rows"` // 1000000
+	GatewayId           string `yaml:"gateway_id"`             // "", the hostname
+	NtpServer           string `yaml:"ntp_server"`             // pool.ntp.org, "" skips the clock check
+	AuditRetentionDays  int    `yaml:"audit_retention_days"`   // 365, 0 keeps the audit log forever
+
+	// The first rule matching a message sets how long it may wait for upload.
+	QueueTtls           []Queue_Ttl `yaml:"queue_ttls"`            // none, messages never expire
+	QueueExpiryInterval Duration    `yaml:"queue_expiry_interval"` // 1m
+
+	// Compaction of the queue during long outages, see compact_queue.
+	DownsampleEnable     Bool     `yaml:"downsample_enable"`      // n
+	DownsampleQueueDepth int      `yaml:"downsample_queue_depth"` // 10000, 0 ignores the depth
+	DownsampleAge        Duration `yaml:"downsample_age"`         // 24h, 0 ignores the age
+	DownsampleWindow     Duration `yaml:"downsample_window"`      // 15m
+	DownsampleInterval   Duration `yaml:"downsample_interval"`    // 10m
+
+	// Sent to sync-tower as a bearer token, its gateway_tokens entry for
+	// gateway_id. Heartbeats are only accepted from, and commands and remote
+	// config only handed to, a gateway that sends it.
+	GatewayToken Secret `yaml:"gateway_token"` // ""
+
+	HeartbeatEndpoint  string   `yaml:"heartbeat_endpoint"`   // "", no heartbeat
+	HeartbeatInterval  Duration `yaml:"heartbeat_interval"`   // 60s
+	CommandEndpoint    string   `yaml:"command_endpoint"`     // "", commands only arrive with uplink responses and are never acknowledged
+	ConfigEndpoint     string   `yaml:"config_endpoint"`      // "", no remote config
+	ConfigPollInterval Duration `yaml:"config_poll_interval"` // 5m
+	ConfigWatch        Bool     `yaml:"config_watch"`         // n
+
+	LogFormat string           `yaml:"log_format"` // text, or json
+	LogLevel  Level            `yaml:"log_level"`  // info
+	LogLevels map[string]Level `yaml:"log_levels"` // per component, e.g. mqtt: debug
+}
+
+func DefaultConfig() *AppConfig {
+	return &AppConfig{
+		DatabaseHost:         "localhost",
+		DatabasePort:         5432,
+		DatabaseName:         "cp_integration",
+		MqttBrokerPort:       1883,
+		WebPort:              8081,
+		HeartbeatInterval:    Duration(60 * time.Second),
+		ConfigPollInterval:   Duration(5 * time.Minute),
+		WebSessionLifetime:   Duration(12 * time.Hour),
+		TracerTimezone:       "Local",
+		TracerPageSize:       100,
+		TracerMaxRows:        1000,
+		TracerExportMaxRows:  1000000,
+		NtpServer:            "pool.ntp.org",
+		AuditRetentionDays:   365,
+		QueueExpiryInterval:  Duration(time.Minute),
+		DownsampleQueueDepth: 10000,
+		DownsampleAge:        Duration(24 * time.Hour),
+		DownsampleWindow:     Duration(15 * time.Minute),
+		DownsampleInterval:   Duration(10 * time.Minute),
+		LogFormat:            log_text,
+		LogLevel:             Level(slog.LevelInfo),
+	}
+}
+
+// Duration is a Go duration string such as "500ms" or "1h".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil || parsed < 0 {
+		return config_type_error(value, "%q is not a duration such as 30s or 5m", value.Value)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) LogValue() slog.Value {
+	return slog.DurationValue(time.Duration(d))
+}
+
+// Bool accepts the historic y/n as well as true/false style values.
+type Bool bool
+
+func (b *Bool) UnmarshalYAML(value *yaml.Node) error {
+	switch strings.ToLower(value.Value) {
+	case "y", "yes", "on":
+		*b = true
+		return nil
+	case "n", "no", "off":
+		*b = false
+		return nil
+	}
+	parsed, err := strconv.ParseBool(value.Value)
+	if err != nil {
+		return config_type_error(value, "%q is not y or n", value.Value)
+	}
+	*b = Bool(parsed)
+	return nil
+}
+
+// Secret is a config value that is kept out of logs and templates. It may
+// reference environment variables as ${NAME}, and any secret key can instead
+// be given as key_file naming a file that holds it, such as a Docker secret.
+type Secret string
+
+// secret_file_tag marks a node load_config filled from a key_file, its value
+// is taken as is.
+const secret_file_tag = "!secret_file"
+
+var env_reference = regexp.MustCompile(`\$\{[A-Za-z_][A-Za-z0-9_]*\}`)
+
+var secret_type = reflect.TypeOf(Secret(""))
+
+func (s *Secret) UnmarshalYAML(value *yaml.Node) error {
+	if value.Tag == secret_file_tag {
+		*s = Secret(value.Value)
+		return nil
+	}
+	missing := []string{}
+	expanded := env_reference.ReplaceAllStringFunc(value.Value, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return val
+	})
+	if len(missing) > 0 {
+		return config_type_error(value, "environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	*s = Secret(expanded)
+	return nil
+}
+
+// String is what gets logged. URLs keep their host and path so they can
+// still be told apart.
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	if u, err := url.Parse(string(s)); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Scheme + "://" + redacted + "@" + u.Host + u.Path
+	}
+	return redacted
+}
+
+const redacted = "********"
+
+// LogValue keeps the secret out of JSON logs, which do not use String.
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+// config_type_error is collected by the yaml decoder alongside its own
+// errors instead of stopping the decode.
+func config_type_error(value *yaml.Node, format string, args ...any) error {
+	return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: ", value.Line) + fmt.Sprintf(format, args...)}}
+}
+
+// Config_Problem is one finding of the validator. Warnings do not stop the
+// config from loading. Line is 0 for a remote config, which has no file.
+type Config_Problem struct {
+	Line    int
+	Key     string
+	Message string
+	Warning bool
+}
+
+func (p Config_Problem) String() string {
+	s := ""
+	if p.Line > 0 {
+		s = fmt.Sprintf("line %d: ", p.Line)
+	}
+	if p.Warning {
+		s += "warning: "
+	}
+	if p.Key != "" {
+		s += p.Key + ": "
+	}
+	return s + p.Message
+}
+
+var yaml_error_line = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// type_error_problems turns the messages of a yaml.TypeError into problems,
+// naming the key from its line where there is one.
+func type_error_problems(err error, lines map[string]int, def_line int) ([]Config_Problem, error) {
+	var type_err *yaml.TypeError
+	if !errors.As(err, &type_err) {
+		return nil, err
+	}
+	problems := []Config_Problem{}
+	for _, msg := range type_err.Errors {
+		p := Config_Problem{Line: def_line, Message: msg}
+		if m := yaml_error_line.FindStringSubmatch(msg); m != nil {
+			p.Line, _ = strconv.Atoi(m[1])
+			p.Message = m[2]
+			p.Key = config_key_at(lines, p.Line)
+		}
+		problems = append(problems, p)
+	}
+	return problems, nil
+}
+
+// load_config reads environment env of path, reporting every problem it
+// finds rather than stopping at the first. err is only set when the file
+// cannot be read or parsed at all.
+func load_config(path string, env string) (*AppConfig, []Config_Problem, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, errors.New("expected a mapping of environments")
+	}
+	root := doc.Content[0]
+	var env_key, env_node *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == env {
+			env_key, env_node = root.Content[i], root.Content[i+1]
+		}
+	}
+	if env_node == nil {
+		return nil, nil, fmt.Errorf("no such environment: %s", env)
+	}
+
+	problems := []Config_Problem{}
+	lines := map[string]int{"": env_key.Line}
+	config_keys(env_node, reflect.TypeOf(AppConfig{}), "", lines, &problems)
+
+	appConfig := DefaultConfig()
+	if err := env_node.Decode(appConfig); err != nil {
+		decode_problems, err := type_error_problems(err, lines, env_key.Line)
+		if err != nil {
+			return nil, nil, err
+		}
+		problems = append(problems, decode_problems...)
+	}
+
+	v := &config_validator{lines: lines}
+	v.validate(appConfig)
+	problems = append(problems, v.problems...)
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return appConfig, problems, nil
+}
+
+// LoadConfig loads environment env of config.yaml. Warnings are logged,
+// any other problem makes it fail with all of them.
+func LoadConfig(env string) (*AppConfig, error) {
+	appConfig, problems, err := load_config("config.yaml", env)
+	if err != nil {
+		return nil, err
+	}
+	errs := []error{}
+	for _, p := range problems {
+		if p.Warning {
+			main_log.Warn("config.yaml " + p.String())
+		} else {
+			errs = append(errs, errors.New("config.yaml "+p.String()))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return appConfig, nil
+}
+
+// validate_config checks a config that did not come straight from a file,
+// such as config.yaml with a remote version laid over it.
+func validate_config(c *AppConfig) error {
+	v := &config_validator{lines: map[string]int{}}
+	v.validate(c)
+	errs := []error{}
+	for _, p := range v.problems {
+		if !p.Warning {
+			errs = append(errs, errors.New(p.String()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// config_keys walks node alongside the type it decodes into, recording the
+// line of every key under its dotted path and warning about keys that no
+// field is tagged with. key_file entries of Secret fields are read here,
+// before the node is decoded.
+func config_keys(node *yaml.Node, t reflect.Type, path string, lines map[string]int, problems *[]Config_Problem) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		if t.Kind() != reflect.Struct {
+			return
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+			if name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			key_path := key.Value
+			if path != "" {
+				key_path = path + "." + key.Value
+			}
+			lines[key_path] = key.Line
+			field, ok := fields[key.Value]
+			if base, is_file := strings.CutSuffix(key.Value, "_file"); !ok && is_file && fields[base] == secret_type {
+				config_secret_file(node, i, base, key_path, problems)
+				continue
+			}
+			if !ok {
+				*problems = append(*problems, Config_Problem{Line: key.Line, Key: key_path, Message: "unknown key, ignored", Warning: true})
+				continue
+			}
+			config_keys(node.Content[i+1], field, key_path, lines, problems)
+		}
+	case yaml.SequenceNode:
+		if t.Kind() != reflect.Slice {
+			return
+		}
+		for i, item := range node.Content {
+			item_path := fmt.Sprintf("%s[%d]", path, i)
+			lines[item_path] = item.Line
+			config_keys(item, t.Elem(), item_path, lines, problems)
+		}
+	}
+}
+
+// config_secret_file replaces the key_file pair at node.Content[i] with key
+// and the content of the file it names.
+func config_secret_file(node *yaml.Node, i int, key string, key_path string, problems *[]Config_Problem) {
+	file_key, path := node.Content[i], node.Content[i+1]
+	for j := 0; j+1 < len(node.Content); j += 2 {
+		if node.Content[j].Value == key {
+			*problems = append(*problems, Config_Problem{Line: file_key.Line, Key: key_path, Message: "set only one of " + key + " and " + file_key.Value})
+			return
+		}
+	}
+	raw, err := os.ReadFile(path.Value)
+	if err != nil {
+		*problems = append(*problems, Config_Problem{Line: file_key.Line, Key: key_path, Message: err.Error()})
+		return
+	}
+	file_key.Value = key
+	*path = yaml.Node{Kind: yaml.ScalarNode, Tag: secret_file_tag, Value: strings.TrimRight(string(raw), "\r\n"), Line: path.Line, Column: path.Column}
+}
+
+// config_key_at names the deepest key on line, for decoder errors that only
+// carry a line number.
+func config_key_at(lines map[string]int, line int) string {
+	found := ""
+	for key, l := range lines {
+		if l == line && len(key) > len(found) {
+			found = key
+		}
+	}
+	return found
+}
+
+type config_validator struct {
+	lines    map[string]int
+	problems []Config_Problem
+}
+
+// line finds the line of key, or of its closest parent when key is absent.
+func (v *config_validator) line(key string) int {
+	for key != "" {
+		if l, ok := v.lines[key]; ok {
+			return l
+		}
+		i := strings.LastIndexAny(key, ".[")
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return v.lines[""]
+}
+
+func (v *config_validator) errorf(key string, format string, args ...any) {
+	v.problems = append(v.problems, Config_Problem{Line: v.line(key), Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *config_validator) required(key string, val string) {
+	if strings.TrimSpace(val) == "" {
+		v.errorf(key, "is required")
+	}
+}
+
+// url checks an optional URL against the allowed schemes.
+func (v *config_validator) url(key string, val string, schemes ...string) {
+	if val == "" {
+		return
+	}
+	u, err := url.Parse(val)
+	if err != nil || u.Host == "" || !slices.Contains(schemes, u.Scheme) {
+		v.errorf(key, "%q is not a URL with scheme %s", val, strings.Join(schemes, ", "))
+	}
+}
+
+func (v *config_validator) port(key string, val int) {
+	if val < 1 || val > 65535 {
+		v.errorf(key, "%d is not a port number", val)
+	}
+}
+
+func (v *config_validator) at_least(key string, val int, low int) {
+	if val < low {
+		v.errorf(key, "must be at least %d, got %d", low, val)
+	}
+}
+
+func (v *config_validator) positive(key string, val Duration) {
+	if val <= 0 {
+		v.errorf(key, "must be longer than 0")
+	}
+}
+
+func (v *config_validator) one_of(key string, val string, allowed ...string) {
+	if !slices.Contains(allowed, val) {
+		v.errorf(key, "%q is not one of %s", val, strings.Join(allowed, ", "))
+	}
+}
+
+func (v *config_validator) validate(c *AppConfig) {
+	v.required("local_database_host", c.DatabaseHost)
+	v.port("local_database_port", c.DatabasePort)
+	v.required("local_database_database", c.DatabaseName)
+	v.required("local_database_username", string(c.DatabaseUsername))
+
+	v.required("mqtt_broker_address", c.MqttBrokerAddress)
+	v.port("mqtt_broker_port", c.MqttBrokerPort)
+	v.port("web_port", c.WebPort)
+	if c.WebDir != "" {
+		if _, err := os.Stat(filepath.Join(c.WebDir, "index.html")); err != nil {
+			v.errorf("web_dir", "%q has no index.html", c.WebDir)
+		}
+	}
+
+	v.required("uplink_endpoint", c.UplinkEndpoint)
+	v.url("uplink_endpoint", c.UplinkEndpoint, "http", "https")
+	v.url("heartbeat_endpoint", c.HeartbeatEndpoint, "http", "https")
+	v.url("command_endpoint", c.CommandEndpoint, "http", "https")
+	v.url("config_endpoint", c.ConfigEndpoint, "http", "https")
+
+	v.positive("heartbeat_interval", c.HeartbeatInterval)
+	v.positive("config_poll_interval", c.ConfigPollInterval)
+
+	v.validate_web(c)
+
+	if _, err := time.LoadLocation(c.TracerTimezone); err != nil {
+		v.errorf("tracer_timezone", "%q is not a time zone such as Asia/Kuala_Lumpur", c.TracerTimezone)
+	}
+	v.at_least("tracer_page_size", c.TracerPageSize, 1)
+	v.at_least("tracer_max_rows", c.TracerMaxRows, 1)
+	v.at_least("tracer_export_max_rows", c.TracerExportMaxRows, 1)
+	v.at_least("audit_retention_days", c.AuditRetentionDays, 0)
+
+	for i, t := range c.QueueTtls {
+		key := fmt.Sprintf("queue_ttls[%d]", i)
+		if t.Ttl < 0 {
+			v.errorf(key+".ttl", "must not be negative")
+		}
+		if t.Action != "" {
+			v.one_of(key+".action", t.Action, expiry_drop, expiry_archive)
+		}
+		// Only uplinks are queued, any other event type would never match.
+		v.one_of(key+".event_type", t.EventType, "", "up")
+	}
+	v.positive("queue_expiry_interval", c.QueueExpiryInterval)
+
+	v.at_least("downsample_queue_depth", c.DownsampleQueueDepth, 0)
+	if c.DownsampleAge < 0 {
+		v.errorf("downsample_age", "must not be negative")
+	}
+	if c.DownsampleEnable && c.DownsampleQueueDepth == 0 && c.DownsampleAge == 0 {
+		v.errorf("downsample_enable", "needs downsample_queue_depth or downsample_age")
+	}
+	if c.DownsampleWindow < Duration(time.Minute) {
+		v.errorf("downsample_window", "must be at least 1m")
+	}
+	v.positive("downsample_interval", c.DownsampleInterval)
+
+	v.one_of("log_format", c.LogFormat, log_text, log_json)
+	for component := range c.LogLevels {
+		if _, ok := log_levels[component]; !ok {
+			v.errorf("log_levels."+component, "unknown component, one of %s", strings.Join(log_components(), ", "))
+		}
+	}
+}
+
+// sample_passwords are the passwords of sample configs, a console account
+// still using one would be open to anyone who read them.
+var sample_passwords = []string{"changeme"}
+
+func sample_password(hash Secret) bool {
+	for _, password := range sample_passwords {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *config_validator) validate_web(c *AppConfig) {
+	usernames := map[string]bool{}
+	for i, u := range c.WebUsers {
+		key := fmt.Sprintf("web_users[%d]", i)
+		v.required(key+".username", u.Username)
+		if usernames[u.Username] {
+			v.errorf(key+".username", "duplicate user %s", u.Username)
+		}
+		usernames[u.Username] = true
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			v.errorf(key+".password_hash", "is not a bcrypt hash, see cache-sync hash-password")
+		} else if sample_password(u.PasswordHash) {
+			v.errorf(key+".password_hash", "is the hash of a sample password, create a new one with cache-sync hash-password")
+		}
+		v.one_of(key+".role", u.Role, web_roles...)
+	}
+	names := map[string]bool{}
+	for i, t := range c.WebApiTokens {
+		key := fmt.Sprintf("web_api_tokens[%d]", i)
+		v.required(key+".name", t.Name)
+		if names[t.Name] {
+			v.errorf(key+".name", "duplicate token %s", t.Name)
+		}
+		names[t.Name] = true
+		if len(t.Token) < 16 {
+			v.errorf(key+".token", "must be at least 16 characters")
+		}
+		v.one_of(key+".role", t.Role, web_roles...)
+	}
+	v.positive("web_session_lifetime", c.WebSessionLifetime)
+}
+
+// check_config implements the check-config command. It validates every
+// environment of the file, or only those named, and prints each problem.
+func check_config(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	path := flags.String("config", "config.yaml", "config file to check")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: cache-sync check-config [-config config.yaml] [environment...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	envs := flags.Args()
+	if len(envs) == 0 {
+		var all map[string]yaml.Node
+		raw, err := os.ReadFile(*path)
+		if err == nil {
+			err = yaml.Unmarshal(raw, &all)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, *path+": "+err.Error())
+			return 1
+		}
+		for env := range all {
+			envs = append(envs, env)
+		}
+		sort.Strings(envs)
+	}
+
+	failed := false
+	for _, env := range envs {
+		_, problems, err := load_config(*path, env)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, *path+": "+err.Error())
+			failed = true
+			continue
+		}
+		errs := 0
+		for _, p := range problems {
+			fmt.Printf("%s:%d: [%s] %s\n", *path, p.Line, env, strings.TrimPrefix(p.String(), fmt.Sprintf("line %d: ", p.Line)))
+			if !p.Warning {
+				errs++
+			}
+		}
+		if errs > 0 {
+			failed = true
+			fmt.Printf("%s: [%s] %d errors\n", *path, env, errs)
+		} else {
+			fmt.Printf("%s: [%s] OK\n", *path, env)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
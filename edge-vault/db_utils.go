@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"sync"
 )
 
@@ -12,24 +13,26 @@ type DBManager struct {
 	mu        sync.Mutex
 }
 
-const (
-	host     = "192.168.230.1"
-	port     = 5432
-	user     = "su_admin"
-	password = "changeme"
-	dbname   = "cp_integration"
-)
+// postgres_dsn is the connection string of the local_database_* settings.
+// It holds the password, so it is never logged.
+func postgres_dsn(appConfig *AppConfig) string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		dsn_value(appConfig.DatabaseHost), appConfig.DatabasePort, dsn_value(string(appConfig.DatabaseUsername)),
+		dsn_value(string(appConfig.DatabasePassword)), dsn_value(appConfig.DatabaseName))
+}
 
-var psqlInfo = fmt.Sprintf("host=%s port=%d user=%s "+
-	"password=%s dbname=%s sslmode=disable",
-	host, port, user, password, dbname)
+// dsn_value quotes a keyword/value connection string value, so a password
+// with spaces or quotes cannot end it early.
+func dsn_value(val string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(val) + "'"
+}
 
-func NewDBManager() (*DBManager, error) {
+func NewDBManager(appConfig *AppConfig) (*DBManager, error) {
 	db1, err := sql.Open("sqlite", "sqlite.db")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database 1: %w", err)
 	}
-	db2, err := sql.Open("postgres", psqlInfo)
+	db2, err := sql.Open("postgres", postgres_dsn(appConfig))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database 2: %w", err)
 	}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestPostgresDsn(t *testing.T) {
+	tests := []struct {
+		name     string
+		password Secret
+		want     string
+	}{
+		{"no password", "", "host='localhost' port=5432 user='cache-sync' password='' dbname='cp_integration' sslmode=disable"},
+		{"plain", "b7d2f9a4", "host='localhost' port=5432 user='cache-sync' password='b7d2f9a4' dbname='cp_integration' sslmode=disable"},
+		{"spaces and quotes", `b7 d2'f9\a4`, `host='localhost' port=5432 user='cache-sync' password='b7 d2\'f9\\a4' dbname='cp_integration' sslmode=disable`},
+		{"option smuggled in", "x sslmode=require", "host='localhost' port=5432 user='cache-sync' password='x sslmode=require' dbname='cp_integration' sslmode=disable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid_config()
+			c.DatabasePassword = tt.password
+			dsn := postgres_dsn(c)
+			if dsn != tt.want {
+				t.Errorf("postgres_dsn() = %s, want %s", dsn, tt.want)
+			}
+			if _, err := pq.NewConnector(dsn); err != nil {
+				t.Errorf("lib/pq cannot parse %s: %v", dsn, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outcomes of a diagnostic check.
+const (
+	diagnostic_ok      = "ok"
+	diagnostic_warning = "warning"
+	diagnostic_failed  = "failed"
+	diagnostic_skipped = "skipped"
+)
+
+// How long one check may take, and the limits past which a check warns.
+const (
+	diagnostic_timeout      = 10 * time.Second
+	diagnostic_cert_expiry  = 14 * 24 * time.Hour
+	diagnostic_clock_warn   = time.Second
+	diagnostic_clock_fail   = time.Minute
+	diagnostic_disk_warn    = 512 * 1024 * 1024
+	diagnostic_disk_fail    = 64 * 1024 * 1024
+	diagnostic_slow_latency = 2 * time.Second
+)
+
+// Diagnostic is the result of one check of the Maintenance page.
+type Diagnostic struct {
+	Name        string
+	Target      string
+	Status      string
+	Detail      string
+	Duration_Ms int64
+}
+
+type Diagnostics_Report struct {
+	Gateway_Id  string
+	Started_At  time.Time
+	Duration_Ms int64
+	Status      string
+	Checks      []Diagnostic
+}
+
+type diagnostic_check struct {
+	name   string
+	target string
+	run    func(ctx context.Context) (status string, detail string)
+}
+
+// last_diagnostics is shown on the Maintenance page until the next run.
+var last_diagnostics atomic.Pointer[Diagnostics_Report]
+
+// Runs one at a time, a second request waits for the first and runs again.
+var diagnostics_mu sync.Mutex
+
+// run_diagnostics checks everything edge-vault depends on, concurrently, and
+// reports the checks in a fixed order.
+func run_diagnostics(ctx context.Context, appConfig *AppConfig) *Diagnostics_Report {
+	diagnostics_mu.Lock()
+	defer diagnostics_mu.Unlock()
+
+	report := &Diagnostics_Report{
+		Gateway_Id: gateway_id(appConfig),
+		Started_At: time.Now(),
+		Status:     diagnostic_ok,
+	}
+	checks := diagnostic_checks(appConfig)
+	report.Checks = make([]Diagnostic, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, diagnostic_timeout)
+			defer cancel()
+			start := time.Now()
+			status, detail := check.run(ctx)
+			report.Checks[i] = Diagnostic{
+				Name:        check.name,
+				Target:      check.target,
+				Status:      status,
+				Detail:      detail,
+				Duration_Ms: time.Since(start).Milliseconds(),
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, d := range report.Checks {
+		if d.Status == diagnostic_failed || (d.Status == diagnostic_warning && report.Status == diagnostic_ok) {
+			report.Status = d.Status
+		}
+	}
+	report.Duration_Ms = time.Since(report.Started_At).Milliseconds()
+	last_diagnostics.Store(report)
+	web_log.Info("Ran diagnostics", "status", report.Status, "duration_ms", report.Duration_Ms)
+	return report
+}
+
+func diagnostic_checks(appConfig *AppConfig) []diagnostic_check {
+	uplink, _ := url.Parse(appConfig.UplinkEndpoint)
+	uplink_addr := net.JoinHostPort(uplink.Hostname(), uplink.Port())
+	if uplink.Port() == "" {
+		uplink_addr = net.JoinHostPort(uplink.Hostname(), map[string]string{"http": "80", "https": "443"}[uplink.Scheme])
+	}
+	mqtt_addr := net.JoinHostPort(appConfig.MqttBrokerAddress, fmt.Sprint(appConfig.MqttBrokerPort))
+	ntp_addr := appConfig.NtpServer
+	if _, _, err := net.SplitHostPort(ntp_addr); err != nil && ntp_addr != "" {
+		ntp_addr = net.JoinHostPort(ntp_addr, "123")
+	}
+
+	return []diagnostic_check{
+		{"DNS", uplink.Hostname(), func(ctx context.Context) (string, string) {
+			return check_dns(ctx, uplink.Hostname())
+		}},
+		{"TCP/TLS", uplink_addr, func(ctx context.Context) (string, string) {
+			return check_tcp_tls(ctx, uplink_addr, uplink.Scheme == "https", uplink.Hostname())
+		}},
+		{"HTTP", appConfig.UplinkEndpoint, func(ctx context.Context) (string, string) {
+			return check_http(ctx, appConfig.UplinkEndpoint)
+		}},
+		{"MQTT", mqtt_addr, func(ctx context.Context) (string, string) {
+			return check_mqtt(ctx, mqtt_addr)
+		}},
+		{"Clock", ntp_addr, func(ctx context.Context) (string, string) {
+			return check_clock(ctx, ntp_addr)
+		}},
+		{"Disk", ".", func(ctx context.Context) (string, string) {
+			return check_disk(".")
+		}},
+		{"SQLite", "sqlite.db", func(ctx context.Context) (string, string) {
+			return check_sqlite(ctx)
+		}},
+	}
+}
+
+func check_dns(ctx context.Context, host string) (string, string) {
+	if net.ParseIP(host) != nil {
+		return diagnostic_skipped, "the endpoint is an IP address"
+	}
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return diagnostic_failed, err.Error()
+	}
+	return diagnostic_ok, fmt.Sprintf("resolved to %v in %s", addrs, time.Since(start).Round(time.Millisecond))
+}
+
+func check_tcp_tls(ctx context.Context, addr string, use_tls bool, server_name string) (string, string) {
+	start := time.Now()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return diagnostic_failed, err.Error()
+	}
+	defer conn.Close()
+	connected := time.Since(start).Round(time.Millisecond)
+	if !use_tls {
+		return diagnostic_ok, fmt.Sprintf("connected in %s, plain http", connected)
+	}
+
+	tls_conn := tls.Client(conn, &tls.Config{ServerName: server_name})
+	if err := tls_conn.HandshakeContext(ctx); err != nil {
+		return diagnostic_failed, fmt.Sprintf("connected in %s, TLS handshake failed: %v", connected, err)
+	}
+	state := tls_conn.ConnectionState()
+	cert := state.PeerCertificates[0]
+	detail := fmt.Sprintf("connected in %s, %s handshake in %s, certificate for %s expires %s",
+		connected, tls.VersionName(state.Version), time.Since(start).Round(time.Millisecond)-connected,
+		cert.Subject.CommonName, cert.NotAfter.Format(time.DateOnly))
+	if time.Until(cert.NotAfter) < diagnostic_cert_expiry {
+		return diagnostic_warning, detail
+	}
+	return diagnostic_ok, detail
+}
+
+// check_http only asks whether the endpoint answers, the uplink endpoint
+// only accepts POST so any status but a server error counts.
+func check_http(ctx context.Context, endpoint string) (string, string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return diagnostic_failed, err.Error()
+	}
+	start := time.Now()
+	resp, err := (&http.Client{Timeout: diagnostic_timeout}).Do(req)
+	if err != nil {
+		return diagnostic_failed, err.Error()
+	}
+	resp.Body.Close()
+	latency := time.Since(start)
+	detail := fmt.Sprintf("%s in %s", resp.Status, latency.Round(time.Millisecond))
+	if resp.StatusCode >= 500 || latency > diagnostic_slow_latency {
+		return diagnostic_warning, detail
+	}
+	return diagnostic_ok, detail
+}
+
+func check_mqtt(ctx context.Context, addr string) (string, string) {
+	state := mqtt_state.Load().(string)
+	start := time.Now()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return diagnostic_failed, fmt.Sprintf("%v, client is %s", err, state)
+	}
+	conn.Close()
+	detail := fmt.Sprintf("broker reachable in %s, client is %s", time.Since(start).Round(time.Millisecond), state)
+	if state != mqtt_connected {
+		return diagnostic_warning, detail
+	}
+	return diagnostic_ok, detail
+}
+
+func check_clock(ctx context.Context, addr string) (string, string) {
+	if addr == "" {
+		return diagnostic_skipped, "no ntp_server configured"
+	}
+	offset, err := ntp_offset(ctx, addr)
+	if err != nil {
+		return diagnostic_failed, err.Error()
+	}
+	detail := fmt.Sprintf("gateway clock is off by %s", offset.Round(time.Millisecond))
+	switch offset = offset.Abs(); {
+	case offset > diagnostic_clock_fail:
+		return diagnostic_failed, detail
+	case offset > diagnostic_clock_warn:
+		return diagnostic_warning, detail
+	}
+	return diagnostic_ok, detail
+}
+
+// Seconds from the NTP epoch, 1900, to the Unix epoch.
+const ntp_epoch_offset = 2208988800
+
+// ntp_offset asks an NTP server, as an SNTP client, how far the local clock
+// is from it. Positive means the gateway is behind.
+func ntp_offset(ctx context.Context, addr string) (time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // no leap warning, version 4, client mode
+	sent := time.Now()
+	binary.BigEndian.PutUint64(req[40:], ntp_time(sent))
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	received := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	if n < 48 {
+		return 0, errors.New("short NTP response")
+	}
+	// The server echoes our transmit time, anything else is not our answer.
+	if binary.BigEndian.Uint64(resp[24:]) != binary.BigEndian.Uint64(req[40:]) {
+		return 0, errors.New("NTP response does not match the request")
+	}
+	if resp[1] == 0 {
+		return 0, fmt.Errorf("NTP server refused the request (%s)", resp[12:16])
+	}
+	server_received := from_ntp_time(binary.BigEndian.Uint64(resp[32:]))
+	server_sent := from_ntp_time(binary.BigEndian.Uint64(resp[40:]))
+	return (server_received.Sub(sent) + server_sent.Sub(received)) / 2, nil
+}
+
+func ntp_time(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntp_epoch_offset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+func from_ntp_time(v uint64) time.Time {
+	secs := int64(v>>32) - ntp_epoch_offset
+	nanos := int64((v & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs, nanos)
+}
+
+func check_disk(path string) (string, string) {
+	abs, _ := filepath.Abs(path)
+	free := disk_free(path)
+	detail := fmt.Sprintf("%.0f MB free on %s", float64(free)/1024/1024, abs)
+	switch {
+	case free < diagnostic_disk_fail:
+		return diagnostic_failed, detail
+	case free < diagnostic_disk_warn:
+		return diagnostic_warning, detail
+	}
+	return diagnostic_ok, detail
+}
+
+// check_sqlite runs an integrity check over the uplink queue. It reads the
+// whole file, which is small as long as uploads keep up.
+func check_sqlite(ctx context.Context) (string, string) {
+	rows, err := db.QueryContext(ctx, "PRAGMA integrity_check;")
+	if err != nil {
+		return diagnostic_failed, err.Error()
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return diagnostic_failed, err.Error()
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return diagnostic_failed, err.Error()
+	}
+	if len(problems) > 0 {
+		return diagnostic_failed, fmt.Sprintf("%d problems, first: %s", len(problems), problems[0])
+	}
+	// The rows hold the only connection until closed.
+	rows.Close()
+	depth, _, _ := queue_stats()
+	return diagnostic_ok, fmt.Sprintf("integrity ok, %d queued messages", depth)
+}
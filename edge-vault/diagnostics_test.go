@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fake_ntp_server answers SNTP requests with a clock offset from the local
+// one. A stratum of 0 is a kiss-o'-death, echo false answers someone else.
+func fake_ntp_server(t *testing.T, offset time.Duration, stratum byte, echo bool) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		req := make([]byte, 48)
+		for {
+			n, addr, err := conn.ReadFrom(req)
+			if err != nil {
+				return
+			}
+			if n < 48 {
+				continue
+			}
+			resp := make([]byte, 48)
+			resp[0], resp[1] = 0x24, stratum
+			copy(resp[12:16], "RATE")
+			if echo {
+				copy(resp[24:32], req[40:48])
+			}
+			now := ntp_time(time.Now().Add(offset))
+			binary.BigEndian.PutUint64(resp[32:], now)
+			binary.BigEndian.PutUint64(resp[40:], now)
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// closed_addr is a local address nothing listens on.
+func closed_addr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestNtpTime(t *testing.T) {
+	tests := []time.Time{
+		time.Unix(0, 0),
+		time.Date(2025, 1, 31, 13, 45, 0, 500000000, time.UTC),
+		time.Date(2035, 12, 31, 23, 59, 59, 999999000, time.UTC),
+	}
+	for _, want := range tests {
+		t.Run(want.String(), func(t *testing.T) {
+			got := from_ntp_time(ntp_time(want))
+			if d := got.Sub(want).Abs(); d > time.Microsecond {
+				t.Errorf("round trip %v, off by %v", got, d)
+			}
+		})
+	}
+	if ntp_time(time.Unix(0, 0))>>32 != ntp_epoch_offset {
+		t.Error("the Unix epoch is not 2208988800 seconds after the NTP epoch")
+	}
+}
+
+func TestCheckClock(t *testing.T) {
+	tests := []struct {
+		name   string
+		addr   func(t *testing.T) string
+		status string
+		detail string
+	}{
+		{"in sync", func(t *testing.T) string { return fake_ntp_server(t, 0, 2, true) }, diagnostic_ok, "off by"},
+		{"gateway behind", func(t *testing.T) string { return fake_ntp_server(t, 5*time.Second, 2, true) }, diagnostic_warning, "off by 5"},
+		{"gateway ahead", func(t *testing.T) string { return fake_ntp_server(t, -5*time.Second, 2, true) }, diagnostic_warning, "off by -5"},
+		{"far off", func(t *testing.T) string { return fake_ntp_server(t, 2*time.Minute, 2, true) }, diagnostic_failed, "off by 2m"},
+		{"kiss of death", func(t *testing.T) string { return fake_ntp_server(t, 0, 0, true) }, diagnostic_failed, "refused the request (RATE)"},
+		{"not our answer", func(t *testing.T) string { return fake_ntp_server(t, 0, 2, false) }, diagnostic_failed, "does not match"},
+		{"not configured", func(t *testing.T) string { return "" }, diagnostic_skipped, "no ntp_server"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			status, detail := check_clock(ctx, tt.addr(t))
+			if status != tt.status || !strings.Contains(detail, tt.detail) {
+				t.Errorf("check_clock() = %s, %q, want %s, %q", status, detail, tt.status, tt.detail)
+			}
+		})
+	}
+}
+
+func TestCheckHttp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cache-sync/uplink":
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case "/broken":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	tests := []struct {
+		name     string
+		endpoint string
+		status   string
+		detail   string
+	}{
+		{"answers", server.URL + "/cache-sync/uplink", diagnostic_ok, "405 Method Not Allowed"},
+		{"server error", server.URL + "/broken", diagnostic_warning, "503 Service Unavailable"},
+		{"unreachable", "http://" + closed_addr(t) + "/cache-sync/uplink", diagnostic_failed, "refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, detail := check_http(context.Background(), tt.endpoint)
+			if status != tt.status || !strings.Contains(detail, tt.detail) {
+				t.Errorf("check_http() = %s, %q, want %s, %q", status, detail, tt.status, tt.detail)
+			}
+		})
+	}
+}
+
+func TestCheckTcpTls(t *testing.T) {
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+	// httptest's certificate is not trusted by the system roots.
+	untrusted := httptest.NewTLSServer(http.NotFoundHandler())
+	defer untrusted.Close()
+	tests := []struct {
+		name    string
+		addr    string
+		use_tls bool
+		status  string
+		detail  string
+	}{
+		{"plain http", plain.Listener.Addr().String(), false, diagnostic_ok, "plain http"},
+		{"untrusted certificate", untrusted.Listener.Addr().String(), true, diagnostic_failed, "TLS handshake failed"},
+		{"unreachable", closed_addr(t), false, diagnostic_failed, "refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, detail := check_tcp_tls(context.Background(), tt.addr, tt.use_tls, "example.com")
+			if status != tt.status || !strings.Contains(detail, tt.detail) {
+				t.Errorf("check_tcp_tls() = %s, %q, want %s, %q", status, detail, tt.status, tt.detail)
+			}
+		})
+	}
+}
+
+func TestCheckMqtt(t *testing.T) {
+	broker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	prev := mqtt_state.Load()
+	t.Cleanup(func() { mqtt_state.Store(prev) })
+	tests := []struct {
+		name   string
+		addr   string
+		state  string
+		status string
+	}{
+		{"connected", broker.Addr().String(), mqtt_connected, diagnostic_ok},
+		{"reachable but client not connected", broker.Addr().String(), mqtt_connecting, diagnostic_warning},
+		{"unreachable", closed_addr(t), mqtt_connecting, diagnostic_failed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mqtt_state.Store(tt.state)
+			status, detail := check_mqtt(context.Background(), tt.addr)
+			if status != tt.status || !strings.Contains(detail, "client is "+tt.state) {
+				t.Errorf("check_mqtt() = %s, %q, want %s", status, detail, tt.status)
+			}
+		})
+	}
+}
+
+func TestCheckDns(t *testing.T) {
+	if status, _ := check_dns(context.Background(), "10.0.0.5"); status != diagnostic_skipped {
+		t.Errorf("check_dns() of an IP address = %s, want %s", status, diagnostic_skipped)
+	}
+	if status, detail := check_dns(context.Background(), "localhost"); status != diagnostic_ok {
+		t.Errorf("check_dns(localhost) = %s, %q", status, detail)
+	}
+}
+
+func TestCheckSqlite(t *testing.T) {
+	test := test_db(t)
+	test.Exec(`INSERT INTO UPLINK_QUEUE (msg_id, deduplication_id, payload, received_at) VALUES ('a', 'a', '{}', 0);`)
+	if status, detail := check_sqlite(context.Background()); status != diagnostic_ok || detail != "integrity ok, 1 queued messages" {
+		t.Errorf("check_sqlite() = %s, %q", status, detail)
+	}
+}
+
+func TestDiagnosticChecks(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   AppConfig
+		uplink   string
+		mqtt     string
+		ntp      string
+		hostname string
+	}{
+		{"https default port", AppConfig{UplinkEndpoint: "https://sync.example.com/cache-sync/uplink", MqttBrokerAddress: "localhost", MqttBrokerPort: 1883, NtpServer: "pool.ntp.org"},
+			"sync.example.com:443", "localhost:1883", "pool.ntp.org:123", "sync.example.com"},
+		{"http explicit port", AppConfig{UplinkEndpoint: "http://10.0.0.5:8080/cache-sync/uplink", MqttBrokerAddress: "10.0.0.6", MqttBrokerPort: 8883, NtpServer: "10.0.0.1:1123"},
+			"10.0.0.5:8080", "10.0.0.6:8883", "10.0.0.1:1123", "10.0.0.5"},
+		{"no ntp server", AppConfig{UplinkEndpoint: "http://sync.example.com/cache-sync/uplink", MqttBrokerAddress: "localhost", MqttBrokerPort: 1883},
+			"sync.example.com:80", "localhost:1883", "", "sync.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := map[string]string{}
+			names := []string{}
+			for _, c := range diagnostic_checks(&tt.config) {
+				targets[c.name] = c.target
+				names = append(names, c.name)
+			}
+			if strings.Join(names, ",") != "DNS,TCP/TLS,HTTP,MQTT,Clock,Disk,SQLite" {
+				t.Errorf("checks %v", names)
+			}
+			if targets["DNS"] != tt.hostname || targets["TCP/TLS"] != tt.uplink || targets["MQTT"] != tt.mqtt || targets["Clock"] != tt.ntp {
+				t.Errorf("targets %v", targets)
+			}
+		})
+	}
+}
+
+func TestDiagnosticsHandler(t *testing.T) {
+	test_db(t)
+	test_web_config(t)
+	uplink := httptest.NewServer(http.NotFoundHandler())
+	defer uplink.Close()
+	host, port, _ := net.SplitHostPort(closed_addr(t))
+	c := current_config()
+	c.UplinkEndpoint = uplink.URL + "/cache-sync/uplink"
+	c.MqttBrokerAddress = host
+	c.MqttBrokerPort, _ = strconv.Atoi(port)
+	c.NtpServer = fake_ntp_server(t, 0, 2, true)
+
+	prev := last_diagnostics.Load()
+	last_diagnostics.Store(nil)
+	t.Cleanup(func() { last_diagnostics.Store(prev) })
+
+	tests := []struct {
+		name   string
+		method string
+		role   string
+		code   int
+	}{
+		{"nothing run yet", http.MethodGet, role_viewer, http.StatusNotFound},
+		{"viewer may not run", http.MethodPost, role_viewer, http.StatusForbidden},
+		{"operator runs", http.MethodPost, role_operator, http.StatusOK},
+		{"viewer sees the last run", http.MethodGet, role_viewer, http.StatusOK},
+		{"other methods", http.MethodDelete, role_admin, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/maintenance/diagnostics", nil)
+			r = r.WithContext(context.WithValue(r.Context(), web_session_key{}, &Web_Session{Username: tt.role, Role: tt.role}))
+			w := httptest.NewRecorder()
+			diagnosticsHandler(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.code, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var report Diagnostics_Report
+			if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+				t.Fatal(err)
+			}
+			statuses := map[string]string{}
+			for _, d := range report.Checks {
+				statuses[d.Name] = d.Status
+			}
+			// MQTT cannot be reached, which fails the whole run.
+			if report.Status != diagnostic_failed || statuses["MQTT"] != diagnostic_failed || statuses["DNS"] != diagnostic_skipped ||
+				statuses["HTTP"] != diagnostic_ok || statuses["Clock"] != diagnostic_ok || statuses["SQLite"] != diagnostic_ok {
+				t.Errorf("report %s, checks %v", report.Status, statuses)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// aggregate_key marks a payload made by compaction, sync-tower stores those
+// apart from raw uplinks.
+const aggregate_key = "aggregate"
+
+// Aggregate_Field sums up one numeric field of the replaced uplinks.
+type Aggregate_Field struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+	Last float64 `json:"last"`
+}
+
+// Aggregate is the aggregate_key of a compacted payload. Fields are keyed
+// by their path in the payload, such as object.sensor.temperature.
+type Aggregate struct {
+	Window_Start time.Time                  `json:"windowStart"`
+	Window_End   time.Time                  `json:"windowEnd"`
+	Count        int                        `json:"count"`
+	First_Time   time.Time                  `json:"firstTime"`
+	Last_Time    time.Time                  `json:"lastTime"`
+	Fields       map[string]Aggregate_Field `json:"fields"`
+}
+
+// compact_window is one device's closed window holding enough uplinks to
+// compact, first_id and last_id are the ones kept.
+type compact_window struct {
+	dev_eui  string
+	start    int64
+	count    int
+	first_id int64
+	last_id  int64
+}
+
+func spawn_downsample_worker() {
+	go downsample_worker()
+	queue_log.Info("Successfully spawned downsample worker")
+}
+
+func downsample_worker() {
+	for {
+		appConfig := current_config()
+		if appConfig.DownsampleEnable {
+			replaced, created, err := compact_queue(appConfig, time.Now())
+			if err != nil {
+				queue_log.Warn("Failed to compact uplink queue", "err", err)
+			} else if replaced > 0 {
+				queue_log.Info("Compacted uplink queue", "replaced", replaced, "aggregates", created)
+			}
+		}
+		time.Sleep(time.Duration(appConfig.DownsampleInterval))
+	}
+}
+
+// compact_queue replaces the queued uplinks of each device within each
+// closed downsample_window by the first and last of them and one aggregate
+// of those in between, once the queue is deeper or older than configured.
+// A window that fails is logged and skipped, the others still compact.
+func compact_queue(appConfig *AppConfig, now time.Time) (replaced int, created int, err error) {
+	depth, oldest_age, err := queue_stats()
+	if err != nil {
+		return 0, 0, err
+	}
+	deep := appConfig.DownsampleQueueDepth > 0 && depth > int64(appConfig.DownsampleQueueDepth)
+	old := appConfig.DownsampleAge > 0 && oldest_age > time.Duration(appConfig.DownsampleAge)
+	if !deep && !old {
+		return 0, 0, nil
+	}
+
+	upload_mu.Lock()
+	defer upload_mu.Unlock()
+
+	// Keeping the first and last, one aggregate only saves a row when it
+	// replaces at least two.
+	window := int64(time.Duration(appConfig.DownsampleWindow).Seconds())
+	current := now.Unix() / window * window
+	rows, err := db.Query(`SELECT json_extract(CAST(payload AS TEXT), '$.deviceInfo.devEui') AS dev_eui,
+			received_at / $1 * $1 AS window_start, count(*), min(id), max(id)
+		FROM UPLINK_QUEUE
+		WHERE received_at > 0 AND received_at < $2 AND json_extract(CAST(payload AS TEXT), '$.`+aggregate_key+`') IS NULL
+		GROUP BY dev_eui, window_start
+		HAVING dev_eui IS NOT NULL AND dev_eui != '' AND count(*) >= 4
+		ORDER BY window_start, dev_eui;`, window, current)
+	if err != nil {
+		return 0, 0, err
+	}
+	windows := []compact_window{}
+	for rows.Next() {
+		var w compact_window
+		if err := rows.Scan(&w.dev_eui, &w.start, &w.count, &w.first_id, &w.last_id); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		windows = append(windows, w)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	for _, w := range windows {
+		start := time.Unix(w.start, 0).UTC()
+		n, err := w.compact(start, start.Add(time.Duration(window)*time.Second))
+		if err != nil {
+			queue_log.Warn("Failed to compact window, skipped", "dev_eui", w.dev_eui, "window_start", start.Format(time.RFC3339), "err", err)
+			continue
+		}
+		if n > 0 {
+			replaced += n
+			created++
+		}
+	}
+	return replaced, created, nil
+}
+
+// compact replaces the uplinks of w between its first and last by one
+// aggregate in a single transaction, and returns how many it replaced. The
+// aggregate takes the lowest id of them, so it keeps their place in the
+// upload order, and expires when the last of them to expire would have.
+func (w compact_window) compact(start time.Time, end time.Time) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	where := `WHERE id > $1 AND id < $2 AND received_at >= $3 AND received_at < $4
+		AND json_extract(CAST(payload AS TEXT), '$.deviceInfo.devEui') = $5
+		AND json_extract(CAST(payload AS TEXT), '$.` + aggregate_key + `') IS NULL`
+	args := []any{w.first_id, w.last_id, start.Unix(), end.Unix(), w.dev_eui}
+	rows, err := tx.Query(`SELECT id, payload, received_at, expires_at, expiry_action FROM UPLINK_QUEUE `+where+` ORDER BY id;`, args...)
+	if err != nil {
+		return 0, err
+	}
+	a := new_aggregator(start, end)
+	var lowest_id, received_at, expires_at int64
+	var expiry_action string
+	never := false
+	for rows.Next() {
+		var id, row_received_at, row_expires_at int64
+		var payload, row_expiry_action string
+		if err := rows.Scan(&id, &payload, &row_received_at, &row_expires_at, &row_expiry_action); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if lowest_id == 0 {
+			lowest_id = id
+		}
+		a.add(payload, row_received_at)
+		received_at = row_received_at
+		never = never || row_expires_at == 0
+		if row_expires_at >= expires_at {
+			expires_at, expiry_action = row_expires_at, row_expiry_action
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if a.agg.Count < 2 {
+		return 0, nil
+	}
+	if never {
+		expires_at, expiry_action = 0, ""
+	}
+
+	id := uuid.New().String()
+	payload, err := a.payload(id)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM UPLINK_QUEUE `+where+`;`, args...); err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`INSERT INTO UPLINK_QUEUE (id, msg_id, deduplication_id, payload, received_at, expires_at, expiry_action)
+		VALUES ($1, $2, $3, $4, $5, $6, $7);`, lowest_id, id, id, payload, received_at, expires_at, expiry_action)
+	if err != nil {
+		return 0, err
+	}
+	return a.agg.Count, tx.Commit()
+}
+
+// aggregator sums up uplinks one at a time, so a window never has to be
+// held in memory.
+type aggregator struct {
+	agg    Aggregate
+	sums   map[string]float64
+	counts map[string]int
+	last   string
+}
+
+func new_aggregator(start time.Time, end time.Time) *aggregator {
+	return &aggregator{
+		agg:    Aggregate{Window_Start: start, Window_End: end, Fields: map[string]Aggregate_Field{}},
+		sums:   map[string]float64{},
+		counts: map[string]int{},
+	}
+}
+
+// add sums up the numeric fields under object of payload, in the order the
+// uplinks were queued.
+func (a *aggregator) add(payload string, received_at int64) {
+	t := payload_time(payload, received_at)
+	if a.agg.Count == 0 {
+		a.agg.First_Time = t
+	}
+	a.agg.Last_Time = t
+	a.agg.Count++
+	a.last = payload
+	for path, val := range flatten_payload(payload) {
+		n, ok := val.(json.Number)
+		if !ok || !strings.HasPrefix(path, "object.") {
+			continue
+		}
+		v, err := n.Float64()
+		if err != nil || math.IsInf(v, 0) {
+			continue
+		}
+		f, seen := a.agg.Fields[path]
+		if !seen {
+			f.Min, f.Max = v, v
+		}
+		f.Min, f.Max, f.Last = min(f.Min, v), max(f.Max, v), v
+		a.agg.Fields[path] = f
+		a.sums[path] += v
+		a.counts[path]++
+	}
+}
+
+// payload builds a ChirpStack-like uplink for the aggregate from the last
+// payload added, with the numeric fields of all of them summed up under
+// aggregate_key instead of the readings.
+func (a *aggregator) payload(deduplication_id string) ([]byte, error) {
+	var last map[string]any
+	if err := json.Unmarshal([]byte(a.last), &last); err != nil {
+		return nil, err
+	}
+	agg := a.agg
+	agg.Fields = map[string]Aggregate_Field{}
+	for path, f := range a.agg.Fields {
+		f.Mean = a.sums[path] / float64(a.counts[path])
+		agg.Fields[path] = f
+	}
+
+	payload := map[string]any{
+		"deduplicationId": deduplication_id,
+		"time":            agg.Last_Time.Format(time.RFC3339Nano),
+		aggregate_key:     agg,
+	}
+	for _, key := range []string{"deviceInfo", "devAddr", "fPort"} {
+		if v, ok := last[key]; ok {
+			payload[key] = v
+		}
+	}
+	return json.Marshal(payload)
+}
+
+// payload_time is the time ChirpStack gave the uplink, or when it was
+// queued.
+func payload_time(payload string, received_at int64) time.Time {
+	var p struct {
+		Time time.Time `json:"time"`
+	}
+	if json.Unmarshal([]byte(payload), &p) == nil && !p.Time.IsZero() {
+		return p.Time.UTC()
+	}
+	return time.Unix(received_at, 0).UTC()
+}
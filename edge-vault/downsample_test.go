@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// uplink_payload is a ChirpStack uplink of dev_eui with object as readings.
+func uplink_payload(dev_eui string, t time.Time, object string) string {
+	return fmt.Sprintf(`{"deduplicationId":"%s-%d","time":%q,"deviceInfo":{"deviceName":"pump-1","devEui":%q},"devAddr":"01ab23cd","fPort":10,"fCnt":%d,"object":%s}`,
+		dev_eui, t.Unix(), t.Format(time.RFC3339Nano), dev_eui, t.Unix()%1000, object)
+}
+
+func TestPayloadTime(t *testing.T) {
+	received := time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		payload string
+		want    time.Time
+	}{
+		{"chirpstack time", `{"time":"2025-01-31T21:40:12.5+08:00"}`, time.Date(2025, 1, 31, 13, 40, 12, 5e8, time.UTC)},
+		{"no time", `{"fCnt":7}`, received},
+		{"bad time", `{"time":"yesterday"}`, received},
+		{"not json", `not json`, received},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := payload_time(tt.payload, received.Unix()); !got.Equal(tt.want) || got.Location() != time.UTC {
+				t.Errorf("payload_time() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	start := time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC)
+	end := start.Add(15 * time.Minute)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	tests := []struct {
+		name     string
+		payloads []string
+		count    int
+		fields   map[string]Aggregate_Field
+		last     time.Time
+	}{
+		{"one reading", []string{uplink_payload("0004a30b001c0530", at(1), `{"temperature":21.5}`)}, 1,
+			map[string]Aggregate_Field{"object.temperature": {Min: 21.5, Max: 21.5, Mean: 21.5, Last: 21.5}}, at(1)},
+		{"min max mean last", []string{
+			uplink_payload("0004a30b001c0530", at(1), `{"temperature":21.5,"sensor":{"humidity":40}}`),
+			uplink_payload("0004a30b001c0530", at(2), `{"temperature":19.5,"sensor":{"humidity":44}}`),
+			uplink_payload("0004a30b001c0530", at(3), `{"temperature":20.5,"sensor":{"humidity":42}}`),
+		}, 3, map[string]Aggregate_Field{
+			"object.temperature":     {Min: 19.5, Max: 21.5, Mean: 20.5, Last: 20.5},
+			"object.sensor.humidity": {Min: 40, Max: 44, Mean: 42, Last: 42},
+		}, at(3)},
+		{"fields missing from some", []string{
+			uplink_payload("0004a30b001c0530", at(1), `{"temperature":20}`),
+			uplink_payload("0004a30b001c0530", at(2), `{"battery":3.6}`),
+			uplink_payload("0004a30b001c0530", at(3), `{"temperature":22}`),
+		}, 3, map[string]Aggregate_Field{
+			"object.temperature": {Min: 20, Max: 22, Mean: 21, Last: 22},
+			"object.battery":     {Min: 3.6, Max: 3.6, Mean: 3.6, Last: 3.6},
+		}, at(3)},
+		{"only numbers under object", []string{
+			uplink_payload("0004a30b001c0530", at(1), `{"state":"open","ok":true,"huge":1e999,"nothing":null}`),
+			uplink_payload("0004a30b001c0530", at(2), `{"state":"closed"}`),
+		}, 2, map[string]Aggregate_Field{}, at(2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := new_aggregator(start, end)
+			for _, payload := range tt.payloads {
+				a.add(payload, 0)
+			}
+			b, err := a.payload("7a1e5c3f-94d2-4b8a-b6e1-2f0c9d8e7a61")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got struct {
+				Deduplication_Id string         `json:"deduplicationId"`
+				Time             time.Time      `json:"time"`
+				Device_Info      map[string]any `json:"deviceInfo"`
+				Dev_Addr         string         `json:"devAddr"`
+				FPort            int            `json:"fPort"`
+				Object           map[string]any `json:"object"`
+				FCnt             *int           `json:"fCnt"`
+				Aggregate        Aggregate      `json:"aggregate"`
+			}
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Deduplication_Id != "7a1e5c3f-94d2-4b8a-b6e1-2f0c9d8e7a61" || !got.Time.Equal(tt.last) ||
+				got.Device_Info["devEui"] != "0004a30b001c0530" || got.Dev_Addr != "01ab23cd" || got.FPort != 10 {
+				t.Errorf("payload() = %s", b)
+			}
+			if got.Object != nil || got.FCnt != nil {
+				t.Errorf("payload() keeps the readings of the last uplink: %s", b)
+			}
+			agg := got.Aggregate
+			if agg.Count != tt.count || !agg.Window_Start.Equal(start) || !agg.Window_End.Equal(end) ||
+				!agg.First_Time.Equal(at(1)) || !agg.Last_Time.Equal(tt.last) {
+				t.Errorf("aggregate = %+v", agg)
+			}
+			if !reflect.DeepEqual(agg.Fields, tt.fields) {
+				t.Errorf("fields = %+v, want %+v", agg.Fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestAggregatorPayloadNotJson(t *testing.T) {
+	a := new_aggregator(time.Now(), time.Now())
+	a.add(`{"object":`, time.Now().Unix())
+	if _, err := a.payload("7a1e5c3f-94d2-4b8a-b6e1-2f0c9d8e7a61"); err == nil {
+		t.Error("payload() of a broken uplink succeeded")
+	}
+}
+
+func TestCompactQueue(t *testing.T) {
+	now := time.Date(2025, 1, 31, 14, 10, 0, 0, time.UTC)
+	closed := time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC)
+	type uplink struct {
+		dev_eui    string
+		received   time.Time
+		expires_at int64
+	}
+	// window queues n uplinks of a device a minute apart from start on.
+	window := func(dev_eui string, start time.Time, n int, expires_at ...int64) []uplink {
+		uplinks := []uplink{}
+		for i := range n {
+			u := uplink{dev_eui, start.Add(time.Duration(i+1) * time.Minute), 0}
+			if i < len(expires_at) {
+				u.expires_at = expires_at[i]
+			}
+			uplinks = append(uplinks, u)
+		}
+		return uplinks
+	}
+	expires := now.Add(time.Hour).Unix()
+	tests := []struct {
+		name       string
+		depth      int
+		uplinks    []uplink
+		replaced   int
+		created    int
+		left       []int64
+		expires_at int64
+	}{
+		{"queue not deep enough", 100, window("0004a30b001c0530", closed, 5), 0, 0, []int64{1, 2, 3, 4, 5}, 0},
+		{"closed window", 1, window("0004a30b001c0530", closed, 5), 3, 1, []int64{1, 2, 5}, 0},
+		{"too few to compact", 1, window("0004a30b001c0530", closed, 3), 0, 0, []int64{1, 2, 3}, 0},
+		{"open window", 1, window("0004a30b001c0530", now.Add(-10*time.Minute), 5), 0, 0, []int64{1, 2, 3, 4, 5}, 0},
+		{"per device", 1, append(window("0004a30b001c0530", closed, 4), window("0004a30b001c0531", closed, 3)...),
+			2, 1, []int64{1, 2, 4, 5, 6, 7}, 0},
+		{"expires with the last to expire", 1, window("0004a30b001c0530", closed, 5, expires, expires+60, expires+120, expires+180, expires),
+			3, 1, []int64{1, 2, 5}, expires + 180},
+		{"one never expires", 1, window("0004a30b001c0530", closed, 5, expires, expires, 0, expires, expires),
+			3, 1, []int64{1, 2, 5}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test := test_db(t)
+			for i, u := range tt.uplinks {
+				action := ""
+				if u.expires_at > 0 {
+					action = expiry_archive
+				}
+				_, err := test.Exec(`INSERT INTO UPLINK_QUEUE (msg_id, deduplication_id, payload, received_at, expires_at, expiry_action)
+					VALUES ($1, $1, $2, $3, $4, $5);`,
+					fmt.Sprintf("m%d", i+1), uplink_payload(u.dev_eui, u.received, `{"temperature":20}`), u.received.Unix(), u.expires_at, action)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			c := valid_config()
+			c.DownsampleEnable, c.DownsampleQueueDepth, c.DownsampleAge = true, tt.depth, 0
+
+			replaced, created, err := compact_queue(c, now)
+			if err != nil || replaced != tt.replaced || created != tt.created {
+				t.Fatalf("compact_queue() = %d, %d, %v, want %d, %d", replaced, created, err, tt.replaced, tt.created)
+			}
+			if left := table_ids(t, test, queue_table); !reflect.DeepEqual(left, tt.left) {
+				t.Errorf("queue %v, want %v", left, tt.left)
+			}
+			if tt.created == 0 {
+				return
+			}
+			// The aggregate takes the place of the first uplink it replaced.
+			var payload string
+			var received_at, expires_at int64
+			if err := test.QueryRow(`SELECT payload, received_at, expires_at FROM UPLINK_QUEUE WHERE id = 2;`).Scan(&payload, &received_at, &expires_at); err != nil {
+				t.Fatal(err)
+			}
+			var got struct {
+				Aggregate Aggregate `json:"aggregate"`
+			}
+			if err := json.Unmarshal([]byte(payload), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Aggregate.Count != tt.replaced || !got.Aggregate.Window_Start.Equal(closed) || expires_at != tt.expires_at {
+				t.Errorf("aggregate %s, expires_at %d, want %d", payload, expires_at, tt.expires_at)
+			}
+
+			// Aggregates are never compacted again.
+			if replaced, _, err := compact_queue(c, now); err != nil || replaced != 0 {
+				t.Errorf("compact_queue() again = %d, %v", replaced, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// What happens to a queued message once its TTL has passed.
+const (
+	expiry_drop    = "drop"
+	expiry_archive = "archive"
+)
+
+// The dead letter reason of archived messages.
+const dead_reason_expired = "expired"
+
+// Queue_Ttl is one rule of queue_ttls. Empty fields match every message,
+// Application matches the id or name and Device the DevEUI or name.
+type Queue_Ttl struct {
+	Application string   `yaml:"application"`
+	Device      string   `yaml:"device"`
+	EventType   string   `yaml:"event_type"` // up, the only type queued
+	Ttl         Duration `yaml:"ttl"`        // 0, kept until uploaded
+	Action      string   `yaml:"action"`     // drop, or archive to the dead letters
+}
+
+// Queue_Message names what a TTL rule can match on.
+type Queue_Message struct {
+	Application_Id   string
+	Application_Name string
+	Dev_Eui          string
+	Device_Name      string
+	Event_Type       string
+}
+
+// queue_message reads the names of a ChirpStack event for the TTL rules.
+func queue_message(application_id string, dev_eui string, event_type string, parsed map[string]any) Queue_Message {
+	m := Queue_Message{Application_Id: application_id, Dev_Eui: dev_eui, Event_Type: event_type}
+	if info, ok := parsed["deviceInfo"].(map[string]any); ok {
+		m.Application_Name, _ = info["applicationName"].(string)
+		m.Device_Name, _ = info["deviceName"].(string)
+	}
+	return m
+}
+
+func (t Queue_Ttl) matches(m Queue_Message) bool {
+	return (t.Application == "" || t.Application == m.Application_Id || t.Application == m.Application_Name) &&
+		(t.Device == "" || t.Device == m.Dev_Eui || t.Device == m.Device_Name) &&
+		(t.EventType == "" || t.EventType == m.Event_Type)
+}
+
+// queue_expiry returns when a message received now expires, 0 for never,
+// and what then happens to it. The first matching rule decides, so a rule
+// with no ttl ahead of a broader one keeps those messages forever.
+func queue_expiry(appConfig *AppConfig, m Queue_Message, received time.Time) (expires_at int64, action string) {
+	for _, t := range appConfig.QueueTtls {
+		if !t.matches(m) {
+			continue
+		}
+		if t.Ttl <= 0 {
+			return 0, ""
+		}
+		action = t.Action
+		if action == "" {
+			action = expiry_drop
+		}
+		return received.Add(time.Duration(t.Ttl)).Unix(), action
+	}
+	return 0, ""
+}
+
+// Expired messages since edge-vault started, reported in heartbeats.
+var (
+	expired_dropped  atomic.Int64
+	expired_archived atomic.Int64
+)
+
+func spawn_expiry_worker() {
+	go expiry_worker()
+	queue_log.Info("Successfully spawned expiry worker")
+}
+
+// expiry_worker sweeps expired messages out of the queue. The uplink worker
+// already skips them, the sweep only frees the space.
+func expiry_worker() {
+	for {
+		if err := restamp_expiry(current_config()); err != nil {
+			queue_log.Warn("Failed to apply queue_ttls to queued messages", "err", err)
+		}
+		dropped, archived, err := expire_uplinks(time.Now())
+		if err != nil {
+			queue_log.Warn("Failed to expire queued messages", "err", err)
+		} else if dropped+archived > 0 {
+			queue_log.Info("Expired queued messages", "dropped", dropped, "archived", archived)
+		}
+		time.Sleep(time.Duration(current_config().QueueExpiryInterval))
+	}
+}
+
+// stamped_ttls are the queue_ttls the queued messages were last stamped
+// with, as JSON.
+var stamped_ttls string
+
+// expiry_select reads what the TTL rules match on of queued messages, and
+// when their TTL starts: when they were received, or requeued after that.
+const expiry_select = `SELECT id, CASE WHEN received_at > 0 THEN max(received_at, requeued_at) ELSE 0 END, expires_at, expiry_action,
+		COALESCE(json_extract(CAST(payload AS TEXT), '$.deviceInfo.applicationId'), ''),
+		COALESCE(json_extract(CAST(payload AS TEXT), '$.deviceInfo.applicationName'), ''),
+		COALESCE(json_extract(CAST(payload AS TEXT), '$.deviceInfo.devEui'), ''),
+		COALESCE(json_extract(CAST(payload AS TEXT), '$.deviceInfo.deviceName'), '')
+	FROM UPLINK_QUEUE `
+
+// expiry_changes reads rows of expiry_select and returns the stamps of the
+// messages whose expiry differs under the queue_ttls of appConfig, how many
+// rows it read and the last id.
+func expiry_changes(appConfig *AppConfig, rows *sql.Rows) (changed []expiry_stamp, n int, last int64, err error) {
+	defer rows.Close()
+	changed = []expiry_stamp{}
+	for rows.Next() {
+		var id, since, expires_at int64
+		var action string
+		m := Queue_Message{Event_Type: "up"}
+		if err := rows.Scan(&id, &since, &expires_at, &action,
+			&m.Application_Id, &m.Application_Name, &m.Dev_Eui, &m.Device_Name); err != nil {
+			return nil, 0, 0, err
+		}
+		n++
+		last = id
+		next, next_action := int64(0), ""
+		if since > 0 {
+			next, next_action = queue_expiry(appConfig, m, time.Unix(since, 0))
+		}
+		if next != expires_at || next_action != action {
+			changed = append(changed, expiry_stamp{id, next, next_action})
+		}
+	}
+	return changed, n, last, rows.Err()
+}
+
+// restamp_expiry works out again when each queued message expires, from
+// when it was received or requeued and the queue_ttls now configured, once
+// after start and whenever they change. A TTL set during an outage so also
+// bounds the backlog queued before it, and messages queued before expiry
+// existed get one. Messages without a received_at have no age and never
+// expire.
+func restamp_expiry(appConfig *AppConfig) error {
+	rules, err := json.Marshal(appConfig.QueueTtls)
+	if err != nil {
+		return err
+	}
+	if string(rules) == stamped_ttls {
+		return nil
+	}
+
+	upload_mu.Lock()
+	defer upload_mu.Unlock()
+	restamped := 0
+	for after := int64(0); ; {
+		rows, err := db.Query(expiry_select+`WHERE id > $1 ORDER BY id LIMIT 1000;`, after)
+		if err != nil {
+			return err
+		}
+		changed, n, last, err := expiry_changes(appConfig, rows)
+		if err != nil {
+			return err
+		}
+		after = last
+		if err := update_expiry(changed); err != nil {
+			return err
+		}
+		restamped += len(changed)
+		if n < 1000 {
+			break
+		}
+	}
+	stamped_ttls = string(rules)
+	if restamped > 0 {
+		queue_log.Info("Applied queue_ttls to queued messages", "restamped", restamped)
+	}
+	return nil
+}
+
+type expiry_stamp struct {
+	id         int64
+	expires_at int64
+	action     string
+}
+
+func update_expiry(stamps []expiry_stamp) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := write_expiry(tx, stamps); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func write_expiry(tx *sql.Tx, stamps []expiry_stamp) error {
+	for _, s := range stamps {
+		if _, err := tx.Exec(`UPDATE UPLINK_QUEUE SET expires_at = $2, expiry_action = $3 WHERE id = $1;`, s.id, s.expires_at, s.action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expire_uplinks archives or drops the messages expired at now in one
+// transaction, holding upload_mu so none is uploaded as it goes.
+func expire_uplinks(now time.Time) (dropped int64, archived int64, err error) {
+	upload_mu.Lock()
+	defer upload_mu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	columns := "id, msg_id, deduplication_id, payload, received_at, attempts, last_error, last_attempt_at, expires_at, expiry_action"
+	result, err := tx.Exec(`INSERT INTO UPLINK_DEAD_LETTER (`+columns+`, dead_at, reason)
+		SELECT `+columns+`, $1, $2 FROM UPLINK_QUEUE WHERE expires_at BETWEEN 1 AND $1 AND expiry_action = $3;`,
+		now.Unix(), dead_reason_expired, expiry_archive)
+	if err != nil {
+		return 0, 0, err
+	}
+	archived, _ = result.RowsAffected()
+	result, err = tx.Exec(`DELETE FROM UPLINK_QUEUE WHERE expires_at BETWEEN 1 AND $1;`, now.Unix())
+	if err != nil {
+		return 0, 0, err
+	}
+	expired, _ := result.RowsAffected()
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	dropped = expired - archived
+	expired_dropped.Add(dropped)
+	expired_archived.Add(archived)
+	return dropped, archived, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueueMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		parsed map[string]any
+		want   Queue_Message
+	}{
+		{"names", map[string]any{"deviceInfo": map[string]any{"applicationName": "irrigation", "deviceName": "pump-1"}},
+			Queue_Message{Application_Id: "5f0c6a4e", Application_Name: "irrigation", Dev_Eui: "0004a30b001c0530", Device_Name: "pump-1", Event_Type: "up"}},
+		{"no deviceInfo", map[string]any{}, Queue_Message{Application_Id: "5f0c6a4e", Dev_Eui: "0004a30b001c0530", Event_Type: "up"}},
+		{"names not strings", map[string]any{"deviceInfo": map[string]any{"deviceName": 7}},
+			Queue_Message{Application_Id: "5f0c6a4e", Dev_Eui: "0004a30b001c0530", Event_Type: "up"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queue_message("5f0c6a4e", "0004a30b001c0530", "up", tt.parsed); got != tt.want {
+				t.Errorf("queue_message() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueExpiry(t *testing.T) {
+	received := time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC)
+	c := &AppConfig{QueueTtls: []Queue_Ttl{
+		{Device: "pump-1"},
+		{Application: "irrigation", Ttl: Duration(time.Hour), Action: expiry_archive},
+		{Device: "0004a30b001c0539", EventType: "up", Ttl: Duration(10 * time.Minute)},
+		{Application: "5f0c6a4e", Ttl: Duration(24 * time.Hour), Action: expiry_drop},
+	}}
+	m := func(application_id, application_name, dev_eui, device_name string) Queue_Message {
+		return Queue_Message{application_id, application_name, dev_eui, device_name, "up"}
+	}
+	tests := []struct {
+		name       string
+		m          Queue_Message
+		expires_at int64
+		action     string
+	}{
+		{"rule without ttl keeps forever", m("5f0c6a4e", "irrigation", "0004a30b001c0530", "pump-1"), 0, ""},
+		{"application name", m("5f0c6a4e", "irrigation", "0004a30b001c0531", "valve-2"), received.Add(time.Hour).Unix(), expiry_archive},
+		{"dev_eui and event type, drop by default", m("", "", "0004a30b001c0539", "meter-9"), received.Add(10 * time.Minute).Unix(), expiry_drop},
+		{"application id", m("5f0c6a4e", "", "0004a30b001c0532", "valve-3"), received.Add(24 * time.Hour).Unix(), expiry_drop},
+		{"no rule matches", m("a1b2c3d4", "weather", "0004a30b001c0533", "station-1"), 0, ""},
+		{"other event type", Queue_Message{Dev_Eui: "0004a30b001c0539", Event_Type: "join"}, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expires_at, action := queue_expiry(c, tt.m, received)
+			if expires_at != tt.expires_at || action != tt.action {
+				t.Errorf("queue_expiry() = %d, %q, want %d, %q", expires_at, action, tt.expires_at, tt.action)
+			}
+		})
+	}
+	if expires_at, action := queue_expiry(&AppConfig{}, m("5f0c6a4e", "irrigation", "", ""), received); expires_at != 0 || action != "" {
+		t.Errorf("queue_expiry() without queue_ttls = %d, %q", expires_at, action)
+	}
+}
+
+func TestRestampExpiry(t *testing.T) {
+	test := test_db(t)
+	prev := stamped_ttls
+	t.Cleanup(func() { stamped_ttls = prev })
+	stamped_ttls = ""
+	received := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	for i, m := range []struct {
+		payload     string
+		received_at int64
+	}{
+		{`{"deviceInfo":{"applicationId":"5f0c6a4e","applicationName":"irrigation","deviceName":"pump-1","devEui":"0004a30b001c0530"}}`, received.Unix()},
+		{`{"deviceInfo":{"applicationId":"5f0c6a4e","applicationName":"irrigation","deviceName":"valve-2","devEui":"0004a30b001c0531"}}`, received.Unix()},
+		{`{"deviceInfo":{"applicationId":"a1b2c3d4","applicationName":"weather","deviceName":"station-1","devEui":"0004a30b001c0532"}}`, received.Unix()},
+		{`{"deviceInfo":{"applicationName":"irrigation"}}`, 0},
+	} {
+		_, err := test.Exec(`INSERT INTO UPLINK_QUEUE (msg_id, deduplication_id, payload, received_at) VALUES ($1, $1, $2, $3);`,
+			string(rune('a'+i)), m.payload, m.received_at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stamps := func() []expiry_stamp {
+		rows, err := test.Query(`SELECT id, expires_at, expiry_action FROM UPLINK_QUEUE ORDER BY id;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		got := []expiry_stamp{}
+		for rows.Next() {
+			var s expiry_stamp
+			rows.Scan(&s.id, &s.expires_at, &s.action)
+			got = append(got, s)
+		}
+		return got
+	}
+
+	tests := []struct {
+		name string
+		ttls []Queue_Ttl
+		want []expiry_stamp
+	}{
+		{"ttl added", []Queue_Ttl{{Device: "pump-1"}, {Application: "irrigation", Ttl: Duration(time.Hour), Action: expiry_archive}},
+			[]expiry_stamp{{1, 0, ""}, {2, received.Add(time.Hour).Unix(), expiry_archive}, {3, 0, ""}, {4, 0, ""}}},
+		{"ttl changed", []Queue_Ttl{{Ttl: Duration(24 * time.Hour)}},
+			[]expiry_stamp{{1, received.Add(24 * time.Hour).Unix(), expiry_drop}, {2, received.Add(24 * time.Hour).Unix(), expiry_drop},
+				{3, received.Add(24 * time.Hour).Unix(), expiry_drop}, {4, 0, ""}}},
+		{"ttls removed", nil, []expiry_stamp{{1, 0, ""}, {2, 0, ""}, {3, 0, ""}, {4, 0, ""}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := restamp_expiry(&AppConfig{QueueTtls: tt.ttls}); err != nil {
+				t.Fatal(err)
+			}
+			if got := stamps(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stamps = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Unchanged queue_ttls leave the queue alone.
+	test.Exec(`UPDATE UPLINK_QUEUE SET expires_at = 1 WHERE id = 1;`)
+	if err := restamp_expiry(&AppConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := stamps()[0]; got.expires_at != 1 {
+		t.Errorf("restamped with the same queue_ttls: %v", got)
+	}
+}
+
+func TestExpireUplinks(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		stamps   []expiry_stamp
+		dropped  int64
+		archived int64
+		left     []int64
+		dead     []int64
+	}{
+		{"nothing expires", []expiry_stamp{{1, 0, ""}, {2, now.Add(time.Minute).Unix(), expiry_drop}}, 0, 0, []int64{1, 2, 3}, []int64{}},
+		{"drop and archive", []expiry_stamp{{1, now.Unix(), expiry_drop}, {2, now.Add(-time.Hour).Unix(), expiry_archive},
+			{3, now.Add(time.Minute).Unix(), expiry_archive}}, 1, 1, []int64{3}, []int64{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test := test_db(t)
+			queue_uplinks(t, test, "pump-1", "valve-2", "pump-3")
+			if err := update_expiry(tt.stamps); err != nil {
+				t.Fatal(err)
+			}
+			dropped_before, archived_before := expired_dropped.Load(), expired_archived.Load()
+
+			dropped, archived, err := expire_uplinks(now)
+			if err != nil || dropped != tt.dropped || archived != tt.archived {
+				t.Fatalf("expire_uplinks() = %d, %d, %v, want %d, %d", dropped, archived, err, tt.dropped, tt.archived)
+			}
+			if left := table_ids(t, test, queue_table); !reflect.DeepEqual(left, tt.left) {
+				t.Errorf("queue %v, want %v", left, tt.left)
+			}
+			if dead := table_ids(t, test, dead_letter_table); !reflect.DeepEqual(dead, tt.dead) {
+				t.Errorf("dead letters %v, want %v", dead, tt.dead)
+			}
+			var reason string
+			test.QueryRow(`SELECT COALESCE(MAX(reason), '') FROM UPLINK_DEAD_LETTER;`).Scan(&reason)
+			if len(tt.dead) > 0 && reason != dead_reason_expired {
+				t.Errorf("dead letter reason %q, want %q", reason, dead_reason_expired)
+			}
+			if d, a := expired_dropped.Load()-dropped_before, expired_archived.Load()-archived_before; d != tt.dropped || a != tt.archived {
+				t.Errorf("heartbeat counts grew by %d, %d, want %d, %d", d, a, tt.dropped, tt.archived)
+			}
+		})
+	}
+}
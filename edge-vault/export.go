@@ -0,0 +1,457 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats of the Data Tracer and the uplink queue.
+const (
+	export_csv    = "csv"
+	export_ndjson = "ndjson"
+	export_xlsx   = "xlsx"
+)
+
+var export_formats = []string{export_csv, export_ndjson, export_xlsx}
+
+var export_content_types = map[string]string{
+	export_csv:    "text/csv; charset=utf-8",
+	export_ndjson: "application/x-ndjson",
+	export_xlsx:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// A sheet holds 1048576 rows, one of them is the header.
+const xlsx_max_rows = 1048575
+
+// Export_Row is one row of an export. Fields fill the fixed columns and
+// Payload, a JSON object, is flattened into one column per field.
+type Export_Row struct {
+	Fields  []any
+	Payload string
+}
+
+// export_source calls fn for every row to export. It runs once, csv and
+// xlsx spool the rows to a temporary file while collecting the payload
+// columns, so what is written is what was read.
+type export_source func(ctx context.Context, fn func(Export_Row) error) error
+
+func init() {
+	// The field types of the sources, for the spool file.
+	gob.Register(time.Time{})
+	gob.Register(json.Number(""))
+}
+
+// write_export streams the rows of source to w, columns names the fixed
+// fields. It returns how many rows were written.
+func write_export(ctx context.Context, w io.Writer, format string, columns []string, source export_source) (int, error) {
+	count := 0
+	if format == export_ndjson {
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		err := source(ctx, func(row Export_Row) error {
+			obj := map[string]any{}
+			for i, c := range columns {
+				obj[c] = row.Fields[i]
+			}
+			if row.Payload != "" {
+				obj["object"] = json.RawMessage(row.Payload)
+			}
+			count++
+			return enc.Encode(obj)
+		})
+		if err != nil {
+			return count, err
+		}
+		return count, bw.Flush()
+	}
+
+	spool, err := os.CreateTemp("", "edge-vault-export-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	spool_writer := bufio.NewWriter(spool)
+	enc := gob.NewEncoder(spool_writer)
+	keys := map[string]bool{}
+	spooled := 0
+	err = source(ctx, func(row Export_Row) error {
+		for k := range flatten_payload(row.Payload) {
+			keys[k] = true
+		}
+		spooled++
+		return enc.Encode(row)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := spool_writer.Flush(); err != nil {
+		return 0, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	payload_columns := []string{}
+	for k := range keys {
+		payload_columns = append(payload_columns, k)
+	}
+	slices.Sort(payload_columns)
+
+	var t table_writer
+	if format == export_xlsx {
+		if t, err = new_xlsx_writer(w); err != nil {
+			return 0, err
+		}
+	} else {
+		t = &csv_writer{csv.NewWriter(w)}
+	}
+	header := []any{}
+	for _, c := range columns {
+		header = append(header, c)
+	}
+	for _, c := range payload_columns {
+		header = append(header, "object."+c)
+	}
+	if err := t.Row(header); err != nil {
+		return 0, err
+	}
+	dec := gob.NewDecoder(bufio.NewReader(spool))
+	for ; count < spooled; count++ {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		var row Export_Row
+		if err := dec.Decode(&row); err != nil {
+			return count, err
+		}
+		flat := flatten_payload(row.Payload)
+		values := row.Fields
+		for _, c := range payload_columns {
+			values = append(values, flat[c])
+		}
+		if err := t.Row(values); err != nil {
+			return count, err
+		}
+	}
+	return count, t.Close()
+}
+
+// flatten_payload turns a JSON object into dotted keys such as
+// "sensor.temperature". Arrays stay whole, a payload that is not an object
+// has no fields.
+func flatten_payload(payload string) map[string]any {
+	flat := map[string]any{}
+	dec := json.NewDecoder(strings.NewReader(payload))
+	dec.UseNumber()
+	var obj map[string]any
+	if dec.Decode(&obj) != nil {
+		return flat
+	}
+	var walk func(prefix string, v any)
+	walk = func(prefix string, v any) {
+		if m, ok := v.(map[string]any); ok && len(m) > 0 {
+			for k, child := range m {
+				walk(strings.TrimPrefix(prefix+"."+k, "."), child)
+			}
+			return
+		}
+		flat[prefix] = v
+	}
+	walk("", obj)
+	delete(flat, "")
+	return flat
+}
+
+// export_text is how a value reads in a csv cell.
+func export_text(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case bool, int, int64, float64:
+		return fmt.Sprint(v)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// formula_text keeps a spreadsheet from running text as a formula by
+// prefixing it with a quote. Numbers such as -5 are left as they are.
+func formula_text(text string) string {
+	if text == "" || !strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return text
+	}
+	if _, err := strconv.ParseFloat(text, 64); err == nil {
+		return text
+	}
+	return "'" + text
+}
+
+type table_writer interface {
+	Row(values []any) error
+	Close() error
+}
+
+type csv_writer struct {
+	w *csv.Writer
+}
+
+func (c *csv_writer) Row(values []any) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = formula_text(export_text(v))
+	}
+	return c.w.Write(record)
+}
+
+func (c *csv_writer) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// xlsx_writer writes a single sheet workbook straight into the zip stream,
+// strings are inline so no shared string table has to be kept.
+type xlsx_writer struct {
+	zip   *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+}
+
+var xlsx_parts = []struct{ name, body string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Export" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+func new_xlsx_writer(w io.Writer) (*xlsx_writer, error) {
+	z := zip.NewWriter(w)
+	for _, part := range xlsx_parts {
+		f, err := z.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.body); err != nil {
+			return nil, err
+		}
+	}
+	f, err := z.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	sheet := bufio.NewWriter(f)
+	sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return &xlsx_writer{zip: z, sheet: sheet}, nil
+}
+
+func (x *xlsx_writer) Row(values []any) error {
+	x.rows++
+	fmt.Fprintf(x.sheet, `<row r="%d">`, x.rows)
+	for i, v := range values {
+		ref := xlsx_column(i) + strconv.Itoa(x.rows)
+		switch v := v.(type) {
+		case nil:
+		case json.Number, int, int64, float64:
+			fmt.Fprintf(x.sheet, `<c r="%s"><v>%s</v></c>`, ref, export_text(v))
+		case bool:
+			b := 0
+			if v {
+				b = 1
+			}
+			fmt.Fprintf(x.sheet, `<c r="%s" t="b"><v>%d</v></c>`, ref, b)
+		default:
+			text := formula_text(export_text(v))
+			// The most a cell holds.
+			if len(text) > 32767 {
+				text = text[:32767]
+			}
+			fmt.Fprintf(x.sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref)
+			xml.EscapeText(x.sheet, []byte(text))
+			x.sheet.WriteString(`</t></is></c>`)
+		}
+	}
+	_, err := x.sheet.WriteString(`</row>`)
+	return err
+}
+
+func (x *xlsx_writer) Close() error {
+	x.sheet.WriteString(`</sheetData></worksheet>`)
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zip.Close()
+}
+
+// xlsx_column names column i, A to Z, then AA and so on.
+func xlsx_column(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+var trace_export_columns = []string{"time", "dev_eui", "device_name"}
+
+func trace_export_source(q *Trace_Query, limit int, loc *time.Location) export_source {
+	return func(ctx context.Context, fn func(Export_Row) error) error {
+		query, args := q.export_sql(limit)
+		rows, err := db_psql.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var t time.Time
+			var dev_eui, device_name string
+			var data sql.NullString
+			if err := rows.Scan(&t, &dev_eui, &device_name, &data); err != nil {
+				return err
+			}
+			if err := fn(Export_Row{Fields: []any{t.In(loc), dev_eui, device_name}, Payload: data.String}); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+}
+
+var queue_export_columns = []string{"id", "msg_id", "deduplication_id", "received_at"}
+
+// queue_export_source reads the queue, or the dead letters, as they are now
+// in batches, so the one SQLite connection is not held while the client
+// downloads. With ids only those messages are exported.
+func queue_export_source(ctx context.Context, table string, ids []int64, loc *time.Location) (export_source, error) {
+	var max_id int64
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(max(id), 0) FROM "+table+";").Scan(&max_id); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, fn func(Export_Row) error) error {
+		last := int64(0)
+		for {
+			batch, err := queue_export_batch(ctx, table, ids, last, max_id, loc)
+			if err != nil || len(batch) == 0 {
+				return err
+			}
+			for _, row := range batch {
+				if err := fn(row); err != nil {
+					return err
+				}
+			}
+			last = batch[len(batch)-1].Fields[0].(int64)
+		}
+	}, nil
+}
+
+func queue_export_batch(ctx context.Context, table string, ids []int64, after int64, max_id int64, loc *time.Location) ([]Export_Row, error) {
+	where, args := "id > $1 AND id <= $2", []any{after, max_id}
+	if len(ids) > 0 {
+		in, id_args := id_list(ids, 3)
+		where += " AND id IN (" + in + ")"
+		args = append(args, id_args...)
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id, msg_id, deduplication_id, received_at, payload FROM "+table+
+		" WHERE "+where+" ORDER BY id LIMIT 500;", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	batch := []Export_Row{}
+	for rows.Next() {
+		var id, received_at int64
+		var msg_id, deduplication_id, payload string
+		if err := rows.Scan(&id, &msg_id, &deduplication_id, &received_at, &payload); err != nil {
+			return nil, err
+		}
+		// 0 for rows queued before received_at was recorded.
+		var received any
+		if received_at > 0 {
+			received = time.Unix(received_at, 0).In(loc)
+		}
+		batch = append(batch, Export_Row{Fields: []any{id, msg_id, deduplication_id, received}, Payload: payload})
+	}
+	return batch, rows.Err()
+}
+
+func start_export(w http.ResponseWriter, format string, filename string) {
+	w.Header().Set("Content-Type", export_content_types[format])
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+}
+
+func dataExportHandler(w http.ResponseWriter, r *http.Request) {
+	appConfig := current_config()
+	query := r.URL.Query()
+	format := query.Get("format")
+	if !slices.Contains(export_formats, format) {
+		http.Error(w, "format must be one of "+strings.Join(export_formats, ", "), http.StatusBadRequest)
+		return
+	}
+	q, err := parse_trace_query(query, appConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	loc, _ := time.LoadLocation(appConfig.TracerTimezone)
+	limit := appConfig.TracerExportMaxRows
+	if format == export_xlsx {
+		limit = min(limit, xlsx_max_rows)
+	}
+
+	start_export(w, format, fmt.Sprintf("trace-%s-%s.%s", q.Event, q.Start.Format("20060102-1504"), format))
+	count, err := write_export(r.Context(), w, format, trace_export_columns, trace_export_source(q, limit, loc))
+	audit_request(r, "data.export", q.Event, nil, map[string]any{"format": format, "filter": query.Encode(), "rows": count}, err)
+	if err != nil {
+		// The response has started, all that is left is to cut it short.
+		web_log.Warn("Data trace export failed", "format", format, "rows", count, "err", err)
+		return
+	}
+	web_log.Info("Exported data trace", "user", current_session(r).Username, "format", format, "event", q.Event, "rows", count)
+}
+
+func queueExportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if !slices.Contains(export_formats, format) {
+		http.Error(w, "format must be one of "+strings.Join(export_formats, ", "), http.StatusBadRequest)
+		return
+	}
+	loc, _ := time.LoadLocation(current_config().TracerTimezone)
+	source, err := queue_export_source(r.Context(), queue_table, nil, loc)
+	if err != nil {
+		web_log.Warn("Failed to read uplink queue", "err", err)
+		http.Error(w, "Failed to read uplink queue", http.StatusInternalServerError)
+		return
+	}
+
+	start_export(w, format, "queue-"+time.Now().In(loc).Format("20060102-1504")+"."+format)
+	count, err := write_export(r.Context(), w, format, queue_export_columns, source)
+	audit_request(r, "queue."+queue_export, queue_table, nil, map[string]any{"format": format, "rows": count}, err)
+	if err != nil {
+		web_log.Warn("Queue export failed", "format", format, "rows", count, "err", err)
+		return
+	}
+	web_log.Info("Exported uplink queue", "user", current_session(r).Username, "format", format, "rows", count)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlattenPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    map[string]any
+	}{
+		{"empty", "", map[string]any{}},
+		{"not an object", `[1,2]`, map[string]any{}},
+		{"invalid", `{"a":`, map[string]any{}},
+		{"flat", `{"temperature":21.5,"ok":true,"label":"pump"}`,
+			map[string]any{"temperature": json.Number("21.5"), "ok": true, "label": "pump"}},
+		{"nested", `{"sensor":{"temperature":21.5,"battery":{"voltage":3}}}`,
+			map[string]any{"sensor.temperature": json.Number("21.5"), "sensor.battery.voltage": json.Number("3")}},
+		{"arrays stay whole", `{"readings":[1,2]}`, map[string]any{"readings": []any{json.Number("1"), json.Number("2")}}},
+		{"empty object is a value", `{"sensor":{},"nil":null}`, map[string]any{"sensor": map[string]any{}, "nil": nil}},
+		{"large integers keep their digits", `{"counter":12345678901234567890}`, map[string]any{"counter": json.Number("12345678901234567890")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := flatten_payload(tt.payload); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flatten_payload() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestXlsxColumn(t *testing.T) {
+	tests := []struct {
+		i    int
+		want string
+	}{
+		{0, "A"}, {1, "B"}, {25, "Z"}, {26, "AA"}, {27, "AB"}, {51, "AZ"}, {52, "BA"}, {701, "ZZ"}, {702, "AAA"}, {16383, "XFD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := xlsx_column(tt.i); got != tt.want {
+				t.Errorf("xlsx_column(%d) = %s, want %s", tt.i, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormulaText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", ""},
+		{"pump-1", "pump-1"},
+		{"=HYPERLINK(\"http://evil.example\")", "'=HYPERLINK(\"http://evil.example\")"},
+		{"+1+2", "'+1+2"},
+		{"-1+2", "'-1+2"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"\r=1", "'\r=1"},
+		{"-5", "-5"},
+		{"+3.5e2", "+3.5e2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := formula_text(tt.text); got != tt.want {
+				t.Errorf("formula_text(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportText(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		want  string
+	}{
+		{"nil", nil, ""},
+		{"string", "pump-1", "pump-1"},
+		{"number", json.Number("21.50"), "21.50"},
+		{"int64", int64(7), "7"},
+		{"bool", true, "true"},
+		{"time", time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC), "2025-01-31T13:45:00Z"},
+		{"array", []any{json.Number("1"), "a"}, `[1,"a"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := export_text(tt.value); got != tt.want {
+				t.Errorf("export_text() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// test_export_source yields rows and counts how often it is run.
+func test_export_source(runs *int, rows ...Export_Row) export_source {
+	return func(ctx context.Context, fn func(Export_Row) error) error {
+		*runs++
+		for _, row := range rows {
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// xlsx_sheet reads the worksheet of an xlsx file.
+func xlsx_sheet(t *testing.T, b []byte) string {
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := z.Open("xl/worksheets/sheet1.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sheet, _ := io.ReadAll(f)
+	return string(sheet)
+}
+
+func TestWriteExport(t *testing.T) {
+	received := time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC)
+	rows := []Export_Row{
+		{Fields: []any{int64(1), "=cmd|' /C calc'!A0", received}, Payload: `{"sensor":{"temperature":21.5}}`},
+		{Fields: []any{int64(2), "pump-2", nil}, Payload: `{"ok":true,"sensor":{"humidity":40}}`},
+	}
+	columns := []string{"id", "device_name", "received_at"}
+	tests := []struct {
+		format   string
+		contains []string
+	}{
+		{export_csv, []string{
+			"id,device_name,received_at,object.ok,object.sensor.humidity,object.sensor.temperature\n",
+			"1,'=cmd|' /C calc'!A0,2025-01-31T13:45:00Z,,,21.5\n",
+			"2,pump-2,,true,40,\n",
+		}},
+		{export_ndjson, []string{
+			`{"device_name":"=cmd|' /C calc'!A0","id":1,"object":{"sensor":{"temperature":21.5}},"received_at":"2025-01-31T13:45:00Z"}` + "\n",
+			`{"device_name":"pump-2","id":2,"object":{"ok":true,"sensor":{"humidity":40}},"received_at":null}` + "\n",
+		}},
+		{export_xlsx, []string{
+			`<c r="F1" t="inlineStr"><is><t xml:space="preserve">object.sensor.temperature</t></is></c>`,
+			`<c r="A2"><v>1</v></c><c r="B2" t="inlineStr"><is><t xml:space="preserve">&#39;=cmd|&#39; /C calc&#39;!A0</t></is></c>`,
+			`<c r="F2"><v>21.5</v></c>`,
+			`<c r="D3" t="b"><v>1</v></c><c r="E3"><v>40</v></c></row>`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var out bytes.Buffer
+			runs := 0
+			count, err := write_export(context.Background(), &out, tt.format, columns, test_export_source(&runs, rows...))
+			if err != nil || count != 2 {
+				t.Fatalf("write_export() = %d, %v", count, err)
+			}
+			if runs != 1 {
+				t.Errorf("source ran %d times, want once", runs)
+			}
+			got := out.String()
+			if tt.format == export_xlsx {
+				got = xlsx_sheet(t, out.Bytes())
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(got, want) {
+					t.Errorf("export lacks %q:\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteExportSourceError(t *testing.T) {
+	failing := func(ctx context.Context, fn func(Export_Row) error) error {
+		if err := fn(Export_Row{Fields: []any{"a"}}); err != nil {
+			return err
+		}
+		return errors.New("connection reset")
+	}
+	for _, format := range export_formats {
+		t.Run(format, func(t *testing.T) {
+			var out bytes.Buffer
+			if _, err := write_export(context.Background(), &out, format, []string{"name"}, failing); err == nil {
+				t.Error("write_export() succeeded")
+			}
+			if format != export_ndjson && out.Len() != 0 {
+				t.Errorf("wrote %q before the source finished", out.String())
+			}
+		})
+	}
+}
+
+func TestQueueExportSource(t *testing.T) {
+	test := test_db(t)
+	for i, payload := range []string{`{"a":1}`, `{"b":2}`, `{"c":3}`} {
+		_, err := test.Exec(`INSERT INTO UPLINK_QUEUE (msg_id, deduplication_id, payload, received_at) VALUES ($1, $1, $2, $3);`,
+			string(rune('a'+i)), payload, int64(i)*60)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		ids  []int64
+		want []string
+	}{
+		{"all", nil, []string{"a", "b", "c"}},
+		{"selected", []int64{1, 3}, []string{"a", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := queue_export_source(context.Background(), queue_table, tt.ids, time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Rows queued after the export started are left out.
+			test.Exec(`INSERT INTO UPLINK_QUEUE (msg_id, deduplication_id, payload, received_at) VALUES ('late', 'late', '{}', 0);`)
+			t.Cleanup(func() { test.Exec(`DELETE FROM UPLINK_QUEUE WHERE msg_id = 'late';`) })
+			got := []string{}
+			err = source(context.Background(), func(row Export_Row) error {
+				got = append(got, row.Fields[1].(string))
+				return nil
+			})
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("exported %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportHandlersRejectFormat(t *testing.T) {
+	test_web_config(t)
+	for _, handler := range []http.HandlerFunc{dataExportHandler, queueExportHandler} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/export?format=pdf", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("status %d, want %d", w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var heartbeat_log = component_logger("heartbeat")
+
+// Version is set at build time with -ldflags "-X main.Version=...".
+var Version = "dev"
+
+var start_time = time.Now()
+
+// MQTT connection states reported in heartbeats.
+const (
+	mqtt_connecting   = "connecting"
+	mqtt_connected    = "connected"
+	mqtt_disconnected = "disconnected"
+)
+
+var mqtt_state atomic.Value
+
+func init() {
+	mqtt_state.Store(mqtt_connecting)
+}
+
+// Heartbeat is what edge-vault reports to sync-tower on every beat.
+type Heartbeat struct {
+	Gateway_Id                 string
+	Hostname                   string
+	Version                    string
+	Uptime_Seconds             int64
+	Queue_Depth                int64
+	Oldest_Queued_Age_Seconds  int64
+	Disk_Free_Bytes            int64
+	Mqtt_State                 string
+	Heartbeat_Interval_Seconds int
+	// Queued messages that expired since edge-vault started.
+	Expired_Dropped  int64
+	Expired_Archived int64
+}
+
+// gateway_id identifies this edge-vault to sync-tower, defaulting to the
+// hostname.
+func gateway_id(appConfig *AppConfig) string {
+	if appConfig.GatewayId != "" {
+		return appConfig.GatewayId
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// sync_tower_request identifies this gateway on a request to sync-tower,
+// which only takes heartbeats and hands commands and remote config to a
+// gateway sending the token it has for it.
+func sync_tower_request(req *http.Request, appConfig *AppConfig) *http.Request {
+	req.Header.Set("X-Gateway-Id", gateway_id(appConfig))
+	if appConfig.GatewayToken != "" {
+		req.Header.Set("Authorization", "Bearer "+string(appConfig.GatewayToken))
+	}
+	return req
+}
+
+// queue_stats returns the number of queued messages and the age of the
+// oldest one. Rows queued before received_at existed do not count towards
+// the age.
+func queue_stats() (depth int64, oldest_age time.Duration, err error) {
+	var oldest int64
+	err = db.QueryRow(`SELECT count(*), COALESCE(min(NULLIF(received_at, 0)), 0) FROM UPLINK_QUEUE;`).Scan(&depth, &oldest)
+	if err != nil {
+		return 0, 0, err
+	}
+	if oldest > 0 {
+		oldest_age = time.Since(time.Unix(oldest, 0))
+	}
+	return depth, oldest_age, nil
+}
+
+func disk_free(path string) int64 {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize)
+}
+
+func NewHeartbeat(appConfig *AppConfig, interval time.Duration) Heartbeat {
+	hostname, _ := os.Hostname()
+	depth, oldest_age, err := queue_stats()
+	if err != nil {
+		heartbeat_log.Warn("Failed to read queue stats", "err", err)
+	}
+	return Heartbeat{
+		Gateway_Id:                 gateway_id(appConfig),
+		Hostname:                   hostname,
+		Version:                    Version,
+		Uptime_Seconds:             int64(time.Since(start_time).Seconds()),
+		Queue_Depth:                depth,
+		Oldest_Queued_Age_Seconds:  int64(oldest_age.Seconds()),
+		Disk_Free_Bytes:            disk_free("."),
+		Mqtt_State:                 mqtt_state.Load().(string),
+		Heartbeat_Interval_Seconds: int(interval.Seconds()),
+		Expired_Dropped:            expired_dropped.Load(),
+		Expired_Archived:           expired_archived.Load(),
+	}
+}
+
+func spawn_heartbeat_worker() {
+	if current_config().HeartbeatEndpoint == "" {
+		heartbeat_log.Info("Heartbeat idle until a heartbeat_endpoint is configured")
+	}
+	interval := time.Duration(current_config().HeartbeatInterval)
+	go heartbeat_worker(time.NewTicker(interval), interval)
+	heartbeat_log.Info("Successfully spawned heartbeat worker", "interval", interval)
+}
+
+func heartbeat_worker(t *time.Ticker, interval time.Duration) {
+	heartbeat_log.Debug("Entering event loop")
+	client := &http.Client{Timeout: 10 * time.Second}
+	failing := false
+	for {
+		appConfig := current_config()
+		// Follow interval changes from a config reload.
+		if next := time.Duration(appConfig.HeartbeatInterval); next != interval {
+			interval = next
+			t.Reset(interval)
+		}
+		if appConfig.HeartbeatEndpoint != "" {
+			err := send_heartbeat(client, appConfig, NewHeartbeat(appConfig, interval))
+			// Only log transitions, a gateway offline for days would otherwise
+			// write a warning every interval.
+			if err != nil && !failing {
+				heartbeat_log.Warn("Failed to send heartbeat", "err", err)
+			} else if err == nil && failing {
+				heartbeat_log.Info("Successfully reached sync-tower again")
+			}
+			failing = err != nil
+		}
+		<-t.C
+	}
+}
+
+func send_heartbeat(client *http.Client, appConfig *AppConfig, hb Heartbeat) error {
+	body, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", appConfig.HeartbeatEndpoint, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(sync_tower_request(req, appConfig))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("heartbeat rejected with status %d", resp.StatusCode)
+	}
+	return nil
+}
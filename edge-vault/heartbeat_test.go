@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueueStats(t *testing.T) {
+	tests := []struct {
+		name        string
+		received_at []int64
+		depth       int64
+		oldest      time.Duration
+	}{
+		{"empty", nil, 0, 0},
+		{"oldest counts", []int64{time.Now().Add(-time.Hour).Unix(), time.Now().Unix()}, 2, time.Hour},
+		{"rows without received_at", []int64{0, time.Now().Add(-time.Minute).Unix()}, 2, time.Minute},
+		{"only rows without received_at", []int64{0}, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test := test_db(t)
+			for i, received_at := range tt.received_at {
+				_, err := test.Exec(`INSERT INTO UPLINK_QUEUE (msg_id, deduplication_id, payload, received_at) VALUES ($1, $1, '{}', $2);`,
+					string(rune('a'+i)), received_at)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			depth, oldest, err := queue_stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if depth != tt.depth || oldest.Round(time.Minute) != tt.oldest {
+				t.Errorf("queue_stats() = %d, %v, want %d, %v", depth, oldest, tt.depth, tt.oldest)
+			}
+		})
+	}
+}
+
+func TestSendHeartbeat(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    int
+		wantErr bool
+	}{
+		{"accepted", http.StatusOK, false},
+		{"rejected", http.StatusBadRequest, true},
+		{"unauthorized", http.StatusUnauthorized, true},
+		{"unavailable", http.StatusServiceUnavailable, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Heartbeat
+			var auth string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				auth = r.Header.Get("Authorization")
+				json.NewDecoder(r.Body).Decode(&got)
+				w.WriteHeader(tt.code)
+			}))
+			defer server.Close()
+			appConfig := &AppConfig{HeartbeatEndpoint: server.URL, GatewayToken: "4e81b0d9c27a6f35"}
+			err := send_heartbeat(server.Client(), appConfig, Heartbeat{Gateway_Id: "spectra-gw-01", Queue_Depth: 7})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("send_heartbeat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.Gateway_Id != "spectra-gw-01" || got.Queue_Depth != 7 {
+				t.Errorf("sync-tower received %+v", got)
+			}
+			if auth != "Bearer 4e81b0d9c27a6f35" {
+				t.Errorf("Authorization = %q", auth)
+			}
+		})
+	}
+}
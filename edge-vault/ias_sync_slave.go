@@ -2,72 +2,38 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/google/uuid"
-	"gopkg.in/yaml.v3"
 	_ "modernc.org/sqlite"
 )
 
-var Reset = "\033[0m"
-var Red = "\033[31m"
-var Green = "\033[32m"
-var Yellow = "\033[33m"
-var Blue = "\033[34m"
-var Magenta = "\033[35m"
-var Cyan = "\033[36m"
-var Gray = "\033[37m"
-var White = "\033[97m"
-
-var infoLog = log.New(os.Stdout, Green+"[INFO] "+Reset, log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
-var warnLog = log.New(os.Stdout, Yellow+"[WARN] "+Reset, log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
-
-var db_mngr, _ = NewDBManager()
-var db = db_mngr.db_sqlite
-
-type (
-	AppConfig struct {
-		DatabaseHost       string `yaml:"local_database_host"`
-		DatabasePort       string `yaml:"local_database_port"`
-		DatabaseDatabase   string `yaml:"local_database_database"`
-		DatabaseUername    string `yaml:"local_database_username"`
-		Databasepassword   string `yaml:"local_database_password"`
-		MqttBrokerAddress  string `yaml:"mqtt_broker_address"`
-		MqttBrokerPort     string `yaml:"mqtt_broker_port"`
-		MqttBrokerUser     string `yaml:"mqtt_broker_user"`
-		MqttBrokerPassword string `yaml:"mqtt_broker_password"`
-		UplinkEndpoint     string `yaml:"uplink_endpoint"`
-		WebPort            string `yaml:"web_port"`
-	}
-
-	ConfigFile map[string]*AppConfig
-)
+var main_log = component_logger("main")
+var mqtt_log = component_logger("mqtt")
+var uplink_log = component_logger("uplink")
 
-func LoadConfig(env string) (*AppConfig, error) {
-	configFile := ConfigFile{}
-	file, _ := os.Open("config.yaml")
-	defer file.Close()
-	decoder := yaml.NewDecoder(file)
+// Opened in main, so check-config runs without the databases.
+var db_mngr *DBManager
+var db *sql.DB
 
-	// Always check for errors!
-	if err := decoder.Decode(&configFile); err != nil {
-		return nil, err
-	}
-
-	appConfig, ok := configFile[env]
-	if !ok {
-		return nil, fmt.Errorf("no such environment: %s", env)
-	}
+// app_config is the config in effect, config.yaml with the applied remote
+// config on top. Workers load it on every iteration so a reload reaches them.
+var app_config atomic.Pointer[AppConfig]
 
-	return appConfig, nil
+func current_config() *AppConfig {
+	return app_config.Load()
 }
 
 var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
@@ -75,101 +41,153 @@ var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Me
 	topic := msg.Topic()
 	msgId := uuid.New().String()
 	parts := strings.Split(topic, "/")
-	infoLog.Println(Cyan + msgId + Reset + Magenta + " Received message!")
 	appId := parts[1]
 	deviceId := parts[3]
 	eventType := parts[5]
-	infoLog.Println(Cyan + msgId + Reset + Blue + " App_ID=" + appId + Reset)
-	infoLog.Println(Cyan + msgId + Reset + Blue + " Device_ID=" + deviceId + Reset)
-	infoLog.Println(Cyan + msgId + Reset + Blue + " Event_Type=" + eventType + Reset)
+	attrs := []any{"msg_id", msgId, "application", appId, "device", deviceId, "event_type", eventType}
+	live := Live_Message{Msg_Id: msgId, Application: appId, Device: deviceId, Event_Type: eventType, Hour_Label: chart_hour_label(time.Now())}
+	lns_stats.Record(eventType, deviceId, msg.Payload())
 	if eventType == "up" {
-		infoLog.Println(Cyan + msgId + Reset + " Supported event type, processing payload...")
 		payload := msg.Payload()
 		json.Unmarshal(payload, &parsed)
 		var dedupeId string
 		if rawVal, exists := parsed["deduplicationId"]; exists {
 			dedupeId = rawVal.(string)
 		}
-		infoLog.Println(Cyan + msgId + Reset + Blue + " Deduplication_ID=" + dedupeId + Reset)
-		infoLog.Println(Cyan + msgId + Reset + " Inserting data into uplink queue...")
-		sqlStatement := ` INSERT INTO UPLINK_QUEUE (msg_id, deduplication_id, payload) 
-							VALUES ($1, $2, $3);`
-		_, err := db.Exec(sqlStatement, msgId, dedupeId, payload)
+		attrs = append(attrs, "deduplication_id", dedupeId)
+		received := time.Now()
+		expires_at, expiry_action := queue_expiry(current_config(), queue_message(appId, deviceId, eventType, parsed), received)
+		sqlStatement := ` INSERT INTO UPLINK_QUEUE (msg_id, deduplication_id, payload, received_at, expires_at, expiry_action) 
+							VALUES ($1, $2, $3, $4, $5, $6);`
+		_, err := db.Exec(sqlStatement, msgId, dedupeId, payload, received.Unix(), expires_at, expiry_action)
 		if err != nil {
+			mqtt_log.Error("Failed to queue message", append(attrs, "outcome", "failed", "err", err)...)
+			live.Outcome = "failed"
+			live_hub.Publish(live_message, live)
 			panic(err)
 		}
-		infoLog.Println(Cyan + msgId + Reset + Green + " Successfully " + Reset + "queue data for uplink!")
-		infoLog.Println(Cyan + msgId + Reset + Green + " Successfully " + Reset + "proccessed payload")
+		mqtt_log.Info("Received message", append(attrs, "outcome", "queued")...)
+		live.Outcome = "queued"
 	} else {
-		infoLog.Println(Cyan + msgId + Reset + Blue + " Unsupported event type, skipped payload processing")
+		mqtt_log.Debug("Received message", append(attrs, "outcome", "skipped")...)
+		live.Outcome = "skipped"
 	}
+	live_hub.Publish(live_message, live)
 }
 
 var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
-	infoLog.Println(Green + "Successfully " + Reset + "connected to MQTT Broker")
+	mqtt_state.Store(mqtt_connected)
+	mqtt_log.Info("Successfully connected to MQTT Broker")
 	subscribed_topic := "application/#"
 	token := client.Subscribe(subscribed_topic, 1, nil)
 	token.Wait()
-	infoLog.Println(Green + "Subscribed to " + Reset + Blue + "Topic=" + subscribed_topic + Reset)
+	mqtt_log.Info("Subscribed to topic", "topic", subscribed_topic)
 }
 
 var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
-	warnLog.Printf("Connection Lost, reconnecting...")
+	mqtt_state.Store(mqtt_disconnected)
+	mqtt_log.Warn("Connection lost, reconnecting", "err", err)
 }
 
 func main() {
-	mode := "dev"
-	infoLog.Println("Application is starting in " + Blue + mode + Reset + " mode")
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(check_config(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		os.Exit(hash_password(os.Args[2:]))
+	}
 
-	infoLog.Println("Loading " + Blue + "./config.yaml" + Reset + " configuration file...")
+	mode := "dev"
+	main_log.Info("Application is starting", "mode", mode)
 
 	appConfig, err := LoadConfig(mode)
 	if err != nil {
 		panic(err)
 	}
-	infoLog.Println(Green + "Successfully " + Reset + "loaded " + Blue + "config.yaml" + Reset + " configuration file!")
+	configure_logging(appConfig)
+	main_log.Info("Successfully loaded config.yaml", "log_format", appConfig.LogFormat, "log_level", slog.Level(appConfig.LogLevel))
 
-	//Start net/http web service in a go routine
-	infoLog.Println("Launching net/http go routine...")
-	go StartServer(appConfig)
+	db_mngr, err = NewDBManager(appConfig)
+	if err != nil {
+		panic(err)
+	}
+	db, db_psql = db_mngr.db_sqlite, db_mngr.db_pgsql
 
 	db.SetMaxOpenConns(1)
-	infoLog.Println("Initializing SQLite DB...")
 
 	defer db.Close()
 	if mode == "dev2" {
-		infoLog.Println(Magenta + "DEV MODE : " + Reset + "Clearing Data...")
-		_, err := db.Exec(`DROP TABLE IF EXISTS UPLINK_QUEUE;`)
+		_, err := db.Exec(`DROP TABLE IF EXISTS UPLINK_QUEUE; PRAGMA user_version = 0;`)
 		if err != nil {
-			warnLog.Println(Yellow + err.Error() + Reset)
+			main_log.Warn("Failed to clear data", "err", err)
+		} else {
+			main_log.Info("Successfully cleared data", "mode", mode)
 		}
-		infoLog.Println(Magenta + "DEV MODE : " + Reset + Green + "Successfully " + Reset + "cleared data!")
 	}
-	_, err = db.Exec(`CREATE TABLE "UPLINK_QUEUE" (
-						"msg_id"	TEXT NOT NULL UNIQUE,
-						"id"	INTEGER,
-						"deduplication_id"	TEXT NOT NULL UNIQUE,
-						"payload"	TEXT NOT NULL,
-						PRIMARY KEY("id" AUTOINCREMENT)
-					);`)
-	if err != nil {
-		warnLog.Println(Yellow + err.Error() + Reset)
+	if err := migrate(db); err != nil {
+		panic(err)
 	}
 
-	infoLog.Println(Green + "Successfully " + Reset + "initialized SQLite DB!")
+	main_log.Info("Successfully initialized SQLite DB")
 
-	broker := appConfig.MqttBrokerAddress
-	port := appConfig.MqttBrokerPort
-	username := appConfig.MqttBrokerUser
-	password := appConfig.MqttBrokerPassword
-	infoLog.Println(
-		"Connecting to MQTT Broker with " +
-			Blue + "Address=" + broker + " Port=" + port + Reset + " ...")
+	local_config = appConfig
+	if appConfig, err = startup_config(appConfig); err != nil {
+		main_log.Warn("Ignoring applied remote config", "err", err)
+		appConfig = local_config
+	}
+	app_config.Store(appConfig)
+	configure_logging(appConfig)
+
+	// Only once the tables are migrated and current_config is set, the
+	// handlers rely on both.
+	go StartServer(appConfig)
 
+	mqtt_log.Info("Connecting to MQTT Broker", "address", appConfig.MqttBrokerAddress, "port", appConfig.MqttBrokerPort)
+
+	mqtt_client = new_mqtt_client(appConfig)
+	if token := mqtt_client.Connect(); token.Wait() && token.Error() != nil {
+		panic(token.Error())
+	}
+
+	spawn_uplink_worker()
+	spawn_heartbeat_worker()
+	spawn_command_workers()
+	spawn_config_worker()
+	spawn_audit_worker()
+	spawn_expiry_worker()
+	spawn_downsample_worker()
+
+	// Reload on SIGHUP, and on every change of config.yaml when config_watch
+	// is enabled. Reloads run here so they never overlap.
+	reload := make(chan bool, 1)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			main_log.Info("Received SIGHUP, reloading")
+			select {
+			case reload <- true:
+			default:
+			}
+		}
+	}()
+	if appConfig.ConfigWatch {
+		go watch_config_file("config.yaml", 5*time.Second, reload)
+	}
+
+	// Keep the program running
+	for range reload {
+		if err := reload_config(mode); err != nil {
+			main_log.Warn("Refused to reload config.yaml, keeping the running config", "err", err)
+		}
+	}
+}
+
+func new_mqtt_client(appConfig *AppConfig) mqtt.Client {
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%s", broker, port))
-	opts.SetUsername(username)
-	opts.SetPassword(password)
+	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", appConfig.MqttBrokerAddress, appConfig.MqttBrokerPort))
+	opts.SetUsername(string(appConfig.MqttBrokerUser))
+	opts.SetPassword(string(appConfig.MqttBrokerPassword))
 	opts.SetAutoReconnect(true)
 	opts.SetMaxReconnectInterval(30 * time.Second)
 	opts.SetConnectRetry(true)
@@ -177,15 +195,7 @@ func main() {
 	opts.SetDefaultPublishHandler(messagePubHandler)
 	opts.OnConnect = connectHandler
 	opts.OnConnectionLost = connectLostHandler
-
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
-	}
-
-	spawn_uplink_worker(appConfig)
-	// Keep the program running
-	select {}
+	return mqtt.NewClient(opts)
 }
 
 type Uplink_Queue struct {
@@ -195,16 +205,26 @@ type Uplink_Queue struct {
 	payload          string
 }
 
-func spawn_uplink_worker(appConfig *AppConfig) {
-	infoLog.Println("Spawning uplink worker...")
+func spawn_uplink_worker() {
 	c_arr := make(chan bool)
 	ticker := time.NewTicker(1000 * time.Millisecond)
-	go uplink_worker(ticker, c_arr, appConfig)
-	infoLog.Println(Green + " Successfully spawned uplink worker!" + Reset)
+	go uplink_worker(ticker, c_arr)
+	uplink_log.Info("Successfully spawned uplink worker")
+}
+
+// uplink_backoff is how long the uplink worker waits after failing to read
+// or update the queue that many times in a row.
+func uplink_backoff(failures int) time.Duration {
+	if failures > 6 {
+		return time.Minute
+	}
+	return min(time.Second<<failures, time.Minute)
 }
 
-func uplink_worker(t *time.Ticker, ch <-chan bool, appConfig *AppConfig) {
-	infoLog.Println(Magenta + "UPLINK WORKER : " + Reset + "Entering event loop!")
+func uplink_worker(t *time.Ticker, ch <-chan bool) {
+	uplink_log.Debug("Entering event loop")
+	failures := 0
+	var retry_at time.Time
 	for {
 		select {
 		// Exit the loop & kill goroutines when received channel.
@@ -212,72 +232,66 @@ func uplink_worker(t *time.Ticker, ch <-chan bool, appConfig *AppConfig) {
 			return
 		// Do work when ticker ticks
 		case <-t.C:
+			appConfig := current_config()
 
-			rows, err := db.Query("select * from UPLINK_QUEUE ORDER BY id DESC LIMIT 20;")
-			if err != nil {
-				warnLog.Println("WARNING!")
-				log.Fatal(err)
+			if time.Now().Before(retry_at) {
+				continue
 			}
 
-			uplink_queue := Uplink_Queue{
-				id:               0,
-				msg_id:           "",
-				deduplication_id: "",
-				payload:          "",
+			upload_mu.Lock()
+			batch, err := db_read_uplinks("select msg_id, id, deduplication_id, payload from UPLINK_QUEUE WHERE expires_at = 0 OR expires_at > $1 ORDER BY id DESC LIMIT 20;",
+				time.Now().Unix())
+			uploaded := 0
+			if err == nil {
+				uploaded, err = upload_queued(appConfig, batch)
 			}
-
-			print_once := false
-			var msgIdArr []string
-			loop_entered := false
-			for rows.Next() {
-				loop_entered = true
-				if !print_once {
-					infoLog.Println(Magenta + "UPLINK WORKER : " + Reset + "Work started...")
-					print_once = true
-				}
-				if err := rows.Scan(&uplink_queue.msg_id, &uplink_queue.id, &uplink_queue.deduplication_id,
-					&uplink_queue.payload); err != nil {
-
-				}
-
-				infoLog.Println(Magenta + "UPLINK WORKER : " + Reset + "Uploading " + Blue + "Message_ID=" + uplink_queue.msg_id + Reset)
-				err := send_uplink(appConfig, uplink_queue.payload)
-				if err != nil {
-					warnLog.Println(Magenta + "UPLINK WORKER : " + Reset + err.Error())
-				} else {
-					msgIdArr = append(msgIdArr, uplink_queue.msg_id)
-					infoLog.Println(Magenta + "UPLINK WORKER : " + Reset + Green + "Successfully " + Reset + "uploaded!")
-				}
-			}
-			rows.Close()
-
-			for _, value := range msgIdArr {
-				infoLog.Println(Magenta + "UPLINK WORKER : " + Reset + "Removing " + Blue + "Message_ID=" + value + Reset + " from upload queue...")
-				_, err := db.Exec("DELETE FROM UPLINK_QUEUE WHERE msg_id=$1", value)
-				if err != nil {
-					panic(err)
-				}
+			upload_mu.Unlock()
+			if err != nil {
+				failures++
+				backoff := uplink_backoff(failures)
+				retry_at = time.Now().Add(backoff)
+				uplink_log.Error("Failed to work the uplink queue, backing off", "err", err, "failures", failures, "retry_in", backoff)
+				continue
 			}
+			failures = 0
 
-			if loop_entered {
-				infoLog.Println(Magenta + "UPLINK WORKER : " + Reset + Green + "Successfully " + Reset + "completed the work!")
+			if len(batch) > 0 {
+				uplink_log.Debug("Completed the work", "uploaded", uploaded)
 			}
 		}
 	}
 }
 
-func send_uplink(appConfig *AppConfig, payload string) (err error) {
+// uplink_client bounds every upload, an unresponsive sync-tower must not
+// hold upload_mu and stall the queue.
+var uplink_client = &http.Client{Timeout: 30 * time.Second}
+
+// send_uplink uploads one payload and returns the commands sync-tower
+// handed back with its acknowledgement.
+func send_uplink(appConfig *AppConfig, payload string) (commands []Command, err error) {
 
-	resp, err := http.Post(appConfig.UplinkEndpoint, "application/json", bytes.NewBuffer([]byte(payload)))
+	req, err := http.NewRequest("POST", appConfig.UplinkEndpoint, bytes.NewBuffer([]byte(payload)))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := uplink_client.Do(sync_tower_request(req, appConfig))
+	if err != nil {
+		return nil, err
 	} else {
+		defer resp.Body.Close()
 		sc := resp.StatusCode
 
 		if sc == 200 {
-			return nil
+			// Older sync-towers answer without Commands.
+			var body struct {
+				Commands []Command
+			}
+			json.NewDecoder(resp.Body).Decode(&body)
+			return body.Commands, nil
 		} else {
-			return errors.New("!200 STATUS CODE")
+			return nil, errors.New("!200 STATUS CODE")
 		}
 	}
 }
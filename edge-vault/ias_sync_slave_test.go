@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUplinkBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{5, 32 * time.Second},
+		{6, time.Minute},
+		{100, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := uplink_backoff(tt.failures); got != tt.want {
+			t.Errorf("uplink_backoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestSendUplink(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		code    int
+		body    string
+		want    int
+		wantErr bool
+	}{
+		{"accepted", 0, http.StatusOK, `{"Status":"OK"}`, 0, false},
+		{"with commands", 0, http.StatusOK, `{"Commands":[{"Id":7,"Type":"resync"}]}`, 1, false},
+		{"rejected", 0, http.StatusServiceUnavailable, "", 0, true},
+		{"unresponsive", time.Second, http.StatusOK, "", 0, true},
+	}
+	prev := uplink_client
+	t.Cleanup(func() { uplink_client = prev })
+	uplink_client = &http.Client{Timeout: 100 * time.Millisecond}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.delay)
+				w.WriteHeader(tt.code)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+			commands, err := send_uplink(&AppConfig{UplinkEndpoint: server.URL}, `{"deduplicationId":"d1"}`)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("send_uplink() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(commands) != tt.want {
+				t.Errorf("send_uplink() = %d commands, want %d", len(commands), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Live event types pushed to the home page.
+const (
+	live_status  = "status"
+	live_message = "message"
+	live_upload  = "upload"
+)
+
+// How many message and upload events a page that just opened is sent.
+const live_recent = 20
+
+// Live_Event is one Server-Sent Event on /events. Id numbers the message
+// and upload events so a browser that reconnects is only sent what it
+// missed. Replay marks the recent events sent to a page that just opened,
+// which its chart already counts.
+type Live_Event struct {
+	Id     uint64 `json:"-"`
+	Type   string
+	Time   time.Time
+	Replay bool
+	Data   any
+}
+
+// Live_Status is what the home page shows about the gateway, pushed every
+// few seconds while a page is open.
+type Live_Status struct {
+	Gateway_Time              string
+	Uptime_Seconds            int64
+	Queue_Depth               int64
+	Oldest_Queued_Age_Seconds int64
+	Mqtt_State                string
+	Cache_Size_MB             float64
+}
+
+type Live_Message struct {
+	Msg_Id      string
+	Application string
+	Device      string
+	Event_Type  string
+	Outcome     string
+	Hour_Label  string
+}
+
+type Live_Upload struct {
+	Msg_Id           string
+	Deduplication_Id string
+	Outcome          string
+	Error            string
+}
+
+// Live_Hub fans events out to every open page. A page that falls behind
+// misses events rather than holding up the workers that publish them.
+type Live_Hub struct {
+	mu      sync.Mutex
+	clients map[chan Live_Event]bool
+	recent  []Live_Event
+	last_id uint64
+}
+
+var live_hub = &Live_Hub{clients: map[chan Live_Event]bool{}}
+
+func (h *Live_Hub) Publish(kind string, data any) {
+	e := Live_Event{Type: kind, Time: time.Now(), Data: data}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if kind != live_status {
+		h.last_id++
+		e.Id = h.last_id
+		h.recent = append(h.recent, e)
+		if len(h.recent) > live_recent {
+			h.recent = h.recent[len(h.recent)-live_recent:]
+		}
+	}
+	for ch := range h.clients {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns the channel of a new page and the recent events it
+// should show first.
+func (h *Live_Hub) Subscribe() (chan Live_Event, []Live_Event) {
+	ch := make(chan Live_Event, 64)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[ch] = true
+	return ch, append([]Live_Event{}, h.recent...)
+}
+
+func (h *Live_Hub) Unsubscribe(ch chan Live_Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, ch)
+}
+
+func (h *Live_Hub) Clients() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+func current_live_status() Live_Status {
+	depth, oldest_age, err := queue_stats()
+	if err != nil {
+		web_log.Warn("Failed to read queue stats", "err", err)
+	}
+	var cache_size float64
+	if info, err := os.Stat("./sqlite.db"); err == nil {
+		cache_size = float64(info.Size()) / 1024 / 1024
+	}
+	return Live_Status{
+		Gateway_Time:              time.Now().Format("02/01/2006 03:04:05 PM MST"),
+		Uptime_Seconds:            int64(time.Since(start_time).Seconds()),
+		Queue_Depth:               depth,
+		Oldest_Queued_Age_Seconds: int64(oldest_age.Seconds()),
+		Mqtt_State:                mqtt_state.Load().(string),
+		Cache_Size_MB:             cache_size,
+	}
+}
+
+// live_status_worker publishes the status while anyone is watching.
+func live_status_worker(interval time.Duration) {
+	for range time.Tick(interval) {
+		if live_hub.Clients() > 0 {
+			live_hub.Publish(live_status, current_live_status())
+		}
+	}
+}
+
+func write_live_event(w http.ResponseWriter, e Live_Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if e.Id > 0 {
+		fmt.Fprintf(w, "id: %d\n", e.Id)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+	return err
+}
+
+// eventsHandler streams Live_Events to the home page as Server-Sent Events.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	ch, recent := live_hub.Subscribe()
+	defer live_hub.Unsubscribe(ch)
+
+	// Ask the browser to wait a bit before reconnecting after a restart.
+	fmt.Fprint(w, "retry: 5000\n\n")
+	write_live_event(w, Live_Event{Type: live_status, Time: time.Now(), Data: current_live_status()})
+	// A Last-Event-ID ahead of the recent events is from before a restart.
+	last_id, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	reconnect := err == nil && (len(recent) == 0 || last_id <= recent[len(recent)-1].Id)
+	for _, e := range recent {
+		if reconnect && e.Id <= last_id {
+			continue
+		}
+		e.Replay = !reconnect
+		write_live_event(w, e)
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	// Comments keep proxies from closing an idle stream.
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			err = write_live_event(w, e)
+		case <-keepalive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
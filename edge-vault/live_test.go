@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test_live_hub swaps in an empty hub until the test ends.
+func test_live_hub(t *testing.T) *Live_Hub {
+	prev := live_hub
+	live_hub = &Live_Hub{clients: map[chan Live_Event]bool{}}
+	t.Cleanup(func() { live_hub = prev })
+	return live_hub
+}
+
+func TestLiveHub(t *testing.T) {
+	h := test_live_hub(t)
+	ch, recent := h.Subscribe()
+	if len(recent) != 0 || h.Clients() != 1 {
+		t.Fatalf("recent %v, %d clients", recent, h.Clients())
+	}
+
+	h.Publish(live_status, Live_Status{Queue_Depth: 3})
+	for i := range live_recent + 5 {
+		h.Publish(live_message, Live_Message{Msg_Id: string(rune('a' + i))})
+	}
+	if e := <-ch; e.Type != live_status || e.Id != 0 {
+		t.Errorf("status event %+v, want no id", e)
+	}
+	if e := <-ch; e.Type != live_message || e.Id != 1 {
+		t.Errorf("first message event %+v, want id 1", e)
+	}
+
+	_, recent = h.Subscribe()
+	if len(recent) != live_recent || recent[0].Id != 6 || recent[len(recent)-1].Id != live_recent+5 {
+		t.Errorf("recent events %d, from %d to %d", len(recent), recent[0].Id, recent[len(recent)-1].Id)
+	}
+	for _, e := range recent {
+		if e.Type == live_status {
+			t.Error("status kept as a recent event")
+		}
+	}
+
+	h.Unsubscribe(ch)
+	if h.Clients() != 1 {
+		t.Errorf("%d clients after unsubscribe, want 1", h.Clients())
+	}
+}
+
+func TestLiveHubSlowClient(t *testing.T) {
+	h := test_live_hub(t)
+	h.Subscribe()
+	done := make(chan bool)
+	go func() {
+		for range 200 {
+			h.Publish(live_upload, Live_Upload{Outcome: "synced"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish blocked on a client that does not read")
+	}
+}
+
+func TestWriteLiveEvent(t *testing.T) {
+	at := time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		event Live_Event
+		want  string
+	}{
+		{"status has no id", Live_Event{Type: live_status, Time: at, Data: map[string]int{"Queue_Depth": 3}},
+			"event: status\ndata: {\"Type\":\"status\",\"Time\":\"2025-01-31T13:45:00Z\",\"Replay\":false,\"Data\":{\"Queue_Depth\":3}}\n\n"},
+		{"message", Live_Event{Id: 7, Type: live_message, Time: at, Replay: true, Data: nil},
+			"id: 7\nevent: message\ndata: {\"Type\":\"message\",\"Time\":\"2025-01-31T13:45:00Z\",\"Replay\":true,\"Data\":null}\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if err := write_live_event(w, tt.event); err != nil {
+				t.Fatal(err)
+			}
+			if w.Body.String() != tt.want {
+				t.Errorf("wrote %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+// read_live_events reads n events off a Server-Sent Events stream.
+func read_live_events(t *testing.T, r *bufio.Reader, n int) []Live_Event {
+	events := []Live_Event{}
+	var e Live_Event
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if id, ok := strings.CutPrefix(line, "id: "); ok {
+			json.Unmarshal([]byte(id), &e.Id)
+		}
+		if line == "" && e.Type != "" {
+			events = append(events, e)
+			e = Live_Event{}
+		}
+	}
+	return events
+}
+
+func TestEventsHandler(t *testing.T) {
+	test_db(t)
+	server := httptest.NewServer(http.HandlerFunc(eventsHandler))
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		last_event_id string
+		want          []uint64
+		replay        bool
+	}{
+		{"new page gets recent events as replay", "", []uint64{1, 2, 3}, true},
+		{"reconnect gets what it missed", "2", []uint64{3}, false},
+		{"reconnect after a restart gets everything", "40", []uint64{1, 2, 3}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := test_live_hub(t)
+			for _, id := range []string{"a", "b", "c"} {
+				h.Publish(live_message, Live_Message{Msg_Id: id})
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			if tt.last_event_id != "" {
+				req.Header.Set("Last-Event-ID", tt.last_event_id)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.Header.Get("Content-Type") != "text/event-stream" {
+				t.Errorf("Content-Type %s", resp.Header.Get("Content-Type"))
+			}
+			r := bufio.NewReader(resp.Body)
+			events := read_live_events(t, r, 1+len(tt.want))
+			if events[0].Type != live_status {
+				t.Errorf("first event %s, want status", events[0].Type)
+			}
+			ids := []uint64{}
+			for _, e := range events[1:] {
+				ids = append(ids, e.Id)
+				if e.Replay != tt.replay {
+					t.Errorf("event %d replay %v, want %v", e.Id, e.Replay, tt.replay)
+				}
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("sent events %v, want %v", ids, tt.want)
+			}
+
+			// The page subscribed before it was sent anything.
+			h.Publish(live_upload, Live_Upload{Msg_Id: "d", Outcome: "synced"})
+			if e := read_live_events(t, r, 1)[0]; e.Type != live_upload || e.Replay {
+				t.Errorf("live event %+v", e)
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var lns_log = component_logger("lns")
+
+// How many signal samples are kept per device and how many joins in all.
+const (
+	lns_samples = 50
+	lns_joins   = 20
+)
+
+// Lns_Event is the part of a ChirpStack event the LNS page reads.
+type Lns_Event struct {
+	Time       time.Time `json:"time"`
+	DevAddr    string    `json:"devAddr"`
+	FCnt       *uint32   `json:"fCnt"`
+	DeviceInfo struct {
+		ApplicationName string `json:"applicationName"`
+		DeviceName      string `json:"deviceName"`
+		DevEui          string `json:"devEui"`
+	} `json:"deviceInfo"`
+	RxInfo []struct {
+		GatewayId string  `json:"gatewayId"`
+		Rssi      int     `json:"rssi"`
+		Snr       float64 `json:"snr"`
+	} `json:"rxInfo"`
+}
+
+type Lns_Sample struct {
+	Time       time.Time
+	Rssi       int
+	Snr        float64
+	Gateway_Id string
+}
+
+// Lns_Device is what the LNS has sent about one device since edge-vault
+// started. Lost counts the frame counters skipped between uplinks, Resets
+// the times the counter went back, as after a rejoin.
+type Lns_Device struct {
+	Dev_Eui     string
+	Device_Name string
+	Application string
+	Dev_Addr    string
+	First_Seen  time.Time
+	Last_Seen   time.Time
+	Uplinks     int64
+	Duplicates  int64
+	Lost        int64
+	Resets      int64
+	Joins       int64
+	Last_Join   time.Time
+	Last_F_Cnt  uint32
+	Samples     []Lns_Sample
+}
+
+type Lns_Join struct {
+	Time        time.Time
+	Dev_Eui     string
+	Device_Name string
+	Dev_Addr    string
+}
+
+type Lns_Stats struct {
+	mu      sync.Mutex
+	started time.Time
+	devices map[string]*Lns_Device
+	joins   []Lns_Join
+}
+
+var lns_stats = &Lns_Stats{started: time.Now(), devices: map[string]*Lns_Device{}}
+
+// Record adds one MQTT event of the LNS. Events other than up and join only
+// count as the device being seen.
+func (s *Lns_Stats) Record(event_type string, dev_eui string, payload []byte) {
+	var e Lns_Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		lns_log.Debug("Ignoring event that is not JSON", "device", dev_eui, "event_type", event_type, "err", err)
+		return
+	}
+	if e.DeviceInfo.DevEui != "" {
+		dev_eui = e.DeviceInfo.DevEui
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[dev_eui]
+	if !ok {
+		d = &Lns_Device{Dev_Eui: dev_eui, First_Seen: e.Time}
+		s.devices[dev_eui] = d
+	}
+	d.Last_Seen = e.Time
+	if e.DeviceInfo.DeviceName != "" {
+		d.Device_Name = e.DeviceInfo.DeviceName
+	}
+	if e.DeviceInfo.ApplicationName != "" {
+		d.Application = e.DeviceInfo.ApplicationName
+	}
+	if e.DevAddr != "" {
+		d.Dev_Addr = e.DevAddr
+	}
+
+	switch event_type {
+	case "join":
+		d.Joins++
+		d.Last_Join = e.Time
+		s.joins = append(s.joins, Lns_Join{Time: e.Time, Dev_Eui: dev_eui, Device_Name: d.Device_Name, Dev_Addr: e.DevAddr})
+		if len(s.joins) > lns_joins {
+			s.joins = s.joins[len(s.joins)-lns_joins:]
+		}
+	case "up":
+		d.record_uplink(e)
+	}
+}
+
+func (d *Lns_Device) record_uplink(e Lns_Event) {
+	if e.FCnt != nil {
+		f_cnt := *e.FCnt
+		switch {
+		case d.Uplinks == 0:
+		case f_cnt == d.Last_F_Cnt:
+			// A retransmission, the LNS already deduplicated across gateways.
+			d.Duplicates++
+			return
+		case f_cnt > d.Last_F_Cnt:
+			d.Lost += int64(f_cnt - d.Last_F_Cnt - 1)
+		default:
+			d.Resets++
+		}
+		d.Last_F_Cnt = f_cnt
+	}
+	d.Uplinks++
+
+	// The gateway that heard the uplink best.
+	if len(e.RxInfo) == 0 {
+		return
+	}
+	best := e.RxInfo[0]
+	for _, rx := range e.RxInfo[1:] {
+		if rx.Rssi > best.Rssi {
+			best = rx
+		}
+	}
+	d.Samples = append(d.Samples, Lns_Sample{Time: e.Time, Rssi: best.Rssi, Snr: best.Snr, Gateway_Id: best.GatewayId})
+	if len(d.Samples) > lns_samples {
+		d.Samples = d.Samples[len(d.Samples)-lns_samples:]
+	}
+}
+
+// Snapshot copies the devices, most recently seen first, and the joins,
+// newest first.
+func (s *Lns_Stats) Snapshot() (devices []Lns_Device, joins []Lns_Join, started time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.devices {
+		c := *d
+		c.Samples = slices.Clone(d.Samples)
+		devices = append(devices, c)
+	}
+	slices.SortFunc(devices, func(a, b Lns_Device) int {
+		return b.Last_Seen.Compare(a.Last_Seen)
+	})
+	joins = slices.Clone(s.joins)
+	slices.Reverse(joins)
+	return devices, joins, s.started
+}
+
+// Lns_Row is one device on the LNS page.
+type Lns_Row struct {
+	Lns_Device
+	Last_Seen_Label string
+	Last_Join_Label string
+	Loss_Percent    float64
+	Last_Rssi       string
+	Last_Snr        string
+	Avg_Rssi        string
+	Avg_Snr         string
+	Rssi_Trend      string
+	Rssi_Points     string
+	Snr_Points      string
+}
+
+func lns_rows(devices []Lns_Device, label func(time.Time) string) []Lns_Row {
+	rows := make([]Lns_Row, 0, len(devices))
+	for _, d := range devices {
+		row := Lns_Row{Lns_Device: d, Last_Seen_Label: label(d.Last_Seen)}
+		if !d.Last_Join.IsZero() {
+			row.Last_Join_Label = label(d.Last_Join)
+		}
+		if d.Uplinks+d.Lost > 0 {
+			row.Loss_Percent = float64(d.Lost) * 100 / float64(d.Uplinks+d.Lost)
+		}
+		if n := len(d.Samples); n > 0 {
+			rssi := make([]float64, n)
+			snr := make([]float64, n)
+			for i, sample := range d.Samples {
+				rssi[i] = float64(sample.Rssi)
+				snr[i] = sample.Snr
+			}
+			row.Last_Rssi = fmt.Sprintf("%d dBm", d.Samples[n-1].Rssi)
+			row.Last_Snr = fmt.Sprintf("%.1f dB", d.Samples[n-1].Snr)
+			row.Avg_Rssi = fmt.Sprintf("%.0f dBm", average(rssi))
+			row.Avg_Snr = fmt.Sprintf("%.1f dB", average(snr))
+			row.Rssi_Trend = signal_trend(rssi, 3)
+			row.Rssi_Points = sparkline(rssi)
+			row.Snr_Points = sparkline(snr)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+type Lns_Join_Row struct {
+	Lns_Join
+	Time_Label string
+}
+
+func average(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// signal_trend compares the newer half of the samples with the older half,
+// a change under threshold is steady.
+func signal_trend(values []float64, threshold float64) string {
+	if len(values) < 4 {
+		return ""
+	}
+	half := len(values) / 2
+	change := average(values[half:]) - average(values[:half])
+	switch {
+	case change > threshold:
+		return "rising"
+	case change < -threshold:
+		return "falling"
+	}
+	return "steady"
+}
+
+// The size of the sparklines on the LNS page.
+const (
+	sparkline_width  = 120
+	sparkline_height = 24
+)
+
+// sparkline returns the points of an SVG polyline of values, scaled to
+// their own range.
+func sparkline(values []float64) string {
+	if len(values) < 2 {
+		return ""
+	}
+	low, high := slices.Min(values), slices.Max(values)
+	if high == low {
+		high = low + 1
+	}
+	points := make([]string, len(values))
+	for i, v := range values {
+		x := float64(i) * sparkline_width / float64(len(values)-1)
+		y := sparkline_height - (v-low)*sparkline_height/(high-low)
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+	return strings.Join(points, " ")
+}
+
+func lnsHandler(w http.ResponseWriter, r *http.Request) {
+	loc, err := time.LoadLocation(current_config().TracerTimezone)
+	if err != nil {
+		loc = time.Local
+	}
+	label := func(t time.Time) string {
+		return t.In(loc).Format("02/01/2006 03:04:05 PM")
+	}
+	devices, joins, started := lns_stats.Snapshot()
+	var lost, uplinks int64
+	for _, d := range devices {
+		lost += d.Lost
+		uplinks += d.Uplinks
+	}
+	join_rows := make([]Lns_Join_Row, 0, len(joins))
+	for _, j := range joins {
+		join_rows = append(join_rows, Lns_Join_Row{Lns_Join: j, Time_Label: label(j.Time)})
+	}
+
+	data := struct {
+		Since     string
+		Timezone  string
+		Devices   []Lns_Row
+		Joins     []Lns_Join_Row
+		Uplinks   int64
+		Lost      int64
+		Width     int
+		Height    int
+		Samples   int
+		Max_Joins int
+	}{
+		Since:     label(started),
+		Timezone:  loc.String(),
+		Devices:   lns_rows(devices, label),
+		Joins:     join_rows,
+		Uplinks:   uplinks,
+		Lost:      lost,
+		Width:     sparkline_width,
+		Height:    sparkline_height,
+		Samples:   lns_samples,
+		Max_Joins: lns_joins,
+	}
+	render(w, r, "lns.html", data)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func lns_uplink(f_cnt int, rssi ...int) []byte {
+	rx := []string{}
+	for i, r := range rssi {
+		rx = append(rx, fmt.Sprintf(`{"gatewayId":"gw%d","rssi":%d,"snr":%d.5}`, i, r, i))
+	}
+	return []byte(fmt.Sprintf(`{"time":"2025-01-31T13:%02d:00Z","devAddr":"01ab5c3d","fCnt":%d,"deviceInfo":{"applicationName":"spectra","deviceName":"pump-1","devEui":"0004a30b001c0530"},"rxInfo":[%s]}`,
+		f_cnt%60, f_cnt, strings.Join(rx, ",")))
+}
+
+func TestLnsFrameCounters(t *testing.T) {
+	tests := []struct {
+		name       string
+		f_cnts     []int
+		uplinks    int64
+		lost       int64
+		duplicates int64
+		resets     int64
+	}{
+		{"in order", []int{1, 2, 3}, 3, 0, 0, 0},
+		{"gap", []int{1, 2, 5, 6}, 4, 2, 0, 0},
+		{"retransmission", []int{1, 2, 2, 3}, 3, 0, 1, 0},
+		{"reset after rejoin", []int{10, 11, 0, 1}, 4, 0, 0, 1},
+		{"first uplink is not a gap", []int{40, 41}, 2, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Lns_Stats{devices: map[string]*Lns_Device{}}
+			for _, f_cnt := range tt.f_cnts {
+				s.Record("up", "0004a30b001c0530", lns_uplink(f_cnt, -90))
+			}
+			d := s.devices["0004a30b001c0530"]
+			if d.Uplinks != tt.uplinks || d.Lost != tt.lost || d.Duplicates != tt.duplicates || d.Resets != tt.resets {
+				t.Errorf("uplinks %d, lost %d, duplicates %d, resets %d, want %d, %d, %d, %d",
+					d.Uplinks, d.Lost, d.Duplicates, d.Resets, tt.uplinks, tt.lost, tt.duplicates, tt.resets)
+			}
+		})
+	}
+}
+
+func TestLnsRecord(t *testing.T) {
+	s := &Lns_Stats{devices: map[string]*Lns_Device{}}
+	s.Record("up", "0004a30b001c0530", lns_uplink(1, -110, -95, -101))
+	s.Record("join", "0004a30b001c0531", []byte(`{"time":"2025-01-31T14:00:00Z","devAddr":"01ab5c3e","deviceInfo":{"deviceName":"valve-2"}}`))
+	s.Record("status", "0004a30b001c0530", []byte(`{"time":"2025-01-31T14:30:00Z","margin":10}`))
+	s.Record("up", "0004a30b001c0532", []byte(`not json`))
+	for range lns_samples + 5 {
+		s.Record("join", "0004a30b001c0533", []byte(`{}`))
+	}
+
+	devices, joins, _ := s.Snapshot()
+	if len(devices) != 3 {
+		t.Fatalf("%d devices, want 3", len(devices))
+	}
+	pump := devices[lns_device_index(devices, "0004a30b001c0530")]
+	if len(pump.Samples) != 1 || pump.Samples[0].Rssi != -95 || pump.Samples[0].Gateway_Id != "gw1" {
+		t.Errorf("best gateway sample %+v", pump.Samples)
+	}
+	if !pump.Last_Seen.Equal(time.Date(2025, 1, 31, 14, 30, 0, 0, time.UTC)) || pump.Uplinks != 1 {
+		t.Errorf("status event did not only mark the device seen: %+v", pump)
+	}
+	if len(joins) != lns_joins {
+		t.Errorf("%d joins kept, want %d", len(joins), lns_joins)
+	}
+	valve := devices[lns_device_index(devices, "0004a30b001c0531")]
+	if valve.Joins != 1 || valve.Device_Name != "valve-2" || valve.Dev_Addr != "01ab5c3e" {
+		t.Errorf("join not recorded: %+v", valve)
+	}
+	// Newest seen first.
+	if devices[0].Dev_Eui != "0004a30b001c0533" {
+		t.Errorf("first device %s", devices[0].Dev_Eui)
+	}
+}
+
+func lns_device_index(devices []Lns_Device, dev_eui string) int {
+	for i, d := range devices {
+		if d.Dev_Eui == dev_eui {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestLnsSamplesKept(t *testing.T) {
+	s := &Lns_Stats{devices: map[string]*Lns_Device{}}
+	for i := range lns_samples + 10 {
+		s.Record("up", "0004a30b001c0530", lns_uplink(i, -100+i%5))
+	}
+	devices, _, _ := s.Snapshot()
+	if len(devices[0].Samples) != lns_samples {
+		t.Errorf("%d samples kept, want %d", len(devices[0].Samples), lns_samples)
+	}
+	// The snapshot is a copy.
+	devices[0].Samples[0].Rssi = 0
+	if s.devices["0004a30b001c0530"].Samples[0].Rssi == 0 {
+		t.Error("snapshot shares samples with the stats")
+	}
+}
+
+func TestSignalTrend(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   string
+	}{
+		{"too few", []float64{-100, -90, -80}, ""},
+		{"rising", []float64{-100, -100, -90, -90}, "rising"},
+		{"falling", []float64{-90, -90, -100, -100}, "falling"},
+		{"steady", []float64{-100, -99, -101, -98}, "steady"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signal_trend(tt.values, 3); got != tt.want {
+				t.Errorf("signal_trend() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   string
+	}{
+		{"too few", []float64{-100}, ""},
+		{"range", []float64{-100, -90, -95}, "0.0,24.0 60.0,0.0 120.0,12.0"},
+		{"flat", []float64{-90, -90}, "0.0,24.0 120.0,24.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sparkline(tt.values); got != tt.want {
+				t.Errorf("sparkline() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLnsRows(t *testing.T) {
+	label := func(t time.Time) string { return t.Format(time.DateTime) }
+	seen := time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC)
+	devices := []Lns_Device{
+		{Dev_Eui: "0004a30b001c0530", Last_Seen: seen, Uplinks: 9, Lost: 1,
+			Samples: []Lns_Sample{{Rssi: -100, Snr: 1}, {Rssi: -100, Snr: 2}, {Rssi: -90, Snr: 3}, {Rssi: -90, Snr: 4.5}}},
+		{Dev_Eui: "0004a30b001c0531", Last_Seen: seen, Last_Join: seen},
+	}
+	rows := lns_rows(devices, label)
+	pump := rows[0]
+	if pump.Loss_Percent != 10 || pump.Last_Rssi != "-90 dBm" || pump.Last_Snr != "4.5 dB" || pump.Avg_Rssi != "-95 dBm" ||
+		pump.Avg_Snr != "2.6 dB" || pump.Rssi_Trend != "rising" || pump.Last_Join_Label != "" || pump.Rssi_Points == "" {
+		t.Errorf("row %+v", pump)
+	}
+	valve := rows[1]
+	if valve.Loss_Percent != 0 || valve.Last_Rssi != "" || valve.Last_Join_Label != "2025-01-31 13:45:00" {
+		t.Errorf("row without uplinks %+v", valve)
+	}
+}
+
+func TestLnsHandler(t *testing.T) {
+	test_web_config(t)
+	if err := test_web_files(t, ""); err != nil {
+		t.Fatal(err)
+	}
+	prev := lns_stats
+	lns_stats = &Lns_Stats{started: time.Now(), devices: map[string]*Lns_Device{}}
+	t.Cleanup(func() { lns_stats = prev })
+	lns_stats.Record("up", "0004a30b001c0530", lns_uplink(1, -90))
+	lns_stats.Record("up", "0004a30b001c0530", lns_uplink(4, -92))
+
+	w := httptest.NewRecorder()
+	lnsHandler(w, httptest.NewRequest(http.MethodGet, "/lns", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "pump-1") || !strings.Contains(w.Body.String(), "0004a30b001c0530") {
+		t.Errorf("status %d, body %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrations_fs embed.FS
+
+// migrate applies the embedded NNNN_name.sql files newer than the SQLite
+// user_version, each in its own transaction, and bumps user_version after
+// each one.
+func migrate(db *sql.DB) error {
+	entries, err := migrations_fs.ReadDir("migrations")
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	var current int
+	if err := db.QueryRow(`PRAGMA user_version;`).Scan(&current); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return fmt.Errorf("migration %s: %w", name, err)
+		}
+		if version <= current {
+			continue
+		}
+		body, err := migrations_fs.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return err
+		}
+
+		main_log.Info("Applying migration", "migration", name)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(body)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s: %w", name, err)
+		}
+		// PRAGMA does not take bound parameters.
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d;`, version)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s: %w", name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %s: %w", name, err)
+		}
+		current = version
+	}
+	main_log.Info("Successfully migrated SQLite DB", "version", current)
+	return nil
+}
@@ -0,0 +1,8 @@
+-- Created at startup before migrations existed, hence IF NOT EXISTS.
+CREATE TABLE IF NOT EXISTS "UPLINK_QUEUE" (
+	"msg_id"	TEXT NOT NULL UNIQUE,
+	"id"	INTEGER,
+	"deduplication_id"	TEXT NOT NULL UNIQUE,
+	"payload"	TEXT NOT NULL,
+	PRIMARY KEY("id" AUTOINCREMENT)
+);
@@ -0,0 +1,3 @@
+-- Unix time the message was queued, 0 for rows queued before this column.
+ALTER TABLE "UPLINK_QUEUE" ADD COLUMN "received_at" INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS "UPLINK_QUEUE_received_at" ON "UPLINK_QUEUE" ("received_at");
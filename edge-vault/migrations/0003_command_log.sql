@@ -0,0 +1,10 @@
+-- Commands from sync-tower already executed here, so a redelivered command is
+-- acknowledged again with its recorded result instead of running twice.
+CREATE TABLE IF NOT EXISTS "COMMAND_LOG" (
+	"command_id"  INTEGER NOT NULL PRIMARY KEY,
+	"type"        TEXT NOT NULL,
+	"success"     INTEGER NOT NULL,
+	"result"      TEXT NOT NULL DEFAULT '',
+	"executed_at" INTEGER NOT NULL,
+	"acked"       INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,10 @@
+-- Config versions fetched from sync-tower and what became of them. The
+-- newest applied version is laid over config.yaml again at startup.
+CREATE TABLE IF NOT EXISTS "REMOTE_CONFIG" (
+	"version"    INTEGER NOT NULL PRIMARY KEY,
+	"config"     TEXT NOT NULL,
+	"status"     TEXT NOT NULL,
+	"error"      TEXT NOT NULL DEFAULT '',
+	"reported"   INTEGER NOT NULL DEFAULT 0,
+	"updated_at" INTEGER NOT NULL
+);
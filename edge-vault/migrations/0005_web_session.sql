@@ -0,0 +1,10 @@
+-- Logged in browsers of the web console, so a restart does not log them
+-- out. The id is the SHA-256 of the session cookie, the cookie itself is
+-- never stored.
+CREATE TABLE IF NOT EXISTS "WEB_SESSION" (
+	"id"         TEXT NOT NULL PRIMARY KEY,
+	"username"   TEXT NOT NULL,
+	"csrf"       TEXT NOT NULL,
+	"expires_at" INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS "WEB_SESSION_expires_at" ON "WEB_SESSION" ("expires_at");
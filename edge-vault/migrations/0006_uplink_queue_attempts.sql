@@ -0,0 +1,16 @@
+-- Failed uploads of each message, shown on the Queue page.
+ALTER TABLE "UPLINK_QUEUE" ADD COLUMN "attempts" INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE "UPLINK_QUEUE" ADD COLUMN "last_error" TEXT NOT NULL DEFAULT '';
+ALTER TABLE "UPLINK_QUEUE" ADD COLUMN "last_attempt_at" INTEGER NOT NULL DEFAULT 0;
+-- Messages an operator took out of the queue, kept until requeued or deleted.
+CREATE TABLE IF NOT EXISTS "UPLINK_DEAD_LETTER" (
+	"id"               INTEGER NOT NULL PRIMARY KEY,
+	"msg_id"           TEXT NOT NULL UNIQUE,
+	"deduplication_id" TEXT NOT NULL,
+	"payload"          TEXT NOT NULL,
+	"received_at"      INTEGER NOT NULL DEFAULT 0,
+	"attempts"         INTEGER NOT NULL DEFAULT 0,
+	"last_error"       TEXT NOT NULL DEFAULT '',
+	"last_attempt_at"  INTEGER NOT NULL DEFAULT 0,
+	"dead_at"          INTEGER NOT NULL
+);
@@ -0,0 +1,25 @@
+-- Administrative actions on this gateway, who did what, when and from where.
+-- Entries are never changed, and only removed by audit retention once they
+-- are more than a day old.
+CREATE TABLE IF NOT EXISTS "AUDIT_LOG" (
+	"id"      INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+	"time"    INTEGER NOT NULL,
+	"actor"   TEXT NOT NULL,
+	"source"  TEXT NOT NULL DEFAULT '',
+	"action"  TEXT NOT NULL,
+	"target"  TEXT NOT NULL DEFAULT '',
+	"before"  TEXT NOT NULL DEFAULT '',
+	"after"   TEXT NOT NULL DEFAULT '',
+	"outcome" TEXT NOT NULL,
+	"error"   TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS "AUDIT_LOG_time" ON "AUDIT_LOG" ("time");
+CREATE TRIGGER IF NOT EXISTS "AUDIT_LOG_no_update" BEFORE UPDATE ON "AUDIT_LOG"
+BEGIN
+	SELECT RAISE(ABORT, 'AUDIT_LOG is append-only');
+END;
+CREATE TRIGGER IF NOT EXISTS "AUDIT_LOG_no_recent_delete" BEFORE DELETE ON "AUDIT_LOG"
+WHEN old."time" > CAST(strftime('%s', 'now') AS INTEGER) - 86400
+BEGIN
+	SELECT RAISE(ABORT, 'AUDIT_LOG entries are kept for at least a day');
+END;
@@ -0,0 +1,7 @@
+-- When a queued message expires, 0 never, and whether it is then dropped
+-- or archived to the dead letters.
+ALTER TABLE "UPLINK_QUEUE" ADD COLUMN "expires_at" INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE "UPLINK_QUEUE" ADD COLUMN "expiry_action" TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS "UPLINK_QUEUE_expires_at" ON "UPLINK_QUEUE" ("expires_at") WHERE "expires_at" > 0;
+-- Why a message is a dead letter, empty when an operator moved it there.
+ALTER TABLE "UPLINK_DEAD_LETTER" ADD COLUMN "reason" TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+-- The expiry of a message travels with it to the dead letters and back, so
+-- a requeued message still expires.
+ALTER TABLE "UPLINK_DEAD_LETTER" ADD COLUMN "expires_at" INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE "UPLINK_DEAD_LETTER" ADD COLUMN "expiry_action" TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+-- When an operator last requeued a message from the dead letters, 0 never.
+-- Its TTL counts from then, or it would expire again right away.
+ALTER TABLE "UPLINK_QUEUE" ADD COLUMN "requeued_at" INTEGER NOT NULL DEFAULT 0;
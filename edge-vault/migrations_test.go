@@ -0,0 +1,43 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// test_db points db at a fresh, migrated SQLite file for the test.
+func test_db(t *testing.T) *sql.DB {
+	t.Helper()
+	test, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "sqlite.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.SetMaxOpenConns(1)
+	if err := migrate(test); err != nil {
+		t.Fatal(err)
+	}
+	prev := db
+	db = test
+	t.Cleanup(func() {
+		db = prev
+		test.Close()
+	})
+	return test
+}
+
+func TestMigrate(t *testing.T) {
+	test := test_db(t)
+	var version int
+	if err := test.QueryRow(`PRAGMA user_version;`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := migrations_fs.ReadDir("migrations")
+	if version != len(entries) {
+		t.Errorf("user_version = %d, want %d", version, len(entries))
+	}
+	// A restart finds everything applied.
+	if err := migrate(test); err != nil {
+		t.Errorf("migrating again: %v", err)
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var queue_log = component_logger("queue")
+
+// The two tables of the Queue page, the only ones its queries name.
+const (
+	queue_table       = "UPLINK_QUEUE"
+	dead_letter_table = "UPLINK_DEAD_LETTER"
+)
+
+const queue_page_size = 100
+
+// Queue actions, those of the dead letters are requeue, delete and export.
+const (
+	queue_retry       = "retry"
+	queue_delete      = "delete"
+	queue_dead_letter = "dead_letter"
+	queue_requeue     = "requeue"
+	queue_export      = "export"
+)
+
+// upload_mu keeps the uplink worker, a retry from the Queue page and a
+// purge from sync-tower from working on the queue at the same time.
+var upload_mu sync.Mutex
+
+// upload_queued uploads a batch read from UPLINK_QUEUE. Uploaded messages
+// leave the queue, failed ones record the attempt.
+func upload_queued(appConfig *AppConfig, batch []Uplink_Queue) (uploaded int, err error) {
+	for _, uplink_queue := range batch {
+		commands, upload_err := send_uplink(appConfig, uplink_queue.payload)
+		queue_commands(commands)
+		if upload_err != nil {
+			uplink_log.Warn("Failed to upload message", "msg_id", uplink_queue.msg_id, "deduplication_id", uplink_queue.deduplication_id, "outcome", "retry", "err", upload_err)
+			live_hub.Publish(live_upload, Live_Upload{Msg_Id: uplink_queue.msg_id, Deduplication_Id: uplink_queue.deduplication_id, Outcome: "retry", Error: upload_err.Error()})
+			_, err = db.Exec(`UPDATE UPLINK_QUEUE SET attempts = attempts + 1, last_error = $1, last_attempt_at = $2 WHERE id = $3;`,
+				upload_err.Error(), time.Now().Unix(), uplink_queue.id)
+		} else {
+			uploaded++
+			uplink_log.Info("Uploaded message", "msg_id", uplink_queue.msg_id, "deduplication_id", uplink_queue.deduplication_id, "outcome", "uploaded", "commands", len(commands))
+			live_hub.Publish(live_upload, Live_Upload{Msg_Id: uplink_queue.msg_id, Deduplication_Id: uplink_queue.deduplication_id, Outcome: "uploaded"})
+			_, err = db.Exec(`DELETE FROM UPLINK_QUEUE WHERE id = $1;`, uplink_queue.id)
+		}
+		if err != nil {
+			return uploaded, err
+		}
+	}
+	return uploaded, nil
+}
+
+// db_read_uplinks reads the messages to upload, closing the rows before the
+// uploads as SQLite has the one connection.
+func db_read_uplinks(query string, args ...any) ([]Uplink_Queue, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	batch := []Uplink_Queue{}
+	for rows.Next() {
+		var u Uplink_Queue
+		if err := rows.Scan(&u.msg_id, &u.id, &u.deduplication_id, &u.payload); err != nil {
+			return nil, err
+		}
+		batch = append(batch, u)
+	}
+	return batch, rows.Err()
+}
+
+// Queue_Row is one message on the Queue page, from either table.
+type Queue_Row struct {
+	Id               int64
+	Msg_Id           string
+	Deduplication_Id string
+	Dev_Eui          string
+	Device_Name      string
+	Received_At      time.Time
+	Age              string
+	Attempts         int64
+	Last_Error       string
+	Last_Attempt_At  time.Time
+	Expires_At       time.Time
+	Dead_At          time.Time
+	Dead_Reason      string
+	Payload          string
+}
+
+// queue_columns reads a Queue_Row, the device comes out of the ChirpStack
+// payload. It is stored as a blob, which json_extract would take for JSONB.
+const queue_columns = `id, msg_id, deduplication_id, received_at, attempts, last_error, last_attempt_at, payload,
+	COALESCE(json_extract(CAST(payload AS TEXT), '$.deviceInfo.devEui'), ''), COALESCE(json_extract(CAST(payload AS TEXT), '$.deviceInfo.deviceName'), '')`
+
+func scan_queue_row(scan func(dest ...any) error, table string) (Queue_Row, error) {
+	var row Queue_Row
+	var received_at, last_attempt_at, expires_at, dead_at int64
+	dest := []any{&row.Id, &row.Msg_Id, &row.Deduplication_Id, &received_at, &row.Attempts, &row.Last_Error,
+		&last_attempt_at, &row.Payload, &row.Dev_Eui, &row.Device_Name}
+	if table == dead_letter_table {
+		dest = append(dest, &dead_at, &row.Dead_Reason)
+	} else {
+		dest = append(dest, &expires_at)
+	}
+	if err := scan(dest...); err != nil {
+		return row, err
+	}
+	// 0 for rows queued before received_at was recorded.
+	if received_at > 0 {
+		row.Received_At = time.Unix(received_at, 0)
+		row.Age = time.Since(row.Received_At).Round(time.Second).String()
+	}
+	if last_attempt_at > 0 {
+		row.Last_Attempt_At = time.Unix(last_attempt_at, 0)
+	}
+	if expires_at > 0 {
+		row.Expires_At = time.Unix(expires_at, 0)
+	}
+	if dead_at > 0 {
+		row.Dead_At = time.Unix(dead_at, 0)
+	}
+	return row, nil
+}
+
+func queue_select(table string) string {
+	if table == dead_letter_table {
+		return "SELECT " + queue_columns + ", dead_at, reason FROM " + table
+	}
+	return "SELECT " + queue_columns + ", expires_at FROM " + table
+}
+
+// db_queue_page reads one page of a table, oldest first as that is the
+// order they were received in. device matches the name or DevEUI.
+func db_queue_page(table string, device string, page int) (rows []Queue_Row, total int64, err error) {
+	where, args := "", []any{}
+	if device != "" {
+		where = ` WHERE json_extract(CAST(payload AS TEXT), '$.deviceInfo.deviceName') = $1 OR json_extract(CAST(payload AS TEXT), '$.deviceInfo.devEui') = $1`
+		args = append(args, device)
+	}
+	if err := db.QueryRow("SELECT count(*) FROM "+table+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, queue_page_size, (page-1)*queue_page_size)
+	result, err := db.Query(fmt.Sprintf("%s%s ORDER BY id LIMIT $%d OFFSET $%d;", queue_select(table), where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer result.Close()
+	rows = []Queue_Row{}
+	for result.Next() {
+		row, err := scan_queue_row(result.Scan, table)
+		if err != nil {
+			return nil, 0, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, total, result.Err()
+}
+
+func db_queue_row(table string, id int64) (Queue_Row, error) {
+	return scan_queue_row(db.QueryRow(queue_select(table)+" WHERE id = $1;", id).Scan, table)
+}
+
+// id_list binds ids as $first, $first+1 ... for an IN list.
+func id_list(ids []int64, first int) (string, []any) {
+	params := make([]string, len(ids))
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		params[i] = "$" + strconv.Itoa(first+i)
+		args[i] = id
+	}
+	return strings.Join(params, ", "), args
+}
+
+// move_uplinks moves messages between the queue and the dead letters in one
+// transaction. Ids stay the same, so a requeued message keeps its place. Its
+// TTL starts over with the queue_ttls now configured, an expired message
+// requeued would otherwise expire again right away.
+func move_uplinks(ctx context.Context, from string, to string, ids []int64) (int64, error) {
+	in, args := id_list(ids, 1)
+	columns := "id, msg_id, deduplication_id, payload, received_at, attempts, last_error, last_attempt_at, expires_at, expiry_action"
+	// Stamped with when the message became a dead letter, or was requeued.
+	stamp := "requeued_at"
+	if to == dead_letter_table {
+		stamp = "dead_at"
+	}
+	args = append(args, time.Now().Unix())
+	insert := fmt.Sprintf("INSERT INTO %s (%s, %s) SELECT %s, $%d FROM %s WHERE id IN (%s);", to, columns, stamp, columns, len(args), from, in)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, insert, args...)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id IN (%s);", from, in), args[:len(ids)]...); err != nil {
+		return 0, err
+	}
+	if to == queue_table {
+		rows, err := tx.QueryContext(ctx, expiry_select+"WHERE id IN ("+in+");", args[:len(ids)]...)
+		if err != nil {
+			return 0, err
+		}
+		changed, _, _, err := expiry_changes(current_config(), rows)
+		if err != nil {
+			return 0, err
+		}
+		if err := write_expiry(tx, changed); err != nil {
+			return 0, err
+		}
+	}
+	moved, _ := result.RowsAffected()
+	return moved, tx.Commit()
+}
+
+func delete_uplinks(ctx context.Context, table string, ids []int64) (int64, error) {
+	in, args := id_list(ids, 1)
+	result, err := db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id IN (%s);", table, in), args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// retry_uplinks uploads the selected messages now rather than waiting for
+// the uplink worker.
+func retry_uplinks(ids []int64) (uploaded int, total int, err error) {
+	upload_mu.Lock()
+	defer upload_mu.Unlock()
+	in, args := id_list(ids, 2)
+	batch, err := db_read_uplinks("SELECT msg_id, id, deduplication_id, payload FROM UPLINK_QUEUE WHERE (expires_at = 0 OR expires_at > $1) AND id IN ("+in+") ORDER BY id;",
+		append([]any{time.Now().Unix()}, args...)...)
+	if err != nil {
+		return 0, 0, err
+	}
+	uploaded, err = upload_queued(current_config(), batch)
+	return uploaded, len(batch), err
+}
+
+// queue_view is the table a Queue page request is about.
+func queue_view(form url.Values) (view string, table string) {
+	if form.Get("view") == "dead" {
+		return "dead", dead_letter_table
+	}
+	return "queue", queue_table
+}
+
+func queue_page_url(view string, device string, page int) string {
+	q := url.Values{}
+	if view == "dead" {
+		q.Set("view", view)
+	}
+	if device != "" {
+		q.Set("device", device)
+	}
+	if page > 1 {
+		q.Set("page", strconv.Itoa(page))
+	}
+	if len(q) == 0 {
+		return "/queue"
+	}
+	return "/queue?" + q.Encode()
+}
+
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		queueActionHandler(w, r)
+		return
+	}
+	query := r.URL.Query()
+	view, table := queue_view(query)
+	device := strings.TrimSpace(query.Get("device"))
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	rows, total, err := db_queue_page(table, device, page)
+	if err != nil {
+		queue_log.Warn("Failed to read uplink queue", "table", table, "err", err)
+		http.Error(w, "Failed to read uplink queue", http.StatusInternalServerError)
+		return
+	}
+	loc, _ := time.LoadLocation(current_config().TracerTimezone)
+	for i := range rows {
+		rows[i].Received_At = rows[i].Received_At.In(loc)
+		rows[i].Last_Attempt_At = rows[i].Last_Attempt_At.In(loc)
+		rows[i].Expires_At = rows[i].Expires_At.In(loc)
+		rows[i].Dead_At = rows[i].Dead_At.In(loc)
+	}
+
+	data := struct {
+		View      string
+		Device    string
+		Rows      []Queue_Row
+		Total     int64
+		Page      int
+		Prev_Page string
+		Next_Page string
+		Message   string
+		Operator  bool
+		Formats   []string
+	}{
+		View:     view,
+		Device:   device,
+		Rows:     rows,
+		Total:    total,
+		Page:     page,
+		Message:  query.Get("message"),
+		Operator: role_at_least(current_session(r).Role, role_operator),
+		Formats:  export_formats,
+	}
+	if page > 1 {
+		data.Prev_Page = queue_page_url(view, device, page-1)
+	}
+	if int64(page*queue_page_size) < total {
+		data.Next_Page = queue_page_url(view, device, page+1)
+	}
+	render(w, r, "queue.html", data)
+}
+
+// queueActionHandler runs a bulk action on the selected messages and goes
+// back to the page it came from with what happened.
+func queueActionHandler(w http.ResponseWriter, r *http.Request) {
+	session := current_session(r)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	view, table := queue_view(r.PostForm)
+	action := r.PostFormValue("action")
+	ids := []int64{}
+	for _, s := range r.PostForm["id"] {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("id %q is not a number", s), http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		http.Error(w, "No messages selected", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > queue_page_size {
+		http.Error(w, fmt.Sprintf("At most %d messages at a time", queue_page_size), http.StatusBadRequest)
+		return
+	}
+
+	allowed := []string{queue_retry, queue_delete, queue_dead_letter, queue_export}
+	if view == "dead" {
+		allowed = []string{queue_requeue, queue_delete, queue_export}
+	}
+	if !slices.Contains(allowed, action) {
+		http.Error(w, fmt.Sprintf("action %q is not one of %s", action, strings.Join(allowed, ", ")), http.StatusBadRequest)
+		return
+	}
+	// Exports only read, the rest changes the queue.
+	if action != queue_export && !role_at_least(session.Role, role_operator) {
+		http.Error(w, "Forbidden, requires the "+role_operator+" role", http.StatusForbidden)
+		return
+	}
+
+	var message string
+	var err error
+	switch action {
+	case queue_export:
+		queue_export_selection(w, r, table, ids)
+		return
+	case queue_retry:
+		var uploaded, total int
+		if uploaded, total, err = retry_uplinks(ids); err == nil {
+			message = fmt.Sprintf("Uploaded %d of %d messages", uploaded, total)
+		}
+	case queue_delete:
+		var n int64
+		if n, err = delete_uplinks(r.Context(), table, ids); err == nil {
+			message = fmt.Sprintf("Deleted %d messages", n)
+		}
+	case queue_dead_letter:
+		var n int64
+		if n, err = move_uplinks(r.Context(), queue_table, dead_letter_table, ids); err == nil {
+			message = fmt.Sprintf("Moved %d messages to the dead letters", n)
+		}
+	case queue_requeue:
+		var n int64
+		if n, err = move_uplinks(r.Context(), dead_letter_table, queue_table, ids); err == nil {
+			message = fmt.Sprintf("Requeued %d messages", n)
+		}
+	}
+	audit_request(r, "queue."+action, table, map[string]any{"ids": ids}, map[string]any{"result": message}, err)
+	if err != nil {
+		queue_log.Warn("Queue action failed", "user", session.Username, "action", action, "table", table, "ids", ids, "err", err)
+		http.Error(w, "Queue action failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	queue_log.Info("Queue action", "user", session.Username, "action", action, "table", table, "ids", ids, "result", message)
+
+	back := queue_page_url(view, r.PostFormValue("device"), 1)
+	if strings.Contains(back, "?") {
+		back += "&"
+	} else {
+		back += "?"
+	}
+	http.Redirect(w, r, back+"message="+url.QueryEscape(message), http.StatusSeeOther)
+}
+
+func queue_export_selection(w http.ResponseWriter, r *http.Request, table string, ids []int64) {
+	format := r.PostFormValue("format")
+	if !slices.Contains(export_formats, format) {
+		http.Error(w, "format must be one of "+strings.Join(export_formats, ", "), http.StatusBadRequest)
+		return
+	}
+	loc, _ := time.LoadLocation(current_config().TracerTimezone)
+	source, err := queue_export_source(r.Context(), table, ids, loc)
+	if err != nil {
+		queue_log.Warn("Failed to read uplink queue", "table", table, "err", err)
+		http.Error(w, "Failed to read uplink queue", http.StatusInternalServerError)
+		return
+	}
+	name := "queue"
+	if table == dead_letter_table {
+		name = "dead-letters"
+	}
+	start_export(w, format, name+"-"+time.Now().In(loc).Format("20060102-1504")+"."+format)
+	count, err := write_export(r.Context(), w, format, queue_export_columns, source)
+	audit_request(r, "queue."+queue_export, table, map[string]any{"ids": ids}, map[string]any{"format": format, "rows": count}, err)
+	if err != nil {
+		queue_log.Warn("Queue export failed", "format", format, "rows", count, "err", err)
+		return
+	}
+	queue_log.Info("Queue action", "user", current_session(r).Username, "action", queue_export, "table", table, "ids", ids, "format", format, "rows", count)
+}
+
+// queueMessageHandler shows one message with its payload.
+func queueMessageHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	view, table := queue_view(query)
+	id, err := strconv.ParseInt(query.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "id must be a number", http.StatusBadRequest)
+		return
+	}
+	row, err := db_queue_row(table, id)
+	if err != nil {
+		http.Error(w, "Message not found, it may have been uploaded", http.StatusNotFound)
+		return
+	}
+	loc, _ := time.LoadLocation(current_config().TracerTimezone)
+	row.Received_At = row.Received_At.In(loc)
+	row.Last_Attempt_At = row.Last_Attempt_At.In(loc)
+	row.Expires_At = row.Expires_At.In(loc)
+	row.Dead_At = row.Dead_At.In(loc)
+
+	var payload any
+	pretty := row.Payload
+	if json.Unmarshal([]byte(row.Payload), &payload) == nil {
+		if b, err := json.MarshalIndent(payload, "", "  "); err == nil {
+			pretty = string(b)
+		}
+	}
+	data := struct {
+		View     string
+		Back     string
+		Row      Queue_Row
+		Payload  string
+		Operator bool
+	}{
+		View:     view,
+		Back:     queue_page_url(view, "", 1),
+		Row:      row,
+		Payload:  pretty,
+		Operator: role_at_least(current_session(r).Role, role_operator),
+	}
+	render(w, r, "queue_message.html", data)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queue_uplinks queues one message per device, ids 1 and up.
+func queue_uplinks(t *testing.T, test *sql.DB, devices ...string) {
+	for i, device := range devices {
+		payload := fmt.Sprintf(`{"deviceInfo":{"deviceName":%q,"devEui":"0004a30b001c053%d"},"data":"AQI="}`, device, i)
+		_, err := test.Exec(`INSERT INTO UPLINK_QUEUE (msg_id, deduplication_id, payload, received_at) VALUES ($1, $1, $2, $3);`,
+			fmt.Sprintf("m%d", i+1), payload, time.Now().Add(-time.Hour).Unix())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func table_ids(t *testing.T, test *sql.DB, table string) []int64 {
+	rows, err := test.Query("SELECT id FROM " + table + " ORDER BY id;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestIdList(t *testing.T) {
+	tests := []struct {
+		ids    []int64
+		first  int
+		params string
+		args   []any
+	}{
+		{[]int64{7}, 1, "$1", []any{int64(7)}},
+		{[]int64{7, 9, 12}, 3, "$3, $4, $5", []any{int64(7), int64(9), int64(12)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.params, func(t *testing.T) {
+			params, args := id_list(tt.ids, tt.first)
+			if params != tt.params || !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("id_list() = %q, %v, want %q, %v", params, args, tt.params, tt.args)
+			}
+		})
+	}
+}
+
+func TestQueuePageUrl(t *testing.T) {
+	tests := []struct {
+		view   string
+		device string
+		page   int
+		want   string
+	}{
+		{"queue", "", 1, "/queue"},
+		{"queue", "", 2, "/queue?page=2"},
+		{"dead", "", 1, "/queue?view=dead"},
+		{"queue", "pump 1&2", 3, "/queue?device=pump+1%262&page=3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := queue_page_url(tt.view, tt.device, tt.page); got != tt.want {
+				t.Errorf("queue_page_url() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueView(t *testing.T) {
+	tests := []struct {
+		form  url.Values
+		view  string
+		table string
+	}{
+		{url.Values{}, "queue", queue_table},
+		{url.Values{"view": {"dead"}}, "dead", dead_letter_table},
+		{url.Values{"view": {"UPLINK_DEAD_LETTER; DROP TABLE UPLINK_QUEUE"}}, "queue", queue_table},
+	}
+	for _, tt := range tests {
+		t.Run(tt.form.Encode(), func(t *testing.T) {
+			if view, table := queue_view(tt.form); view != tt.view || table != tt.table {
+				t.Errorf("queue_view() = %s, %s, want %s, %s", view, table, tt.view, tt.table)
+			}
+		})
+	}
+}
+
+func TestDbQueuePage(t *testing.T) {
+	test := test_db(t)
+	devices := []string{}
+	for i := range queue_page_size + 5 {
+		devices = append(devices, []string{"pump-1", "valve-2"}[i%2])
+	}
+	queue_uplinks(t, test, devices...)
+	test.Exec(`UPDATE UPLINK_QUEUE SET attempts = 2, last_error = 'timeout' WHERE id = 1;`)
+	tests := []struct {
+		name   string
+		device string
+		page   int
+		rows   int
+		total  int64
+	}{
+		{"first page", "", 1, queue_page_size, queue_page_size + 5},
+		{"last page", "", 2, 5, queue_page_size + 5},
+		{"by name", "pump-1", 1, 53, 53},
+		{"by devEui", "0004a30b001c0531", 1, 1, 1},
+		{"no match", "' OR 1=1 --", 1, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, total, err := db_queue_page(queue_table, tt.device, tt.page)
+			if err != nil || len(rows) != tt.rows || total != tt.total {
+				t.Fatalf("db_queue_page() = %d rows of %d, %v, want %d of %d", len(rows), total, err, tt.rows, tt.total)
+			}
+		})
+	}
+	row, err := db_queue_row(queue_table, 1)
+	if err != nil || row.Device_Name != "pump-1" || row.Dev_Eui != "0004a30b001c0530" || row.Attempts != 2 || row.Last_Error != "timeout" || row.Age == "" {
+		t.Errorf("db_queue_row() = %+v, %v", row, err)
+	}
+}
+
+// test_queue_ttls makes a config with ttls the running one for the test.
+func test_queue_ttls(t *testing.T, ttls []Queue_Ttl) {
+	c := valid_config()
+	c.QueueTtls = ttls
+	prev := app_config.Load()
+	app_config.Store(c)
+	t.Cleanup(func() { app_config.Store(prev) })
+}
+
+func TestMoveUplinks(t *testing.T) {
+	test := test_db(t)
+	test_queue_ttls(t, nil)
+	queue_uplinks(t, test, "pump-1", "valve-2", "pump-3")
+	test.Exec(`UPDATE UPLINK_QUEUE SET expires_at = 1900000000, expiry_action = 'archive' WHERE id = 2;`)
+
+	moved, err := move_uplinks(context.Background(), queue_table, dead_letter_table, []int64{2, 3, 9})
+	if err != nil || moved != 2 {
+		t.Fatalf("move_uplinks() to dead letters = %d, %v", moved, err)
+	}
+	if q, d := table_ids(t, test, queue_table), table_ids(t, test, dead_letter_table); !reflect.DeepEqual(q, []int64{1}) || !reflect.DeepEqual(d, []int64{2, 3}) {
+		t.Errorf("queue %v, dead letters %v", q, d)
+	}
+	dead, err := db_queue_row(dead_letter_table, 2)
+	if err != nil || dead.Dead_At.IsZero() || dead.Device_Name != "valve-2" {
+		t.Errorf("dead letter %+v, %v", dead, err)
+	}
+
+	if moved, err := move_uplinks(context.Background(), dead_letter_table, queue_table, []int64{2}); err != nil || moved != 1 {
+		t.Fatalf("move_uplinks() requeue = %d, %v", moved, err)
+	}
+	requeued, err := db_queue_row(queue_table, 2)
+	if err != nil || !requeued.Expires_At.IsZero() {
+		t.Errorf("requeued %+v, %v, want the same id and no expiry without queue_ttls", requeued, err)
+	}
+
+	if n, err := delete_uplinks(context.Background(), dead_letter_table, []int64{3}); err != nil || n != 1 {
+		t.Errorf("delete_uplinks() = %d, %v", n, err)
+	}
+}
+
+func TestRequeueExpired(t *testing.T) {
+	tests := []struct {
+		name   string
+		ttls   []Queue_Ttl
+		expiry time.Duration
+	}{
+		{"no queue_ttls", nil, 0},
+		{"ttl starts over", []Queue_Ttl{{Device: "valve-2", Ttl: Duration(30 * time.Minute), Action: expiry_archive}}, 30 * time.Minute},
+		{"other device", []Queue_Ttl{{Device: "pump-1", Ttl: Duration(2 * time.Hour)}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test := test_db(t)
+			test_queue_ttls(t, tt.ttls)
+			prev := stamped_ttls
+			t.Cleanup(func() { stamped_ttls = prev })
+			queue_uplinks(t, test, "pump-1", "valve-2")
+			// Received an hour ago with a ttl of 30m, archived on expiry.
+			test.Exec(`UPDATE UPLINK_QUEUE SET expires_at = $1, expiry_action = 'archive' WHERE id = 2;`, time.Now().Add(-30*time.Minute).Unix())
+			if _, archived, err := expire_uplinks(time.Now()); err != nil || archived != 1 {
+				t.Fatalf("expire_uplinks() = %d archived, %v", archived, err)
+			}
+
+			requeued_at := time.Now()
+			if moved, err := move_uplinks(context.Background(), dead_letter_table, queue_table, []int64{2}); err != nil || moved != 1 {
+				t.Fatalf("move_uplinks() requeue = %d, %v", moved, err)
+			}
+			// A restart restamps every message, the requeue must hold.
+			stamped_ttls = ""
+			if err := restamp_expiry(current_config()); err != nil {
+				t.Fatal(err)
+			}
+			row, err := db_queue_row(queue_table, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.expiry == 0 && !row.Expires_At.IsZero() {
+				t.Errorf("requeued message expires at %v, want never", row.Expires_At)
+			}
+			if want := requeued_at.Add(tt.expiry); tt.expiry > 0 && row.Expires_At.Sub(want).Abs() > 2*time.Second {
+				t.Errorf("requeued message expires at %v, want %v", row.Expires_At, want)
+			}
+			if dropped, archived, err := expire_uplinks(time.Now()); err != nil || dropped+archived != 0 {
+				t.Errorf("expire_uplinks() after requeue = %d, %d, %v", dropped, archived, err)
+			}
+			if ids := table_ids(t, test, queue_table); !reflect.DeepEqual(ids, []int64{1, 2}) {
+				t.Errorf("queue %v, want the requeued message back", ids)
+			}
+		})
+	}
+}
+
+func TestRetryUplinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		uploaded int
+		left     []int64
+		attempts int64
+	}{
+		{"uploaded", http.StatusOK, 2, []int64{2}, 0},
+		{"failed", http.StatusBadGateway, 0, []int64{1, 2, 3}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(tt.status) }))
+			defer server.Close()
+			test := test_db(t)
+			test_live_hub(t)
+			test_web_config(t).UplinkEndpoint = server.URL
+			queue_uplinks(t, test, "pump-1", "valve-2", "pump-3")
+			// An expired message is left to the expiry worker.
+			test.Exec(`UPDATE UPLINK_QUEUE SET expires_at = 1 WHERE id = 2;`)
+
+			uploaded, total, err := retry_uplinks([]int64{1, 2, 3})
+			if err != nil || uploaded != tt.uploaded || total != 2 {
+				t.Errorf("retry_uplinks() = %d of %d, %v, want %d of 2", uploaded, total, err, tt.uploaded)
+			}
+			if left := table_ids(t, test, queue_table); !reflect.DeepEqual(left, tt.left) {
+				t.Errorf("left %v, want %v", left, tt.left)
+			}
+			var attempts int64
+			test.QueryRow(`SELECT attempts FROM UPLINK_QUEUE WHERE id = 1;`).Scan(&attempts)
+			if attempts != tt.attempts {
+				t.Errorf("attempts %d, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestQueueActionHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     string
+		form     string
+		code     int
+		location string
+		queue    []int64
+		dead     []int64
+	}{
+		{"delete", role_operator, "action=delete&id=1&id=2", http.StatusSeeOther, "/queue?message=Deleted+2+messages", []int64{3}, []int64{4}},
+		{"dead letter", role_operator, "action=dead_letter&id=3&device=pump", http.StatusSeeOther,
+			"/queue?device=pump&message=Moved+1+messages+to+the+dead+letters", []int64{1, 2}, []int64{3, 4}},
+		{"requeue", role_operator, "view=dead&action=requeue&id=4", http.StatusSeeOther, "/queue?view=dead&message=Requeued+1+messages", []int64{1, 2, 3, 4}, []int64{}},
+		{"viewer may not change", role_viewer, "action=delete&id=1", http.StatusForbidden, "", []int64{1, 2, 3}, []int64{4}},
+		{"not a dead letter action", role_operator, "view=dead&action=retry&id=4", http.StatusBadRequest, "", []int64{1, 2, 3}, []int64{4}},
+		{"not a queue action", role_operator, "action=requeue&id=1", http.StatusBadRequest, "", []int64{1, 2, 3}, []int64{4}},
+		{"id not a number", role_operator, "action=delete&id=1+OR+1", http.StatusBadRequest, "", []int64{1, 2, 3}, []int64{4}},
+		{"nothing selected", role_operator, "action=delete", http.StatusBadRequest, "", []int64{1, 2, 3}, []int64{4}},
+		{"too many", role_operator, "action=delete" + strings.Repeat("&id=1", queue_page_size+1), http.StatusBadRequest, "", []int64{1, 2, 3}, []int64{4}},
+		{"viewer may export", role_viewer, "action=export&format=csv&id=1", http.StatusOK, "", []int64{1, 2, 3}, []int64{4}},
+		{"export format", role_viewer, "action=export&format=pdf&id=1", http.StatusBadRequest, "", []int64{1, 2, 3}, []int64{4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test := test_db(t)
+			test_web_config(t)
+			queue_uplinks(t, test, "pump-1", "valve-2", "pump-3", "valve-4")
+			move_uplinks(context.Background(), queue_table, dead_letter_table, []int64{4})
+
+			r := httptest.NewRequest(http.MethodPost, "/queue", strings.NewReader(tt.form))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r = r.WithContext(context.WithValue(r.Context(), web_session_key{}, &Web_Session{Username: tt.role, Role: tt.role}))
+			w := httptest.NewRecorder()
+			queueHandler(w, r)
+			if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+				t.Fatalf("status %d to %q, want %d to %q: %s", w.Code, w.Header().Get("Location"), tt.code, tt.location, w.Body.String())
+			}
+			if q, d := table_ids(t, test, queue_table), table_ids(t, test, dead_letter_table); !reflect.DeepEqual(q, tt.queue) || !reflect.DeepEqual(d, tt.dead) {
+				t.Errorf("queue %v, dead letters %v, want %v, %v", q, d, tt.queue, tt.dead)
+			}
+			var audited int
+			test.QueryRow(`SELECT count(*) FROM AUDIT_LOG WHERE action LIKE 'queue.%';`).Scan(&audited)
+			if (audited == 1) != (tt.code == http.StatusSeeOther || tt.code == http.StatusOK) {
+				t.Errorf("%d audit entries", audited)
+			}
+		})
+	}
+}
+
+func TestQueueMessageHandler(t *testing.T) {
+	test := test_db(t)
+	test_web_config(t)
+	if err := test_web_files(t, ""); err != nil {
+		t.Fatal(err)
+	}
+	queue_uplinks(t, test, "pump-1")
+	tests := []struct {
+		name string
+		url  string
+		code int
+		body string
+	}{
+		{"message", "/queue/message?id=1", http.StatusOK, "&#34;deviceName&#34;: &#34;pump-1&#34;"},
+		{"not a number", "/queue/message?id=x", http.StatusBadRequest, "id must be a number"},
+		{"gone", "/queue/message?id=2", http.StatusNotFound, "may have been uploaded"},
+		{"not a dead letter", "/queue/message?view=dead&id=1", http.StatusNotFound, "may have been uploaded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			r = r.WithContext(context.WithValue(r.Context(), web_session_key{}, &Web_Session{Username: "viewer", Role: role_viewer}))
+			w := httptest.NewRecorder()
+			queueMessageHandler(w, r)
+			if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("status %d, body %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
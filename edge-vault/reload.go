@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// reload_config loads config.yaml again, lays the applied remote config
+// over it and applies the result, reconnecting MQTT if the broker settings
+// changed. A config that fails validation is refused and the running one
+// stays in effect.
+func reload_config(mode string) error {
+	remote_config_mu.Lock()
+	defer remote_config_mu.Unlock()
+
+	next_local, err := LoadConfig(mode)
+	if err != nil {
+		return err
+	}
+	next, err := startup_config(next_local)
+	if err != nil {
+		main_log.Warn("Ignoring applied remote config", "err", err)
+		next = next_local
+	}
+
+	prev := current_config()
+	if next.WebPort != prev.WebPort {
+		main_log.Warn("Setting changed, it only takes effect after a restart", "key", "web_port")
+	}
+	if next.WebDir != prev.WebDir {
+		main_log.Warn("Setting changed, it only takes effect after a restart", "key", "web_dir")
+	}
+	if postgres_dsn(next) != postgres_dsn(prev) {
+		main_log.Warn("Setting changed, it only takes effect after a restart", "key", "local_database")
+	}
+	if err := apply_config(next); err != nil {
+		return err
+	}
+	local_config = next_local
+	main_log.Info("Successfully reloaded config.yaml")
+	return nil
+}
+
+// watch_config_file asks for a reload whenever the modification time of
+// path changes. Polling keeps this working on filesystems without inotify.
+func watch_config_file(path string, interval time.Duration, reload chan<- bool) {
+	var last time.Time
+	if info, err := os.Stat(path); err == nil {
+		last = info.ModTime()
+	}
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(last) {
+			continue
+		}
+		last = info.ModTime()
+		main_log.Info("Config file changed, reloading", "file", path)
+		select {
+		case reload <- true:
+		default:
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func write_config(t *testing.T, content string) {
+	if err := os.WriteFile("config.yaml", []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	const base = "test:\n  local_database_username: cache-sync\n  mqtt_broker_address: tcp://localhost\n  mqtt_broker_port: 1883\n  uplink_endpoint: http://localhost:8080/cache-sync/uplink\n"
+	tests := []struct {
+		name     string
+		config   string
+		remote   string
+		wantErr  bool
+		interval time.Duration
+	}{
+		{"applied", base + "  heartbeat_interval: 45s\n", "", false, 45 * time.Second},
+		{"remote config laid over", base + "  heartbeat_interval: 45s\n", `{"heartbeat_interval":"30s"}`, false, 30 * time.Second},
+		{"invalid refused", base + "  heartbeat_interval: often\n", "", true, time.Minute},
+		{"unparsable refused", "test: [", "", true, time.Minute},
+		{"missing environment refused", "prod:\n  heartbeat_interval: 45s\n", "", true, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			test := test_db(t)
+			if tt.remote != "" {
+				_, err := test.Exec(`INSERT INTO REMOTE_CONFIG (version, config, status, error, updated_at) VALUES (1, $1, $2, '', 0);`, tt.remote, config_applied)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			running := DefaultConfig()
+			running.MqttBrokerAddress = "tcp://localhost"
+			running.UplinkEndpoint = "http://localhost:8080/cache-sync/uplink"
+			prev := app_config.Load()
+			app_config.Store(running)
+			t.Cleanup(func() { app_config.Store(prev) })
+
+			write_config(t, tt.config)
+			err := reload_config("test")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reload_config() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if c := current_config(); time.Duration(c.HeartbeatInterval) != tt.interval {
+				t.Errorf("running heartbeat_interval %v, want %v", c.HeartbeatInterval, tt.interval)
+			}
+		})
+	}
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	write_config(t, "test: {}\n")
+	reload := make(chan bool, 1)
+	go watch_config_file("config.yaml", 10*time.Millisecond, reload)
+
+	select {
+	case <-reload:
+		t.Fatal("reload asked for before the file changed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes("config.yaml", later, later); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reload:
+	case <-time.After(time.Second):
+		t.Fatal("no reload after the file changed")
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var config_log = component_logger("config")
+
+// Keys sync-tower may override, gateway_id and config_endpoint stay local
+// so a bad version cannot cut the gateway off.
+var remote_config_keys = []string{
+	"mqtt_broker_address",
+	"mqtt_broker_port",
+	"mqtt_broker_user",
+	"mqtt_broker_password",
+	"uplink_endpoint",
+	"heartbeat_endpoint",
+	"heartbeat_interval",
+	"command_endpoint",
+}
+
+// What became of a remote config version, reported back to sync-tower.
+const (
+	config_applied     = "applied"
+	config_rejected    = "rejected"
+	config_rolled_back = "rolled_back"
+)
+
+type Remote_Config struct {
+	Version int
+	Config  map[string]string
+}
+
+// local_config is config.yaml as loaded, remote versions are laid over it
+// rather than over each other.
+var local_config *AppConfig
+
+// reload_mu serialises config swaps and guards mqtt_client.
+var reload_mu sync.Mutex
+
+// remote_config_mu keeps the poll and the reconfigure command from applying
+// the same version twice.
+var remote_config_mu sync.Mutex
+
+func overlay_config(base *AppConfig, overrides map[string]string) (*AppConfig, error) {
+	for key := range overrides {
+		if !slices.Contains(remote_config_keys, key) {
+			return nil, fmt.Errorf("%s cannot be managed remotely", key)
+		}
+	}
+	// Plain scalars resolve like they would in config.yaml, so "1883"
+	// decodes into the int port and "30s" into a Duration.
+	next := *base
+	errs := []error{}
+	for key, val := range overrides {
+		node := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Value: key},
+			{Kind: yaml.ScalarNode, Value: val},
+		}}
+		if err := node.Decode(&next); err != nil {
+			problems, err := type_error_problems(err, map[string]int{}, 0)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range problems {
+				errs = append(errs, errors.New(key+": "+p.Message))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &next, nil
+}
+
+// config_values reads keys of c by their yaml name for the audit log,
+// secrets only tell whether they are set.
+func config_values(c *AppConfig, keys []string) map[string]string {
+	values := map[string]string{}
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+		if slices.Contains(keys, name) {
+			values[name] = fmt.Sprint(v.Field(i).Interface())
+		}
+	}
+	return values
+}
+
+func mqtt_settings_changed(a *AppConfig, b *AppConfig) bool {
+	return a.MqttBrokerAddress != b.MqttBrokerAddress || a.MqttBrokerPort != b.MqttBrokerPort ||
+		a.MqttBrokerUser != b.MqttBrokerUser || a.MqttBrokerPassword != b.MqttBrokerPassword
+}
+
+// apply_config makes next the config in effect, reconnecting to the MQTT
+// broker first when its settings changed. On error the previous config and
+// broker stay in effect. The workers pick the rest up on their next
+// iteration.
+func apply_config(next *AppConfig) error {
+	reload_mu.Lock()
+	defer reload_mu.Unlock()
+
+	prev := current_config()
+	if mqtt_settings_changed(prev, next) {
+		if err := switch_mqtt(prev, next); err != nil {
+			return err
+		}
+	}
+	app_config.Store(next)
+	configure_logging(next)
+	return nil
+}
+
+// switch_mqtt disconnects before connecting so two clients never queue the
+// same uplink, and reconnects to the previous broker when the new one fails.
+func switch_mqtt(prev *AppConfig, next *AppConfig) error {
+	mqtt_log.Info("Reconnecting to MQTT Broker", "address", next.MqttBrokerAddress, "port", next.MqttBrokerPort)
+	mqtt_client.Disconnect(250)
+	mqtt_state.Store(mqtt_connecting)
+
+	client := new_mqtt_client(next)
+	token := client.Connect()
+	err := errors.New("timed out connecting to MQTT broker")
+	if token.WaitTimeout(30 * time.Second) {
+		err = token.Error()
+	}
+	if err == nil {
+		mqtt_client = client
+		return nil
+	}
+
+	client.Disconnect(0)
+	mqtt_log.Warn("Failed to connect, reconnecting to the previous broker", "address", next.MqttBrokerAddress, "previous_address", prev.MqttBrokerAddress, "err", err)
+	// Connect retries in the background until the old broker is back.
+	mqtt_client.Connect()
+	return err
+}
+
+// check_endpoint accepts any HTTP answer, it only proves sync-tower is there.
+func check_endpoint(endpoint string) error {
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Get(endpoint)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// apply_remote_config validates a version against config.yaml, applies it
+// and rolls back when the new uplink endpoint cannot be reached.
+func apply_remote_config(rc *Remote_Config) (status string, err error) {
+	next, err := overlay_config(local_config, rc.Config)
+	if err == nil {
+		err = validate_config(next)
+	}
+	if err != nil {
+		return config_rejected, err
+	}
+
+	prev := current_config()
+	if err := apply_config(next); err != nil {
+		return config_rolled_back, err
+	}
+	if next.UplinkEndpoint != prev.UplinkEndpoint {
+		if err := check_endpoint(next.UplinkEndpoint); err != nil {
+			if rollback_err := apply_config(prev); rollback_err != nil {
+				config_log.Error("Rollback failed", "version", rc.Version, "err", rollback_err)
+			}
+			return config_rolled_back, fmt.Errorf("uplink_endpoint unreachable: %w", err)
+		}
+	}
+	return config_applied, nil
+}
+
+// startup_config lays the newest applied remote version over config.yaml.
+func startup_config(appConfig *AppConfig) (*AppConfig, error) {
+	var version int
+	var config string
+	err := db.QueryRow(`SELECT version, config FROM REMOTE_CONFIG WHERE status = $1 ORDER BY version DESC LIMIT 1;`, config_applied).Scan(&version, &config)
+	if errors.Is(err, sql.ErrNoRows) {
+		return appConfig, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var overrides map[string]string
+	if err := json.Unmarshal([]byte(config), &overrides); err != nil {
+		return nil, err
+	}
+	next, err := overlay_config(appConfig, overrides)
+	if err != nil {
+		return nil, err
+	}
+	if err := validate_config(next); err != nil {
+		return nil, err
+	}
+	config_log.Info("Using remote config", "version", version)
+	return next, nil
+}
+
+// applied_config_version is the remote version in effect, 0 for none.
+func applied_config_version() int {
+	var version int
+	db.QueryRow(`SELECT COALESCE(max(version), 0) FROM REMOTE_CONFIG WHERE status = $1;`, config_applied).Scan(&version)
+	return version
+}
+
+func spawn_config_worker() {
+	if current_config().ConfigEndpoint == "" {
+		config_log.Info("Remote config disabled, no config_endpoint configured")
+		return
+	}
+	go config_worker()
+	config_log.Info("Successfully spawned config worker")
+}
+
+func config_worker() {
+	config_log.Debug("Entering event loop")
+	failing := false
+	for {
+		_, err := sync_remote_config()
+		if err != nil && !failing {
+			config_log.Warn("Failed to sync remote config", "err", err)
+		}
+		failing = err != nil
+		time.Sleep(time.Duration(current_config().ConfigPollInterval))
+	}
+}
+
+// sync_remote_config fetches the latest version for this gateway and, if it
+// is new, applies it and reports the outcome. Versions tried before are not
+// tried again, only their report is retried.
+func sync_remote_config() (string, error) {
+	remote_config_mu.Lock()
+	defer remote_config_mu.Unlock()
+
+	appConfig := current_config()
+	if appConfig.ConfigEndpoint == "" {
+		return "", errors.New("no config_endpoint configured")
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	rc, err := fetch_remote_config(client, appConfig)
+	if err != nil {
+		return "", err
+	}
+	if rc == nil {
+		return "no remote config", nil
+	}
+
+	var status, apply_err string
+	var reported bool
+	err = db.QueryRow(`SELECT status, error, reported FROM REMOTE_CONFIG WHERE version = $1;`, rc.Version).Scan(&status, &apply_err, &reported)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		keys := slices.Sorted(maps.Keys(rc.Config))
+		before := config_values(current_config(), keys)
+		var e error
+		status, e = apply_remote_config(rc)
+		record_audit(audit_sync_tower, audit_sync_tower, "config.remote", fmt.Sprintf("version %d", rc.Version),
+			before, config_values(current_config(), keys), e)
+		apply_err = ""
+		if e != nil {
+			apply_err = e.Error()
+			config_log.Warn("Remote config not applied", "version", rc.Version, "outcome", status, "err", apply_err)
+		} else {
+			config_log.Info("Successfully applied remote config", "version", rc.Version, "outcome", status)
+		}
+		config, _ := json.Marshal(rc.Config)
+		_, err = db.Exec(`INSERT INTO REMOTE_CONFIG (version, config, status, error, updated_at) VALUES ($1, $2, $3, $4, $5);`,
+			rc.Version, string(config), status, apply_err, time.Now().Unix())
+		if err != nil {
+			return "", err
+		}
+	}
+
+	result := fmt.Sprintf("config version %d %s", rc.Version, status)
+	if !reported {
+		// Report with the config now in effect, the endpoint is local so
+		// a rollback does not change it.
+		if err := report_remote_config(client, current_config(), rc.Version, status, apply_err); err != nil {
+			return result, fmt.Errorf("failed to report config version %d: %w", rc.Version, err)
+		}
+		db.Exec(`UPDATE REMOTE_CONFIG SET reported = 1 WHERE version = $1;`, rc.Version)
+	}
+	if status != config_applied {
+		return result, errors.New(result + ": " + apply_err)
+	}
+	return result, nil
+}
+
+func fetch_remote_config(client *http.Client, appConfig *AppConfig) (*Remote_Config, error) {
+	req, err := http.NewRequest("GET", appConfig.ConfigEndpoint+"/current?gateway_id="+url.QueryEscape(gateway_id(appConfig)), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(sync_tower_request(req, appConfig))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("config fetch rejected with status %d", resp.StatusCode)
+	}
+	var rc Remote_Config
+	if err := json.NewDecoder(resp.Body).Decode(&rc); err != nil {
+		return nil, err
+	}
+	return &rc, nil
+}
+
+func report_remote_config(client *http.Client, appConfig *AppConfig, version int, status string, apply_err string) error {
+	body, err := json.Marshal(struct {
+		Gateway_Id string
+		Version    int
+		Status     string
+		Error      string
+	}{
+		Gateway_Id: gateway_id(appConfig),
+		Version:    version,
+		Status:     status,
+		Error:      apply_err,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", appConfig.ConfigEndpoint+"/report", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(sync_tower_request(req, appConfig))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("config report rejected with status %d", resp.StatusCode)
+	}
+	return nil
+}
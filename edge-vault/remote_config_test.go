@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverlayConfig(t *testing.T) {
+	base := DefaultConfig()
+	base.MqttBrokerAddress = "tcp://localhost"
+	base.UplinkEndpoint = "https://tower.example.com/cache-sync/uplink"
+	tests := []struct {
+		name      string
+		overrides map[string]string
+		wantErr   string
+		check     func(c *AppConfig) bool
+	}{
+		{"nothing", map[string]string{}, "", func(c *AppConfig) bool { return reflect.DeepEqual(c, base) }},
+		{"port as text", map[string]string{"mqtt_broker_port": "8883"}, "", func(c *AppConfig) bool { return c.MqttBrokerPort == 8883 }},
+		{"duration", map[string]string{"heartbeat_interval": "30s"}, "", func(c *AppConfig) bool { return c.HeartbeatInterval == Duration(30*time.Second) }},
+		{"secret", map[string]string{"mqtt_broker_password": "hunter2"}, "", func(c *AppConfig) bool { return c.MqttBrokerPassword == "hunter2" }},
+		{"several", map[string]string{"uplink_endpoint": "https://other.example.com/uplink", "mqtt_broker_user": "gw"}, "",
+			func(c *AppConfig) bool {
+				return c.UplinkEndpoint == "https://other.example.com/uplink" && c.MqttBrokerUser == "gw" && c.MqttBrokerAddress == base.MqttBrokerAddress
+			}},
+		{"local key", map[string]string{"gateway_id": "elsewhere"}, "cannot be managed remotely", nil},
+		{"bad port", map[string]string{"mqtt_broker_port": "mqtt"}, "mqtt_broker_port", nil},
+		{"bad duration", map[string]string{"heartbeat_interval": "often"}, "heartbeat_interval", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := *base
+			next, err := overlay_config(base, tt.overrides)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("overlay_config() = %v, want an error about %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(next) {
+				t.Errorf("overlay_config() = %+v", next)
+			}
+			if !reflect.DeepEqual(*base, before) {
+				t.Error("overlay_config() changed its base")
+			}
+		})
+	}
+}
+
+func TestConfigValues(t *testing.T) {
+	c := DefaultConfig()
+	c.MqttBrokerPassword = "hunter2"
+	c.UplinkEndpoint = "https://tower.example.com/cache-sync/uplink"
+	got := config_values(c, []string{"mqtt_broker_password", "mqtt_broker_port", "uplink_endpoint", "heartbeat_interval"})
+	want := map[string]string{
+		"mqtt_broker_password": redacted,
+		"mqtt_broker_port":     "1883",
+		"uplink_endpoint":      "https://tower.example.com/cache-sync/uplink",
+		"heartbeat_interval":   "1m0s",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("config_values() = %v, want %v", got, want)
+	}
+}
+
+func TestMqttSettingsChanged(t *testing.T) {
+	base := DefaultConfig()
+	tests := []struct {
+		name   string
+		change func(c *AppConfig)
+		want   bool
+	}{
+		{"unchanged", func(c *AppConfig) {}, false},
+		{"other setting", func(c *AppConfig) { c.UplinkEndpoint = "https://other.example.com" }, false},
+		{"address", func(c *AppConfig) { c.MqttBrokerAddress = "tcp://broker" }, true},
+		{"port", func(c *AppConfig) { c.MqttBrokerPort = 8883 }, true},
+		{"user", func(c *AppConfig) { c.MqttBrokerUser = "gw" }, true},
+		{"password", func(c *AppConfig) { c.MqttBrokerPassword = "hunter2" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := *base
+			tt.change(&next)
+			if got := mqtt_settings_changed(base, &next); got != tt.want {
+				t.Errorf("mqtt_settings_changed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchAndReportRemoteConfig(t *testing.T) {
+	var report struct {
+		Gateway_Id string
+		Version    int
+		Status     string
+	}
+	current := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer 4e81b0d9c27a6f35" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/cache-sync/gateway-config/current":
+			if current == "" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Write([]byte(current))
+		case "/cache-sync/gateway-config/report":
+			json.NewDecoder(r.Body).Decode(&report)
+		}
+	}))
+	defer server.Close()
+	endpoint := server.URL + "/cache-sync/gateway-config"
+
+	tests := []struct {
+		name    string
+		token   Secret
+		current string
+		version int
+		wantErr bool
+	}{
+		{"no version yet", "4e81b0d9c27a6f35", "", 0, false},
+		{"version", "4e81b0d9c27a6f35", `{"Version":3,"Config":{"heartbeat_interval":"30s"}}`, 3, false},
+		{"wrong token", "wrong", `{"Version":3,"Config":{}}`, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current = tt.current
+			appConfig := &AppConfig{GatewayId: "spectra-gw-01", GatewayToken: tt.token, ConfigEndpoint: endpoint}
+			rc, err := fetch_remote_config(server.Client(), appConfig)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetch_remote_config() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (rc == nil && tt.version != 0) || (rc != nil && rc.Version != tt.version) {
+				t.Errorf("fetch_remote_config() = %+v, want version %d", rc, tt.version)
+			}
+			err = report_remote_config(server.Client(), appConfig, 3, config_applied, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("report_remote_config() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (report.Gateway_Id != "spectra-gw-01" || report.Version != 3 || report.Status != config_applied) {
+				t.Errorf("sync-tower received %+v", report)
+			}
+		})
+	}
+}
@@ -1,54 +1,58 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
-	"fmt"
 	"net/http"
+	"net/url"
 	"os"
-	"text/template"
+	"strconv"
 	"time"
 
 	_ "github.com/lib/pq"
 )
 
-var db_psql = db_mngr.db_pgsql
+var db_psql *sql.DB
 
-var ws_prefix = Cyan + "[net/http] " + Reset
-var glob_appConfig *AppConfig
+var web_log = component_logger("web")
 
 func StartServer(appConfig *AppConfig) {
-	glob_appConfig = appConfig
-	infoLog.Println(ws_prefix + "Setting up net/http routes...")
+	if err := load_web_files(appConfig.WebDir); err != nil {
+		web_log.Error("Failed to load web templates", "web_dir", appConfig.WebDir, "err", err)
+		os.Exit(1)
+	}
 	//Static file route handler
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("templates/static/"))))
-
-	http.HandleFunc("/", homeHandler)
-	http.HandleFunc("/data", dataTracerHandler)
-	http.HandleFunc("/data_result", dataResultHandler)
-	http.HandleFunc("/maintenance", maintenanceHandler)
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(web_static))))
 
-	infoLog.Println(ws_prefix + Green + "Successfully " + Reset + "Configured routes!")
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/logout", web_auth(role_viewer, logoutHandler))
+	http.HandleFunc("/", web_auth(role_viewer, homeHandler))
+	http.HandleFunc("/events", web_auth(role_viewer, eventsHandler))
+	http.HandleFunc("/data", web_auth(role_viewer, dataTracerHandler))
+	http.HandleFunc("/data_result", web_auth(role_viewer, dataResultHandler))
+	http.HandleFunc("/data_export", web_auth(role_viewer, dataExportHandler))
+	http.HandleFunc("/queue_export", web_auth(role_viewer, queueExportHandler))
+	http.HandleFunc("/queue", web_auth(role_viewer, queueHandler))
+	http.HandleFunc("/queue/message", web_auth(role_viewer, queueMessageHandler))
+	http.HandleFunc("/lns", web_auth(role_viewer, lnsHandler))
+	http.HandleFunc("/maintenance", web_auth(role_viewer, maintenanceHandler))
+	http.HandleFunc("/maintenance/diagnostics", web_auth(role_viewer, diagnosticsHandler))
+	http.HandleFunc("/audit", web_auth(role_admin, auditHandler))
+	http.HandleFunc("/audit_export", web_auth(role_admin, auditExportHandler))
+	go live_status_worker(2 * time.Second)
+	if len(appConfig.WebUsers) == 0 {
+		web_log.Warn("No web_users configured, the console only shows the login page")
+	}
 
-	infoLog.Println(ws_prefix + Green + "Serving " + Reset + "web service on port : " + Blue + appConfig.WebPort + Reset)
-	http.ListenAndServe(":"+appConfig.WebPort, nil)
+	web_log.Info("Serving web service", "port", appConfig.WebPort)
+	if err := http.ListenAndServe(":"+strconv.Itoa(appConfig.WebPort), nil); err != nil {
+		web_log.Error("Web service failed", "err", err)
+	}
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("templates/index.html"))
-
-	fileInfo, _ := os.Stat("./sqlite.db")
-	fileSize := fileInfo.Size()
-	fileSizeMB := float64(fileSize) / float64(1024)
-	fileSizeMB = fileSizeMB / 1024
-
-	rows, _ := db.Query(`select count(*) from UPLINK_QUEUE`)
-	var aaa int64
-	for rows.Next() {
-		err := rows.Scan(&aaa)
-		if err != nil {
-			println(err)
-		}
-	}
+	appConfig := current_config()
+	status := current_live_status()
 	hostname, _ := os.Hostname()
 
 	uplink_count := db_get_data_count_chart()
@@ -58,76 +62,179 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 		Hostname          string
 		DatabaseHost      string
 		MqttBrokerAddress string
-		MqttBrokerPort    string
-		MqttBrokerUser    string
+		MqttBrokerPort    int
+		MqttBrokerUser    Secret
 		UplinkEndpoint    string
-		WebUiPort         string
-		CacheSize         float64
-		CacheRowCount     int64
+		WebUiPort         int
+		Status            Live_Status
+		Uptime            string
 		UplinkCount       any
 	}{
 		Hostname:          hostname,
-		DatabaseHost:      glob_appConfig.DatabaseHost,
-		MqttBrokerAddress: glob_appConfig.MqttBrokerAddress,
-		MqttBrokerPort:    glob_appConfig.MqttBrokerPort,
-		MqttBrokerUser:    glob_appConfig.MqttBrokerUser,
-		UplinkEndpoint:    glob_appConfig.UplinkEndpoint,
-		WebUiPort:         glob_appConfig.WebPort,
-		CacheSize:         fileSizeMB,
-		CacheRowCount:     aaa,
+		DatabaseHost:      redact(appConfig.DatabaseHost),
+		MqttBrokerAddress: appConfig.MqttBrokerAddress,
+		MqttBrokerPort:    appConfig.MqttBrokerPort,
+		MqttBrokerUser:    appConfig.MqttBrokerUser,
+		UplinkEndpoint:    appConfig.UplinkEndpoint,
+		WebUiPort:         appConfig.WebPort,
+		Status:            status,
+		Uptime:            (time.Duration(status.Uptime_Seconds) * time.Second).String(),
 		UplinkCount:       string(uplink_count_json),
 	}
 
-	tmpl.Execute(w, data)
+	render(w, r, "index.html", data)
+}
+
+// redact hides a config value on the console that is not a Secret but
+// still says more about the network than a visitor needs.
+func redact(val string) string {
+	if val == "" {
+		return ""
+	}
+	return redacted
 }
 
 func dataTracerHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("templates/data_tracer.html"))
-	device_names := db_get_device_names()
-	tmpl.Execute(w, device_names)
+	appConfig := current_config()
+	data := struct {
+		Device_Names []string
+		Events       []string
+		Timezone     string
+		Page_Size    int
+		Max_Rows     int
+	}{
+		Device_Names: db_get_device_names(),
+		Events:       trace_event_names,
+		Timezone:     appConfig.TracerTimezone,
+		Page_Size:    appConfig.TracerPageSize,
+		Max_Rows:     appConfig.TracerMaxRows,
+	}
+	render(w, r, "data_tracer.html", data)
 }
 
 func dataResultHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("templates/data_result.html"))
-
+	appConfig := current_config()
 	// Get GET form data from URL parameters
 	query := r.URL.Query()
-	startDatetime := query.Get("datetime_start")
-	endDatetime := query.Get("datetime_end")
-	deviceName := query.Get("device_name")
-
-	query_results := db_get_data_trace_result(startDatetime, endDatetime, deviceName)
 
-	query_form := struct {
-		Datetime_Start string
-		Datetime_End   string
-		Device_Name    string
-	}{
-		Datetime_Start: startDatetime,
-		Datetime_End:   endDatetime,
-		Device_Name:    deviceName,
-	}
 	data := struct {
-		Query_Form    any
-		Query_Results any
+		Query_Form    url.Values
+		Query_Results []Trace_Row
+		Timezone      string
+		Error         string
+		Page          int
+		Prev_Page     string
+		Next_Page     string
+		Exports       map[string]string
 	}{
-		Query_Form:    query_form,
-		Query_Results: query_results,
+		Query_Form: query,
+		Timezone:   appConfig.TracerTimezone,
 	}
 
-	tmpl.Execute(w, data)
+	q, err := parse_trace_query(query, appConfig)
+	if err != nil {
+		data.Error = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+		render(w, r, "data_result.html", data)
+		return
+	}
+	loc, _ := time.LoadLocation(appConfig.TracerTimezone)
+	results, more, err := db_trace(r.Context(), q, loc)
+	if err != nil {
+		web_log.Warn("Failed to query data trace", "event", q.Event, "device", q.Device_Name, "err", err)
+		data.Error = "Failed to query the backend database"
+		w.WriteHeader(http.StatusInternalServerError)
+		render(w, r, "data_result.html", data)
+		return
+	}
+	data.Query_Results = results
+	data.Page = q.Page
+	if q.Page > 1 {
+		data.Prev_Page = trace_page_url(query, q.Page-1)
+	}
+	if more {
+		data.Next_Page = trace_page_url(query, q.Page+1)
+	}
+	data.Exports = map[string]string{}
+	for _, format := range export_formats {
+		export := url.Values{}
+		for k, v := range query {
+			export[k] = v
+		}
+		export.Del("page")
+		export.Del("limit")
+		export.Set("format", format)
+		data.Exports[format] = "/data_export?" + export.Encode()
+	}
+
+	render(w, r, "data_result.html", data)
+}
+
+func trace_page_url(query url.Values, page int) string {
+	next := url.Values{}
+	for k, v := range query {
+		next[k] = v
+	}
+	next.Set("page", strconv.Itoa(page))
+	return "/data_result?" + next.Encode()
 }
 
+// maintenanceHandler shows the last diagnostics, operators can run them
+// again with a POST.
 func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("templates/maintenance.html"))
-	tmpl.Execute(w, nil)
+	operator := role_at_least(current_session(r).Role, role_operator)
+	if r.Method == http.MethodPost {
+		if !operator {
+			http.Error(w, "Forbidden, requires the "+role_operator+" role", http.StatusForbidden)
+			return
+		}
+		report := run_diagnostics(r.Context(), current_config())
+		audit_request(r, "diagnostics.run", "", nil, map[string]any{"status": report.Status}, nil)
+		http.Redirect(w, r, "/maintenance", http.StatusSeeOther)
+		return
+	}
+	render(w, r, "maintenance.html", struct {
+		Report   *Diagnostics_Report
+		Operator bool
+	}{
+		Report:   last_diagnostics.Load(),
+		Operator: operator,
+	})
+}
+
+// diagnosticsHandler is the API of the Maintenance page: GET returns the
+// last diagnostics, POST runs them (operator role) and returns the result.
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	var report *Diagnostics_Report
+	switch r.Method {
+	case http.MethodGet:
+		if report = last_diagnostics.Load(); report == nil {
+			http.Error(w, "No diagnostics have run yet, POST to run them", http.StatusNotFound)
+			return
+		}
+	case http.MethodPost:
+		if !role_at_least(current_session(r).Role, role_operator) {
+			http.Error(w, "Forbidden, requires the "+role_operator+" role", http.StatusForbidden)
+			return
+		}
+		report = run_diagnostics(r.Context(), current_config())
+		audit_request(r, "diagnostics.run", "", nil, map[string]any{"status": report.Status}, nil)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
 }
 
 func db_get_device_names() []string {
 	rows, err := db_psql.Query("select distinct eu.device_name from event_up eu;")
 	if err != nil {
-		warnLog.Println("ERROR!" + err.Error())
+		web_log.Warn("Failed to query device names", "err", err)
+		return []string{}
 	}
+	defer rows.Close()
 	device_names := []string{}
 	for rows.Next() {
 		device_name := ""
@@ -139,54 +246,41 @@ func db_get_device_names() []string {
 	return device_names
 }
 
-func db_get_data_trace_result(datetime_start string, datetime_end string, device_name string) (result any) {
-	query_string := fmt.Sprintf("select time, device_name, object from event_up where time > '%s'::TIMESTAMP AT TIME ZONE 'Asia/Kuala_Lumpur' and time < '%s'::TIMESTAMP AT TIME ZONE 'Asia/Kuala_Lumpur' and device_name = '%s' and object != '{}' order by time desc;",
-		datetime_start, datetime_end, device_name)
-
+func db_get_data_count_chart() any {
+	query_string := "SELECT DATE_TRUNC('hour', time) AS hour_start, COUNT(*) AS row_count FROM event_up WHERE time >= NOW() - INTERVAL '24 hours' GROUP BY hour_start ORDER BY hour_start;"
+	data := []any{}
 	rows, err := db_psql.Query(query_string)
 	if err != nil {
-		warnLog.Println("ERROR!" + err.Error())
-	}
-
-	query_row := struct {
-		Time        time.Time
-		Device_Name string
-		Data        string
-	}{
-		Time:        time.Now(),
-		Device_Name: "",
-		Data:        "",
-	}
-	Data := []any{}
-	for rows.Next() {
-		if err := rows.Scan(&query_row.Time, &query_row.Device_Name, &query_row.Data); err != nil {
-		} else {
-			loc, _ := time.LoadLocation("Local")
-			query_row.Time = query_row.Time.In(loc)
-			Data = append(Data, query_row)
-		}
+		web_log.Warn("Failed to query uplink count", "err", err)
+		return data
 	}
-	return Data
-}
-
-func db_get_data_count_chart() any {
-	query_string := "SELECT DATE_TRUNC('hour', time) AS hour_start, COUNT(*) AS row_count FROM event_up WHERE time >= NOW() - INTERVAL '24 hours' GROUP BY hour_start ORDER BY hour_start;"
-	rows, _ := db_psql.Query(query_string)
+	defer rows.Close()
 	row := struct {
 		Hour_Start   time.Time
+		Hour_Label   string
 		Uplink_Count int64
 	}{
 		Hour_Start:   time.Now(),
 		Uplink_Count: 0,
 	}
 
-	data := []any{}
-
 	for rows.Next() {
 		if err := rows.Scan(&row.Hour_Start, &row.Uplink_Count); err != nil {
 		} else {
+			row.Hour_Label = chart_hour_label(row.Hour_Start)
 			data = append(data, row)
 		}
 	}
 	return data
 }
+
+// chart_hour_label labels the hour of t on the home chart. Labelled here, in
+// tracer_timezone, as the browser may be elsewhere.
+func chart_hour_label(t time.Time) string {
+	loc, err := time.LoadLocation(current_config().TracerTimezone)
+	if err != nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc).Format("01/02, 15:04")
+}
@@ -0,0 +1,76 @@
+
+  // Keeps the home page current from the /events stream of the gateway.
+  const liveState = document.getElementById('live-state');
+  const eventRows = document.getElementById('gateway-events');
+  const maxEventRows = 20;
+
+  function setText(id, text) {
+    document.getElementById(id).textContent = text;
+  }
+
+  function formatUptime(seconds) {
+    const h = Math.floor(seconds / 3600);
+    const m = Math.floor(seconds % 3600 / 60);
+    const s = seconds % 60;
+    return (h > 0 ? h + 'h' : '') + (h > 0 || m > 0 ? m + 'm' : '') + s + 's';
+  }
+
+  function addEventRow(time, kind, device, msgId, outcome) {
+    const tr = document.createElement('tr');
+    for (const text of [new Date(time).toLocaleTimeString(), kind, device, msgId, outcome]) {
+      const td = document.createElement('td');
+      td.textContent = text;
+      tr.appendChild(td);
+    }
+    eventRows.prepend(tr);
+    while (eventRows.rows.length > maxEventRows) {
+      eventRows.deleteRow(-1);
+    }
+  }
+
+  // Counts a queued uplink on the chart, starting a new bar on a new hour.
+  function countUplink(hourLabel) {
+    const labels = chart.data.labels;
+    const counts = chart.data.datasets[0].data;
+    if (labels.length > 0 && labels[labels.length - 1] === hourLabel) {
+      counts[counts.length - 1]++;
+    } else {
+      labels.push(hourLabel);
+      counts.push(1);
+      if (labels.length > 24) {
+        labels.shift();
+        counts.shift();
+      }
+    }
+    chart.update();
+  }
+
+  const source = new EventSource('/events');
+
+  source.onopen = () => { liveState.textContent = 'live'; };
+  source.onerror = () => { liveState.textContent = 'reconnecting'; };
+
+  source.addEventListener('status', (e) => {
+    const status = JSON.parse(e.data).Data;
+    setText('gateway-time', status.Gateway_Time);
+    setText('uptime', formatUptime(status.Uptime_Seconds));
+    setText('mqtt-state', status.Mqtt_State);
+    setText('cache-size', status.Cache_Size_MB.toFixed(2));
+    setText('queue-depth', status.Queue_Depth);
+    setText('oldest-queued', status.Oldest_Queued_Age_Seconds);
+  });
+
+  source.addEventListener('message', (e) => {
+    const event = JSON.parse(e.data);
+    const msg = event.Data;
+    addEventRow(event.Time, msg.Event_Type, msg.Application + '/' + msg.Device, msg.Msg_Id, msg.Outcome);
+    if (msg.Event_Type === 'up' && msg.Outcome === 'queued' && !event.Replay) {
+      countUplink(msg.Hour_Label);
+    }
+  });
+
+  source.addEventListener('upload', (e) => {
+    const event = JSON.parse(e.data);
+    const upload = event.Data;
+    addEventRow(event.Time, 'upload', '', upload.Msg_Id, upload.Error ? upload.Outcome + ': ' + upload.Error : upload.Outcome);
+  });
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+// Trace_Event is one event table of the ChirpStack PostgreSQL integration.
+// Object is the JSON shown for each row, the payload for uplinks and the
+// whole row for the others.
+type Trace_Event struct {
+	Table   string
+	Object  string
+	Payload bool
+}
+
+// trace_events are the event types the tracer accepts, the only table
+// names that ever end up in a query.
+var trace_events = map[string]Trace_Event{
+	"up":       {Table: "event_up", Object: "e.object", Payload: true},
+	"join":     {Table: "event_join", Object: "to_jsonb(e)"},
+	"ack":      {Table: "event_ack", Object: "to_jsonb(e)"},
+	"txack":    {Table: "event_tx_ack", Object: "to_jsonb(e)"},
+	"status":   {Table: "event_status", Object: "to_jsonb(e)"},
+	"log":      {Table: "event_log", Object: "to_jsonb(e)"},
+	"location": {Table: "event_location", Object: "to_jsonb(e)"},
+}
+
+var trace_event_names = []string{"up", "join", "ack", "txack", "status", "log", "location"}
+
+// The datetime-local inputs of the form, with or without seconds.
+var trace_time_layouts = []string{"2006-01-02T15:04", "2006-01-02T15:04:05"}
+
+var dev_eui_pattern = regexp.MustCompile(`^[0-9a-fA-F]{16}$`)
+var payload_field_pattern = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+
+// Trace_Query is a validated Data Tracer form. Only Start and End are
+// required, F_Port is -1 for any port.
+type Trace_Query struct {
+	Start       time.Time
+	End         time.Time
+	Event       string
+	Dev_Eui     string
+	Device_Name string
+	F_Port      int
+	Field       string
+	Value       string
+	Page        int
+	Limit       int
+}
+
+type Trace_Row struct {
+	Time        time.Time
+	Dev_Eui     string
+	Device_Name string
+	Data        string
+}
+
+// parse_trace_query validates the form of the Data Tracer. Times are read
+// in tracer_timezone.
+func parse_trace_query(form url.Values, appConfig *AppConfig) (*Trace_Query, error) {
+	loc, err := time.LoadLocation(appConfig.TracerTimezone)
+	if err != nil {
+		return nil, err
+	}
+	q := &Trace_Query{
+		Event:       form.Get("event"),
+		Dev_Eui:     strings.ToLower(strings.TrimSpace(form.Get("dev_eui"))),
+		Device_Name: form.Get("device_name"),
+		F_Port:      -1,
+		Field:       strings.TrimSpace(form.Get("field")),
+		Value:       form.Get("value"),
+		Page:        1,
+		Limit:       appConfig.TracerPageSize,
+	}
+	if q.Start, err = parse_trace_time(form.Get("datetime_start"), loc); err != nil {
+		return nil, fmt.Errorf("start date: %w", err)
+	}
+	if q.End, err = parse_trace_time(form.Get("datetime_end"), loc); err != nil {
+		return nil, fmt.Errorf("end date: %w", err)
+	}
+	if !q.End.After(q.Start) {
+		return nil, errors.New("end date must be after start date")
+	}
+	if q.Event == "" {
+		q.Event = "up"
+	}
+	event, ok := trace_events[q.Event]
+	if !ok {
+		return nil, fmt.Errorf("event type %q is not one of %s", q.Event, strings.Join(trace_event_names, ", "))
+	}
+	if q.Dev_Eui != "" && !dev_eui_pattern.MatchString(q.Dev_Eui) {
+		return nil, fmt.Errorf("devEui %q is not 16 hex digits", q.Dev_Eui)
+	}
+	if s := form.Get("f_port"); s != "" {
+		if q.F_Port, err = strconv.Atoi(s); err != nil || q.F_Port < 0 || q.F_Port > 255 {
+			return nil, fmt.Errorf("fPort %q is not between 0 and 255", s)
+		}
+		if q.Event != "up" {
+			return nil, errors.New("fPort only applies to up events")
+		}
+	}
+	if q.Field != "" {
+		if !payload_field_pattern.MatchString(q.Field) {
+			return nil, fmt.Errorf("payload field %q is not a dotted path such as sensor.temperature", q.Field)
+		}
+		if !event.Payload {
+			return nil, errors.New("payload field only applies to up events")
+		}
+	}
+	if s := form.Get("page"); s != "" {
+		if q.Page, err = strconv.Atoi(s); err != nil || q.Page < 1 {
+			return nil, fmt.Errorf("page %q is not a positive number", s)
+		}
+	}
+	if s := form.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 {
+			return nil, fmt.Errorf("limit %q is not a positive number", s)
+		}
+	}
+	q.Limit = min(q.Limit, appConfig.TracerMaxRows)
+	return q, nil
+}
+
+func parse_trace_time(s string, loc *time.Location) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, errors.New("is required")
+	}
+	for _, layout := range trace_time_layouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date and time such as 2025-01-31T13:45", s)
+}
+
+// where builds the conditions of q, every value the user typed is a bound
+// parameter.
+func (q *Trace_Query) where() (string, []any) {
+	event := trace_events[q.Event]
+	where := []string{"e.time >= $1", "e.time < $2"}
+	args := []any{q.Start, q.End}
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if q.Dev_Eui != "" {
+		add("e.dev_eui = decode($%d, 'hex')", q.Dev_Eui)
+	}
+	if q.Device_Name != "" {
+		add("e.device_name = $%d", q.Device_Name)
+	}
+	if q.F_Port >= 0 {
+		add("e.f_port = $%d", q.F_Port)
+	}
+	if q.Field != "" {
+		add("e.object #> $%d::text[] IS NOT NULL", "{"+strings.ReplaceAll(q.Field, ".", ",")+"}")
+		if q.Value != "" {
+			add(fmt.Sprintf("e.object #>> $%d::text[] = $%%d", len(args)), q.Value)
+		}
+	}
+	if event.Payload && q.Field == "" {
+		where = append(where, "e.object != '{}'")
+	}
+	return strings.Join(where, " AND "), args
+}
+
+// sql is the query of one page, it asks for one row more than the limit to
+// tell whether there is a next page.
+func (q *Trace_Query) sql() (string, []any) {
+	event := trace_events[q.Event]
+	where, args := q.where()
+	args = append(args, q.Limit+1, (q.Page-1)*q.Limit)
+	query := fmt.Sprintf("SELECT e.time, encode(e.dev_eui, 'hex'), e.device_name, %s::text FROM %s e WHERE %s ORDER BY e.time DESC LIMIT $%d OFFSET $%d;",
+		event.Object, event.Table, where, len(args)-1, len(args))
+	return query, args
+}
+
+// export_sql is the query of an export, oldest first and up to limit rows.
+func (q *Trace_Query) export_sql(limit int) (string, []any) {
+	event := trace_events[q.Event]
+	where, args := q.where()
+	args = append(args, limit)
+	query := fmt.Sprintf("SELECT e.time, encode(e.dev_eui, 'hex'), e.device_name, %s::text FROM %s e WHERE %s ORDER BY e.time LIMIT $%d;",
+		event.Object, event.Table, where, len(args))
+	return query, args
+}
+
+// db_trace runs q against the backend database, more tells whether another
+// page follows.
+func db_trace(ctx context.Context, q *Trace_Query, loc *time.Location) (rows []Trace_Row, more bool, err error) {
+	query, args := q.sql()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	result, err := db_psql.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer result.Close()
+
+	rows = []Trace_Row{}
+	for result.Next() {
+		var row Trace_Row
+		var data sql.NullString
+		if err := result.Scan(&row.Time, &row.Dev_Eui, &row.Device_Name, &data); err != nil {
+			return nil, false, err
+		}
+		row.Time = row.Time.In(loc)
+		row.Data = data.String
+		rows = append(rows, row)
+	}
+	if len(rows) > q.Limit {
+		return rows[:q.Limit], true, result.Err()
+	}
+	return rows, false, result.Err()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceQuery(t *testing.T) {
+	kl, _ := time.LoadLocation("Asia/Kuala_Lumpur")
+	c := valid_config()
+	c.TracerTimezone, c.TracerPageSize, c.TracerMaxRows = "Asia/Kuala_Lumpur", 100, 500
+	form := func(extra string) url.Values {
+		v, err := url.ParseQuery("datetime_start=2025-01-31T13:45&datetime_end=2025-01-31T14:45" + extra)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	start, end := time.Date(2025, 1, 31, 13, 45, 0, 0, kl), time.Date(2025, 1, 31, 14, 45, 0, 0, kl)
+	tests := []struct {
+		name    string
+		form    url.Values
+		want    *Trace_Query
+		wantErr string
+	}{
+		{"defaults", form(""), &Trace_Query{Start: start, End: end, Event: "up", F_Port: -1, Page: 1, Limit: 100}, ""},
+		{"filters", form("&event=up&dev_eui=+0004A30B001C0530+&device_name=pump-1&f_port=10&field=sensor.temperature&value=21.5&page=3&limit=20"),
+			&Trace_Query{Start: start, End: end, Event: "up", Dev_Eui: "0004a30b001c0530", Device_Name: "pump-1", F_Port: 10,
+				Field: "sensor.temperature", Value: "21.5", Page: 3, Limit: 20}, ""},
+		{"limit capped at tracer_max_rows", form("&limit=100000"), &Trace_Query{Start: start, End: end, Event: "up", F_Port: -1, Page: 1, Limit: 500}, ""},
+		{"other event", form("&event=join"), &Trace_Query{Start: start, End: end, Event: "join", F_Port: -1, Page: 1, Limit: 100}, ""},
+		{"missing start", url.Values{"datetime_end": {"2025-01-31T14:45"}}, nil, "start date: is required"},
+		{"bad end", url.Values{"datetime_start": {"2025-01-31T13:45"}, "datetime_end": {"31/01/2025"}}, nil, "end date:"},
+		{"end before start", url.Values{"datetime_start": {"2025-01-31T14:45"}, "datetime_end": {"2025-01-31T13:45"}}, nil, "after start"},
+		{"unknown event", form("&event=event_up%3BDROP+TABLE+event_up"), nil, "event type"},
+		{"dev_eui injection", form("&dev_eui='+OR+1=1--"), nil, "devEui"},
+		{"f_port out of range", form("&f_port=256"), nil, "fPort"},
+		{"f_port not a number", form("&f_port=1+OR+1=1"), nil, "fPort"},
+		{"f_port on joins", form("&event=join&f_port=10"), nil, "only applies to up"},
+		{"field injection", form("&field=a}'::text[]"), nil, "payload field"},
+		{"field on joins", form("&event=join&field=sensor"), nil, "only applies to up"},
+		{"page", form("&page=0"), nil, "page"},
+		{"limit", form("&limit=-1"), nil, "limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parse_trace_query(tt.form, c)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parse_trace_query() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(q, tt.want) {
+				t.Errorf("parse_trace_query() = %+v, want %+v", q, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTraceTime(t *testing.T) {
+	utc := time.UTC
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{"2025-01-31T13:45", time.Date(2025, 1, 31, 13, 45, 0, 0, utc), false},
+		{"2025-01-31T13:45:30", time.Date(2025, 1, 31, 13, 45, 30, 0, utc), false},
+		{"", time.Time{}, true},
+		{"2025-01-31 13:45", time.Time{}, true},
+		{"2025-02-30T13:45", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parse_trace_time(tt.in, utc)
+			if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+				t.Errorf("parse_trace_time() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraceQuerySql(t *testing.T) {
+	start, end := time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC), time.Date(2025, 1, 31, 14, 45, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		query Trace_Query
+		sql   string
+		args  []any
+	}{
+		{"uplinks", Trace_Query{Start: start, End: end, Event: "up", F_Port: -1, Page: 1, Limit: 100},
+			"SELECT e.time, encode(e.dev_eui, 'hex'), e.device_name, e.object::text FROM event_up e WHERE e.time >= $1 AND e.time < $2 AND e.object != '{}' ORDER BY e.time DESC LIMIT $3 OFFSET $4;",
+			[]any{start, end, 101, 0}},
+		{"filters are bound", Trace_Query{Start: start, End: end, Event: "up", Dev_Eui: "0004a30b001c0530", Device_Name: "pump'; DROP TABLE event_up; --",
+			F_Port: 10, Field: "sensor.temperature", Value: "21.5", Page: 3, Limit: 20},
+			"SELECT e.time, encode(e.dev_eui, 'hex'), e.device_name, e.object::text FROM event_up e WHERE e.time >= $1 AND e.time < $2" +
+				" AND e.dev_eui = decode($3, 'hex') AND e.device_name = $4 AND e.f_port = $5 AND e.object #> $6::text[] IS NOT NULL" +
+				" AND e.object #>> $6::text[] = $7 ORDER BY e.time DESC LIMIT $8 OFFSET $9;",
+			[]any{start, end, "0004a30b001c0530", "pump'; DROP TABLE event_up; --", 10, "{sensor,temperature}", "21.5", 21, 40}},
+		{"other event", Trace_Query{Start: start, End: end, Event: "txack", F_Port: -1, Page: 2, Limit: 50},
+			"SELECT e.time, encode(e.dev_eui, 'hex'), e.device_name, to_jsonb(e)::text FROM event_tx_ack e WHERE e.time >= $1 AND e.time < $2 ORDER BY e.time DESC LIMIT $3 OFFSET $4;",
+			[]any{start, end, 51, 50}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, args := tt.query.sql()
+			if sql != tt.sql {
+				t.Errorf("sql()\n%s\nwant\n%s", sql, tt.sql)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
+
+func TestTraceQueryExportSql(t *testing.T) {
+	start, end := time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC), time.Date(2025, 1, 31, 14, 45, 0, 0, time.UTC)
+	q := Trace_Query{Start: start, End: end, Event: "up", Device_Name: "pump-1", F_Port: -1, Page: 3, Limit: 20}
+	sql, args := q.export_sql(1000000)
+	want := "SELECT e.time, encode(e.dev_eui, 'hex'), e.device_name, e.object::text FROM event_up e WHERE e.time >= $1 AND e.time < $2" +
+		" AND e.device_name = $3 AND e.object != '{}' ORDER BY e.time LIMIT $4;"
+	if sql != want || !reflect.DeepEqual(args, []any{start, end, "pump-1", 1000000}) {
+		t.Errorf("export_sql() = %s %v", sql, args)
+	}
+}
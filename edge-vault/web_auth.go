@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Console roles, each one may do everything the roles before it may.
+// Viewers read, operators also act on the queue and admins also change
+// configuration.
+const (
+	role_viewer   = "viewer"
+	role_operator = "operator"
+	role_admin    = "admin"
+)
+
+var web_roles = []string{role_viewer, role_operator, role_admin}
+
+func role_at_least(role string, want string) bool {
+	return slices.Index(web_roles, role) >= slices.Index(web_roles, want)
+}
+
+// Web_User is an account of the web console. PasswordHash is a bcrypt hash
+// as printed by cache-sync hash-password.
+type Web_User struct {
+	Username     string `yaml:"username"`
+	PasswordHash Secret `yaml:"password_hash"`
+	Role         string `yaml:"role"` // viewer
+}
+
+func (u *Web_User) UnmarshalYAML(value *yaml.Node) error {
+	type plain Web_User
+	p := plain{Role: role_viewer}
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	*u = Web_User(p)
+	return nil
+}
+
+// Web_Api_Token lets scripts call the console with an
+// "Authorization: Bearer <token>" header instead of logging in.
+type Web_Api_Token struct {
+	Name  string `yaml:"name"`
+	Token Secret `yaml:"token"`
+	Role  string `yaml:"role"` // viewer
+}
+
+func (t *Web_Api_Token) UnmarshalYAML(value *yaml.Node) error {
+	type plain Web_Api_Token
+	p := plain{Role: role_viewer}
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	*t = Web_Api_Token(p)
+	return nil
+}
+
+const web_session_cookie = "cache_sync_session"
+
+// Web_Session is a logged in browser, kept in WEB_SESSION, or an API token
+// for the duration of one request. The role is looked up again on every request so removing a
+// user from config.yaml ends their sessions on the next reload.
+type Web_Session struct {
+	Username string
+	Role     string
+	Csrf     string
+	Expires  time.Time
+	api      bool
+}
+
+// session_key is what WEB_SESSION stores for a session cookie, so reading
+// the database does not give away live sessions.
+func session_key(cookie string) string {
+	sum := sha256.Sum256([]byte(cookie))
+	return hex.EncodeToString(sum[:])
+}
+
+// store_session saves a new session and drops the expired ones.
+func store_session(cookie string, s *Web_Session) error {
+	if _, err := db.Exec(`DELETE FROM WEB_SESSION WHERE expires_at < $1;`, time.Now().Unix()); err != nil {
+		return err
+	}
+	_, err := db.Exec(`INSERT INTO WEB_SESSION (id, username, csrf, expires_at) VALUES ($1, $2, $3, $4);`,
+		session_key(cookie), s.Username, s.Csrf, s.Expires.Unix())
+	return err
+}
+
+func load_session(cookie string) (*Web_Session, error) {
+	s := &Web_Session{}
+	var expires_at int64
+	err := db.QueryRow(`SELECT username, csrf, expires_at FROM WEB_SESSION WHERE id = $1;`, session_key(cookie)).
+		Scan(&s.Username, &s.Csrf, &expires_at)
+	s.Expires = time.Unix(expires_at, 0)
+	return s, err
+}
+
+func delete_session(cookie string) error {
+	_, err := db.Exec(`DELETE FROM WEB_SESSION WHERE id = $1;`, session_key(cookie))
+	return err
+}
+
+type web_session_key struct{}
+
+// current_session is the caller of a request that passed web_auth.
+func current_session(r *http.Request) *Web_Session {
+	s, _ := r.Context().Value(web_session_key{}).(*Web_Session)
+	return s
+}
+
+func random_token() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func find_web_user(appConfig *AppConfig, username string) *Web_User {
+	for i := range appConfig.WebUsers {
+		if appConfig.WebUsers[i].Username == username {
+			return &appConfig.WebUsers[i]
+		}
+	}
+	return nil
+}
+
+// request_session finds the session of the cookie or the API token of r,
+// nil when there is none or it is no longer valid.
+func request_session(r *http.Request) *Web_Session {
+	appConfig := current_config()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok {
+			return nil
+		}
+		for _, t := range appConfig.WebApiTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+				return &Web_Session{Username: "token:" + t.Name, Role: t.Role, api: true}
+			}
+		}
+		return nil
+	}
+
+	cookie, err := r.Cookie(web_session_cookie)
+	if err != nil {
+		return nil
+	}
+	s, err := load_session(cookie.Value)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			web_log.Warn("Failed to read web session", "err", err)
+		}
+		return nil
+	}
+	user := find_web_user(appConfig, s.Username)
+	if user == nil || time.Now().After(s.Expires) {
+		delete_session(cookie.Value)
+		return nil
+	}
+	current := *s
+	current.Role = user.Role
+	return &current
+}
+
+// web_auth only lets callers with at least role through. Browsers without
+// a session are sent to the login page, anything else gets a 401. Changes
+// made with a session cookie must carry its CSRF token, as the csrf_token
+// form field or the X-CSRF-Token header.
+func web_auth(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := request_session(r)
+		if s == nil {
+			if r.Method == http.MethodGet && r.Header.Get("Authorization") == "" {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !s.api && r.Method != http.MethodGet && r.Method != http.MethodHead && !valid_csrf(r, s) {
+			web_log.Warn("Rejected request without CSRF token", "user", s.Username, "path", r.URL.Path, "source", r.RemoteAddr)
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		if !role_at_least(s.Role, role) {
+			http.Error(w, "Forbidden, requires the "+role+" role", http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), web_session_key{}, s)))
+	}
+}
+
+func valid_csrf(r *http.Request, s *Web_Session) bool {
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.PostFormValue("csrf_token")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.Csrf)) == 1
+}
+
+// Failed logins are limited per source address and, less strictly so one
+// address cannot lock an account out as easily, per username. Once either
+// has failed too often within login_window, logins are refused until the
+// window has passed.
+const (
+	login_window          = 15 * time.Minute
+	login_max_per_source  = 5
+	login_max_per_account = 20
+)
+
+type login_failures struct {
+	count int
+	since time.Time
+}
+
+var login_limiter = struct {
+	sync.Mutex
+	m map[string]*login_failures
+}{m: map[string]*login_failures{}}
+
+// login_blocked reports whether the keys have failed to log in more often
+// than allowed, and how long until they may try again.
+func login_blocked(now time.Time, source string, username string) (bool, time.Duration) {
+	login_limiter.Lock()
+	defer login_limiter.Unlock()
+	for key, f := range login_limiter.m {
+		if now.Sub(f.since) >= login_window {
+			delete(login_limiter.m, key)
+		}
+	}
+	var wait time.Duration
+	if f := login_limiter.m["source:"+source]; f != nil && f.count >= login_max_per_source {
+		wait = max(wait, login_window-now.Sub(f.since))
+	}
+	if f := login_limiter.m["user:"+username]; f != nil && f.count >= login_max_per_account {
+		wait = max(wait, login_window-now.Sub(f.since))
+	}
+	return wait > 0, wait
+}
+
+func login_failed(now time.Time, source string, username string) {
+	login_limiter.Lock()
+	defer login_limiter.Unlock()
+	for _, key := range []string{"source:" + source, "user:" + username} {
+		f := login_limiter.m[key]
+		if f == nil {
+			f = &login_failures{since: now}
+			login_limiter.m[key] = f
+		}
+		f.count++
+	}
+}
+
+// request_ip is the address failed logins are counted against and the
+// audit log records, without the port which changes with every connection.
+func request_ip(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Compared against when the username is unknown, so a failed login takes
+// as long whether or not the user exists.
+var dummy_password_hash, _ = bcrypt.GenerateFromPassword([]byte("cache-sync"), bcrypt.DefaultCost)
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	// Only redirect within the console.
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	data := struct {
+		Next    string
+		Error   string
+		NoUsers bool
+	}{
+		Next:    next,
+		NoUsers: len(current_config().WebUsers) == 0,
+	}
+	if r.Method != http.MethodPost {
+		render(w, r, "login.html", data)
+		return
+	}
+
+	username := r.PostFormValue("username")
+	if blocked, wait := login_blocked(time.Now(), request_ip(r), username); blocked {
+		web_log.Warn("Refused login after too many failures", "user", username, "source", r.RemoteAddr)
+		record_audit(username, request_ip(r), "login", username, nil, nil, errors.New("too many failed logins"))
+		data.Error = fmt.Sprintf("Too many failed logins, try again in %d minutes", int(wait.Minutes())+1)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		w.WriteHeader(http.StatusTooManyRequests)
+		render(w, r, "login.html", data)
+		return
+	}
+	user := find_web_user(current_config(), username)
+	hash := dummy_password_hash
+	if user != nil {
+		hash = []byte(user.PasswordHash)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(r.PostFormValue("password"))); err != nil || user == nil {
+		login_failed(time.Now(), request_ip(r), username)
+		web_log.Warn("Failed login", "user", username, "source", r.RemoteAddr)
+		record_audit(username, request_ip(r), "login", username, nil, nil, errors.New("wrong username or password"))
+		data.Error = "Wrong username or password"
+		w.WriteHeader(http.StatusUnauthorized)
+		render(w, r, "login.html", data)
+		return
+	}
+
+	lifetime := time.Duration(current_config().WebSessionLifetime)
+	id := random_token()
+	session := &Web_Session{Username: user.Username, Role: user.Role, Csrf: random_token(), Expires: time.Now().Add(lifetime)}
+	if err := store_session(id, session); err != nil {
+		web_log.Error("Failed to store web session", "user", user.Username, "err", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     web_session_cookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(lifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	web_log.Info("Logged in", "user", user.Username, "role", user.Role, "source", r.RemoteAddr)
+	record_audit(user.Username, request_ip(r), "login", user.Username, nil, map[string]any{"role": user.Role}, nil)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(web_session_cookie); err == nil {
+		if err := delete_session(cookie.Value); err != nil {
+			web_log.Warn("Failed to delete web session", "err", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: web_session_cookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	web_log.Info("Logged out", "user", current_session(r).Username, "source", r.RemoteAddr)
+	audit_request(r, "logout", current_session(r).Username, nil, nil, nil)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// hash_password implements the hash-password command, it reads a password
+// from stdin and prints the bcrypt hash to put in web_users.
+func hash_password(args []string) int {
+	flags := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	cost := flags.Int("cost", bcrypt.DefaultCost, "bcrypt cost")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: cache-sync hash-password [-cost 10] < password")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	// A password piped in without a trailing newline ends at EOF.
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		fmt.Fprintln(os.Stderr, "failed to read password:", err)
+		return 1
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "no password given")
+		return 1
+	}
+	if slices.Contains(sample_passwords, password) {
+		fmt.Fprintln(os.Stderr, "that is a sample password, choose another")
+		return 1
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), *cost)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(string(hash))
+	return 0
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// test_web_config runs the console with an operator account, whose
+// password is "operator-password", and a viewer API token.
+func test_web_config(t *testing.T) *AppConfig {
+	hash, err := bcrypt.GenerateFromPassword([]byte("operator-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := valid_config()
+	c.WebUsers = []Web_User{{Username: "operator", PasswordHash: Secret(hash), Role: role_operator}}
+	c.WebApiTokens = []Web_Api_Token{{Name: "grafana", Token: "9b2e61c0d4a87f35", Role: role_viewer}}
+	prev := app_config.Load()
+	app_config.Store(c)
+	t.Cleanup(func() { app_config.Store(prev) })
+	return c
+}
+
+func reset_login_limiter(t *testing.T) {
+	login_limiter.Lock()
+	login_limiter.m = map[string]*login_failures{}
+	login_limiter.Unlock()
+	t.Cleanup(func() {
+		login_limiter.Lock()
+		login_limiter.m = map[string]*login_failures{}
+		login_limiter.Unlock()
+	})
+}
+
+func TestRoleAtLeast(t *testing.T) {
+	tests := []struct {
+		role string
+		want string
+		ok   bool
+	}{
+		{role_viewer, role_viewer, true},
+		{role_viewer, role_operator, false},
+		{role_operator, role_viewer, true},
+		{role_operator, role_admin, false},
+		{role_admin, role_operator, true},
+		{"", role_viewer, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role+" "+tt.want, func(t *testing.T) {
+			if got := role_at_least(tt.role, tt.want); got != tt.ok {
+				t.Errorf("role_at_least(%q, %q) = %v, want %v", tt.role, tt.want, got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWebRoleDefault(t *testing.T) {
+	var c struct {
+		Users  []Web_User      `yaml:"web_users"`
+		Tokens []Web_Api_Token `yaml:"web_api_tokens"`
+	}
+	err := yaml.Unmarshal([]byte("web_users:\n  - username: viewer\n  - username: admin\n    role: admin\nweb_api_tokens:\n  - name: grafana\n"), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Users[0].Role != role_viewer || c.Users[1].Role != role_admin || c.Tokens[0].Role != role_viewer {
+		t.Errorf("roles %q, %q, %q", c.Users[0].Role, c.Users[1].Role, c.Tokens[0].Role)
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		failures func()
+		at       time.Time
+		source   string
+		username string
+		blocked  bool
+		wait     time.Duration
+	}{
+		{"no failures", func() {}, now, "10.0.0.5", "operator", false, 0},
+		{"below the source limit", func() {
+			for range login_max_per_source - 1 {
+				login_failed(now, "10.0.0.5", "operator")
+			}
+		}, now, "10.0.0.5", "operator", false, 0},
+		{"source blocked", func() {
+			for range login_max_per_source {
+				login_failed(now, "10.0.0.5", "operator")
+			}
+		}, now.Add(5 * time.Minute), "10.0.0.5", "admin", true, 10 * time.Minute},
+		{"other source allowed", func() {
+			for range login_max_per_source {
+				login_failed(now, "10.0.0.5", "operator")
+			}
+		}, now, "10.0.0.6", "operator", false, 0},
+		{"account blocked from any source", func() {
+			for i := range login_max_per_account {
+				login_failed(now, fmt.Sprintf("10.0.1.%d", i), "operator")
+			}
+		}, now, "10.0.0.6", "operator", true, login_window},
+		{"window passed", func() {
+			for range login_max_per_source {
+				login_failed(now, "10.0.0.5", "operator")
+			}
+		}, now.Add(login_window), "10.0.0.5", "operator", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reset_login_limiter(t)
+			tt.failures()
+			blocked, wait := login_blocked(tt.at, tt.source, tt.username)
+			if blocked != tt.blocked || wait != tt.wait {
+				t.Errorf("login_blocked() = %v, %v, want %v, %v", blocked, wait, tt.blocked, tt.wait)
+			}
+		})
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	test := test_db(t)
+	expired := &Web_Session{Username: "operator", Csrf: "c0", Expires: time.Now().Add(-time.Minute)}
+	if err := store_session("expired-cookie", expired); err != nil {
+		t.Fatal(err)
+	}
+	live := &Web_Session{Username: "operator", Csrf: "c1", Expires: time.Now().Add(time.Hour).Truncate(time.Second)}
+	if err := store_session("live-cookie", live); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := load_session("expired-cookie"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expired session not dropped: %v", err)
+	}
+	s, err := load_session("live-cookie")
+	if err != nil || s.Username != "operator" || s.Csrf != "c1" || !s.Expires.Equal(live.Expires) {
+		t.Errorf("load_session() = %+v, %v", s, err)
+	}
+	var stored int
+	test.QueryRow(`SELECT count(*) FROM WEB_SESSION WHERE id = 'live-cookie';`).Scan(&stored)
+	if stored != 0 {
+		t.Error("cookie stored as is")
+	}
+	if err := delete_session("live-cookie"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := load_session("live-cookie"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("deleted session still loads: %v", err)
+	}
+}
+
+func TestWebAuth(t *testing.T) {
+	test_db(t)
+	test_web_config(t)
+	store_session("operator-cookie", &Web_Session{Username: "operator", Csrf: "c1", Expires: time.Now().Add(time.Hour)})
+	store_session("removed-cookie", &Web_Session{Username: "removed", Csrf: "c2", Expires: time.Now().Add(time.Hour)})
+
+	tests := []struct {
+		name   string
+		method string
+		role   string
+		cookie string
+		header map[string]string
+		code   int
+	}{
+		{"browser without session", http.MethodGet, role_viewer, "", nil, http.StatusSeeOther},
+		{"script without session", http.MethodPost, role_viewer, "", nil, http.StatusUnauthorized},
+		{"unknown cookie", http.MethodGet, role_viewer, "forged-cookie", nil, http.StatusSeeOther},
+		{"user removed from config", http.MethodGet, role_viewer, "removed-cookie", nil, http.StatusSeeOther},
+		{"session", http.MethodGet, role_operator, "operator-cookie", nil, http.StatusOK},
+		{"role too low", http.MethodGet, role_admin, "operator-cookie", nil, http.StatusForbidden},
+		{"change without csrf", http.MethodPost, role_operator, "operator-cookie", nil, http.StatusForbidden},
+		{"change with wrong csrf", http.MethodPost, role_operator, "operator-cookie", map[string]string{"X-CSRF-Token": "c2"}, http.StatusForbidden},
+		{"change with csrf", http.MethodPost, role_operator, "operator-cookie", map[string]string{"X-CSRF-Token": "c1"}, http.StatusOK},
+		{"api token", http.MethodGet, role_viewer, "", map[string]string{"Authorization": "Bearer 9b2e61c0d4a87f35"}, http.StatusOK},
+		{"api token needs no csrf", http.MethodPost, role_viewer, "", map[string]string{"Authorization": "Bearer 9b2e61c0d4a87f35"}, http.StatusOK},
+		{"api token role too low", http.MethodPost, role_operator, "", map[string]string{"Authorization": "Bearer 9b2e61c0d4a87f35"}, http.StatusForbidden},
+		{"wrong api token", http.MethodGet, role_viewer, "", map[string]string{"Authorization": "Bearer 0000000000000000"}, http.StatusUnauthorized},
+		{"not a bearer token", http.MethodGet, role_viewer, "", map[string]string{"Authorization": "Basic b3BlcmF0b3I6"}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen *Web_Session
+			handler := web_auth(tt.role, func(w http.ResponseWriter, r *http.Request) { seen = current_session(r) })
+			r := httptest.NewRequest(tt.method, "/queue?page=2", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: web_session_cookie, Value: tt.cookie})
+			}
+			for key, val := range tt.header {
+				r.Header.Set(key, val)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			if tt.code == http.StatusSeeOther && w.Header().Get("Location") != "/login?next="+url.QueryEscape("/queue?page=2") {
+				t.Errorf("redirected to %s", w.Header().Get("Location"))
+			}
+			if tt.code == http.StatusOK && seen == nil {
+				t.Error("handler ran without a session")
+			}
+		})
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		username string
+		failures int
+		code     int
+		location string
+		cookie   bool
+	}{
+		{"logged in", "operator-password", "operator", 0, http.StatusSeeOther, "/queue", true},
+		{"wrong password", "viewer-password", "operator", 0, http.StatusUnauthorized, "", false},
+		{"unknown user", "operator-password", "admin", 0, http.StatusUnauthorized, "", false},
+		{"too many failures", "operator-password", "operator", login_max_per_source, http.StatusTooManyRequests, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			test := test_db(t)
+			test_web_config(t)
+			reset_login_limiter(t)
+			if err := test_web_files(t, ""); err != nil {
+				t.Fatal(err)
+			}
+			for range tt.failures {
+				login_failed(time.Now(), "192.0.2.1", tt.username)
+			}
+
+			form := url.Values{"username": {tt.username}, "password": {tt.password}, "next": {"/queue"}}
+			r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			loginHandler(w, r)
+			if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+				t.Fatalf("status %d to %q, want %d to %q", w.Code, w.Header().Get("Location"), tt.code, tt.location)
+			}
+			if tt.code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Error("no Retry-After")
+			}
+			var sessions, audited int
+			test.QueryRow(`SELECT count(*) FROM WEB_SESSION;`).Scan(&sessions)
+			test.QueryRow(`SELECT count(*) FROM AUDIT_LOG WHERE action = 'login';`).Scan(&audited)
+			if (sessions == 1) != tt.cookie || (len(w.Result().Cookies()) == 1) != tt.cookie {
+				t.Errorf("%d sessions, cookies %v", sessions, w.Result().Cookies())
+			}
+			if audited != 1 {
+				t.Errorf("%d login audit entries, want 1", audited)
+			}
+		})
+	}
+}
+
+func TestLoginNextStaysInConsole(t *testing.T) {
+	tests := []struct {
+		next string
+		want string
+	}{
+		{"/queue", "/queue"},
+		{"", "/"},
+		{"//evil.example", "/"},
+		{"https://evil.example", "/"},
+	}
+	test_db(t)
+	test_web_config(t)
+	reset_login_limiter(t)
+	for _, tt := range tests {
+		t.Run(tt.next, func(t *testing.T) {
+			form := url.Values{"username": {"operator"}, "password": {"operator-password"}, "next": {tt.next}}
+			r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			loginHandler(w, r)
+			if w.Header().Get("Location") != tt.want {
+				t.Errorf("redirected to %q, want %q", w.Header().Get("Location"), tt.want)
+			}
+		})
+	}
+}
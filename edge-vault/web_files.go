@@ -0,0 +1,89 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+)
+
+// The console is built into the binary so a gateway only needs the .bin,
+// web_dir points at a copy of templates/ to work on it without rebuilding.
+//
+//go:embed templates
+var embedded_templates embed.FS
+
+var web_files fs.FS
+var web_static fs.FS
+
+// web_templates is parsed once at startup. With web_dir set it is parsed
+// again on every render so template edits show up on a browser refresh.
+var web_templates *template.Template
+
+// web_files_dir is the web_dir the console was loaded from, a changed
+// web_dir only takes effect after a restart.
+var web_files_dir string
+
+func load_web_files(web_dir string) error {
+	web_files_dir = web_dir
+	if web_dir != "" {
+		web_files = os.DirFS(web_dir)
+	} else {
+		web_files, _ = fs.Sub(embedded_templates, "templates")
+	}
+	static, err := fs.Sub(web_files, "static")
+	if err != nil {
+		return err
+	}
+	web_static = static
+	web_templates, err = parse_templates()
+	return err
+}
+
+func parse_templates() (*template.Template, error) {
+	return template.New("").Funcs(web_template_funcs(nil)).ParseFS(web_files, "*.html")
+}
+
+// web_template_funcs are available in every page, for the logout form and
+// the navigation.
+func web_template_funcs(s *Web_Session) template.FuncMap {
+	return template.FuncMap{
+		"csrf_token": func() string {
+			if s == nil {
+				return ""
+			}
+			return s.Csrf
+		},
+		"user": func() string {
+			if s == nil {
+				return ""
+			}
+			return s.Username
+		},
+		"admin": func() bool {
+			return s != nil && role_at_least(s.Role, role_admin)
+		},
+	}
+}
+
+func render(w http.ResponseWriter, r *http.Request, name string, data any) {
+	tmpl := web_templates
+	if web_files_dir != "" {
+		var err error
+		if tmpl, err = parse_templates(); err != nil {
+			web_log.Warn("Failed to parse web templates", "web_dir", web_files_dir, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	tmpl, err := tmpl.Clone()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Funcs(web_template_funcs(current_session(r)))
+	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+		web_log.Warn("Failed to render page", "template", name, "err", err)
+	}
+}
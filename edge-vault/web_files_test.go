@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// test_web_files loads the console from web_dir, the embedded copy when
+// empty, and restores the running one when the test ends.
+func test_web_files(t *testing.T, web_dir string) error {
+	prev_files, prev_static, prev_templates, prev_dir := web_files, web_static, web_templates, web_files_dir
+	t.Cleanup(func() {
+		web_files, web_static, web_templates, web_files_dir = prev_files, prev_static, prev_templates, prev_dir
+	})
+	return load_web_files(web_dir)
+}
+
+func TestEmbeddedWebFiles(t *testing.T) {
+	if err := test_web_files(t, ""); err != nil {
+		t.Fatal(err)
+	}
+	pages, _ := fs.Glob(web_files, "*.html")
+	for _, page := range pages {
+		if web_templates.Lookup(page) == nil {
+			t.Errorf("%s not parsed", page)
+		}
+	}
+	for _, asset := range []string{"css/main.css", "css/font-awesome.min.css", "fonts/fontawesome-webfont.woff2", "js/chart.js"} {
+		if _, err := fs.Stat(web_static, asset); err != nil {
+			t.Errorf("static/%s not embedded: %v", asset, err)
+		}
+	}
+	// The console works on a gateway without internet.
+	external := regexp.MustCompile(`(src|href)="(https?:)?//`)
+	for _, page := range pages {
+		content, _ := fs.ReadFile(web_files, page)
+		if m := external.Find(content); m != nil {
+			t.Errorf("%s loads %s from the internet", page, m)
+		}
+	}
+}
+
+func TestStaticFiles(t *testing.T) {
+	if err := test_web_files(t, ""); err != nil {
+		t.Fatal(err)
+	}
+	static := http.StripPrefix("/static/", http.FileServer(http.FS(web_static)))
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/static/css/main.css", http.StatusOK},
+		{"/static/js/chart.js", http.StatusOK},
+		{"/static/missing.css", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			static.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.code {
+				t.Errorf("GET %s = %d, want %d", tt.path, w.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestWebDirOverride(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "static"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(content string) {
+		if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{{define "index.html"}}first {{.}}{{end}}`)
+	if err := test_web_files(t, dir); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		content string
+		code    int
+		body    string
+	}{
+		{"rendered from web_dir", `{{define "index.html"}}first {{.}}{{end}}`, http.StatusOK, "first page"},
+		{"edits show without a restart", `{{define "index.html"}}second {{.}}{{end}}`, http.StatusOK, "second page"},
+		{"parse error", `{{define "index.html"}}{{if}}{{end}}`, http.StatusInternalServerError, "missing value for if"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			write(tt.content)
+			w := httptest.NewRecorder()
+			render(w, httptest.NewRequest(http.MethodGet, "/", nil), "index.html", "page")
+			if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("render() = %d %q, want %d %q", w.Code, w.Body.String(), tt.code, tt.body)
+			}
+		})
+	}
+}
+
+func TestWebTemplateFuncs(t *testing.T) {
+	tests := []struct {
+		name    string
+		session *Web_Session
+		want    string
+	}{
+		{"logged out", nil, "[][false]"},
+		{"viewer", &Web_Session{Username: "viewer", Role: role_viewer, Csrf: "c1"}, "[c1][viewer][false]"},
+		{"admin", &Web_Session{Username: "admin", Role: role_admin, Csrf: "c2"}, "[c2][admin][true]"},
+	}
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "static"), 0o755)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte(`{{define "index.html"}}[{{csrf_token}}]{{with user}}[{{.}}]{{end}}[{{admin}}]{{end}}`), 0o644)
+	if err := test_web_files(t, dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.session != nil {
+				r = r.WithContext(context.WithValue(r.Context(), web_session_key{}, tt.session))
+			}
+			w := httptest.NewRecorder()
+			render(w, r, "index.html", nil)
+			if w.Body.String() != tt.want {
+				t.Errorf("rendered %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var alert_log = component_logger("alert")
+
+// Alert rule types.
+const (
+	rule_gateway_silent = "gateway_silent"
+	rule_device_silent  = "device_silent"
+	rule_backlog        = "backlog"
+	rule_sink_failing   = "sink_failing"
+)
+
+// Alert states.
+const (
+	alert_firing   = "firing"
+	alert_resolved = "resolved"
+)
+
+// AlertRule is one configured condition. threshold is a duration for the
+// silent and sink_failing rules and a message count for backlog. subjects
+// optionally limits the rule to some gateway ids, dev euis or sink names.
+type AlertRule struct {
+	Name           string   `yaml:"name"`
+	Type           string   `yaml:"type"`
+	Threshold      string   `yaml:"threshold"`
+	Lookback       Duration `yaml:"lookback"` // 720h
+	Severity       string   `yaml:"severity"`
+	Subjects       []string `yaml:"subjects"`
+	Channels       []string `yaml:"channels"`
+	RepeatInterval Duration `yaml:"repeat_interval"` // 0, notify once
+}
+
+// Threshold used when a rule leaves it out.
+var default_thresholds = map[string]string{
+	rule_gateway_silent: "10m",
+	rule_device_silent:  "6h",
+	rule_backlog:        "1000",
+	rule_sink_failing:   "15m",
+}
+
+func (rule *AlertRule) UnmarshalYAML(value *yaml.Node) error {
+	type plain AlertRule
+	p := plain{Lookback: Duration(30 * 24 * time.Hour)}
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	if p.Threshold == "" {
+		p.Threshold = default_thresholds[p.Type]
+	}
+	*rule = AlertRule(p)
+	return nil
+}
+
+// threshold_duration and threshold_count read a threshold load_config
+// already validated.
+func (rule AlertRule) threshold_duration() time.Duration {
+	d, _ := time.ParseDuration(rule.Threshold)
+	return d
+}
+
+func (rule AlertRule) threshold_count() int64 {
+	n, _ := strconv.ParseInt(rule.Threshold, 10, 64)
+	return n
+}
+
+type Alert struct {
+	Id                 int64
+	Rule_Name          string
+	Subject            string
+	Severity           string
+	State              string
+	Message            string
+	Started_At         time.Time
+	Resolved_At        *time.Time
+	Last_Notified_At   *time.Time
+	Notification_Count int
+	Acknowledged_At    *time.Time
+	Acknowledged_By    string
+}
+
+type Alert_Silence struct {
+	Id         int64
+	Rule_Name  string
+	Subject    string
+	Starts_At  time.Time
+	Ends_At    time.Time
+	Created_By string
+	Comment    string
+}
+
+func (s Alert_Silence) Matches(rule string, subject string) bool {
+	return (s.Rule_Name == "" || s.Rule_Name == rule) && (s.Subject == "" || s.Subject == subject)
+}
+
+// Alert_Condition is a subject for which a rule currently holds.
+type Alert_Condition struct {
+	Subject string
+	Message string
+}
+
+// AlertEngine evaluates every rule on an interval, keeps one firing alert
+// per rule and subject, and notifies the rule's channels when an alert
+// fires, is still unacknowledged after repeat_interval, or resolves.
+type AlertEngine struct {
+	appConfig *AppConfig
+	rules     []AlertRule
+	channels  map[string]*Rate_Limited_Notifier
+	interval  time.Duration
+	done      chan bool
+	wg        sync.WaitGroup
+}
+
+func NewAlertEngine(appConfig *AppConfig) (*AlertEngine, error) {
+	e := &AlertEngine{
+		appConfig: appConfig,
+		rules:     appConfig.AlertRules,
+		channels:  map[string]*Rate_Limited_Notifier{},
+		interval:  time.Duration(appConfig.AlertEvaluationInterval),
+		done:      make(chan bool),
+	}
+	for _, cc := range appConfig.AlertChannels {
+		if _, exists := e.channels[cc.Name]; exists {
+			e.Close()
+			return nil, fmt.Errorf("duplicate alert channel %s", cc.Name)
+		}
+		n, err := NewNotifier(cc)
+		if err != nil {
+			e.Close()
+			return nil, err
+		}
+		e.channels[cc.Name] = &Rate_Limited_Notifier{Notifier: n, limit: cc.RateLimitPerHour}
+	}
+	for _, rule := range e.rules {
+		switch rule.Type {
+		case rule_gateway_silent, rule_device_silent, rule_backlog, rule_sink_failing:
+		default:
+			e.Close()
+			return nil, fmt.Errorf("alert rule %s: unknown type %q", rule.Name, rule.Type)
+		}
+		for _, name := range rule.Channels {
+			if _, ok := e.channels[name]; !ok {
+				e.Close()
+				return nil, fmt.Errorf("alert rule %s: unknown channel %s", rule.Name, name)
+			}
+		}
+	}
+	return e, nil
+}
+
+func (e *AlertEngine) Start() {
+	e.wg.Add(1)
+	go e.alert_worker()
+}
+
+// Stop waits for a running evaluation to finish and closes the channels.
+func (e *AlertEngine) Stop() {
+	close(e.done)
+	e.wg.Wait()
+	e.Close()
+}
+
+func (e *AlertEngine) Close() {
+	for _, ch := range e.channels {
+		ch.Close()
+	}
+}
+
+func (e *AlertEngine) alert_worker() {
+	defer e.wg.Done()
+	alert_log.Debug("Entering evaluation loop", "rules", len(e.rules), "interval", e.interval)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+			e.evaluate_all()
+		}
+	}
+}
+
+func (e *AlertEngine) evaluate_all() {
+	ctx := context.Background()
+	silences, err := active_silences(ctx)
+	if err != nil {
+		alert_log.Warn("Failed to load silences", "err", err)
+		return
+	}
+	for _, rule := range e.rules {
+		conditions, err := e.evaluate(ctx, rule)
+		if err != nil {
+			alert_log.Warn("Failed to evaluate rule", "rule", rule.Name, "err", err)
+			continue
+		}
+		if len(rule.Subjects) > 0 {
+			conditions = slices.DeleteFunc(conditions, func(c Alert_Condition) bool {
+				return !slices.Contains(rule.Subjects, c.Subject)
+			})
+		}
+		if err := e.process(ctx, rule, conditions, silences); err != nil {
+			alert_log.Warn("Failed to process rule", "rule", rule.Name, "err", err)
+		}
+	}
+}
+
+func (e *AlertEngine) evaluate(ctx context.Context, rule AlertRule) ([]Alert_Condition, error) {
+	conditions := []Alert_Condition{}
+	switch rule.Type {
+	case rule_gateway_silent:
+		threshold := rule.threshold_duration()
+		gateways, err := gateway_states(ctx, e.appConfig)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range gateways {
+			if silent := time.Since(g.Last_Seen); silent > threshold {
+				conditions = append(conditions, Alert_Condition{
+					Subject: g.Gateway_Id,
+					Message: fmt.Sprintf("Gateway %s (%s) has not sent a heartbeat for %s, last seen %s",
+						g.Gateway_Id, g.Hostname, silent.Round(time.Second), g.Last_Seen.Format(time.RFC3339)),
+				})
+			}
+		}
+
+	case rule_device_silent:
+		threshold := rule.threshold_duration()
+		// Devices silent for longer than lookback are considered removed.
+		lookback := time.Duration(rule.Lookback)
+		// Walks uplink_message_dev_eui_received_at_idx one device at a
+		// time and reads its last uplink from the index, so the cost
+		// follows the number of devices rather than of uplinks.
+		rows, err := db.QueryContext(ctx, `
+			WITH RECURSIVE device AS (
+				SELECT min(dev_eui) AS dev_eui FROM uplink_message WHERE dev_eui > ''
+				UNION ALL
+				SELECT (SELECT min(m.dev_eui) FROM uplink_message m WHERE m.dev_eui > d.dev_eui)
+				FROM device d WHERE d.dev_eui IS NOT NULL
+			)
+			SELECT d.dev_eui, last.received_at FROM device d
+			CROSS JOIN LATERAL (
+				SELECT m.received_at FROM uplink_message m
+				WHERE m.dev_eui = d.dev_eui
+				ORDER BY m.received_at DESC LIMIT 1
+			) last
+			WHERE last.received_at > now() - $1 * interval '1 second'
+			  AND last.received_at < now() - $2 * interval '1 second';`,
+			lookback.Seconds(), threshold.Seconds())
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var dev_eui string
+			var last_seen time.Time
+			if err := rows.Scan(&dev_eui, &last_seen); err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, Alert_Condition{
+				Subject: dev_eui,
+				Message: fmt.Sprintf("Device %s has not sent an uplink for %s, last seen %s",
+					dev_eui, time.Since(last_seen).Round(time.Second), last_seen.Format(time.RFC3339)),
+			})
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+	case rule_backlog:
+		threshold := rule.threshold_count()
+		gateways, err := gateway_states(ctx, e.appConfig)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range gateways {
+			if g.Queue_Depth > threshold {
+				conditions = append(conditions, Alert_Condition{
+					Subject: g.Gateway_Id,
+					Message: fmt.Sprintf("Gateway %s has %d queued messages, above %d, oldest queued %s ago",
+						g.Gateway_Id, g.Queue_Depth, threshold, time.Duration(g.Oldest_Queued_Age_Seconds)*time.Second),
+				})
+			} else if g.Backlog_Growing {
+				conditions = append(conditions, Alert_Condition{
+					Subject: g.Gateway_Id,
+					Message: fmt.Sprintf("Gateway %s backlog keeps growing: %v", g.Gateway_Id, g.Queue_Depth_Trend),
+				})
+			}
+		}
+
+	case rule_sink_failing:
+		threshold := rule.threshold_duration()
+		lags, err := outbox_lag()
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range lags {
+			age := time.Duration(l.Oldest_Pending_Age * float64(time.Second))
+			if age > threshold {
+				conditions = append(conditions, Alert_Condition{
+					Subject: l.Sink,
+					Message: fmt.Sprintf("Sink %s has %d pending messages, oldest %s old, last error: %s",
+						l.Sink, l.Pending, age.Round(time.Second), l.Last_Error),
+				})
+			}
+		}
+	}
+	return conditions, nil
+}
+
+// process reconciles the rule's firing alerts with its current conditions.
+func (e *AlertEngine) process(ctx context.Context, rule AlertRule, conditions []Alert_Condition, silences []Alert_Silence) error {
+	active, err := list_alerts(ctx, rule.Name, alert_firing, 0)
+	if err != nil {
+		return err
+	}
+	by_subject := map[string]Alert{}
+	for _, a := range active {
+		by_subject[a.Subject] = a
+	}
+	repeat := time.Duration(rule.RepeatInterval)
+
+	seen := map[string]bool{}
+	for _, c := range conditions {
+		seen[c.Subject] = true
+		a, exists := by_subject[c.Subject]
+		if !exists {
+			err := db.QueryRowContext(ctx, `
+				INSERT INTO alert (rule_name, subject, severity, message) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (rule_name, subject) WHERE state = 'firing' DO NOTHING
+				RETURNING id, started_at;`,
+				rule.Name, c.Subject, rule.Severity, c.Message).Scan(&a.Id, &a.Started_At)
+			if errors.Is(err, sql.ErrNoRows) {
+				// Fired concurrently, the insert that won notifies.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			alert_log.Warn("Alert firing", "rule", rule.Name, "subject", c.Subject, "severity", rule.Severity, "message", c.Message)
+			e.notify(ctx, rule, a, alert_firing, c.Message, silences)
+			continue
+		}
+
+		if _, err := db.ExecContext(ctx, `UPDATE alert SET message = $2 WHERE id = $1;`, a.Id, c.Message); err != nil {
+			return err
+		}
+		if notification_due(a, repeat, time.Now()) {
+			e.notify(ctx, rule, a, alert_firing, c.Message, silences)
+		}
+	}
+
+	for subject, a := range by_subject {
+		if seen[subject] {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE alert SET state = 'resolved', resolved_at = now() WHERE id = $1;`, a.Id); err != nil {
+			return err
+		}
+		alert_log.Info("Alert resolved", "rule", rule.Name, "subject", subject)
+		// Only tell people about a resolution if they heard about the alert.
+		if a.Notification_Count > 0 {
+			e.notify(ctx, rule, a, alert_resolved, a.Message, silences)
+		}
+	}
+	return nil
+}
+
+// notification_due reports whether a firing alert should be notified again.
+// An alert nobody heard about yet, because it was silenced or no channel
+// accepted it, is due right away.
+func notification_due(a Alert, repeat time.Duration, now time.Time) bool {
+	if a.Acknowledged_At != nil {
+		return false
+	}
+	if a.Last_Notified_At == nil {
+		return true
+	}
+	return repeat > 0 && now.Sub(*a.Last_Notified_At) >= repeat
+}
+
+// notify sends to every channel of the rule unless a silence matches, and
+// records the notification when at least one channel accepted it.
+func (e *AlertEngine) notify(ctx context.Context, rule AlertRule, a Alert, state string, message string, silences []Alert_Silence) {
+	for _, s := range silences {
+		if s.Matches(rule.Name, a.Subject) {
+			return
+		}
+	}
+
+	n := Notification{
+		Alert_Id:   a.Id,
+		Rule:       rule.Name,
+		Subject:    a.Subject,
+		Severity:   rule.Severity,
+		State:      state,
+		Message:    message,
+		Started_At: a.Started_At,
+		Sent_At:    time.Now(),
+	}
+	sent := false
+	for _, name := range rule.Channels {
+		ch := e.channels[name]
+		if !ch.Allow() {
+			alert_log.Warn("Channel rate limited, dropped notification", "channel", name, "rule", rule.Name, "subject", n.Subject)
+			continue
+		}
+		notify_ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := ch.Notify(notify_ctx, n)
+		cancel()
+		if err != nil {
+			alert_log.Warn("Channel failed", "channel", name, "rule", rule.Name, "err", err)
+			continue
+		}
+		sent = true
+	}
+	if sent {
+		_, err := db.ExecContext(ctx, `UPDATE alert SET last_notified_at = now(), notification_count = notification_count + 1 WHERE id = $1;`, a.Id)
+		if err != nil {
+			alert_log.Warn("Failed to record notification", "rule", rule.Name, "subject", a.Subject, "err", err)
+		}
+	}
+}
+
+// list_alerts returns alerts, optionally only those of one rule or state,
+// newest first. A limit of 0 returns all of them.
+func list_alerts(ctx context.Context, rule string, state string, limit int) ([]Alert, error) {
+	query := `
+		SELECT id, rule_name, subject, severity, state, message, started_at, resolved_at,
+			last_notified_at, notification_count, acknowledged_at, acknowledged_by
+		FROM alert
+		WHERE ($1 = '' OR rule_name = $1) AND ($2 = '' OR state = $2)
+		ORDER BY started_at DESC`
+	args := []any{rule, state}
+	if limit > 0 {
+		query += ` LIMIT $3`
+		args = append(args, limit)
+	}
+	rows, err := db.QueryContext(ctx, query+`;`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := []Alert{}
+	for rows.Next() {
+		var a Alert
+		if err := rows.Scan(&a.Id, &a.Rule_Name, &a.Subject, &a.Severity, &a.State, &a.Message, &a.Started_At,
+			&a.Resolved_At, &a.Last_Notified_At, &a.Notification_Count, &a.Acknowledged_At, &a.Acknowledged_By); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+func active_silences(ctx context.Context) ([]Alert_Silence, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, rule_name, subject, starts_at, ends_at, created_by, comment
+		FROM alert_silence WHERE starts_at <= now() AND ends_at > now()
+		ORDER BY ends_at;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	silences := []Alert_Silence{}
+	for rows.Next() {
+		var s Alert_Silence
+		if err := rows.Scan(&s.Id, &s.Rule_Name, &s.Subject, &s.Starts_At, &s.Ends_At, &s.Created_By, &s.Comment); err != nil {
+			return nil, err
+		}
+		silences = append(silences, s)
+	}
+	return silences, rows.Err()
+}
+
+// alertsHandler lists alerts. ?state=firing (default), resolved or all.
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "":
+		state = alert_firing
+	case "all":
+		state = ""
+	}
+	alerts, err := list_alerts(r.Context(), r.URL.Query().Get("rule"), state, 500)
+	if err != nil {
+		alert_log.Warn("Failed to query alerts", "err", err)
+		write_json_error(w, http.StatusInternalServerError, "Failed to query alerts")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+// alertAckHandler acknowledges a firing alert, which stops its repeats. It
+// needs an api_tokens token, whose name is recorded as acknowledging it.
+func alertAckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		write_json_error(w, http.StatusMethodNotAllowed, "Only POST method is supported")
+		return
+	}
+	actor, ok := require_admin(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Id int64
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Id == 0 {
+		write_json_error(w, http.StatusBadRequest, "Expected {\"Id\": <alert id>}")
+		return
+	}
+
+	res, err := db.ExecContext(r.Context(), `
+		UPDATE alert SET acknowledged_at = now(), acknowledged_by = $2
+		WHERE id = $1 AND state = 'firing' AND acknowledged_at IS NULL;`, body.Id, actor)
+	if err != nil {
+		record_audit(r, actor, "alert.ack", fmt.Sprintf("alert %d", body.Id), nil, nil, err)
+		alert_log.Warn("Failed to acknowledge alert", "err", err)
+		write_json_error(w, http.StatusInternalServerError, "Failed to acknowledge alert")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		write_json_error(w, http.StatusNotFound, "No unacknowledged firing alert with that id")
+		return
+	}
+	record_audit(r, actor, "alert.ack", fmt.Sprintf("alert %d", body.Id), nil, nil, nil)
+	alert_log.Info("Alert acknowledged", "id", body.Id, "by", actor)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status string
+	}{
+		Status: "OK",
+	})
+}
+
+// alertSilencesHandler lists active silences on GET, creates one on POST
+// and ends one early on DELETE ?id=. POST and DELETE need an api_tokens
+// token.
+func alertSilencesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	actor := ""
+	if r.Method == "POST" || r.Method == "DELETE" {
+		var ok bool
+		if actor, ok = require_admin(w, r); !ok {
+			return
+		}
+	}
+
+	switch r.Method {
+	case "GET":
+		enableCors(&w)
+		silences, err := active_silences(r.Context())
+		if err != nil {
+			alert_log.Warn("Failed to query silences", "err", err)
+			write_json_error(w, http.StatusInternalServerError, "Failed to query silences")
+			return
+		}
+		json.NewEncoder(w).Encode(silences)
+
+	case "POST":
+		var body struct {
+			Rule     string
+			Subject  string
+			Duration string
+			Comment  string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			write_json_error(w, http.StatusBadRequest, "Malformed silence")
+			return
+		}
+		duration, err := time.ParseDuration(body.Duration)
+		if err != nil || duration <= 0 {
+			write_json_error(w, http.StatusBadRequest, "Duration must be a positive duration such as 2h")
+			return
+		}
+		var s Alert_Silence
+		err = db.QueryRowContext(r.Context(), `
+			INSERT INTO alert_silence (rule_name, subject, ends_at, created_by, comment)
+			VALUES ($1, $2, now() + $3 * interval '1 second', $4, $5)
+			RETURNING id, rule_name, subject, starts_at, ends_at, created_by, comment;`,
+			body.Rule, body.Subject, duration.Seconds(), actor, body.Comment).
+			Scan(&s.Id, &s.Rule_Name, &s.Subject, &s.Starts_At, &s.Ends_At, &s.Created_By, &s.Comment)
+		record_audit(r, actor, "silence.create", fmt.Sprintf("silence %d", s.Id), nil,
+			map[string]any{"Rule": body.Rule, "Subject": body.Subject, "Duration": body.Duration, "Comment": body.Comment}, err)
+		if err != nil {
+			alert_log.Warn("Failed to create silence", "err", err)
+			write_json_error(w, http.StatusInternalServerError, "Failed to create silence")
+			return
+		}
+		alert_log.Info("Silence created", "id", s.Id, "rule", s.Rule_Name, "subject", s.Subject, "by", s.Created_By, "until", s.Ends_At)
+		json.NewEncoder(w).Encode(s)
+
+	case "DELETE":
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			write_json_error(w, http.StatusBadRequest, "Expected ?id=<silence id>")
+			return
+		}
+		// The end it had, for the audit log. Ending a silence that already
+		// ended is not an action.
+		var ends_at time.Time
+		err = db.QueryRowContext(r.Context(), `SELECT ends_at FROM alert_silence WHERE id = $1 AND ends_at > now();`, id).Scan(&ends_at)
+		if err == nil {
+			_, err = db.ExecContext(r.Context(), `UPDATE alert_silence SET ends_at = now() WHERE id = $1 AND ends_at > now();`, id)
+			record_audit(r, actor, "silence.end", fmt.Sprintf("silence %d", id),
+				map[string]any{"Ends_At": ends_at}, map[string]any{"Ends_At": time.Now()}, err)
+		} else if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+		if err != nil {
+			alert_log.Warn("Failed to end silence", "err", err)
+			write_json_error(w, http.StatusInternalServerError, "Failed to end silence")
+			return
+		}
+		json.NewEncoder(w).Encode(struct {
+			Status string
+		}{
+			Status: "OK",
+		})
+
+	default:
+		write_json_error(w, http.StatusMethodNotAllowed, "Only GET, POST and DELETE methods are supported")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// error_keys lists the keys of the problems that are errors.
+func error_keys(problems []Config_Problem) []string {
+	keys := []string{}
+	for _, p := range problems {
+		if !p.Warning {
+			keys = append(keys, p.Key)
+		}
+	}
+	return keys
+}
+
+func TestAlertRuleDefaults(t *testing.T) {
+	tests := []struct {
+		yaml      string
+		threshold string
+		lookback  time.Duration
+	}{
+		{"name: a\ntype: gateway_silent", "10m", 720 * time.Hour},
+		{"name: a\ntype: device_silent\nlookback: 48h", "6h", 48 * time.Hour},
+		{"name: a\ntype: backlog", "1000", 720 * time.Hour},
+		{"name: a\ntype: sink_failing\nthreshold: 1h", "1h", 720 * time.Hour},
+		{"name: a\ntype: unknown", "", 720 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.yaml, func(t *testing.T) {
+			var rule AlertRule
+			if err := yaml.Unmarshal([]byte(tt.yaml), &rule); err != nil {
+				t.Fatal(err)
+			}
+			if rule.Threshold != tt.threshold || time.Duration(rule.Lookback) != tt.lookback {
+				t.Errorf("got %q, %v, want %q, %v", rule.Threshold, time.Duration(rule.Lookback), tt.threshold, tt.lookback)
+			}
+		})
+	}
+}
+
+func TestAlertRuleThreshold(t *testing.T) {
+	tests := []struct {
+		threshold string
+		duration  time.Duration
+		count     int64
+	}{
+		{"10m", 10 * time.Minute, 0},
+		{"1000", 0, 1000},
+		{"", 0, 0},
+	}
+	for _, tt := range tests {
+		rule := AlertRule{Threshold: tt.threshold}
+		if d, n := rule.threshold_duration(), rule.threshold_count(); d != tt.duration || n != tt.count {
+			t.Errorf("threshold %q = %v, %d, want %v, %d", tt.threshold, d, n, tt.duration, tt.count)
+		}
+	}
+}
+
+func TestAlertSilenceMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		silence Alert_Silence
+		want    bool
+	}{
+		{"everything", Alert_Silence{}, true},
+		{"rule", Alert_Silence{Rule_Name: "gateway-down"}, true},
+		{"other rule", Alert_Silence{Rule_Name: "backlog"}, false},
+		{"subject", Alert_Silence{Subject: "spectra-gw-01"}, true},
+		{"other subject", Alert_Silence{Subject: "spectra-gw-02"}, false},
+		{"rule and subject", Alert_Silence{Rule_Name: "gateway-down", Subject: "spectra-gw-01"}, true},
+		{"rule and other subject", Alert_Silence{Rule_Name: "gateway-down", Subject: "spectra-gw-02"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.silence.Matches("gateway-down", "spectra-gw-01"); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotificationDue(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) *time.Time {
+		at := now.Add(-d)
+		return &at
+	}
+	tests := []struct {
+		name   string
+		alert  Alert
+		repeat time.Duration
+		want   bool
+	}{
+		{"never notified", Alert{}, time.Hour, true},
+		{"never notified without repeats", Alert{}, 0, true},
+		{"repeat due", Alert{Last_Notified_At: ago(2 * time.Hour)}, time.Hour, true},
+		{"repeat not due", Alert{Last_Notified_At: ago(time.Minute)}, time.Hour, false},
+		{"no repeats", Alert{Last_Notified_At: ago(2 * time.Hour)}, 0, false},
+		{"acknowledged", Alert{Last_Notified_At: ago(2 * time.Hour), Acknowledged_At: ago(time.Minute)}, time.Hour, false},
+		{"acknowledged before notified", Alert{Acknowledged_At: ago(time.Minute)}, time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := notification_due(tt.alert, tt.repeat, now); got != tt.want {
+				t.Errorf("notification_due() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAlerts(t *testing.T) {
+	webhook := AlertChannelConfig{Name: "ops", Type: "webhook", WebhookUrl: "https://hooks.example.com/ops"}
+	rule := func(name string, rule_type string, threshold string) AlertRule {
+		return AlertRule{Name: name, Type: rule_type, Threshold: threshold, Channels: []string{"ops"}}
+	}
+	tests := []struct {
+		name     string
+		channels []AlertChannelConfig
+		rules    []AlertRule
+		want     []string
+	}{
+		{"valid", []AlertChannelConfig{webhook}, []AlertRule{rule("down", rule_gateway_silent, "10m"), rule("backlog", rule_backlog, "500")}, []string{}},
+		{"duplicate channel", []AlertChannelConfig{webhook, webhook}, nil, []string{"alert_channels[1].name"}},
+		{"webhook without url", []AlertChannelConfig{{Name: "ops", Type: "webhook"}}, nil, []string{"alert_channels[0].webhook_url"}},
+		{"unknown channel type", []AlertChannelConfig{{Name: "ops", Type: "sms"}}, nil, []string{"alert_channels[0].type"}},
+		{"duplicate rule", []AlertChannelConfig{webhook}, []AlertRule{rule("down", rule_gateway_silent, "10m"), rule("down", rule_device_silent, "6h")}, []string{"alert_rules[1].name"}},
+		{"rule without name", []AlertChannelConfig{webhook}, []AlertRule{rule("", rule_gateway_silent, "10m")}, []string{"alert_rules[0].name"}},
+		{"count as duration", []AlertChannelConfig{webhook}, []AlertRule{rule("down", rule_gateway_silent, "10")}, []string{"alert_rules[0].threshold"}},
+		{"duration as count", []AlertChannelConfig{webhook}, []AlertRule{rule("backlog", rule_backlog, "10m")}, []string{"alert_rules[0].threshold"}},
+		{"unknown rule type", []AlertChannelConfig{webhook}, []AlertRule{rule("down", "cpu", "10m")}, []string{"alert_rules[0].type"}},
+		{"unknown rule channel", nil, []AlertRule{rule("down", rule_gateway_silent, "10m")}, []string{"alert_rules[0].channels"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &config_validator{lines: map[string]int{}}
+			v.validate_alerts(&AppConfig{AlertChannels: tt.channels, AlertRules: tt.rules})
+			if got := error_keys(v.problems); !slices.Equal(got, tt.want) {
+				t.Errorf("errors at %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var audit_log = component_logger("audit")
+
+// Outcomes of an audited action.
+const (
+	audit_ok     = "ok"
+	audit_failed = "failed"
+)
+
+// Audit_Entry is one row of audit_log. Before and After are null when the
+// action has nothing to show.
+type Audit_Entry struct {
+	Id      int64
+	Time    time.Time
+	Actor   string
+	Source  string
+	Action  string
+	Target  string
+	Before  json.RawMessage
+	After   json.RawMessage
+	Outcome string
+	Error   string
+}
+
+// record_audit appends an entry for an action asked for in r. actor is the
+// api_tokens name r authenticated with, never a name the caller gave. An
+// action that happened is not undone when its entry cannot be written, that
+// only gets logged.
+func record_audit(r *http.Request, actor string, action string, target string, before any, after any, action_err error) {
+	e := Audit_Entry{
+		Actor:   actor,
+		Source:  request_ip(r),
+		Action:  action,
+		Target:  target,
+		Before:  audit_json(before),
+		After:   audit_json(after),
+		Outcome: audit_ok,
+	}
+	if action_err != nil {
+		e.Outcome = audit_failed
+		e.Error = action_err.Error()
+	}
+	// Recorded even when the client has gone away.
+	_, err := db.ExecContext(context.Background(), `
+		INSERT INTO audit_log (actor, source, action, target, before, after, outcome, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`,
+		e.Actor, e.Source, e.Action, e.Target, nullable_json(e.Before), nullable_json(e.After), e.Outcome, e.Error)
+	if err != nil {
+		audit_log.Error("Failed to record audit entry", "actor", actor, "action", action, "target", target, "err", err)
+	}
+}
+
+func request_ip(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func audit_json(v any) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return b
+}
+
+func nullable_json(b json.RawMessage) any {
+	if b == nil {
+		return nil
+	}
+	return []byte(b)
+}
+
+// Audit_Query filters the audit log. Actor matches exactly, Action too or
+// as a prefix when it ends in a dot, such as "command.".
+type Audit_Query struct {
+	Actor  string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+const (
+	audit_default_limit = 100
+	audit_max_limit     = 100000
+)
+
+func parse_audit_query(r *http.Request) (Audit_Query, error) {
+	query := r.URL.Query()
+	q := Audit_Query{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Limit:  audit_default_limit,
+	}
+	var err error
+	if s := query.Get("since"); s != "" {
+		if q.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, fmt.Errorf("since must be an RFC 3339 time such as 2024-01-02T15:04:05Z")
+		}
+	}
+	if s := query.Get("until"); s != "" {
+		if q.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, fmt.Errorf("until must be an RFC 3339 time such as 2024-01-02T15:04:05Z")
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 1 || q.Limit > audit_max_limit {
+			return q, fmt.Errorf("limit must be between 1 and %d", audit_max_limit)
+		}
+	}
+	return q, nil
+}
+
+// list_audit reads the matching entries, newest first.
+func list_audit(ctx context.Context, q Audit_Query) ([]Audit_Entry, error) {
+	action, prefix := q.Action, strings.HasSuffix(q.Action, ".")
+	var since, until *time.Time
+	if !q.Since.IsZero() {
+		since = &q.Since
+	}
+	if !q.Until.IsZero() {
+		until = &q.Until
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, time, actor, source, action, target, before, after, outcome, error
+		FROM audit_log
+		WHERE ($1 = '' OR actor = $1)
+			AND ($2 = '' OR action = $2 OR ($3 AND starts_with(action, $2)))
+			AND ($4::timestamptz IS NULL OR time >= $4)
+			AND ($5::timestamptz IS NULL OR time < $5)
+		ORDER BY id DESC LIMIT $6;`,
+		q.Actor, action, prefix, since, until, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []Audit_Entry{}
+	for rows.Next() {
+		var e Audit_Entry
+		var before, after []byte
+		if err := rows.Scan(&e.Id, &e.Time, &e.Actor, &e.Source, &e.Action, &e.Target, &before, &after, &e.Outcome, &e.Error); err != nil {
+			return nil, err
+		}
+		e.Before, e.After = before, after
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// auditHandler lists the audit log on GET, filtered by ?actor=, ?action=,
+// ?since= and ?until= (RFC 3339) and at most ?limit= entries. ?format= is
+// json, the default, or csv and ndjson to export it. It needs an api_tokens
+// token.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := require_admin(w, r); !ok {
+		return
+	}
+	if r.Method != "GET" {
+		write_json_error(w, http.StatusMethodNotAllowed, "Only GET method is supported")
+		return
+	}
+	q, err := parse_audit_query(r)
+	if err != nil {
+		write_json_error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" && format != "ndjson" {
+		write_json_error(w, http.StatusBadRequest, "format must be one of json, csv, ndjson")
+		return
+	}
+	entries, err := list_audit(r.Context(), q)
+	if err != nil {
+		audit_log.Warn("Failed to query audit log", "err", err)
+		write_json_error(w, http.StatusInternalServerError, "Failed to query audit log")
+		return
+	}
+
+	filename := "audit-" + time.Now().UTC().Format("20060102-1504")
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "time", "actor", "source", "action", "target", "before", "after", "outcome", "error"})
+		for _, e := range entries {
+			cw.Write([]string{strconv.FormatInt(e.Id, 10), e.Time.UTC().Format(time.RFC3339), e.Actor, e.Source, e.Action,
+				e.Target, string(e.Before), string(e.After), e.Outcome, e.Error})
+		}
+		cw.Flush()
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.ndjson"`)
+		enc := json.NewEncoder(w)
+		for _, e := range entries {
+			enc.Encode(e)
+		}
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditJson(t *testing.T) {
+	tests := []struct {
+		name     string
+		v        any
+		want     string
+		nullable bool
+	}{
+		{"nil", nil, "", true},
+		{"map", map[string]any{"gateway_id": "spectra-gw-01", "ttl": 3600}, `{"gateway_id":"spectra-gw-01","ttl":3600}`, false},
+		{"raw json", json.RawMessage(`{"Type":"restart"}`), `{"Type":"restart"}`, false},
+		{"not json", math.NaN(), `"NaN"`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := audit_json(tt.v)
+			if string(got) != tt.want {
+				t.Errorf("audit_json() = %s, want %s", got, tt.want)
+			}
+			if null := nullable_json(got) == nil; null != tt.nullable {
+				t.Errorf("nullable_json() is nil %v, want %v", null, tt.nullable)
+			}
+		})
+	}
+}
+
+func TestRequestIp(t *testing.T) {
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{"192.0.2.10:51234", "192.0.2.10"},
+		{"[2001:db8::1]:51234", "2001:db8::1"},
+		{"192.0.2.10", "192.0.2.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remote, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/cache-sync/audit", nil)
+			r.RemoteAddr = tt.remote
+			if got := request_ip(r); got != tt.want {
+				t.Errorf("request_ip() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAuditQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    Audit_Query
+		wantErr string
+	}{
+		{"defaults", "", Audit_Query{Limit: audit_default_limit}, ""},
+		{"filters", "actor=ops&action=command.&since=2025-01-31T13:45:00Z&until=2025-02-01T00:00:00%2B08:00&limit=500",
+			Audit_Query{Actor: "ops", Action: "command.", Since: time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC),
+				Until: time.Date(2025, 1, 31, 16, 0, 0, 0, time.UTC), Limit: 500}, ""},
+		{"since without zone", "since=2025-01-31T13:45", Audit_Query{}, "since must be an RFC 3339 time"},
+		{"bad until", "until=tomorrow", Audit_Query{}, "until must be an RFC 3339 time"},
+		{"limit zero", "limit=0", Audit_Query{}, "limit must be between 1 and 100000"},
+		{"limit too large", "limit=100001", Audit_Query{}, "limit must be between 1 and 100000"},
+		{"limit not a number", "limit=all", Audit_Query{}, "limit must be between 1 and 100000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parse_audit_query(httptest.NewRequest(http.MethodGet, "/cache-sync/audit?"+tt.query, nil))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parse_audit_query() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Actor != tt.want.Actor || got.Action != tt.want.Action || !got.Since.Equal(tt.want.Since) ||
+				!got.Until.Equal(tt.want.Until) || got.Limit != tt.want.Limit {
+				t.Errorf("parse_audit_query() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAuditHandlerRejects covers the answers given before the audit log is
+// read.
+func TestAuditHandlerRejects(t *testing.T) {
+	test_config(t, &AppConfig{ApiTokens: map[string]Secret{"ops": "7f3c9e2a51d84b06"}})
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		token  string
+		status int
+		error  string
+	}{
+		{"no token", http.MethodGet, "/cache-sync/audit", "", http.StatusUnauthorized, "An api_tokens bearer token is required"},
+		{"gateway token", http.MethodGet, "/cache-sync/audit", "0b1d2c3e4f5a6b7c", http.StatusUnauthorized, "An api_tokens bearer token is required"},
+		{"post", http.MethodPost, "/cache-sync/audit", "7f3c9e2a51d84b06", http.StatusMethodNotAllowed, "Only GET method is supported"},
+		{"bad since", http.MethodGet, "/cache-sync/audit?since=yesterday", "7f3c9e2a51d84b06", http.StatusBadRequest,
+			"since must be an RFC 3339 time such as 2024-01-02T15:04:05Z"},
+		{"bad limit", http.MethodGet, "/cache-sync/audit?limit=-5", "7f3c9e2a51d84b06", http.StatusBadRequest, "limit must be between 1 and 100000"},
+		{"bad format", http.MethodGet, "/cache-sync/audit?format=xlsx", "7f3c9e2a51d84b06", http.StatusBadRequest,
+			"format must be one of json, csv, ndjson"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.url, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			auditHandler(w, r)
+			var body map[string]string
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if w.Code != tt.status || !reflect.DeepEqual(body, map[string]string{"error": tt.error}) {
+				t.Errorf("status %d, body %s, want %d, %q", w.Code, w.Body.String(), tt.status, tt.error)
+			}
+		})
+	}
+}
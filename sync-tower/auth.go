@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+var auth_log = component_logger("auth")
+
+// bearer_token is the token of an "Authorization: Bearer" header.
+func bearer_token(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func token_equal(given string, want Secret) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(given), []byte(want)) == 1
+}
+
+// api_token_name returns the name api_tokens gives the token of r. The name
+// is the actor of everything done with it.
+func api_token_name(appConfig *AppConfig, r *http.Request) (string, bool) {
+	token := bearer_token(r)
+	if token == "" {
+		return "", false
+	}
+	for name, want := range appConfig.ApiTokens {
+		if token_equal(token, want) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// require_admin answers 401 unless r carries one of api_tokens, and returns
+// the name of the token.
+func require_admin(w http.ResponseWriter, r *http.Request) (actor string, ok bool) {
+	actor, ok = api_token_name(current_config(), r)
+	if !ok {
+		auth_log.Warn("Rejected unauthenticated request", "path", r.URL.Path, "source", request_ip(r))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sync-tower"`)
+		write_json_error(w, http.StatusUnauthorized, "An api_tokens bearer token is required")
+	}
+	return actor, ok
+}
+
+// gateway_authenticated reports whether r carries the gateway_tokens entry
+// of gateway_id. A gateway without one cannot authenticate at all.
+func gateway_authenticated(appConfig *AppConfig, r *http.Request, gateway_id string) bool {
+	return gateway_id != "" && token_equal(bearer_token(r), appConfig.GatewayTokens[gateway_id])
+}
+
+// require_gateway answers 401 unless r carries the token of gateway_id.
+func require_gateway(w http.ResponseWriter, r *http.Request, gateway_id string) bool {
+	if gateway_authenticated(current_config(), r, gateway_id) {
+		return true
+	}
+	auth_log.Warn("Rejected unauthenticated gateway", "path", r.URL.Path, "gateway_id", gateway_id, "source", request_ip(r))
+	w.Header().Set("WWW-Authenticate", `Bearer realm="sync-tower"`)
+	write_json_error(w, http.StatusUnauthorized, "The gateway_tokens bearer token of the gateway is required")
+	return false
+}
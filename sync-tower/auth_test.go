@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"Bearer 7f3c9e2a51d84b06", "7f3c9e2a51d84b06"},
+		{"Bearer  7f3c9e2a51d84b06 ", "7f3c9e2a51d84b06"},
+		{"Basic b3BzOnNlY3JldA==", ""},
+		{"bearer 7f3c9e2a51d84b06", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", tt.header)
+		if got := bearer_token(r); got != tt.want {
+			t.Errorf("bearer_token(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestTokens(t *testing.T) {
+	appConfig := &AppConfig{
+		ApiTokens:     map[string]Secret{"ops": "7f3c9e2a51d84b06", "ci": "0b1d2c3e4f5a6b7c"},
+		GatewayTokens: map[string]Secret{"spectra-gw-01": "4e81b0d9c27a6f35", "spectra-gw-02": ""},
+	}
+	tests := []struct {
+		name       string
+		token      string
+		gateway_id string
+		api_name   string
+		gateway    bool
+	}{
+		{"api token", "7f3c9e2a51d84b06", "spectra-gw-01", "ops", false},
+		{"other api token", "0b1d2c3e4f5a6b7c", "", "ci", false},
+		{"gateway token", "4e81b0d9c27a6f35", "spectra-gw-01", "", true},
+		{"token of another gateway", "4e81b0d9c27a6f35", "spectra-gw-03", "", false},
+		{"gateway without token", "", "spectra-gw-02", "", false},
+		{"no token", "", "spectra-gw-01", "", false},
+		{"wrong token", "7f3c9e2a51d84b07", "spectra-gw-01", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			name, ok := api_token_name(appConfig, r)
+			if name != tt.api_name || ok != (tt.api_name != "") {
+				t.Errorf("api_token_name() = %q, %v, want %q", name, ok, tt.api_name)
+			}
+			if got := gateway_authenticated(appConfig, r, tt.gateway_id); got != tt.gateway {
+				t.Errorf("gateway_authenticated() = %v, want %v", got, tt.gateway)
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	test_config(t, &AppConfig{ApiTokens: map[string]Secret{"ops": "7f3c9e2a51d84b06"}})
+	tests := []struct {
+		name  string
+		token string
+		actor string
+		code  int
+	}{
+		{"authorized", "7f3c9e2a51d84b06", "ops", http.StatusOK},
+		{"unauthorized", "wrong", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/cache-sync/audit", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			actor, ok := require_admin(w, r)
+			if actor != tt.actor || ok != (tt.code == http.StatusOK) || w.Code != tt.code {
+				t.Errorf("require_admin() = %q, %v, status %d, want %q, status %d", actor, ok, w.Code, tt.actor, tt.code)
+			}
+			if !ok && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate")
+			}
+		})
+	}
+}
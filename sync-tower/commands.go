@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var command_log = component_logger("command")
+
+// Command types understood by edge-vault.
+const (
+	command_downlink = "downlink"
+	command_purge    = "purge"
+	command_resync   = "resync"
+	// Fetch the latest gateway_config version now instead of on the next poll.
+	command_reconfigure = "reconfigure"
+)
+
+// Command states. A delivered command that is not acknowledged within
+// command_ack_timeout is delivered again, up to command_max_deliveries
+// times. edge-vault remembers which commands it already executed.
+const (
+	command_pending   = "pending"
+	command_delivered = "delivered"
+	command_succeeded = "succeeded"
+	command_failed    = "failed"
+	command_expired   = "expired"
+)
+
+const command_ack_timeout = 5 * time.Minute
+
+// A command delivered this often without an acknowledgement fails, such as
+// on a gateway without a command_endpoint to acknowledge it on.
+const command_max_deliveries = 5
+
+// The topic edge-vault publishes a downlink on is built from these, so they
+// must not carry MQTT separators or wildcards.
+var (
+	dev_eui_pattern        = regexp.MustCompile(`^[0-9a-fA-F]{16}$`)
+	application_id_pattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+type Command struct {
+	Id           int64
+	Gateway_Id   string
+	Type         string
+	Payload      json.RawMessage
+	Status       string
+	Attempts     int
+	Result       string
+	Created_By   string
+	Created_At   time.Time
+	Expires_At   *time.Time
+	Delivered_At *time.Time
+	Completed_At *time.Time
+}
+
+// Downlink is the payload of a downlink command, published by edge-vault on
+// application/{Application}/device/{Dev_Eui}/command/down.
+type Downlink struct {
+	Application string
+	Dev_Eui     string
+	FPort       int
+	Data        string // base64
+	Confirmed   bool
+}
+
+// Purge is the payload of a purge command. Without Older_Than_Seconds the
+// whole upload queue is dropped.
+type Purge struct {
+	Older_Than_Seconds int64
+}
+
+// command_waiters wakes long-polling gateways when a command is queued for
+// them on this instance. Pollers also re-check periodically, so commands
+// queued through another instance are picked up too.
+var command_waiters = struct {
+	sync.Mutex
+	m map[string]chan bool
+}{m: map[string]chan bool{}}
+
+func command_waiter(gateway_id string) chan bool {
+	command_waiters.Lock()
+	defer command_waiters.Unlock()
+	ch, ok := command_waiters.m[gateway_id]
+	if !ok {
+		ch = make(chan bool, 1)
+		command_waiters.m[gateway_id] = ch
+	}
+	return ch
+}
+
+func wake_gateway(gateway_id string) {
+	select {
+	case command_waiter(gateway_id) <- true:
+	default:
+	}
+}
+
+func validate_command(c *Command) error {
+	if c.Gateway_Id == "" {
+		return fmt.Errorf("Gateway_Id is required")
+	}
+	if len(c.Payload) == 0 {
+		c.Payload = json.RawMessage(`{}`)
+	}
+	switch c.Type {
+	case command_downlink:
+		var d Downlink
+		if err := json.Unmarshal(c.Payload, &d); err != nil {
+			return fmt.Errorf("malformed downlink payload: %w", err)
+		}
+		if !application_id_pattern.MatchString(d.Application) {
+			return fmt.Errorf("downlink Application must be a ChirpStack application id (UUID)")
+		}
+		if !dev_eui_pattern.MatchString(d.Dev_Eui) {
+			return fmt.Errorf("downlink Dev_Eui must be 16 hex characters")
+		}
+		if d.FPort < 1 || d.FPort > 223 {
+			return fmt.Errorf("downlink FPort must be between 1 and 223")
+		}
+		if _, err := base64.StdEncoding.DecodeString(d.Data); err != nil {
+			return fmt.Errorf("downlink Data must be base64: %w", err)
+		}
+	case command_purge:
+		var p Purge
+		if err := json.Unmarshal(c.Payload, &p); err != nil {
+			return fmt.Errorf("malformed purge payload: %w", err)
+		}
+	case command_resync, command_reconfigure:
+	default:
+		return fmt.Errorf("unknown command type %q", c.Type)
+	}
+	return nil
+}
+
+func create_command(ctx context.Context, c Command, ttl time.Duration) (Command, error) {
+	var expires_at *time.Time
+	if ttl > 0 {
+		t := time.Now().Add(ttl)
+		expires_at = &t
+	}
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO gateway_command (gateway_id, type, payload, created_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, status, created_at, expires_at;`,
+		c.Gateway_Id, c.Type, []byte(c.Payload), c.Created_By, expires_at).
+		Scan(&c.Id, &c.Status, &c.Created_At, &c.Expires_At)
+	if err != nil {
+		return c, err
+	}
+	wake_gateway(c.Gateway_Id)
+	return c, nil
+}
+
+const command_columns = `id, gateway_id, type, payload, status, attempts, result, created_by, created_at,
+	expires_at, delivered_at, completed_at`
+
+func scan_commands(rows interface {
+	Next() bool
+	Scan(...any) error
+	Err() error
+}) ([]Command, error) {
+	commands := []Command{}
+	for rows.Next() {
+		var c Command
+		var payload []byte
+		if err := rows.Scan(&c.Id, &c.Gateway_Id, &c.Type, &payload, &c.Status, &c.Attempts, &c.Result, &c.Created_By,
+			&c.Created_At, &c.Expires_At, &c.Delivered_At, &c.Completed_At); err != nil {
+			return nil, err
+		}
+		c.Payload = payload
+		commands = append(commands, c)
+	}
+	return commands, rows.Err()
+}
+
+// claim_commands marks the gateway's due commands delivered and returns them,
+// expiring those past their deadline first and failing those delivered
+// command_max_deliveries times without an acknowledgement.
+func claim_commands(ctx context.Context, gateway_id string, limit int) ([]Command, error) {
+	_, err := db.ExecContext(ctx, `
+		UPDATE gateway_command SET status = 'expired', completed_at = now()
+		WHERE gateway_id = $1 AND status IN ('pending', 'delivered') AND expires_at < now();`, gateway_id)
+	if err != nil {
+		return nil, err
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE gateway_command SET status = 'failed', completed_at = now(),
+			result = 'not acknowledged after ' || attempts || ' deliveries'
+		WHERE gateway_id = $1 AND status = 'delivered' AND attempts >= $2
+			AND delivered_at < now() - $3 * interval '1 second';`,
+		gateway_id, command_max_deliveries, command_ack_timeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		command_log.Warn("Gave up on unacknowledged commands", "gateway_id", gateway_id, "commands", n, "outcome", command_failed)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		UPDATE gateway_command SET status = 'delivered', delivered_at = now(), attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM gateway_command
+			WHERE gateway_id = $1
+				AND (status = 'pending' OR (status = 'delivered' AND delivered_at < now() - $2 * interval '1 second'))
+			ORDER BY id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+command_columns+`;`,
+		gateway_id, command_ack_timeout.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	commands, err := scan_commands(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range commands {
+		command_log.Info("Delivering command", "id", c.Id, "type", c.Type, "gateway_id", gateway_id, "attempt", c.Attempts)
+	}
+	return commands, nil
+}
+
+func list_commands(ctx context.Context, gateway_id string, status string, limit int) ([]Command, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+command_columns+`
+		FROM gateway_command
+		WHERE ($1 = '' OR gateway_id = $1) AND ($2 = '' OR status = $2)
+		ORDER BY id DESC LIMIT $3;`, gateway_id, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scan_commands(rows)
+}
+
+// commandsHandler lists commands on GET (?gateway_id=, ?status=) and queues
+// one on POST. Ttl is an optional duration after which an undelivered
+// command expires. Both need an api_tokens token.
+func commandsHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := require_admin(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		commands, err := list_commands(r.Context(), r.URL.Query().Get("gateway_id"), r.URL.Query().Get("status"), 500)
+		if err != nil {
+			command_log.Warn("Failed to query commands", "err", err)
+			write_json_error(w, http.StatusInternalServerError, "Failed to query commands")
+			return
+		}
+		json.NewEncoder(w).Encode(commands)
+
+	case "POST":
+		var body struct {
+			Gateway_Id string
+			Type       string
+			Payload    json.RawMessage
+			Ttl        string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			write_json_error(w, http.StatusBadRequest, "Malformed command")
+			return
+		}
+		c := Command{Gateway_Id: body.Gateway_Id, Type: body.Type, Payload: body.Payload, Created_By: actor}
+		if err := validate_command(&c); err != nil {
+			write_json_error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var ttl time.Duration
+		if body.Ttl != "" {
+			var err error
+			if ttl, err = time.ParseDuration(body.Ttl); err != nil || ttl <= 0 {
+				write_json_error(w, http.StatusBadRequest, "Ttl must be a positive duration such as 1h")
+				return
+			}
+		}
+		c, err := create_command(r.Context(), c, ttl)
+		record_audit(r, c.Created_By, "command."+c.Type, c.Gateway_Id, nil, map[string]any{"Id": c.Id, "Payload": c.Payload, "Ttl": body.Ttl}, err)
+		if err != nil {
+			command_log.Warn("Failed to queue command", "err", err)
+			write_json_error(w, http.StatusInternalServerError, "Failed to queue command")
+			return
+		}
+		command_log.Info("Queued command", "id", c.Id, "type", c.Type, "gateway_id", c.Gateway_Id, "by", c.Created_By)
+		json.NewEncoder(w).Encode(c)
+
+	default:
+		write_json_error(w, http.StatusMethodNotAllowed, "Only GET and POST methods are supported")
+	}
+}
+
+// commandPollHandler holds the request open for up to ?wait= (default 30s,
+// at most 5m) until a command is due for ?gateway_id=, which must send its
+// gateway_tokens token.
+func commandPollHandler(w http.ResponseWriter, r *http.Request) {
+	gateway_id := r.URL.Query().Get("gateway_id")
+	if gateway_id == "" {
+		write_json_error(w, http.StatusBadRequest, "Expected ?gateway_id=")
+		return
+	}
+	if !require_gateway(w, r, gateway_id) {
+		return
+	}
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil || wait <= 0 {
+		wait = 30 * time.Second
+	}
+	wait = min(wait, 5*time.Minute)
+
+	// The server write timeout is shorter than a long-poll.
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 10*time.Second))
+
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	recheck := time.NewTicker(5 * time.Second)
+	defer recheck.Stop()
+	waiter := command_waiter(gateway_id)
+	for {
+		commands, err := claim_commands(r.Context(), gateway_id, 20)
+		if err != nil {
+			command_log.Warn("Failed to claim commands", "err", err)
+			write_json_error(w, http.StatusInternalServerError, "Failed to claim commands")
+			return
+		}
+		if len(commands) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(commands)
+			return
+		}
+		select {
+		case <-waiter:
+		case <-recheck.C:
+		case <-deadline.C:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(commands)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// commandAckHandler records the result edge-vault reports for a command.
+func commandAckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		write_json_error(w, http.StatusMethodNotAllowed, "Only POST method is supported")
+		return
+	}
+	var body struct {
+		Id         int64
+		Gateway_Id string
+		Success    bool
+		Result     string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Id == 0 || body.Gateway_Id == "" {
+		write_json_error(w, http.StatusBadRequest, "Malformed acknowledgement")
+		return
+	}
+	if !require_gateway(w, r, body.Gateway_Id) {
+		return
+	}
+
+	status := command_failed
+	if body.Success {
+		status = command_succeeded
+	}
+	res, err := db.ExecContext(r.Context(), `
+		UPDATE gateway_command SET status = $3, result = $4, completed_at = now()
+		WHERE id = $1 AND gateway_id = $2 AND status IN ('pending', 'delivered');`,
+		body.Id, body.Gateway_Id, status, body.Result)
+	if err != nil {
+		command_log.Warn("Failed to record acknowledgement", "err", err)
+		write_json_error(w, http.StatusInternalServerError, "Failed to record acknowledgement")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Already acknowledged or expired, still a 200 so edge-vault stops retrying.
+		command_log.Info("Ignored repeated acknowledgement", "id", body.Id, "gateway_id", body.Gateway_Id)
+	} else {
+		command_log.Info("Command acknowledged", "id", body.Id, "gateway_id", body.Gateway_Id, "outcome", status, "result", body.Result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status string
+	}{
+		Status: "OK",
+	})
+}
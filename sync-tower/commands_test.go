@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// test_config makes appConfig the running config for the test.
+func test_config(t *testing.T, appConfig *AppConfig) {
+	prev := app_config.Load()
+	app_config.Store(appConfig)
+	t.Cleanup(func() { app_config.Store(prev) })
+}
+
+func TestValidateCommand(t *testing.T) {
+	downlink := func(payload string) Command {
+		return Command{Gateway_Id: "spectra-gw-01", Type: command_downlink, Payload: json.RawMessage(payload)}
+	}
+	tests := []struct {
+		name    string
+		command Command
+		wantErr string
+	}{
+		{"downlink", downlink(`{"Application":"5f0c6a4e-8a52-4c8e-9d6c-0f7d3b2a1e90","Dev_Eui":"0004A30B001C0530","FPort":10,"Data":"AQI="}`), ""},
+		{"application not a uuid", downlink(`{"Application":"app/+/#","Dev_Eui":"0004a30b001c0530","FPort":10,"Data":"AQI="}`), "Application"},
+		{"dev_eui with topic separator", downlink(`{"Application":"5f0c6a4e-8a52-4c8e-9d6c-0f7d3b2a1e90","Dev_Eui":"0004a30b/01c0530","FPort":10,"Data":"AQI="}`), "Dev_Eui"},
+		{"dev_eui too short", downlink(`{"Application":"5f0c6a4e-8a52-4c8e-9d6c-0f7d3b2a1e90","Dev_Eui":"0004a30b","FPort":10,"Data":"AQI="}`), "Dev_Eui"},
+		{"fport out of range", downlink(`{"Application":"5f0c6a4e-8a52-4c8e-9d6c-0f7d3b2a1e90","Dev_Eui":"0004a30b001c0530","FPort":224,"Data":"AQI="}`), "FPort"},
+		{"data not base64", downlink(`{"Application":"5f0c6a4e-8a52-4c8e-9d6c-0f7d3b2a1e90","Dev_Eui":"0004a30b001c0530","FPort":10,"Data":"%%"}`), "Data"},
+		{"malformed downlink", downlink(`[1]`), "malformed"},
+		{"purge", Command{Gateway_Id: "spectra-gw-01", Type: command_purge, Payload: json.RawMessage(`{"Older_Than_Seconds":3600}`)}, ""},
+		{"purge without payload", Command{Gateway_Id: "spectra-gw-01", Type: command_purge}, ""},
+		{"resync", Command{Gateway_Id: "spectra-gw-01", Type: command_resync}, ""},
+		{"reconfigure", Command{Gateway_Id: "spectra-gw-01", Type: command_reconfigure}, ""},
+		{"no gateway", Command{Type: command_resync}, "Gateway_Id"},
+		{"unknown type", Command{Gateway_Id: "spectra-gw-01", Type: "reboot"}, "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate_command(&tt.command)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validate_command() = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validate_command() = %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCommandHandlersRequireTokens(t *testing.T) {
+	test_config(t, &AppConfig{
+		ApiTokens:     map[string]Secret{"ops": "7f3c9e2a51d84b06"},
+		GatewayTokens: map[string]Secret{"spectra-gw-01": "4e81b0d9c27a6f35"},
+	})
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		token   string
+		code    int
+	}{
+		{"queue without token", commandsHandler, http.MethodPost, "/cache-sync/commands", `{}`, "", http.StatusUnauthorized},
+		{"queue with gateway token", commandsHandler, http.MethodPost, "/cache-sync/commands", `{}`, "4e81b0d9c27a6f35", http.StatusUnauthorized},
+		{"queue invalid command", commandsHandler, http.MethodPost, "/cache-sync/commands", `{"Gateway_Id":"spectra-gw-01","Type":"reboot"}`, "7f3c9e2a51d84b06", http.StatusBadRequest},
+		{"poll without gateway", commandPollHandler, http.MethodGet, "/cache-sync/commands/poll", "", "4e81b0d9c27a6f35", http.StatusBadRequest},
+		{"poll without token", commandPollHandler, http.MethodGet, "/cache-sync/commands/poll?gateway_id=spectra-gw-01", "", "", http.StatusUnauthorized},
+		{"poll with api token", commandPollHandler, http.MethodGet, "/cache-sync/commands/poll?gateway_id=spectra-gw-01", "", "7f3c9e2a51d84b06", http.StatusUnauthorized},
+		{"poll unknown gateway", commandPollHandler, http.MethodGet, "/cache-sync/commands/poll?gateway_id=spectra-gw-02", "", "4e81b0d9c27a6f35", http.StatusUnauthorized},
+		{"ack without token", commandAckHandler, http.MethodPost, "/cache-sync/commands/ack", `{"Id":1,"Gateway_Id":"spectra-gw-01"}`, "", http.StatusUnauthorized},
+		{"ack malformed", commandAckHandler, http.MethodPost, "/cache-sync/commands/ack", `{"Id":1}`, "4e81b0d9c27a6f35", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != tt.code {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+		})
+	}
+}
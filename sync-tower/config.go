@@ -0,0 +1,685 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AppConfig is one environment of config.yaml. The comment on a field is
+// its default, see DefaultConfig.
+type AppConfig struct {
+	ListenAddress string `yaml:"listen_address"` // "", all interfaces
+	ListenPort    int    `yaml:"listen_port"`    // 8899
+	UplinkPath    string `yaml:"uplink_path"`    // /cache-sync/uplink
+	HeartbeatPath string `yaml:"heartbeat_path"` // /cache-sync/heartbeat
+	DatabaseUrl   Secret `yaml:"database_url"`   // required
+	ConfigWatch   Bool   `yaml:"config_watch"`   // n
+
+	// Bearer tokens of the admin API by name, the name is recorded as the
+	// actor. Without any the admin API refuses every request.
+	ApiTokens map[string]Secret `yaml:"api_tokens"`
+	// Bearer token of each gateway_id, for its heartbeats, commands and
+	// remote config.
+	GatewayTokens map[string]Secret `yaml:"gateway_tokens"`
+
+	LogFormat string           `yaml:"log_format"` // text, or json
+	LogLevel  Level            `yaml:"log_level"`  // info
+	LogLevels map[string]Level `yaml:"log_levels"` // per component, e.g. sink: debug
+
+	InfluxdbEnable        Bool     `yaml:"influxdb_enable"` // n
+	InfluxdbVersion       int      `yaml:"influxdb_version"`
+	InfluxdbUrl           string   `yaml:"influxdb_url"`
+	InfluxdbToken         Secret   `yaml:"influxdb_token"`
+	InfluxdbOrg           string   `yaml:"influxdb_org"`
+	InfluxdbBucket        string   `yaml:"influxdb_bucket"`
+	InfluxdbMeasurement   string   `yaml:"influxdb_measurement"`
+	InfluxdbBatchSize     int      `yaml:"influxdb_batch_size"`     // 500
+	InfluxdbFlushInterval Duration `yaml:"influxdb_flush_interval"` // 1s
+	InfluxdbBufferSize    int      `yaml:"influxdb_buffer_size"`    // 10000
+	InfluxdbMaxRetries    int      `yaml:"influxdb_max_retries"`    // 3
+	InfluxdbSpillDir      string   `yaml:"influxdb_spill_dir"`      // influx_spill
+
+	Sinks               []SinkConfig `yaml:"sinks"`                 // postgres, plus influxdb when influxdb_enable
+	OutboxPollInterval  Duration     `yaml:"outbox_poll_interval"`  // 5s
+	OutboxBatchSize     int          `yaml:"outbox_batch_size"`     // 100
+	OutboxRetentionDays int          `yaml:"outbox_retention_days"` // 0, keep forever
+
+	PartitionInterval   string   `yaml:"partition_interval"`   // "", not partitioned
+	PartitionPremake    int      `yaml:"partition_premake"`    // 3
+	RetentionDays       int      `yaml:"retention_days"`       // 0, keep forever
+	RetentionAction     string   `yaml:"retention_action"`     // drop
+	ArchiveDir          string   `yaml:"archive_dir"`          // archive
+	AuditRetentionDays  int      `yaml:"audit_retention_days"` // 365, 0 keeps forever
+	MaintenanceInterval Duration `yaml:"maintenance_interval"` // 1h
+
+	HealthTargets []HealthTarget `yaml:"health_targets"`
+
+	GatewayHeartbeatTimeout Duration `yaml:"gateway_heartbeat_timeout"` // 5m
+	GatewayBacklogSamples   int      `yaml:"gateway_backlog_samples"`   // 6
+	HeartbeatRetentionDays  int      `yaml:"heartbeat_retention_days"`  // 7
+
+	AlertRules              []AlertRule          `yaml:"alert_rules"`
+	AlertChannels           []AlertChannelConfig `yaml:"alert_channels"`
+	AlertEvaluationInterval Duration             `yaml:"alert_evaluation_interval"` // 1m
+}
+
+func DefaultConfig() *AppConfig {
+	return &AppConfig{
+		ListenPort:              8899,
+		UplinkPath:              "/cache-sync/uplink",
+		HeartbeatPath:           "/cache-sync/heartbeat",
+		LogFormat:               log_text,
+		LogLevel:                Level(slog.LevelInfo),
+		InfluxdbVersion:         2,
+		InfluxdbBatchSize:       500,
+		InfluxdbFlushInterval:   Duration(time.Second),
+		InfluxdbBufferSize:      10000,
+		InfluxdbMaxRetries:      3,
+		InfluxdbSpillDir:        "influx_spill",
+		OutboxPollInterval:      Duration(5 * time.Second),
+		OutboxBatchSize:         100,
+		PartitionPremake:        3,
+		RetentionAction:         retention_drop,
+		ArchiveDir:              "archive",
+		AuditRetentionDays:      365,
+		MaintenanceInterval:     Duration(time.Hour),
+		GatewayHeartbeatTimeout: Duration(5 * time.Minute),
+		GatewayBacklogSamples:   6,
+		HeartbeatRetentionDays:  7,
+		AlertEvaluationInterval: Duration(time.Minute),
+	}
+}
+
+// Duration is a Go duration string such as "500ms" or "1h".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil || parsed < 0 {
+		return config_type_error(value, "%q is not a duration such as 30s or 5m", value.Value)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) LogValue() slog.Value {
+	return slog.DurationValue(time.Duration(d))
+}
+
+// Bool accepts the historic y/n as well as true/false style values.
+type Bool bool
+
+func (b *Bool) UnmarshalYAML(value *yaml.Node) error {
+	switch strings.ToLower(value.Value) {
+	case "y", "yes", "on":
+		*b = true
+		return nil
+	case "n", "no", "off":
+		*b = false
+		return nil
+	}
+	parsed, err := strconv.ParseBool(value.Value)
+	if err != nil {
+		return config_type_error(value, "%q is not y or n", value.Value)
+	}
+	*b = Bool(parsed)
+	return nil
+}
+
+// Secret is a config value that is kept out of logs and responses. It may
+// reference environment variables as ${NAME}, and any secret key can instead
+// be given as key_file naming a file that holds it, such as a Docker secret.
+type Secret string
+
+// secret_file_tag marks a node load_config filled from a key_file, its value
+// is taken as is.
+const secret_file_tag = "!secret_file"
+
+var env_reference = regexp.MustCompile(`\$\{[A-Za-z_][A-Za-z0-9_]*\}`)
+
+var secret_type = reflect.TypeOf(Secret(""))
+
+func (s *Secret) UnmarshalYAML(value *yaml.Node) error {
+	if value.Tag == secret_file_tag {
+		*s = Secret(value.Value)
+		return nil
+	}
+	missing := []string{}
+	expanded := env_reference.ReplaceAllStringFunc(value.Value, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return val
+	})
+	if len(missing) > 0 {
+		return config_type_error(value, "environment variable %s is not set", strings.Join(missing, ", "))
+	}
+	*s = Secret(expanded)
+	return nil
+}
+
+// String is what gets logged. URLs keep their host and path so they can
+// still be told apart.
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	if u, err := url.Parse(string(s)); err == nil && u.Scheme != "" && u.Host != "" {
+		return u.Scheme + "://" + redacted + "@" + u.Host + u.Path
+	}
+	return redacted
+}
+
+const redacted = "********"
+
+// LogValue keeps the secret out of JSON logs, which do not use String.
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+// config_type_error is collected by the yaml decoder alongside its own
+// errors instead of stopping the decode.
+func config_type_error(value *yaml.Node, format string, args ...any) error {
+	return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: ", value.Line) + fmt.Sprintf(format, args...)}}
+}
+
+// Config_Problem is one finding of the validator. Warnings do not stop the
+// config from loading.
+type Config_Problem struct {
+	Line    int
+	Key     string
+	Message string
+	Warning bool
+}
+
+func (p Config_Problem) String() string {
+	s := fmt.Sprintf("line %d: ", p.Line)
+	if p.Warning {
+		s += "warning: "
+	}
+	if p.Key != "" {
+		s += p.Key + ": "
+	}
+	return s + p.Message
+}
+
+var yaml_error_line = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// load_config reads environment env of path, reporting every problem it
+// finds rather than stopping at the first. err is only set when the file
+// cannot be read or parsed at all.
+func load_config(path string, env string) (*AppConfig, []Config_Problem, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, errors.New("expected a mapping of environments")
+	}
+	root := doc.Content[0]
+	var env_key, env_node *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == env {
+			env_key, env_node = root.Content[i], root.Content[i+1]
+		}
+	}
+	if env_node == nil {
+		return nil, nil, fmt.Errorf("no such environment: %s", env)
+	}
+
+	problems := []Config_Problem{}
+	lines := map[string]int{"": env_key.Line}
+	config_keys(env_node, reflect.TypeOf(AppConfig{}), "", lines, &problems)
+
+	appConfig := DefaultConfig()
+	if err := env_node.Decode(appConfig); err != nil {
+		var type_err *yaml.TypeError
+		if !errors.As(err, &type_err) {
+			return nil, nil, err
+		}
+		for _, msg := range type_err.Errors {
+			p := Config_Problem{Line: env_key.Line, Message: msg}
+			if m := yaml_error_line.FindStringSubmatch(msg); m != nil {
+				p.Line, _ = strconv.Atoi(m[1])
+				p.Message = m[2]
+				p.Key = config_key_at(lines, p.Line)
+			}
+			problems = append(problems, p)
+		}
+	}
+
+	v := &config_validator{lines: lines}
+	v.validate(appConfig)
+	problems = append(problems, v.problems...)
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return appConfig, problems, nil
+}
+
+// LoadConfig loads environment env of config.yaml. Warnings are logged,
+// any other problem makes it fail with all of them.
+func LoadConfig(env string) (*AppConfig, error) {
+	appConfig, problems, err := load_config("config.yaml", env)
+	if err != nil {
+		return nil, err
+	}
+	errs := []error{}
+	for _, p := range problems {
+		if p.Warning {
+			main_log.Warn("config.yaml " + p.String())
+		} else {
+			errs = append(errs, errors.New("config.yaml "+p.String()))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return appConfig, nil
+}
+
+// config_keys walks node alongside the type it decodes into, recording the
+// line of every key under its dotted path and warning about keys that no
+// field is tagged with. key_file entries of Secret fields are read here,
+// before the node is decoded.
+func config_keys(node *yaml.Node, t reflect.Type, path string, lines map[string]int, problems *[]Config_Problem) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		if t.Kind() != reflect.Struct {
+			return
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+			if name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			key_path := key.Value
+			if path != "" {
+				key_path = path + "." + key.Value
+			}
+			lines[key_path] = key.Line
+			field, ok := fields[key.Value]
+			if base, is_file := strings.CutSuffix(key.Value, "_file"); !ok && is_file && fields[base] == secret_type {
+				config_secret_file(node, i, base, key_path, problems)
+				continue
+			}
+			if !ok {
+				*problems = append(*problems, Config_Problem{Line: key.Line, Key: key_path, Message: "unknown key, ignored", Warning: true})
+				continue
+			}
+			config_keys(node.Content[i+1], field, key_path, lines, problems)
+		}
+	case yaml.SequenceNode:
+		if t.Kind() != reflect.Slice {
+			return
+		}
+		for i, item := range node.Content {
+			item_path := fmt.Sprintf("%s[%d]", path, i)
+			lines[item_path] = item.Line
+			config_keys(item, t.Elem(), item_path, lines, problems)
+		}
+	}
+}
+
+// config_secret_file replaces the key_file pair at node.Content[i] with key
+// and the content of the file it names.
+func config_secret_file(node *yaml.Node, i int, key string, key_path string, problems *[]Config_Problem) {
+	file_key, path := node.Content[i], node.Content[i+1]
+	for j := 0; j+1 < len(node.Content); j += 2 {
+		if node.Content[j].Value == key {
+			*problems = append(*problems, Config_Problem{Line: file_key.Line, Key: key_path, Message: "set only one of " + key + " and " + file_key.Value})
+			return
+		}
+	}
+	raw, err := os.ReadFile(path.Value)
+	if err != nil {
+		*problems = append(*problems, Config_Problem{Line: file_key.Line, Key: key_path, Message: err.Error()})
+		return
+	}
+	file_key.Value = key
+	*path = yaml.Node{Kind: yaml.ScalarNode, Tag: secret_file_tag, Value: strings.TrimRight(string(raw), "\r\n"), Line: path.Line, Column: path.Column}
+}
+
+// config_key_at names the deepest key on line, for decoder errors that only
+// carry a line number.
+func config_key_at(lines map[string]int, line int) string {
+	found := ""
+	for key, l := range lines {
+		if l == line && len(key) > len(found) {
+			found = key
+		}
+	}
+	return found
+}
+
+type config_validator struct {
+	lines    map[string]int
+	problems []Config_Problem
+}
+
+// line finds the line of key, or of its closest parent when key is absent.
+func (v *config_validator) line(key string) int {
+	for key != "" {
+		if l, ok := v.lines[key]; ok {
+			return l
+		}
+		i := strings.LastIndexAny(key, ".[")
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return v.lines[""]
+}
+
+func (v *config_validator) errorf(key string, format string, args ...any) {
+	v.problems = append(v.problems, Config_Problem{Line: v.line(key), Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *config_validator) warnf(key string, format string, args ...any) {
+	v.problems = append(v.problems, Config_Problem{Line: v.line(key), Key: key, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+func (v *config_validator) required(key string, val string) {
+	if strings.TrimSpace(val) == "" {
+		v.errorf(key, "is required")
+	}
+}
+
+// url checks an optional URL against the allowed schemes.
+func (v *config_validator) url(key string, val string, schemes ...string) {
+	if val == "" {
+		return
+	}
+	u, err := url.Parse(val)
+	if err != nil || u.Host == "" || !slices.Contains(schemes, u.Scheme) {
+		v.errorf(key, "%q is not a URL with scheme %s", val, strings.Join(schemes, ", "))
+	}
+}
+
+func (v *config_validator) at_least(key string, val int, low int) {
+	if val < low {
+		v.errorf(key, "must be at least %d, got %d", low, val)
+	}
+}
+
+func (v *config_validator) positive(key string, val Duration) {
+	if val <= 0 {
+		v.errorf(key, "must be longer than 0")
+	}
+}
+
+func (v *config_validator) one_of(key string, val string, allowed ...string) {
+	if !slices.Contains(allowed, val) {
+		v.errorf(key, "%q is not one of %s", val, strings.Join(allowed, ", "))
+	}
+}
+
+func (v *config_validator) path(key string, val string) {
+	if !strings.HasPrefix(val, "/") {
+		v.errorf(key, "%q must start with /", val)
+	}
+}
+
+func (v *config_validator) validate(c *AppConfig) {
+	if c.ListenPort < 1 || c.ListenPort > 65535 {
+		v.errorf("listen_port", "%d is not a port number", c.ListenPort)
+	}
+	v.path("uplink_path", c.UplinkPath)
+	v.path("heartbeat_path", c.HeartbeatPath)
+	v.required("database_url", string(c.DatabaseUrl))
+	for name, token := range c.ApiTokens {
+		v.required("api_tokens."+name, string(token))
+	}
+	for gateway_id, token := range c.GatewayTokens {
+		v.required("gateway_tokens."+gateway_id, string(token))
+	}
+	// pgx also takes "host=... dbname=..." keyword strings. The message only
+	// shows the redacted URL.
+	if u, err := url.Parse(string(c.DatabaseUrl)); c.DatabaseUrl != "" && !strings.Contains(string(c.DatabaseUrl), "=") &&
+		(err != nil || u.Host == "" || (u.Scheme != "postgres" && u.Scheme != "postgresql")) {
+		v.errorf("database_url", "%s is not a postgres URL", c.DatabaseUrl)
+	}
+
+	v.one_of("log_format", c.LogFormat, log_text, log_json)
+	for component := range c.LogLevels {
+		if _, ok := log_levels[component]; !ok {
+			v.errorf("log_levels."+component, "unknown component, one of %s", strings.Join(log_components(), ", "))
+		}
+	}
+
+	v.one_of("influxdb_version", strconv.Itoa(c.InfluxdbVersion), "1", "2")
+	v.url("influxdb_url", c.InfluxdbUrl, "http", "https")
+	v.at_least("influxdb_batch_size", c.InfluxdbBatchSize, 1)
+	v.at_least("influxdb_buffer_size", c.InfluxdbBufferSize, 1)
+	v.at_least("influxdb_max_retries", c.InfluxdbMaxRetries, 0)
+	v.at_least("outbox_batch_size", c.OutboxBatchSize, 1)
+	v.at_least("outbox_retention_days", c.OutboxRetentionDays, 0)
+
+	v.one_of("partition_interval", c.PartitionInterval, "", partition_daily, partition_monthly)
+	v.at_least("partition_premake", c.PartitionPremake, 1)
+	v.at_least("retention_days", c.RetentionDays, 0)
+	v.one_of("retention_action", c.RetentionAction, retention_drop, retention_archive)
+	v.at_least("audit_retention_days", c.AuditRetentionDays, 0)
+
+	v.at_least("gateway_backlog_samples", c.GatewayBacklogSamples, 2)
+	v.at_least("heartbeat_retention_days", c.HeartbeatRetentionDays, 1)
+
+	v.positive("influxdb_flush_interval", c.InfluxdbFlushInterval)
+	v.positive("outbox_poll_interval", c.OutboxPollInterval)
+	v.positive("maintenance_interval", c.MaintenanceInterval)
+	v.positive("gateway_heartbeat_timeout", c.GatewayHeartbeatTimeout)
+	v.positive("alert_evaluation_interval", c.AlertEvaluationInterval)
+
+	v.validate_sinks(c)
+	v.validate_health_targets(c)
+	v.validate_alerts(c)
+}
+
+func (v *config_validator) validate_sinks(c *AppConfig) {
+	names := map[string]bool{}
+	for i, sc := range c.Sinks {
+		key := fmt.Sprintf("sinks[%d]", i)
+		name := sc.Name
+		if name == "" {
+			name = sc.Type
+		}
+		if names[name] {
+			v.errorf(key+".name", "duplicate sink %s", name)
+		}
+		names[name] = true
+		v.one_of(key+".on_error", sc.OnError, "", sink_on_error_retry, sink_on_error_ignore, sink_on_error_reject)
+		v.at_least(key+".max_attempts", sc.MaxAttempts, 0)
+
+		switch sc.Type {
+		case "postgres":
+		case "influxdb":
+			v.url(key+".influxdb_url", sc.InfluxdbUrl, "http", "https")
+			if sc.InfluxdbUrl == "" && c.InfluxdbUrl == "" {
+				v.errorf(key+".influxdb_url", "is required, or set influxdb_url at the top level")
+			}
+		case "mqtt":
+			v.required(key+".mqtt_broker", sc.MqttBroker)
+			v.url(key+".mqtt_broker", sc.MqttBroker, "tcp", "ssl", "tls", "ws", "wss", "mqtt", "mqtts")
+			v.required(key+".mqtt_topic", sc.MqttTopic)
+			if sc.MqttQos < 0 || sc.MqttQos > 2 {
+				v.errorf(key+".mqtt_qos", "must be 0, 1 or 2, got %d", sc.MqttQos)
+			}
+		case "webhook":
+			v.required(key+".webhook_url", sc.WebhookUrl)
+			v.url(key+".webhook_url", sc.WebhookUrl, "http", "https")
+		case "file":
+			v.required(key+".file_path", sc.FilePath)
+			v.at_least(key+".file_max_size_mb", sc.FileMaxSize, 1)
+			v.at_least(key+".file_max_files", sc.FileMaxFiles, 1)
+		default:
+			v.errorf(key+".type", "%q is not one of postgres, influxdb, mqtt, webhook, file", sc.Type)
+		}
+	}
+	if len(c.Sinks) == 0 && c.InfluxdbEnable && c.InfluxdbUrl == "" {
+		v.errorf("influxdb_url", "is required when influxdb_enable is y")
+	}
+}
+
+func (v *config_validator) validate_health_targets(c *AppConfig) {
+	names := map[string]bool{}
+	for i, t := range c.HealthTargets {
+		key := fmt.Sprintf("health_targets[%d]", i)
+		v.required(key+".name", t.Name)
+		if names[t.Name] {
+			v.errorf(key+".name", "duplicate health target %s", t.Name)
+		}
+		names[t.Name] = true
+		v.required(key+".url", t.Url)
+		v.url(key+".url", t.Url, "http", "https")
+		v.positive(key+".interval", t.Interval)
+		v.positive(key+".timeout", t.Timeout)
+		v.at_least(key+".failures_before_down", t.FailuresBeforeDown, 1)
+	}
+}
+
+func (v *config_validator) validate_alerts(c *AppConfig) {
+	channels := map[string]bool{}
+	for i, cc := range c.AlertChannels {
+		key := fmt.Sprintf("alert_channels[%d]", i)
+		v.required(key+".name", cc.Name)
+		if channels[cc.Name] {
+			v.errorf(key+".name", "duplicate alert channel %s", cc.Name)
+		}
+		channels[cc.Name] = true
+		v.at_least(key+".rate_limit_per_hour", cc.RateLimitPerHour, 0)
+		switch cc.Type {
+		case "smtp":
+			v.required(key+".smtp_host", cc.SmtpHost)
+			v.required(key+".smtp_from", cc.SmtpFrom)
+			if len(cc.SmtpTo) == 0 {
+				v.errorf(key+".smtp_to", "is required")
+			}
+		case "webhook":
+			v.required(key+".webhook_url", cc.WebhookUrl)
+			v.url(key+".webhook_url", cc.WebhookUrl, "http", "https")
+		case "mqtt":
+			v.required(key+".mqtt_broker", cc.MqttBroker)
+			v.url(key+".mqtt_broker", cc.MqttBroker, "tcp", "ssl", "tls", "ws", "wss", "mqtt", "mqtts")
+			v.required(key+".mqtt_topic", cc.MqttTopic)
+		default:
+			v.errorf(key+".type", "%q is not one of smtp, webhook, mqtt", cc.Type)
+		}
+	}
+
+	rule_names := map[string]bool{}
+	for i, rule := range c.AlertRules {
+		key := fmt.Sprintf("alert_rules[%d]", i)
+		v.required(key+".name", rule.Name)
+		// Alerts are keyed by rule name, two rules would share them.
+		if rule_names[rule.Name] {
+			v.errorf(key+".name", "duplicate alert rule %s", rule.Name)
+		}
+		rule_names[rule.Name] = true
+		switch rule.Type {
+		case rule_gateway_silent, rule_device_silent, rule_sink_failing:
+			if d, err := time.ParseDuration(rule.Threshold); err != nil || d <= 0 {
+				v.errorf(key+".threshold", "%q is not a duration such as 10m", rule.Threshold)
+			}
+		case rule_backlog:
+			if n, err := strconv.Atoi(rule.Threshold); err != nil || n < 0 {
+				v.errorf(key+".threshold", "%q is not a message count", rule.Threshold)
+			}
+		default:
+			v.errorf(key+".type", "%q is not one of %s, %s, %s, %s", rule.Type, rule_gateway_silent, rule_device_silent, rule_backlog, rule_sink_failing)
+		}
+		if len(rule.Channels) == 0 {
+			v.warnf(key+".channels", "no channels, alerts are only recorded")
+		}
+		for _, name := range rule.Channels {
+			if !channels[name] {
+				v.errorf(key+".channels", "unknown channel %s", name)
+			}
+		}
+	}
+}
+
+// check_config implements the check-config command. It validates every
+// environment of the file, or only those named, and prints each problem.
+// The exit code is 1 when any environment has errors.
+func check_config(args []string) int {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	path := flags.String("config", "config.yaml", "config file to check")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: sync-tower check-config [-config config.yaml] [environment...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	envs := flags.Args()
+	if len(envs) == 0 {
+		var all map[string]yaml.Node
+		raw, err := os.ReadFile(*path)
+		if err == nil {
+			err = yaml.Unmarshal(raw, &all)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, *path+": "+err.Error())
+			return 1
+		}
+		for env := range all {
+			envs = append(envs, env)
+		}
+		sort.Strings(envs)
+	}
+
+	failed := false
+	for _, env := range envs {
+		_, problems, err := load_config(*path, env)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, *path+": "+err.Error())
+			failed = true
+			continue
+		}
+		errs := 0
+		for _, p := range problems {
+			fmt.Printf("%s:%d: [%s] %s\n", *path, p.Line, env, strings.TrimPrefix(p.String(), fmt.Sprintf("line %d: ", p.Line)))
+			if !p.Warning {
+				errs++
+			}
+		}
+		if errs > 0 {
+			failed = true
+			fmt.Printf("%s: [%s] %d errors\n", *path, env, errs)
+		} else {
+			fmt.Printf("%s: [%s] OK\n", *path, env)
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
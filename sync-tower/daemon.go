@@ -1,83 +1,330 @@
 package main
 
 import (
-	"database/sql"
-	"log"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed templates/*.html
+var templates_fs embed.FS
+
+var templates = template.Must(template.ParseFS(templates_fs, "templates/*.html"))
+
+var health_log = component_logger("health")
+
+// Health states of a monitored application.
+const (
+	status_unknown  = "unknown"
+	status_up       = "up"
+	status_degraded = "degraded"
+	status_down     = "down"
 )
 
-var Done = make(chan bool)
+type HealthTarget struct {
+	Name               string   `yaml:"name"`
+	Url                string   `yaml:"url"`
+	Interval           Duration `yaml:"interval"`             // 30s
+	Timeout            Duration `yaml:"timeout"`              // 5s
+	ExpectedStatus     int      `yaml:"expected_status"`      // 200
+	DegradedLatency    Duration `yaml:"degraded_latency"`     // 0, off
+	FailuresBeforeDown int      `yaml:"failures_before_down"` // 3
+}
+
+func (t *HealthTarget) UnmarshalYAML(value *yaml.Node) error {
+	type plain HealthTarget
+	p := plain{
+		Interval:           Duration(30 * time.Second),
+		Timeout:            Duration(5 * time.Second),
+		ExpectedStatus:     http.StatusOK,
+		FailuresBeforeDown: 3,
+	}
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	*t = HealthTarget(p)
+	return nil
+}
 
 type Application_Status struct {
-	id                   int
-	application_name     string
-	application_addresss string
-	response_code        int
-	last_seen            string
+	Application_Name    string
+	Application_Address string
+	Status              string
+	Response_Code       int
+	Latency_Ms          int64
+	Last_Error          string
+	Last_Checked        *time.Time
+	Last_Seen           *time.Time
+	Status_Since        *time.Time
+}
+
+type Application_Status_Change struct {
+	Application_Name string
+	Previous_Status  string
+	Status           string
+	Response_Code    int
+	Latency_Ms       int64
+	Error            string
+	Changed_At       time.Time
+}
+
+// HealthMonitor probes every configured target on its own interval and keeps
+// application_status current, recording each status transition in
+// application_status_history.
+type HealthMonitor struct {
+	targets []HealthTarget
+	done    chan bool
+	wg      sync.WaitGroup
+}
+
+func NewHealthMonitor(appConfig *AppConfig) (*HealthMonitor, error) {
+	names := map[string]bool{}
+	for _, t := range appConfig.HealthTargets {
+		if t.Name == "" || t.Url == "" {
+			return nil, fmt.Errorf("health target needs a name and url")
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate health target %s", t.Name)
+		}
+		names[t.Name] = true
+	}
+	return &HealthMonitor{
+		targets: appConfig.HealthTargets,
+		done:    make(chan bool),
+	}, nil
+}
+
+func (h *HealthMonitor) Start() {
+	// Targets removed from config would otherwise stay on the status page
+	// with their last status. Their history is kept.
+	names := []string{}
+	for _, t := range h.targets {
+		names = append(names, t.Name)
+	}
+	if _, err := db.Exec(`DELETE FROM application_status WHERE NOT (application_name = ANY($1));`, names); err != nil {
+		health_log.Warn("Failed to remove unconfigured applications", "err", err)
+	}
+	for _, t := range h.targets {
+		_, err := db.Exec(`
+			INSERT INTO application_status (application_name, application_address) VALUES ($1, $2)
+			ON CONFLICT (application_name) DO UPDATE SET application_address = EXCLUDED.application_address;`,
+			t.Name, t.Url)
+		if err != nil {
+			health_log.Warn("Failed to register application", "application", t.Name, "err", err)
+		}
+		h.wg.Add(1)
+		go h.application_ping_worker(t)
+	}
+	health_log.Info("Successfully spawned probe workers", "targets", len(h.targets))
+}
+
+func (h *HealthMonitor) Stop() {
+	close(h.done)
+	h.wg.Wait()
 }
 
-func application_status_daemon(db *sql.DB) {
+func (h *HealthMonitor) application_ping_worker(t HealthTarget) {
+	defer h.wg.Done()
+
+	client := &http.Client{Timeout: time.Duration(t.Timeout)}
+
+	status := h.current_status(t.Name)
+	failures := 0
+
+	ticker := time.NewTicker(time.Duration(t.Interval))
+	defer ticker.Stop()
+	for {
+		code, latency, err := probe(client, t.Url)
+		var next string
+		next, failures, err = probe_status(t, code, latency, err, failures)
+		// A slow but correct answer still counts as seen.
+		reachable := failures == 0
+
+		if record_err := record_probe(t.Name, status, next, code, latency, reachable, err); record_err != nil {
+			health_log.Warn("Failed to record probe", "application", t.Name, "err", record_err)
+		} else if next != status {
+			level := slog.LevelInfo
+			if next != status_up {
+				level = slog.LevelWarn
+			}
+			health_log.Log(context.Background(), level, "Application status changed", "application", t.Name, "status", next, "previous", status, "code", code, "latency", latency, "err", err)
+			status = next
+		}
 
-	rows, err := db.Query("SELECT * FROM APPLICATION_STATUS")
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe_status is the status of t after a probe, given the failed probes
+// in a row before it. It returns the new count of failures and why the
+// target is not up.
+func probe_status(t HealthTarget, code int, latency time.Duration, probe_err error, failures int) (string, int, error) {
+	if probe_err == nil && code != t.ExpectedStatus {
+		probe_err = fmt.Errorf("expected status %d, got %d", t.ExpectedStatus, code)
+	}
+	if probe_err != nil {
+		failures++
+		if failures >= t.FailuresBeforeDown {
+			return status_down, failures, probe_err
+		}
+		return status_degraded, failures, probe_err
+	}
+	degraded_latency := time.Duration(t.DegradedLatency)
+	if degraded_latency > 0 && latency > degraded_latency {
+		return status_degraded, 0, fmt.Errorf("latency %s above %s", latency.Round(time.Millisecond), degraded_latency)
+	}
+	return status_up, 0, nil
+}
+
+func (h *HealthMonitor) current_status(name string) string {
+	status := status_unknown
+	db.QueryRow(`SELECT status FROM application_status WHERE application_name = $1;`, name).Scan(&status)
+	return status
+}
+
+func probe(client *http.Client, url string) (code int, latency time.Duration, err error) {
+	start := time.Now()
+	resp, err := client.Get(url)
+	latency = time.Since(start)
 	if err != nil {
-		log.Fatal(err)
+		return 0, latency, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	return resp.StatusCode, latency, nil
+}
+
+// record_probe updates the current state and, on a transition, appends to
+// the history in the same transaction.
+func record_probe(name string, previous string, status string, code int, latency time.Duration, reachable bool, probe_err error) error {
+	last_error := ""
+	if probe_err != nil {
+		last_error = probe_err.Error()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE application_status SET
+			status        = $2,
+			response_code = $3,
+			latency_ms    = $4,
+			last_error    = $5,
+			last_checked  = now(),
+			last_seen     = CASE WHEN $6 THEN now() ELSE last_seen END,
+			status_since  = CASE WHEN status = $2 AND status_since IS NOT NULL THEN status_since ELSE now() END
+		WHERE application_name = $1;`,
+		name, status, code, latency.Milliseconds(), last_error, reachable)
+	if err != nil {
+		return err
 	}
-	defer rows.Close()
 
-	application_status := Application_Status{
-		id:                   0,
-		application_name:     "",
-		application_addresss: "",
-		response_code:        0,
-		last_seen:            "",
+	if status != previous {
+		_, err = tx.Exec(`
+			INSERT INTO application_status_history (application_name, previous_status, status, response_code, latency_ms, error)
+			VALUES ($1, $2, $3, $4, $5, $6);`,
+			name, previous, status, code, latency.Milliseconds(), last_error)
+		if err != nil {
+			return err
+		}
 	}
-	c_arr := []chan bool{}
+	return tx.Commit()
+}
 
+func application_statuses(ctx context.Context) ([]Application_Status, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT application_name, application_address, status, response_code, latency_ms, last_error,
+			last_checked, last_seen, status_since
+		FROM application_status ORDER BY application_name;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := []Application_Status{}
 	for rows.Next() {
-		if err := rows.Scan(&application_status.id, &application_status.application_name, &application_status.application_addresss,
-			&application_status.response_code, &application_status.last_seen); err != nil {
+		var s Application_Status
+		if err := rows.Scan(&s.Application_Name, &s.Application_Address, &s.Status, &s.Response_Code, &s.Latency_Ms,
+			&s.Last_Error, &s.Last_Checked, &s.Last_Seen, &s.Status_Since); err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, rows.Err()
+}
+
+func application_status_changes(ctx context.Context, limit int) ([]Application_Status_Change, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT application_name, previous_status, status, response_code, latency_ms, error, changed_at
+		FROM application_status_history ORDER BY changed_at DESC LIMIT $1;`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	changes := []Application_Status_Change{}
+	for rows.Next() {
+		var c Application_Status_Change
+		if err := rows.Scan(&c.Application_Name, &c.Previous_Status, &c.Status, &c.Response_Code, &c.Latency_Ms,
+			&c.Error, &c.Changed_At); err != nil {
+			return nil, err
 		}
-		// Create a seperate go routine here to ping each server independently.
-		infoLog.Println(application_status)
-		temp_ch := make(chan bool)
-		c_arr = append(c_arr, temp_ch)
-		ticker := time.NewTicker(1000 * time.Millisecond)
-		go application_ping_worker(ticker, application_status, temp_ch)
+		changes = append(changes, c)
 	}
-	infoLog.Println(c_arr)
+	return changes, rows.Err()
 }
 
-func application_ping_worker(t *time.Ticker, as Application_Status, ch <-chan bool) {
-	for {
-		select {
-		// Exit the loop & kill goroutines when received channel.
-		case <-ch:
-			return
-		// Do work when ticker ticks
-		case <-t.C:
-			rs, err := http.Get(as.application_addresss)
-			if err != nil {
-				log.Fatal(err)
-			}
-			// update DB here.
-			stmt, err := db.Prepare(`UPDATE APPLICATION_STATUS SET 
-									last_seen = ?
-									where application_id = ?;`)
-
-			defer stmt.Close()
-			if err != nil {
-				log.Fatal(err)
-			}
-			infoLog.Println("here")
-			ct := time.Now()
-			fct := ct.Format("2006-01-02 15:04:05")
-			_, err = stmt.Exec(fct, as.id)
-			if err != nil {
-				log.Fatal(err)
-			}
-			infoLog.Println(rs.StatusCode)
+// applicationStatusHandler serves the monitor state as JSON, or as an HTML
+// page when asked for with ?format=html or by a browser.
+func applicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+
+	statuses, err := application_statuses(r.Context())
+	if err != nil {
+		health_log.Warn("Failed to query application status", "err", err)
+		write_json_error(w, http.StatusInternalServerError, "Failed to query application status")
+		return
+	}
+	changes, err := application_status_changes(r.Context(), 50)
+	if err != nil {
+		health_log.Warn("Failed to query application status", "err", err)
+		write_json_error(w, http.StatusInternalServerError, "Failed to query application status")
+		return
+	}
+
+	data := struct {
+		Applications []Application_Status
+		History      []Application_Status_Change
+	}{
+		Applications: statuses,
+		History:      changes,
+	}
+
+	if r.URL.Query().Get("format") == "html" || strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := templates.ExecuteTemplate(w, "application_status.html", data); err != nil {
+			health_log.Warn("Failed to render application status", "err", err)
 		}
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestProbeStatus(t *testing.T) {
+	target := HealthTarget{ExpectedStatus: http.StatusOK, FailuresBeforeDown: 3, DegradedLatency: Duration(time.Second)}
+	refused := errors.New("connection refused")
+	tests := []struct {
+		name      string
+		target    HealthTarget
+		code      int
+		latency   time.Duration
+		err       error
+		failures  int
+		status    string
+		remaining int
+		wantErr   bool
+	}{
+		{"up", target, 200, 100 * time.Millisecond, nil, 0, status_up, 0, false},
+		{"recovers", target, 200, 100 * time.Millisecond, nil, 5, status_up, 0, false},
+		{"slow", target, 200, 2 * time.Second, nil, 0, status_degraded, 0, true},
+		{"slow without degraded_latency", HealthTarget{ExpectedStatus: 200, FailuresBeforeDown: 3}, 200, time.Minute, nil, 0, status_up, 0, false},
+		{"unexpected status", target, 503, 0, nil, 0, status_degraded, 1, true},
+		{"other expected status", HealthTarget{ExpectedStatus: 204, FailuresBeforeDown: 3}, 204, 0, nil, 0, status_up, 0, false},
+		{"unreachable", target, 0, 0, refused, 1, status_degraded, 2, true},
+		{"down after failures_before_down", target, 0, 0, refused, 2, status_down, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, failures, err := probe_status(tt.target, tt.code, tt.latency, tt.err, tt.failures)
+			if status != tt.status || failures != tt.remaining || (err != nil) != tt.wantErr {
+				t.Errorf("probe_status() = %s, %d, %v, want %s, %d, error %v", status, failures, err, tt.status, tt.remaining, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	tests := []struct {
+		name    string
+		url     string
+		code    int
+		wantErr bool
+	}{
+		{"up", server.URL + "/health", http.StatusOK, false},
+		{"error status", server.URL + "/down", http.StatusServiceUnavailable, false},
+		{"unreachable", "http://127.0.0.1:1/health", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, err := probe(&http.Client{Timeout: time.Second}, tt.url)
+			if code != tt.code || (err != nil) != tt.wantErr {
+				t.Errorf("probe() = %d, %v, want %d, error %v", code, err, tt.code, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewHealthMonitor(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []HealthTarget
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"valid", []HealthTarget{{Name: "api", Url: "http://api"}, {Name: "web", Url: "http://web"}}, false},
+		{"missing url", []HealthTarget{{Name: "api"}}, true},
+		{"duplicate name", []HealthTarget{{Name: "api", Url: "http://a"}, {Name: "api", Url: "http://b"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHealthMonitor(&AppConfig{HealthTargets: tt.targets})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewHealthMonitor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHealthTargetDefaults(t *testing.T) {
+	var target HealthTarget
+	if err := yaml.Unmarshal([]byte("name: api\nurl: http://api/health\nfailures_before_down: 5"), &target); err != nil {
+		t.Fatal(err)
+	}
+	want := HealthTarget{Name: "api", Url: "http://api/health", Interval: Duration(30 * time.Second),
+		Timeout: Duration(5 * time.Second), ExpectedStatus: http.StatusOK, FailuresBeforeDown: 5}
+	if target != want {
+		t.Errorf("got %+v, want %+v", target, want)
+	}
+}
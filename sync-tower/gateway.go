@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+var gateway_log = component_logger("gateway")
+
+// Heartbeat is what edge-vault reports about itself on every beat.
+type Heartbeat struct {
+	Gateway_Id                 string
+	Hostname                   string
+	Version                    string
+	Uptime_Seconds             int64
+	Queue_Depth                int64
+	Oldest_Queued_Age_Seconds  int64
+	Disk_Free_Bytes            int64
+	Mqtt_State                 string
+	Heartbeat_Interval_Seconds int
+	// Queued messages that expired since edge-vault started, older
+	// edge-vaults leave them 0.
+	Expired_Dropped  int64
+	Expired_Archived int64
+}
+
+// Gateway_State is the latest heartbeat of a gateway plus what sync-tower
+// concludes from it.
+type Gateway_State struct {
+	Heartbeat
+	Source_Address    string
+	Config_Version    int
+	First_Seen        time.Time
+	Last_Seen         time.Time
+	Overdue           bool
+	Backlog_Growing   bool
+	Queue_Depth_Trend []int64
+}
+
+func heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		write_json_error(w, http.StatusMethodNotAllowed, "Only POST method is supported")
+		return
+	}
+
+	var hb Heartbeat
+	if err := json.NewDecoder(r.Body).Decode(&hb); err != nil || hb.Gateway_Id == "" {
+		write_json_error(w, http.StatusBadRequest, "Malformed heartbeat")
+		return
+	}
+	if !require_gateway(w, r, hb.Gateway_Id) {
+		return
+	}
+
+	if err := record_heartbeat(r.Context(), hb, r.RemoteAddr); err != nil {
+		gateway_log.Warn("Failed to record heartbeat", "gateway_id", hb.Gateway_Id, "err", err)
+		write_json_error(w, http.StatusServiceUnavailable, "Failed to record heartbeat")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		Status string
+	}{
+		Status: "OK",
+	})
+}
+
+func record_heartbeat(ctx context.Context, hb Heartbeat, source_address string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO gateway (gateway_id, hostname, version, uptime_seconds, queue_depth, oldest_queued_age_seconds,
+			disk_free_bytes, mqtt_state, heartbeat_interval_seconds, source_address, expired_dropped, expired_archived)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (gateway_id) DO UPDATE SET
+			hostname                   = EXCLUDED.hostname,
+			version                    = EXCLUDED.version,
+			uptime_seconds             = EXCLUDED.uptime_seconds,
+			queue_depth                = EXCLUDED.queue_depth,
+			oldest_queued_age_seconds  = EXCLUDED.oldest_queued_age_seconds,
+			disk_free_bytes            = EXCLUDED.disk_free_bytes,
+			mqtt_state                 = EXCLUDED.mqtt_state,
+			heartbeat_interval_seconds = EXCLUDED.heartbeat_interval_seconds,
+			source_address             = EXCLUDED.source_address,
+			expired_dropped            = EXCLUDED.expired_dropped,
+			expired_archived           = EXCLUDED.expired_archived,
+			last_seen                  = now();`,
+		hb.Gateway_Id, hb.Hostname, hb.Version, hb.Uptime_Seconds, hb.Queue_Depth, hb.Oldest_Queued_Age_Seconds,
+		hb.Disk_Free_Bytes, hb.Mqtt_State, hb.Heartbeat_Interval_Seconds, source_address, hb.Expired_Dropped, hb.Expired_Archived)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO gateway_heartbeat (gateway_id, queue_depth, oldest_queued_age_seconds, disk_free_bytes, mqtt_state)
+		VALUES ($1, $2, $3, $4, $5);`,
+		hb.Gateway_Id, hb.Queue_Depth, hb.Oldest_Queued_Age_Seconds, hb.Disk_Free_Bytes, hb.Mqtt_State)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// gateway_states returns every known gateway, flagging those whose heartbeat
+// is overdue and those whose queue grew over the last backlog_samples beats.
+func gateway_states(ctx context.Context, appConfig *AppConfig) ([]Gateway_State, error) {
+	timeout := time.Duration(appConfig.GatewayHeartbeatTimeout)
+	samples := appConfig.GatewayBacklogSamples
+
+	type_map := pgtype.NewMap()
+	trends := map[string][]int64{}
+	rows, err := db.QueryContext(ctx, `
+		SELECT gateway_id, array_agg(queue_depth ORDER BY received_at)
+		FROM (
+			SELECT gateway_id, queue_depth, received_at,
+				row_number() OVER (PARTITION BY gateway_id ORDER BY received_at DESC) AS rn
+			FROM gateway_heartbeat
+			WHERE received_at > now() - interval '1 day'
+		) recent
+		WHERE rn <= $1
+		GROUP BY gateway_id;`, samples)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id string
+		var trend []int64
+		if err := rows.Scan(&id, type_map.SQLScanner(&trend)); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		trends[id] = trend
+	}
+	rows.Close()
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT gateway_id, hostname, version, uptime_seconds, queue_depth, oldest_queued_age_seconds,
+			disk_free_bytes, mqtt_state, heartbeat_interval_seconds, source_address, config_version, first_seen, last_seen,
+			expired_dropped, expired_archived
+		FROM gateway ORDER BY gateway_id;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := []Gateway_State{}
+	for rows.Next() {
+		var g Gateway_State
+		if err := rows.Scan(&g.Gateway_Id, &g.Hostname, &g.Version, &g.Uptime_Seconds, &g.Queue_Depth,
+			&g.Oldest_Queued_Age_Seconds, &g.Disk_Free_Bytes, &g.Mqtt_State, &g.Heartbeat_Interval_Seconds,
+			&g.Source_Address, &g.Config_Version, &g.First_Seen, &g.Last_Seen, &g.Expired_Dropped, &g.Expired_Archived); err != nil {
+			return nil, err
+		}
+
+		// Allow three missed beats before calling a fast-beating gateway overdue.
+		allowed := max(timeout, 3*time.Duration(g.Heartbeat_Interval_Seconds)*time.Second)
+		g.Overdue = time.Since(g.Last_Seen) > allowed
+		g.Queue_Depth_Trend = trends[g.Gateway_Id]
+		g.Backlog_Growing = backlog_growing(g.Queue_Depth_Trend, samples)
+		states = append(states, g)
+	}
+	return states, rows.Err()
+}
+
+// backlog_growing reports whether a full window of queue depths never shrank
+// and ended higher than it started.
+func backlog_growing(trend []int64, samples int) bool {
+	if len(trend) < samples || len(trend) < 2 {
+		return false
+	}
+	for i := 1; i < len(trend); i++ {
+		if trend[i] < trend[i-1] {
+			return false
+		}
+	}
+	return trend[len(trend)-1] > trend[0]
+}
+
+func gatewaysHandler(w http.ResponseWriter, r *http.Request, appConfig *AppConfig) {
+	if _, ok := require_admin(w, r); !ok {
+		return
+	}
+
+	states, err := gateway_states(r.Context(), appConfig)
+	if err != nil {
+		gateway_log.Warn("Failed to query gateways", "err", err)
+		write_json_error(w, http.StatusInternalServerError, "Failed to query gateways")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
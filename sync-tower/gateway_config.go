@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+var config_log = component_logger("config")
+
+// Keys of edge-vault's config.yaml that may be managed remotely. gateway_id
+// and config_endpoint stay local so a bad version cannot cut a gateway off.
+var remote_config_keys = []string{
+	"mqtt_broker_address",
+	"mqtt_broker_port",
+	"mqtt_broker_user",
+	"mqtt_broker_password",
+	"uplink_endpoint",
+	"heartbeat_endpoint",
+	"heartbeat_interval",
+	"command_endpoint",
+}
+
+// Remote config keys masked when configs are listed, only the gateway
+// fetching its current version with its token sees them.
+var secret_config_keys = []string{"mqtt_broker_password"}
+
+// States of a config version as reported by the gateway.
+const (
+	config_pending     = "pending"
+	config_applied     = "applied"
+	config_rejected    = "rejected"
+	config_rolled_back = "rolled_back"
+)
+
+type Gateway_Config struct {
+	Gateway_Id  string
+	Version     int
+	Config      map[string]string
+	Comment     string
+	Created_By  string
+	Created_At  time.Time
+	Status      string
+	Error       string
+	Reported_At *time.Time
+}
+
+func (c Gateway_Config) Redacted() Gateway_Config {
+	config := map[string]string{}
+	for key, val := range c.Config {
+		if slices.Contains(secret_config_keys, key) && val != "" {
+			val = redacted
+		}
+		config[key] = val
+	}
+	c.Config = config
+	return c
+}
+
+func validate_gateway_config(config map[string]string) error {
+	if len(config) == 0 {
+		return errors.New("Config is empty")
+	}
+	for key := range config {
+		if !slices.Contains(remote_config_keys, key) {
+			return fmt.Errorf("%s cannot be managed remotely", key)
+		}
+	}
+	return nil
+}
+
+// create_gateway_config stores config as the next version for the gateway
+// and asks the gateway to fetch it right away.
+func create_gateway_config(ctx context.Context, c Gateway_Config) (Gateway_Config, error) {
+	config, err := json.Marshal(c.Config)
+	if err != nil {
+		return c, err
+	}
+	err = db.QueryRowContext(ctx, `
+		INSERT INTO gateway_config (gateway_id, version, config, comment, created_by)
+		SELECT $1::text, COALESCE(max(version), 0) + 1, $2::jsonb, $3::text, $4::text FROM gateway_config WHERE gateway_id = $1
+		RETURNING version, created_at, status;`,
+		c.Gateway_Id, config, c.Comment, c.Created_By).Scan(&c.Version, &c.Created_At, &c.Status)
+	if err != nil {
+		return c, err
+	}
+	if _, err := create_command(ctx, Command{Gateway_Id: c.Gateway_Id, Type: command_reconfigure, Created_By: c.Created_By}, time.Hour); err != nil {
+		// The gateway still picks the version up on its next poll.
+		config_log.Warn("Failed to queue reconfigure command", "gateway_id", c.Gateway_Id, "version", c.Version, "err", err)
+	}
+	return c, nil
+}
+
+func list_gateway_configs(ctx context.Context, gateway_id string, limit int) ([]Gateway_Config, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT gateway_id, version, config, comment, created_by, created_at, status, error, reported_at
+		FROM gateway_config WHERE gateway_id = $1
+		ORDER BY version DESC LIMIT $2;`, gateway_id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	configs := []Gateway_Config{}
+	for rows.Next() {
+		var c Gateway_Config
+		var config []byte
+		if err := rows.Scan(&c.Gateway_Id, &c.Version, &config, &c.Comment, &c.Created_By, &c.Created_At,
+			&c.Status, &c.Error, &c.Reported_At); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(config, &c.Config); err != nil {
+			return nil, err
+		}
+		configs = append(configs, c)
+	}
+	return configs, rows.Err()
+}
+
+// gatewayConfigHandler lists the versions of ?gateway_id= on GET and stores
+// a new version on POST. Both need an api_tokens token.
+func gatewayConfigHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := require_admin(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		gateway_id := r.URL.Query().Get("gateway_id")
+		if gateway_id == "" {
+			write_json_error(w, http.StatusBadRequest, "Expected ?gateway_id=")
+			return
+		}
+		configs, err := list_gateway_configs(r.Context(), gateway_id, 100)
+		if err != nil {
+			config_log.Warn("Failed to query gateway config", "err", err)
+			write_json_error(w, http.StatusInternalServerError, "Failed to query gateway config")
+			return
+		}
+		for i := range configs {
+			configs[i] = configs[i].Redacted()
+		}
+		json.NewEncoder(w).Encode(configs)
+
+	case "POST":
+		var c Gateway_Config
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil || c.Gateway_Id == "" {
+			write_json_error(w, http.StatusBadRequest, "Expected {\"Gateway_Id\": ..., \"Config\": {...}}")
+			return
+		}
+		c.Created_By = actor
+		if err := validate_gateway_config(c.Config); err != nil {
+			write_json_error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		// The version it replaces, for the audit log.
+		var before any
+		if previous, err := list_gateway_configs(r.Context(), c.Gateway_Id, 1); err == nil && len(previous) > 0 {
+			before = previous[0].Redacted().Config
+		}
+		c, err := create_gateway_config(r.Context(), c)
+		record_audit(r, c.Created_By, "config.create", fmt.Sprintf("%s version %d", c.Gateway_Id, c.Version),
+			before, c.Redacted().Config, err)
+		if err != nil {
+			config_log.Warn("Failed to store gateway config", "err", err)
+			write_json_error(w, http.StatusInternalServerError, "Failed to store gateway config")
+			return
+		}
+		config_log.Info("Stored config", "gateway_id", c.Gateway_Id, "version", c.Version, "by", c.Created_By)
+		json.NewEncoder(w).Encode(c.Redacted())
+
+	default:
+		write_json_error(w, http.StatusMethodNotAllowed, "Only GET and POST methods are supported")
+	}
+}
+
+// gatewayConfigCurrentHandler serves the latest version of ?gateway_id= to
+// edge-vault, 204 when there is none. Secrets are included, so the gateway
+// has to send its gateway_tokens token.
+func gatewayConfigCurrentHandler(w http.ResponseWriter, r *http.Request) {
+	gateway_id := r.URL.Query().Get("gateway_id")
+	if gateway_id == "" {
+		write_json_error(w, http.StatusBadRequest, "Expected ?gateway_id=")
+		return
+	}
+	if !require_gateway(w, r, gateway_id) {
+		return
+	}
+	configs, err := list_gateway_configs(r.Context(), gateway_id, 1)
+	if err != nil {
+		config_log.Warn("Failed to query gateway config", "err", err)
+		write_json_error(w, http.StatusInternalServerError, "Failed to query gateway config")
+		return
+	}
+	if len(configs) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Version int
+		Config  map[string]string
+	}{
+		Version: configs[0].Version,
+		Config:  configs[0].Config,
+	})
+}
+
+// gatewayConfigReportHandler records what a gateway did with a version.
+func gatewayConfigReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		write_json_error(w, http.StatusMethodNotAllowed, "Only POST method is supported")
+		return
+	}
+	var body struct {
+		Gateway_Id string
+		Version    int
+		Status     string
+		Error      string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Gateway_Id == "" || body.Version == 0 {
+		write_json_error(w, http.StatusBadRequest, "Malformed config report")
+		return
+	}
+	if !require_gateway(w, r, body.Gateway_Id) {
+		return
+	}
+	switch body.Status {
+	case config_applied, config_rejected, config_rolled_back:
+	default:
+		write_json_error(w, http.StatusBadRequest, "Status must be applied, rejected or rolled_back")
+		return
+	}
+
+	err := report_gateway_config(r.Context(), body.Gateway_Id, body.Version, body.Status, body.Error)
+	if errors.Is(err, sql.ErrNoRows) {
+		write_json_error(w, http.StatusNotFound, "No such config version")
+		return
+	}
+	if err != nil {
+		config_log.Warn("Failed to record config report", "err", err)
+		write_json_error(w, http.StatusInternalServerError, "Failed to record config report")
+		return
+	}
+	if body.Status == config_applied {
+		config_log.Info("Gateway applied config", "gateway_id", body.Gateway_Id, "version", body.Version, "outcome", body.Status)
+	} else {
+		config_log.Warn("Gateway did not apply config", "gateway_id", body.Gateway_Id, "version", body.Version, "outcome", body.Status, "err", body.Error)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status string
+	}{
+		Status: "OK",
+	})
+}
+
+func report_gateway_config(ctx context.Context, gateway_id string, version int, status string, report_err string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE gateway_config SET status = $3, error = $4, reported_at = now()
+		WHERE gateway_id = $1 AND version = $2;`, gateway_id, version, status, report_err)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if status == config_applied {
+		_, err = tx.ExecContext(ctx, `UPDATE gateway SET config_version = $2 WHERE gateway_id = $1;`, gateway_id, version)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
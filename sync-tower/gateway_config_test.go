@@ -0,0 +1,98 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGatewayConfigRedacted(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]string
+		want   map[string]string
+	}{
+		{"password masked", map[string]string{"mqtt_broker_password": "hunter2", "mqtt_broker_user": "gw"},
+			map[string]string{"mqtt_broker_password": redacted, "mqtt_broker_user": "gw"}},
+		{"empty password kept", map[string]string{"mqtt_broker_password": ""}, map[string]string{"mqtt_broker_password": ""}},
+		{"no secrets", map[string]string{"heartbeat_interval": "30s"}, map[string]string{"heartbeat_interval": "30s"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Gateway_Config{Gateway_Id: "spectra-gw-01", Config: tt.config}
+			original := maps.Clone(tt.config)
+			if got := c.Redacted().Config; !maps.Equal(got, tt.want) {
+				t.Errorf("Redacted() = %v, want %v", got, tt.want)
+			}
+			if !maps.Equal(c.Config, original) {
+				t.Error("Redacted() changed the original config")
+			}
+		})
+	}
+}
+
+func TestValidateGatewayConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]string
+		wantErr bool
+	}{
+		{"remote keys", map[string]string{"mqtt_broker_address": "tcp://broker", "heartbeat_interval": "30s"}, false},
+		{"empty", map[string]string{}, true},
+		{"local key", map[string]string{"gateway_id": "elsewhere"}, true},
+		{"config_endpoint stays local", map[string]string{"config_endpoint": "https://elsewhere"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validate_gateway_config(tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validate_gateway_config() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGatewayConfigHandlersRequireTokens(t *testing.T) {
+	test_config(t, &AppConfig{
+		ApiTokens:     map[string]Secret{"ops": "7f3c9e2a51d84b06"},
+		GatewayTokens: map[string]Secret{"spectra-gw-01": "4e81b0d9c27a6f35"},
+	})
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		token   string
+		code    int
+	}{
+		{"list without token", gatewayConfigHandler, http.MethodGet, "/cache-sync/gateway-config", "", "", http.StatusUnauthorized},
+		{"create with gateway token", gatewayConfigHandler, http.MethodPost, "/cache-sync/gateway-config", `{}`, "4e81b0d9c27a6f35", http.StatusUnauthorized},
+		{"create local key", gatewayConfigHandler, http.MethodPost, "/cache-sync/gateway-config",
+			`{"Gateway_Id":"spectra-gw-01","Config":{"gateway_id":"x"}}`, "7f3c9e2a51d84b06", http.StatusBadRequest},
+		{"current without token", gatewayConfigCurrentHandler, http.MethodGet, "/cache-sync/gateway-config/current?gateway_id=spectra-gw-01", "", "", http.StatusUnauthorized},
+		{"current with api token", gatewayConfigCurrentHandler, http.MethodGet, "/cache-sync/gateway-config/current?gateway_id=spectra-gw-01", "", "7f3c9e2a51d84b06", http.StatusUnauthorized},
+		{"current of another gateway", gatewayConfigCurrentHandler, http.MethodGet, "/cache-sync/gateway-config/current?gateway_id=spectra-gw-02", "", "4e81b0d9c27a6f35", http.StatusUnauthorized},
+		{"report without token", gatewayConfigReportHandler, http.MethodPost, "/cache-sync/gateway-config/report",
+			`{"Gateway_Id":"spectra-gw-01","Version":3,"Status":"applied"}`, "", http.StatusUnauthorized},
+		{"report unknown status", gatewayConfigReportHandler, http.MethodPost, "/cache-sync/gateway-config/report",
+			`{"Gateway_Id":"spectra-gw-01","Version":3,"Status":"pending"}`, "4e81b0d9c27a6f35", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != tt.code {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.code, w.Body)
+			}
+			if w.Header().Get("Access-Control-Allow-Origin") != "" {
+				t.Error("gateway config endpoints must not allow cross-origin requests")
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBacklogGrowing(t *testing.T) {
+	tests := []struct {
+		name    string
+		trend   []int64
+		samples int
+		want    bool
+	}{
+		{"growing", []int64{10, 20, 20, 35}, 4, true},
+		{"window not full", []int64{10, 20, 35}, 4, false},
+		{"single sample", []int64{10}, 1, false},
+		{"shrank once", []int64{10, 20, 15, 35}, 4, false},
+		{"flat", []int64{20, 20, 20, 20}, 4, false},
+		{"empty queue", []int64{0, 0, 0}, 3, false},
+		{"more samples than needed", []int64{1, 2, 3, 4, 5}, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backlog_growing(tt.trend, tt.samples); got != tt.want {
+				t.Errorf("backlog_growing(%v, %d) = %v, want %v", tt.trend, tt.samples, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeartbeatHandlerRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		token  string
+		code   int
+	}{
+		{"wrong method", http.MethodGet, "", "", http.StatusMethodNotAllowed},
+		{"malformed", http.MethodPost, `{"Gateway_Id":`, "", http.StatusBadRequest},
+		{"no gateway id", http.MethodPost, `{"Hostname":"spectra-gw-01"}`, "", http.StatusBadRequest},
+		{"no token", http.MethodPost, `{"Gateway_Id":"spectra-gw-01"}`, "", http.StatusUnauthorized},
+		{"token of another gateway", http.MethodPost, `{"Gateway_Id":"spectra-gw-02"}`, "4e81b0d9c27a6f35", http.StatusUnauthorized},
+	}
+	test_config(t, &AppConfig{GatewayTokens: map[string]Secret{"spectra-gw-01": "4e81b0d9c27a6f35"}})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "/cache-sync/heartbeat", strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			heartbeatHandler(w, r)
+			if w.Code != tt.code {
+				t.Errorf("status %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestGatewaysHandlerRequiresAdmin(t *testing.T) {
+	test_config(t, &AppConfig{ApiTokens: map[string]Secret{"ops": "7f3c9e2a51d84b06"}})
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"no token", ""},
+		{"gateway token", "4e81b0d9c27a6f35"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/cache-sync/gateways", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			gatewaysHandler(w, r, current_config())
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			if w.Header().Get("Access-Control-Allow-Origin") != "" {
+				t.Error("gateways are listed to any origin")
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+var influx_log = component_logger("influxdb")
+
+// Lines per spill file before a new one is started.
+const spill_file_max_lines = 5000
+
+// InfluxWriter buffers points in memory and writes them to InfluxDB in
+// batches from a single goroutine, so request handlers never wait on the
+// time-series backend. Points that cannot be written after all retries, or
+// that arrive while the buffer is full, are appended to line protocol files
+// in spill_dir and replayed once InfluxDB accepts writes again.
+type InfluxWriter struct {
+	write_api      api.WriteAPIBlocking
+	points         chan *write.Point
+	batch_size     int
+	flush_interval time.Duration
+	max_retries    int
+	spill_dir      string
+
+	spill_mu    sync.Mutex
+	spill_file  *os.File
+	spill_lines int
+
+	done chan bool
+	wg   sync.WaitGroup
+}
+
+func NewInfluxWriter(client influxdb2.Client, appConfig *AppConfig) (*InfluxWriter, error) {
+	w := &InfluxWriter{
+		write_api:      client.WriteAPIBlocking(appConfig.InfluxdbOrg, appConfig.InfluxdbBucket),
+		points:         make(chan *write.Point, appConfig.InfluxdbBufferSize),
+		batch_size:     appConfig.InfluxdbBatchSize,
+		flush_interval: time.Duration(appConfig.InfluxdbFlushInterval),
+		max_retries:    appConfig.InfluxdbMaxRetries,
+		spill_dir:      appConfig.InfluxdbSpillDir,
+		done:           make(chan bool),
+	}
+	if w.spill_dir == "" {
+		w.spill_dir = "influx_spill"
+	}
+	if err := os.MkdirAll(w.spill_dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spill directory: %w", err)
+	}
+	return w, nil
+}
+
+// Start spawns the writer goroutine. It is kept out of NewInfluxWriter so a
+// writer replacing another on the same spill directory only starts once the
+// old one is closed.
+func (w *InfluxWriter) Start() {
+	w.wg.Add(1)
+	go w.writer_worker()
+}
+
+// Enqueue hands a point to the writer without blocking. When the in-memory
+// buffer is full the point goes straight to the spill directory instead.
+func (w *InfluxWriter) Enqueue(p *write.Point) {
+	select {
+	case w.points <- p:
+	default:
+		if err := w.spill([]*write.Point{p}); err != nil {
+			influx_log.Warn("Buffer full and spill failed, point dropped", "err", err)
+		}
+	}
+}
+
+// Close stops the writer after flushing everything still buffered. Whatever
+// cannot be written is left in the spill directory for the next start.
+func (w *InfluxWriter) Close() {
+	close(w.done)
+	w.wg.Wait()
+
+	w.spill_mu.Lock()
+	defer w.spill_mu.Unlock()
+	if w.spill_file != nil {
+		w.spill_file.Close()
+		w.spill_file = nil
+	}
+}
+
+func (w *InfluxWriter) writer_worker() {
+	defer w.wg.Done()
+	influx_log.Debug("Entering writer loop", "batch_size", w.batch_size, "flush_interval", w.flush_interval)
+
+	ticker := time.NewTicker(w.flush_interval)
+	defer ticker.Stop()
+
+	batch := make([]*write.Point, 0, w.batch_size)
+	for {
+		select {
+		case <-w.done:
+			// Drain whatever is still buffered before exiting.
+			for {
+				select {
+				case p := <-w.points:
+					batch = append(batch, p)
+					if len(batch) >= w.batch_size {
+						w.flush(batch)
+						batch = batch[:0]
+					}
+				default:
+					w.flush(batch)
+					return
+				}
+			}
+		case p := <-w.points:
+			batch = append(batch, p)
+			if len(batch) >= w.batch_size {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if w.flush(batch) {
+				w.replay_spill()
+			}
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes one batch, retrying with backoff, and spills it to disk if
+// every attempt fails. It reports whether InfluxDB accepted the batch.
+func (w *InfluxWriter) flush(batch []*write.Point) bool {
+	if len(batch) == 0 {
+		return true
+	}
+
+	err := w.write_with_retry(func(ctx context.Context) error {
+		return w.write_api.WritePoint(ctx, batch...)
+	})
+	if err == nil {
+		return true
+	}
+
+	influx_log.Warn("Write failed, spilling to disk", "points", len(batch), "err", err)
+	if err := w.spill(batch); err != nil {
+		influx_log.Error("Spill failed, points dropped", "points", len(batch), "err", err)
+	}
+	return false
+}
+
+func (w *InfluxWriter) write_with_retry(fn func(ctx context.Context) error) (err error) {
+	backoff := 500 * time.Millisecond
+	for attempt := 0; attempt <= w.max_retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-w.done:
+				// Shutting down, do not keep the process waiting on retries.
+				return err
+			}
+			backoff *= 2
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = fn(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (w *InfluxWriter) spill(batch []*write.Point) error {
+	w.spill_mu.Lock()
+	defer w.spill_mu.Unlock()
+
+	if w.spill_file == nil || w.spill_lines >= spill_file_max_lines {
+		if w.spill_file != nil {
+			w.spill_file.Close()
+		}
+		name := filepath.Join(w.spill_dir, fmt.Sprintf("influx_%d.lp", time.Now().UnixNano()))
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			w.spill_file = nil
+			return err
+		}
+		w.spill_file = f
+		w.spill_lines = 0
+	}
+
+	var sb strings.Builder
+	for _, p := range batch {
+		sb.WriteString(write.PointToLineProtocol(p, time.Nanosecond))
+	}
+	if _, err := w.spill_file.WriteString(sb.String()); err != nil {
+		return err
+	}
+	w.spill_lines += len(batch)
+	return w.spill_file.Sync()
+}
+
+// replay_spill sends spilled files back to InfluxDB, oldest first, removing
+// each file once all of its lines were accepted.
+func (w *InfluxWriter) replay_spill() {
+	// Under spill_mu the active file is closed and every spill file renamed
+	// to .replaying, so points spilled while replaying go to a new file and
+	// are never removed along with the ones replayed. Files left .replaying
+	// by a failed replay are picked up again.
+	w.spill_mu.Lock()
+	if w.spill_file != nil {
+		w.spill_file.Close()
+		w.spill_file = nil
+	}
+	spilled, _ := filepath.Glob(filepath.Join(w.spill_dir, "influx_*.lp"))
+	for _, name := range spilled {
+		if err := os.Rename(name, name+".replaying"); err != nil {
+			influx_log.Warn("Failed to claim spill file for replay", "file", name, "err", err)
+		}
+	}
+	w.spill_mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(w.spill_dir, "influx_*.lp.replaying"))
+	if err != nil || len(files) == 0 {
+		return
+	}
+	sort.Strings(files)
+
+	for _, name := range files {
+		lines, err := read_lines(name)
+		if err != nil {
+			influx_log.Warn("Failed to read spill file", "file", name, "err", err)
+			return
+		}
+		for start := 0; start < len(lines); start += w.batch_size {
+			end := min(start+w.batch_size, len(lines))
+			err := w.write_with_retry(func(ctx context.Context) error {
+				return w.write_api.WriteRecord(ctx, lines[start:end]...)
+			})
+			if err != nil {
+				// Keep the file, lines already written are idempotent in InfluxDB.
+				influx_log.Warn("Replay failed", "file", name, "err", err)
+				return
+			}
+		}
+		os.Remove(name)
+		influx_log.Info("Successfully replayed spilled points", "file", name, "points", len(lines))
+	}
+}
+
+func read_lines(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// fake_write_api records what is written and fails while err is set.
+type fake_write_api struct {
+	err   error
+	lines []string
+}
+
+func (f *fake_write_api) WriteRecord(ctx context.Context, line ...string) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.lines = append(f.lines, line...)
+	return nil
+}
+
+func (f *fake_write_api) WritePoint(ctx context.Context, point ...*write.Point) error {
+	if f.err != nil {
+		return f.err
+	}
+	for _, p := range point {
+		f.lines = append(f.lines, write.PointToLineProtocol(p, time.Nanosecond))
+	}
+	return nil
+}
+
+func (f *fake_write_api) EnableBatching()                 {}
+func (f *fake_write_api) Flush(ctx context.Context) error { return nil }
+
+func test_influx_writer(t *testing.T, api *fake_write_api) *InfluxWriter {
+	return &InfluxWriter{
+		write_api:  api,
+		batch_size: 2,
+		spill_dir:  t.TempDir(),
+		done:       make(chan bool),
+	}
+}
+
+func test_points(n int) []*write.Point {
+	points := []*write.Point{}
+	for i := range n {
+		points = append(points, write.NewPoint("uplink", map[string]string{"dev_eui": "0004a30b001c0530"},
+			map[string]any{"f_cnt": i}, time.Unix(1700000000+int64(i), 0)))
+	}
+	return points
+}
+
+func spilled_lines(t *testing.T, dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "influx_*.lp*"))
+	slices.Sort(files)
+	lines := []string{}
+	for _, name := range files {
+		l, err := read_lines(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, l...)
+	}
+	return lines
+}
+
+func TestInfluxWriterFlush(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		points   int
+		accepted bool
+		spilled  int
+	}{
+		{"empty batch", errors.New("unreachable"), 0, true, 0},
+		{"written", nil, 3, true, 0},
+		{"failed batch is spilled", errors.New("unreachable"), 3, false, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fake_write_api{err: tt.err}
+			w := test_influx_writer(t, api)
+			if accepted := w.flush(test_points(tt.points)); accepted != tt.accepted {
+				t.Errorf("flush() = %v, want %v", accepted, tt.accepted)
+			}
+			w.Close()
+			if spilled := len(spilled_lines(t, w.spill_dir)); spilled != tt.spilled {
+				t.Errorf("spilled %d lines, want %d", spilled, tt.spilled)
+			}
+		})
+	}
+}
+
+func TestInfluxWriterReplaySpill(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		leftover string
+		written  int
+		kept     int
+	}{
+		{"replayed and removed", nil, "", 5, 0},
+		{"kept while failing", errors.New("unreachable"), "", 0, 5},
+		{"leftover of a failed replay", nil, "a v=1 1\nb v=2 2\n", 7, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fake_write_api{}
+			w := test_influx_writer(t, api)
+			if tt.leftover != "" {
+				name := filepath.Join(w.spill_dir, "influx_1.lp.replaying")
+				if err := os.WriteFile(name, []byte(tt.leftover), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.spill(test_points(5)); err != nil {
+				t.Fatal(err)
+			}
+			api.err = tt.err
+			w.replay_spill()
+			w.Close()
+			if len(api.lines) != tt.written {
+				t.Errorf("wrote %d lines, want %d", len(api.lines), tt.written)
+			}
+			if kept := len(spilled_lines(t, w.spill_dir)); kept != tt.kept {
+				t.Errorf("kept %d spilled lines, want %d", kept, tt.kept)
+			}
+		})
+	}
+}
+
+func TestInfluxWriterSpillRotates(t *testing.T) {
+	w := test_influx_writer(t, &fake_write_api{})
+	defer w.Close()
+	points := test_points(1)
+	for range spill_file_max_lines + 1 {
+		if err := w.spill(points); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(w.spill_dir, "influx_*.lp"))
+	if len(files) != 2 {
+		t.Errorf("spilled into %d files, want 2", len(files))
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"empty", "", []string{}},
+		{"lines", "a v=1 1\nb v=2 2\n", []string{"a v=1 1", "b v=2 2"}},
+		{"blank lines and no trailing newline", "a v=1 1\n\n\nb v=2 2", []string{"a v=1 1", "b v=2 2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "influx_1.lp")
+			if err := os.WriteFile(name, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := read_lines(name)
+			if err != nil || !slices.Equal(got, tt.want) {
+				t.Errorf("read_lines() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var Reset = "\033[0m"
+var Red = "\033[31m"
+var Green = "\033[32m"
+var Yellow = "\033[33m"
+var Blue = "\033[34m"
+var Magenta = "\033[35m"
+var Cyan = "\033[36m"
+var Gray = "\033[37m"
+var White = "\033[97m"
+
+// Log formats, text is one line per event with key=value fields and json is
+// one object per event for log shippers.
+const (
+	log_text = "text"
+	log_json = "json"
+)
+
+// log_output is the handler every component logger writes to, replaced by
+// configure_logging.
+var log_output atomic.Pointer[slog.Handler]
+
+// log_levels holds the level of every component, filled as the component
+// loggers are declared.
+var log_levels = map[string]*slog.LevelVar{}
+
+// component_logger is the logger of one part of sync-tower, its level can
+// be set on its own with log_levels in config.yaml.
+func component_logger(component string) *slog.Logger {
+	level := new(slog.LevelVar)
+	log_levels[component] = level
+	return slog.New(&component_handler{component: component, level: level})
+}
+
+func log_components() []string {
+	components := []string{}
+	for component := range log_levels {
+		components = append(components, component)
+	}
+	slices.Sort(components)
+	return components
+}
+
+// configure_logging applies log_format, log_level and log_levels. It is
+// called again on reload.
+func configure_logging(appConfig *AppConfig) {
+	for component, level := range log_levels {
+		if l, ok := appConfig.LogLevels[component]; ok {
+			level.Set(slog.Level(l))
+		} else {
+			level.Set(slog.Level(appConfig.LogLevel))
+		}
+	}
+	var h slog.Handler
+	if appConfig.LogFormat == log_json {
+		h = slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: log_json_attr})
+	} else {
+		h = new_text_handler(os.Stdout)
+	}
+	log_output.Store(&h)
+}
+
+func log_json_attr(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		a.Value = slog.StringValue(strings.ToLower(a.Value.String()))
+	}
+	if a.Value.Kind() == slog.KindDuration {
+		a.Value = slog.StringValue(a.Value.Duration().String())
+	}
+	return a
+}
+
+func current_log_output() slog.Handler {
+	if h := log_output.Load(); h != nil {
+		return *h
+	}
+	// Before config.yaml is loaded.
+	h := new_text_handler(os.Stdout)
+	log_output.CompareAndSwap(nil, &h)
+	return *log_output.Load()
+}
+
+// Level is a log level in config.yaml, one of debug, info, warn or error.
+type Level slog.Level
+
+func (l *Level) UnmarshalYAML(value *yaml.Node) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value.Value)); err != nil {
+		return config_type_error(value, "%q is not one of debug, info, warn, error", value.Value)
+	}
+	*l = Level(level)
+	return nil
+}
+
+// component_handler adds the component to every record and filters on its
+// level before handing the record to log_output. Groups are flattened into
+// dotted keys.
+type component_handler struct {
+	component string
+	level     *slog.LevelVar
+	attrs     []slog.Attr
+	group     string
+}
+
+func (h *component_handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *component_handler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	out.AddAttrs(slog.String("component", h.component))
+	out.AddAttrs(h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(h.grouped(a))
+		return true
+	})
+	return current_log_output().Handle(ctx, out)
+}
+
+func (h *component_handler) grouped(a slog.Attr) slog.Attr {
+	if h.group != "" {
+		a.Key = h.group + "." + a.Key
+	}
+	return a
+}
+
+func (h *component_handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *h
+	next.attrs = slices.Clone(h.attrs)
+	for _, a := range attrs {
+		next.attrs = append(next.attrs, h.grouped(a))
+	}
+	return &next
+}
+
+func (h *component_handler) WithGroup(name string) slog.Handler {
+	next := *h
+	next.group = strings.TrimPrefix(h.group+"."+name, ".")
+	return &next
+}
+
+// text_handler writes the familiar "[INFO] date time file:line: [component]
+// message key=value" lines, coloured when out is a terminal.
+type text_handler struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	colour bool
+}
+
+func new_text_handler(out *os.File) slog.Handler {
+	info, err := out.Stat()
+	tty := err == nil && info.Mode()&os.ModeCharDevice != 0
+	_, no_colour := os.LookupEnv("NO_COLOR")
+	return &text_handler{mu: &sync.Mutex{}, out: out, colour: tty && !no_colour}
+}
+
+func (h *text_handler) paint(colour string, s string) string {
+	if !h.colour {
+		return s
+	}
+	return colour + s + Reset
+}
+
+func (h *text_handler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *text_handler) Handle(_ context.Context, r slog.Record) error {
+	var b bytes.Buffer
+	switch {
+	case r.Level >= slog.LevelError:
+		b.WriteString(h.paint(Red, "[ERROR] "))
+	case r.Level >= slog.LevelWarn:
+		b.WriteString(h.paint(Yellow, "[WARN] "))
+	case r.Level >= slog.LevelInfo:
+		b.WriteString(h.paint(Green, "[INFO] "))
+	default:
+		b.WriteString(h.paint(Gray, "[DEBUG] "))
+	}
+	b.WriteString(r.Time.Format("2006/01/02 15:04:05.000000 "))
+	if r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		b.WriteString(filepath.Base(frame.File) + ":" + strconv.Itoa(frame.Line) + ": ")
+	}
+	fields := []slog.Attr{}
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "component" {
+			b.WriteString(h.paint(Cyan, "["+a.Value.String()+"] "))
+		} else {
+			fields = append(fields, a)
+		}
+		return true
+	})
+	b.WriteString(r.Message)
+	for _, a := range fields {
+		b.WriteString(" " + h.paint(Blue, a.Key+"=") + log_text_value(a.Value))
+	}
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.out.Write(b.Bytes())
+	return err
+}
+
+func log_text_value(v slog.Value) string {
+	v = v.Resolve()
+	var s string
+	switch v.Kind() {
+	case slog.KindTime:
+		s = v.Time().Format(time.RFC3339)
+	case slog.KindDuration:
+		s = v.Duration().Round(time.Millisecond).String()
+	default:
+		s = v.String()
+	}
+	if s == "" || strings.ContainsAny(s, " \"=\n\t") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// The component handler never passes attrs or groups on.
+func (h *text_handler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *text_handler) WithGroup(string) slog.Handler      { return h }
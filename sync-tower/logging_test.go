@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// capture_logs sends every component logger to a JSON handler writing to
+// the returned buffer until the test ends.
+func capture_logs(t *testing.T) *bytes.Buffer {
+	var b bytes.Buffer
+	prev := log_output.Load()
+	var h slog.Handler = slog.NewJSONHandler(&b, &slog.HandlerOptions{Level: slog.LevelDebug, ReplaceAttr: log_json_attr})
+	log_output.Store(&h)
+	t.Cleanup(func() { log_output.Store(prev) })
+	return &b
+}
+
+func TestLevelUnmarshal(t *testing.T) {
+	tests := []struct {
+		yaml    string
+		want    slog.Level
+		wantErr bool
+	}{
+		{"debug", slog.LevelDebug, false},
+		{"info", slog.LevelInfo, false},
+		{"WARN", slog.LevelWarn, false},
+		{"error", slog.LevelError, false},
+		{"verbose", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.yaml, func(t *testing.T) {
+			var l Level
+			err := yaml.Unmarshal([]byte(tt.yaml), &l)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && slog.Level(l) != tt.want {
+				t.Errorf("Unmarshal() = %v, want %v", slog.Level(l), tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	prev := map[string]slog.Level{}
+	for component, level := range log_levels {
+		prev[component] = level.Level()
+	}
+	t.Cleanup(func() {
+		for component, level := range prev {
+			log_levels[component].Set(level)
+		}
+	})
+	tests := []struct {
+		name   string
+		config AppConfig
+		sink   slog.Level
+		outbox slog.Level
+	}{
+		{"log_level for all", AppConfig{LogLevel: Level(slog.LevelWarn)}, slog.LevelWarn, slog.LevelWarn},
+		{"log_levels per component", AppConfig{LogLevel: Level(slog.LevelInfo), LogLevels: map[string]Level{"sink": Level(slog.LevelDebug)}},
+			slog.LevelDebug, slog.LevelInfo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev_output := log_output.Load()
+			t.Cleanup(func() { log_output.Store(prev_output) })
+			configure_logging(&tt.config)
+			if log_levels["sink"].Level() != tt.sink || log_levels["outbox"].Level() != tt.outbox {
+				t.Errorf("sink %v, outbox %v, want %v, %v", log_levels["sink"].Level(), log_levels["outbox"].Level(), tt.sink, tt.outbox)
+			}
+		})
+	}
+}
+
+func TestComponentHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		level  slog.Level
+		log    func(l *slog.Logger)
+		fields map[string]any // nil when nothing is logged
+	}{
+		{"fields", slog.LevelInfo, func(l *slog.Logger) { l.Info("Uplink written", "msg_id", "a1", "dev_eui", "0004a30b001c0530") },
+			map[string]any{"level": "info", "msg": "Uplink written", "component": "sink", "msg_id": "a1", "dev_eui": "0004a30b001c0530"}},
+		{"below level", slog.LevelInfo, func(l *slog.Logger) { l.Debug("Uplink written") }, nil},
+		{"with attrs and group", slog.LevelDebug, func(l *slog.Logger) { l.With("msg_id", "a1").WithGroup("sync").Debug("Sent", "outcome", "ok") },
+			map[string]any{"level": "debug", "msg": "Sent", "component": "sink", "msg_id": "a1", "sync.outcome": "ok"}},
+		{"duration as text", slog.LevelInfo, func(l *slog.Logger) { l.Warn("Slow", "latency", 1500*time.Millisecond) },
+			map[string]any{"level": "warn", "msg": "Slow", "component": "sink", "latency": "1.5s"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := capture_logs(t)
+			level := new(slog.LevelVar)
+			level.Set(tt.level)
+			tt.log(slog.New(&component_handler{component: "sink", level: level}))
+			if tt.fields == nil {
+				if out.Len() != 0 {
+					t.Errorf("logged %s", out.String())
+				}
+				return
+			}
+			if strings.Count(out.String(), "\n") != 1 {
+				t.Fatalf("want one line, got %q", out.String())
+			}
+			var got map[string]any
+			if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			for key, want := range tt.fields {
+				if got[key] != want {
+					t.Errorf("%s = %v, want %v", key, got[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestTextHandler(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	h := new_text_handler(f)
+	if h.(*text_handler).colour {
+		t.Error("colour on a file")
+	}
+	prev := log_output.Load()
+	log_output.Store(&h)
+	t.Cleanup(func() { log_output.Store(prev) })
+	level := new(slog.LevelVar)
+	slog.New(&component_handler{component: "outbox", level: level}).Error("Sync failed", "msg_id", "a1", "err", "connection refused")
+
+	line, _ := os.ReadFile(f.Name())
+	want := regexp.MustCompile(`^\[ERROR\] \d{4}/\d\d/\d\d \d\d:\d\d:\d\d\.\d{6} logging_test\.go:\d+: \[outbox\] Sync failed msg_id=a1 err="connection refused"\n$`)
+	if !want.Match(line) {
+		t.Errorf("text line %q", line)
+	}
+}
+
+func TestLogTextValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value slog.Value
+		want  string
+	}{
+		{"plain", slog.StringValue("0004a30b001c0530"), "0004a30b001c0530"},
+		{"empty", slog.StringValue(""), `""`},
+		{"spaces", slog.StringValue("connection refused"), `"connection refused"`},
+		{"equals", slog.StringValue("a=b"), `"a=b"`},
+		{"int", slog.IntValue(42), "42"},
+		{"duration", slog.DurationValue(1234567 * time.Microsecond), "1.235s"},
+		{"time", slog.TimeValue(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)), "2024-03-01T08:00:00Z"},
+		{"secret", slog.AnyValue(Secret("a1b2c3d4e5f6")), redacted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := log_text_value(tt.value); got != tt.want {
+				t.Errorf("log_text_value() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+var maintenance_log = component_logger("maintenance")
+
+const ingest_table = "chirpstack_ingest"
+
+// Compacted uplinks, see PostgresSink.
+const aggregate_table = "chirpstack_aggregate"
+
+// Supported partition_interval and retention_action values.
+const (
+	partition_daily   = "daily"
+	partition_monthly = "monthly"
+
+	retention_drop    = "drop"
+	retention_archive = "archive"
+)
+
+// Maintenance keeps central storage bounded: it turns chirpstack_ingest into
+// a table partitioned by received_at, creates partitions ahead of time, and
+// drops or archives data older than the retention period.
+type Maintenance struct {
+	partition_interval  string
+	premake             int
+	retention           time.Duration
+	retention_action    string
+	archive_dir         string
+	outbox_retention    time.Duration
+	heartbeat_retention time.Duration
+	audit_retention     time.Duration
+	interval            time.Duration
+
+	done chan bool
+	wg   sync.WaitGroup
+}
+
+type Partition struct {
+	Name string
+	From time.Time // zero for MINVALUE
+	To   time.Time
+}
+
+type Maintenance_Run struct {
+	Id          int64
+	Started_At  time.Time
+	Finished_At time.Time
+	Actions     []string
+	Error       string
+}
+
+func NewMaintenance(appConfig *AppConfig) (*Maintenance, error) {
+	m := &Maintenance{
+		partition_interval:  appConfig.PartitionInterval,
+		premake:             appConfig.PartitionPremake,
+		retention:           time.Duration(appConfig.RetentionDays) * 24 * time.Hour,
+		retention_action:    appConfig.RetentionAction,
+		archive_dir:         appConfig.ArchiveDir,
+		outbox_retention:    time.Duration(appConfig.OutboxRetentionDays) * 24 * time.Hour,
+		heartbeat_retention: time.Duration(appConfig.HeartbeatRetentionDays) * 24 * time.Hour,
+		audit_retention:     time.Duration(appConfig.AuditRetentionDays) * 24 * time.Hour,
+		interval:            time.Duration(appConfig.MaintenanceInterval),
+		done:                make(chan bool),
+	}
+	if m.partition_interval != "" && m.partition_interval != partition_daily && m.partition_interval != partition_monthly {
+		return nil, fmt.Errorf("unknown partition_interval %q", m.partition_interval)
+	}
+	if m.retention_action == "" {
+		m.retention_action = retention_drop
+	}
+	if m.retention_action != retention_drop && m.retention_action != retention_archive {
+		return nil, fmt.Errorf("unknown retention_action %q", m.retention_action)
+	}
+	if m.archive_dir == "" {
+		m.archive_dir = "archive"
+	}
+	return m, nil
+}
+
+func (m *Maintenance) Start() {
+	m.wg.Add(1)
+	go m.maintenance_worker()
+}
+
+// Stop waits for a running pass to finish, so a reload never has two
+// passes partitioning or expiring at once.
+func (m *Maintenance) Stop() {
+	close(m.done)
+	m.wg.Wait()
+}
+
+func (m *Maintenance) maintenance_worker() {
+	defer m.wg.Done()
+	maintenance_log.Debug("Entering maintenance loop", "interval", m.interval)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	m.run()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.run()
+		}
+	}
+}
+
+// run performs one maintenance pass and records what it did.
+func (m *Maintenance) run() {
+	ctx := context.Background()
+	report := Maintenance_Run{Started_At: time.Now(), Actions: []string{}}
+	action := func(format string, args ...any) {
+		text := fmt.Sprintf(format, args...)
+		maintenance_log.Info(text)
+		report.Actions = append(report.Actions, text)
+	}
+
+	err := m.run_steps(ctx, action)
+	if err != nil {
+		maintenance_log.Warn("Maintenance failed", "err", err)
+		report.Error = err.Error()
+	}
+	report.Finished_At = time.Now()
+
+	_, err = db.ExecContext(ctx, `INSERT INTO maintenance_run (started_at, finished_at, actions, error) VALUES ($1, $2, $3, $4);`,
+		report.Started_At, report.Finished_At, report.Actions, report.Error)
+	if err != nil {
+		maintenance_log.Warn("Failed to record maintenance run", "err", err)
+	}
+}
+
+func (m *Maintenance) run_steps(ctx context.Context, action func(string, ...any)) error {
+	partitioned := false
+	if m.partition_interval != "" {
+		if err := m.ensure_partitioned(ctx, action); err != nil {
+			return err
+		}
+		if err := m.ensure_partitions(ctx, action); err != nil {
+			return err
+		}
+		partitioned = true
+	}
+
+	if m.retention > 0 {
+		cutoff := time.Now().Add(-m.retention)
+		if partitioned {
+			if err := m.expire_partitions(ctx, cutoff, action); err != nil {
+				return err
+			}
+		} else if err := m.expire_rows(ctx, cutoff, action); err != nil {
+			return err
+		}
+		if err := m.expire_aggregates(ctx, cutoff, action); err != nil {
+			return err
+		}
+	}
+
+	if m.outbox_retention > 0 {
+		if err := m.expire_outbox(ctx, time.Now().Add(-m.outbox_retention), action); err != nil {
+			return err
+		}
+	}
+
+	res, err := db.ExecContext(ctx, `DELETE FROM gateway_heartbeat WHERE received_at < $1;`, time.Now().Add(-m.heartbeat_retention))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		action("Deleted %d gateway heartbeats older than %s", n, m.heartbeat_retention)
+	}
+
+	if m.audit_retention > 0 {
+		res, err := db.ExecContext(ctx, `DELETE FROM audit_log WHERE time < $1;`, time.Now().Add(-m.audit_retention))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			action("Deleted %d audit entries older than %s", n, m.audit_retention)
+		}
+	}
+	return nil
+}
+
+func period_start(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	if interval == partition_daily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func period_next(t time.Time, interval string) time.Time {
+	if interval == partition_daily {
+		return t.AddDate(0, 0, 1)
+	}
+	return t.AddDate(0, 1, 0)
+}
+
+func partition_name(t time.Time, interval string) string {
+	if interval == partition_daily {
+		return ingest_table + "_p" + t.Format("20060102")
+	}
+	return ingest_table + "_p" + t.Format("200601")
+}
+
+func quote_ident(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func quote_time(t time.Time) string {
+	return "'" + t.UTC().Format(time.RFC3339) + "'"
+}
+
+// ensure_partitioned converts a plain chirpstack_ingest into a partitioned
+// table. The existing table becomes chirpstack_ingest_legacy, a partition
+// covering everything up to the end of the current period, so no rows move
+// and retention eventually drops it like any other partition.
+func (m *Maintenance) ensure_partitioned(ctx context.Context, action func(string, ...any)) error {
+	var kind string
+	err := db.QueryRowContext(ctx, `SELECT relkind::text FROM pg_class WHERE oid = $1::text::regclass;`, ingest_table).Scan(&kind)
+	if err != nil {
+		return err
+	}
+	if kind == "p" {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE `+ingest_table+` IN ACCESS EXCLUSIVE MODE;`); err != nil {
+		return err
+	}
+
+	var newest sql.NullTime
+	if err := tx.QueryRowContext(ctx, `SELECT max(received_at) FROM `+ingest_table+`;`).Scan(&newest); err != nil {
+		return err
+	}
+	upper := time.Now()
+	if newest.Valid && newest.Time.After(upper) {
+		upper = newest.Time
+	}
+	boundary := period_next(period_start(upper, m.partition_interval), m.partition_interval)
+
+	// Keep the index definitions so they can be recreated on the new parent,
+	// where PostgreSQL attaches the legacy indexes instead of rebuilding them.
+	rows, err := tx.QueryContext(ctx, `
+		SELECT i.relname, pg_get_indexdef(x.indexrelid), x.indisunique
+		FROM pg_index x JOIN pg_class i ON i.oid = x.indexrelid
+		WHERE x.indrelid = $1::text::regclass;`, ingest_table)
+	if err != nil {
+		return err
+	}
+	type index_def struct {
+		name   string
+		def    string
+		unique bool
+	}
+	indexes := []index_def{}
+	for rows.Next() {
+		var d index_def
+		if err := rows.Scan(&d.name, &d.def, &d.unique); err != nil {
+			rows.Close()
+			return err
+		}
+		indexes = append(indexes, d)
+	}
+	rows.Close()
+
+	for _, d := range indexes {
+		if _, err := tx.ExecContext(ctx, `ALTER INDEX `+quote_ident(d.name)+` RENAME TO `+quote_ident(d.name+"_legacy")+`;`); err != nil {
+			return err
+		}
+	}
+
+	legacy := ingest_table + "_legacy"
+	statements := []string{
+		`ALTER TABLE ` + ingest_table + ` RENAME TO ` + legacy + `;`,
+		`CREATE TABLE ` + ingest_table + ` (LIKE ` + legacy + ` INCLUDING DEFAULTS INCLUDING CONSTRAINTS) PARTITION BY RANGE (received_at);`,
+		`ALTER SEQUENCE IF EXISTS ` + ingest_table + `_id_seq OWNED BY ` + ingest_table + `.id;`,
+		`ALTER TABLE ` + ingest_table + ` ATTACH PARTITION ` + legacy + ` FOR VALUES FROM (MINVALUE) TO (` + quote_time(boundary) + `);`,
+	}
+	for _, d := range indexes {
+		// Unique indexes on a partitioned table must include the partition key.
+		if d.unique && !strings.Contains(d.def, "received_at") {
+			continue
+		}
+		statements = append(statements, d.def+";")
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("%s: %w", statement, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	action("Converted %s to a %s partitioned table, existing rows kept in %s up to %s",
+		ingest_table, m.partition_interval, legacy, boundary.Format(time.RFC3339))
+	return nil
+}
+
+var partition_bound_re = regexp.MustCompile(`FROM \((.+)\) TO \((.+)\)`)
+
+func list_partitions(ctx context.Context) ([]Partition, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.relname, pg_get_expr(c.relpartbound, c.oid)
+		FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = $1::text::regclass;`, ingest_table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partitions := []Partition{}
+	for rows.Next() {
+		var name, bound string
+		if err := rows.Scan(&name, &bound); err != nil {
+			return nil, err
+		}
+		match := partition_bound_re.FindStringSubmatch(bound)
+		if match == nil {
+			// DEFAULT partitions have no range and are never expired.
+			continue
+		}
+		p := Partition{Name: name}
+		if p.From, err = parse_bound(match[1]); err != nil {
+			return nil, fmt.Errorf("partition %s: %w", name, err)
+		}
+		if p.To, err = parse_bound(match[2]); err != nil {
+			return nil, fmt.Errorf("partition %s: %w", name, err)
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions, rows.Err()
+}
+
+// parse_bound reads a timestamptz literal as printed by pg_get_expr.
+func parse_bound(bound string) (time.Time, error) {
+	if bound == "MINVALUE" {
+		return time.Time{}, nil
+	}
+	if bound == "MAXVALUE" {
+		return time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	bound = strings.Trim(bound, "'")
+	t, err := time.Parse("2006-01-02 15:04:05.999999-07", bound)
+	if err != nil {
+		// Zones with a minutes offset, e.g. +05:30.
+		t, err = time.Parse("2006-01-02 15:04:05.999999-07:00", bound)
+	}
+	return t, err
+}
+
+func overlaps(partitions []Partition, from time.Time, to time.Time) bool {
+	for _, p := range partitions {
+		if (p.From.IsZero() || p.From.Before(to)) && p.To.After(from) {
+			return true
+		}
+	}
+	return false
+}
+
+// ensure_partitions creates the current period's partition and premake
+// periods ahead, so inserts never find a missing range.
+func (m *Maintenance) ensure_partitions(ctx context.Context, action func(string, ...any)) error {
+	partitions, err := list_partitions(ctx)
+	if err != nil {
+		return err
+	}
+
+	from := period_start(time.Now(), m.partition_interval)
+	for i := 0; i <= m.premake; i++ {
+		to := period_next(from, m.partition_interval)
+		if !overlaps(partitions, from, to) {
+			name := partition_name(from, m.partition_interval)
+			_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+quote_ident(name)+` PARTITION OF `+ingest_table+
+				` FOR VALUES FROM (`+quote_time(from)+`) TO (`+quote_time(to)+`);`)
+			if err != nil {
+				return fmt.Errorf("create partition %s: %w", name, err)
+			}
+			partitions = append(partitions, Partition{Name: name, From: from, To: to})
+			action("Created partition %s", name)
+		}
+		from = to
+	}
+	return nil
+}
+
+// expire_partitions archives and/or drops every partition that ends before
+// the retention cutoff.
+func (m *Maintenance) expire_partitions(ctx context.Context, cutoff time.Time, action func(string, ...any)) error {
+	partitions, err := list_partitions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, p := range partitions {
+		if p.To.After(cutoff) {
+			continue
+		}
+		if m.retention_action == retention_archive {
+			count, file, err := m.archive(ctx, `SELECT row_to_json(t)::text FROM `+quote_ident(p.Name)+` t;`, p.Name)
+			if err != nil {
+				return fmt.Errorf("archive partition %s: %w", p.Name, err)
+			}
+			action("Archived %d rows of partition %s to %s", count, p.Name, file)
+		}
+		if _, err := db.ExecContext(ctx, `ALTER TABLE `+ingest_table+` DETACH PARTITION `+quote_ident(p.Name)+`;`); err != nil {
+			return fmt.Errorf("detach partition %s: %w", p.Name, err)
+		}
+		if _, err := db.ExecContext(ctx, `DROP TABLE `+quote_ident(p.Name)+`;`); err != nil {
+			return fmt.Errorf("drop partition %s: %w", p.Name, err)
+		}
+		action("Dropped partition %s", p.Name)
+	}
+	return nil
+}
+
+// expire_rows is the retention path for an unpartitioned table.
+func (m *Maintenance) expire_rows(ctx context.Context, cutoff time.Time, action func(string, ...any)) error {
+	if m.retention_action == retention_archive {
+		name := ingest_table + "_before_" + cutoff.UTC().Format("20060102T150405")
+		count, file, err := m.archive(ctx, `SELECT row_to_json(t)::text FROM `+ingest_table+` t WHERE received_at < `+quote_time(cutoff)+`;`, name)
+		if err != nil {
+			return fmt.Errorf("archive rows: %w", err)
+		}
+		if count > 0 {
+			action("Archived %d rows older than %s to %s", count, cutoff.Format(time.RFC3339), file)
+		} else {
+			os.Remove(file)
+		}
+	}
+	res, err := db.ExecContext(ctx, `DELETE FROM `+ingest_table+` WHERE received_at < $1;`, cutoff)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		action("Deleted %d rows older than %s from %s", n, cutoff.Format(time.RFC3339), ingest_table)
+	}
+	return nil
+}
+
+// expire_aggregates applies retention to chirpstack_aggregate, which is
+// never partitioned, the same way expire_rows does to chirpstack_ingest.
+func (m *Maintenance) expire_aggregates(ctx context.Context, cutoff time.Time, action func(string, ...any)) error {
+	if m.retention_action == retention_archive {
+		name := aggregate_table + "_before_" + cutoff.UTC().Format("20060102T150405")
+		count, file, err := m.archive(ctx, `SELECT row_to_json(t)::text FROM `+aggregate_table+` t WHERE received_at < `+quote_time(cutoff)+`;`, name)
+		if err != nil {
+			return fmt.Errorf("archive aggregates: %w", err)
+		}
+		if count > 0 {
+			action("Archived %d aggregates older than %s to %s", count, cutoff.Format(time.RFC3339), file)
+		} else {
+			os.Remove(file)
+		}
+	}
+	res, err := db.ExecContext(ctx, `DELETE FROM `+aggregate_table+` WHERE received_at < $1;`, cutoff)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		action("Deleted %d rows older than %s from %s", n, cutoff.Format(time.RFC3339), aggregate_table)
+	}
+	return nil
+}
+
+// expire_outbox removes stored messages older than the cutoff once no sink
+// is still waiting for them. Their outbox rows go with them.
+func (m *Maintenance) expire_outbox(ctx context.Context, cutoff time.Time, action func(string, ...any)) error {
+	total := int64(0)
+	for {
+		res, err := db.ExecContext(ctx, `
+			DELETE FROM uplink_message WHERE id IN (
+				SELECT m.id FROM uplink_message m
+				WHERE m.received_at < $1
+				  AND NOT EXISTS (SELECT 1 FROM sink_outbox o WHERE o.message_id = m.id AND o.status = 'pending')
+				LIMIT 10000);`, cutoff)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+		if n < 10000 {
+			break
+		}
+	}
+	if total > 0 {
+		action("Deleted %d outbox messages older than %s", total, cutoff.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// archive streams the single text column returned by query into a gzipped
+// NDJSON file in archive_dir. The file only gets its final name once it is
+// complete and synced, so a crash never leaves a truncated archive behind.
+func (m *Maintenance) archive(ctx context.Context, query string, name string) (int64, string, error) {
+	if err := os.MkdirAll(m.archive_dir, 0o755); err != nil {
+		return 0, "", err
+	}
+	final := filepath.Join(m.archive_dir, name+".ndjson.gz")
+	tmp := final + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, "", err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	buffered := bufio.NewWriter(f)
+	gz := gzip.NewWriter(buffered)
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return 0, "", err
+	}
+	defer rows.Close()
+
+	count := int64(0)
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return 0, "", err
+		}
+		gz.Write([]byte(line))
+		gz.Write([]byte("\n"))
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, "", err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, "", err
+	}
+	if err := buffered.Flush(); err != nil {
+		return 0, "", err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, "", err
+	}
+	if err := os.Rename(tmp, final); err != nil {
+		return 0, "", err
+	}
+	return count, final, nil
+}
+
+func maintenanceStatusHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	w.Header().Set("Content-Type", "application/json")
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, started_at, finished_at, actions, error
+		FROM maintenance_run ORDER BY started_at DESC LIMIT 50;`)
+	if err != nil {
+		maintenance_log.Warn("Failed to query maintenance runs", "err", err)
+		write_json_error(w, http.StatusInternalServerError, "Failed to query maintenance runs")
+		return
+	}
+	defer rows.Close()
+
+	type_map := pgtype.NewMap()
+	runs := []Maintenance_Run{}
+	for rows.Next() {
+		var run Maintenance_Run
+		if err := rows.Scan(&run.Id, &run.Started_At, &run.Finished_At, type_map.SQLScanner(&run.Actions), &run.Error); err != nil {
+			maintenance_log.Warn("Failed to read maintenance run", "err", err)
+			continue
+		}
+		runs = append(runs, run)
+	}
+	json.NewEncoder(w).Encode(runs)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeriods(t *testing.T) {
+	at := time.Date(2026, 1, 31, 22, 15, 0, 0, time.FixedZone("MYT", 8*3600))
+	tests := []struct {
+		interval string
+		start    time.Time
+		next     time.Time
+		name     string
+	}{
+		{partition_daily, time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC), time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), "chirpstack_ingest_p20260131"},
+		{partition_monthly, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), "chirpstack_ingest_p202601"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.interval, func(t *testing.T) {
+			start := period_start(at, tt.interval)
+			if !start.Equal(tt.start) {
+				t.Errorf("period_start() = %v, want %v", start, tt.start)
+			}
+			if next := period_next(start, tt.interval); !next.Equal(tt.next) {
+				t.Errorf("period_next() = %v, want %v", next, tt.next)
+			}
+			if name := partition_name(start, tt.interval); name != tt.name {
+				t.Errorf("partition_name() = %s, want %s", name, tt.name)
+			}
+		})
+	}
+}
+
+func TestParseBound(t *testing.T) {
+	tests := []struct {
+		bound   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"MINVALUE", time.Time{}, false},
+		{"MAXVALUE", time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{"'2026-02-01 00:00:00+00'", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), false},
+		{"'2026-02-01 08:00:00+08'", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), false},
+		{"'2026-02-01 05:30:00+05:30'", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), false},
+		{"'2026-02-01 00:00:00.5+00'", time.Date(2026, 2, 1, 0, 0, 0, 500000000, time.UTC), false},
+		{"'yesterday'", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.bound, func(t *testing.T) {
+			got, err := parse_bound(tt.bound)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse_bound() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("parse_bound() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverlaps(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2026, 1, d, 0, 0, 0, 0, time.UTC) }
+	partitions := []Partition{
+		{Name: "legacy", To: day(5)},
+		{Name: "p20260110", From: day(10), To: day(11)},
+	}
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     bool
+	}{
+		{"inside legacy", day(3), day(4), true},
+		{"right after legacy", day(5), day(6), false},
+		{"same range", day(10), day(11), true},
+		{"spans a partition", day(9), day(12), true},
+		{"right before", day(9), day(10), false},
+		{"after all", day(11), day(12), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := overlaps(partitions, tt.from, tt.to); got != tt.want {
+				t.Errorf("overlaps() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuoting(t *testing.T) {
+	tests := []struct {
+		got, want string
+	}{
+		{quote_ident("chirpstack_ingest_p202601"), `"chirpstack_ingest_p202601"`},
+		{quote_ident(`odd"name`), `"odd""name"`},
+		{quote_time(time.Date(2026, 1, 1, 8, 0, 0, 0, time.FixedZone("MYT", 8*3600))), "'2026-01-01T00:00:00Z'"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got %s, want %s", tt.got, tt.want)
+		}
+	}
+}
+
+func TestNewMaintenance(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  AppConfig
+		wantErr bool
+		action  string
+		archive string
+	}{
+		{"defaults", AppConfig{}, false, retention_drop, "archive"},
+		{"archive", AppConfig{PartitionInterval: partition_daily, RetentionAction: retention_archive, ArchiveDir: "/var/lib/sync-tower"}, false, retention_archive, "/var/lib/sync-tower"},
+		{"unknown interval", AppConfig{PartitionInterval: "weekly"}, true, "", ""},
+		{"unknown action", AppConfig{RetentionAction: "truncate"}, true, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMaintenance(&tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewMaintenance() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (m.retention_action != tt.action || m.archive_dir != tt.archive) {
+				t.Errorf("got %s, %s, want %s, %s", m.retention_action, m.archive_dir, tt.action, tt.archive)
+			}
+		})
+	}
+}
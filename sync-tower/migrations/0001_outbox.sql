@@ -0,0 +1,24 @@
+-- Outbox tables, previously created at startup by create_outbox_tables.
+CREATE TABLE IF NOT EXISTS uplink_message (
+    id               BIGSERIAL PRIMARY KEY,
+    received_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    dev_eui          TEXT NOT NULL DEFAULT '',
+    deduplication_id TEXT NOT NULL DEFAULT '',
+    source_address   TEXT NOT NULL DEFAULT '',
+    payload          JSONB NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uplink_message_deduplication_id_idx
+    ON uplink_message (deduplication_id) WHERE deduplication_id <> '';
+
+CREATE TABLE IF NOT EXISTS sink_outbox (
+    message_id      BIGINT NOT NULL REFERENCES uplink_message (id) ON DELETE CASCADE,
+    sink_name       TEXT NOT NULL,
+    status          TEXT NOT NULL DEFAULT 'pending',
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    last_error      TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    delivered_at    TIMESTAMPTZ,
+    PRIMARY KEY (message_id, sink_name)
+);
+CREATE INDEX IF NOT EXISTS sink_outbox_pending_idx
+    ON sink_outbox (sink_name, next_attempt_at) WHERE status = 'pending';
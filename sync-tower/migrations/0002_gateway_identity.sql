@@ -0,0 +1,2 @@
+-- Which edge-vault forwarded the message, from the X-Gateway-Id header.
+ALTER TABLE uplink_message ADD COLUMN IF NOT EXISTS gateway_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,58 @@
+-- The original table only had these columns and was created by hand.
+CREATE TABLE IF NOT EXISTS chirpstack_ingest (
+    id               BIGSERIAL,
+    dev_eui          TEXT,
+    tenant_name      TEXT,
+    application_name TEXT,
+    raw_payload      JSONB
+);
+
+ALTER TABLE chirpstack_ingest
+    ADD COLUMN IF NOT EXISTS message_id       BIGINT,
+    ADD COLUMN IF NOT EXISTS received_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS time             TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS device_name      TEXT,
+    ADD COLUMN IF NOT EXISTS f_cnt            BIGINT,
+    ADD COLUMN IF NOT EXISTS f_port           INTEGER,
+    ADD COLUMN IF NOT EXISTS dr               INTEGER,
+    ADD COLUMN IF NOT EXISTS frequency        BIGINT,
+    ADD COLUMN IF NOT EXISTS rssi             INTEGER,
+    ADD COLUMN IF NOT EXISTS snr              REAL,
+    ADD COLUMN IF NOT EXISTS gateway_ids      TEXT[],
+    ADD COLUMN IF NOT EXISTS deduplication_id TEXT,
+    ADD COLUMN IF NOT EXISTS gateway_id       TEXT;
+
+-- Fill the typed columns for rows stored before they existed.
+UPDATE chirpstack_ingest SET
+    time             = (raw_payload->>'time')::timestamptz,
+    received_at      = COALESCE((raw_payload->>'time')::timestamptz, received_at),
+    device_name      = raw_payload->'deviceInfo'->>'deviceName',
+    f_cnt            = (raw_payload->>'fCnt')::bigint,
+    f_port           = (raw_payload->>'fPort')::integer,
+    dr               = (raw_payload->>'dr')::integer,
+    frequency        = (raw_payload->'txInfo'->>'frequency')::bigint,
+    rssi             = (SELECT max((rx->>'rssi')::integer) FROM jsonb_array_elements(raw_payload->'rxInfo') rx),
+    snr              = (SELECT max((rx->>'snr')::real) FROM jsonb_array_elements(raw_payload->'rxInfo') rx),
+    gateway_ids      = ARRAY(SELECT DISTINCT rx->>'gatewayId' FROM jsonb_array_elements(raw_payload->'rxInfo') rx),
+    deduplication_id = raw_payload->>'deduplicationId'
+WHERE time IS NULL
+  AND jsonb_typeof(raw_payload) = 'object'
+  AND raw_payload->>'time' ~ '^\d{4}-\d{2}-\d{2}T'
+  AND jsonb_typeof(COALESCE(raw_payload->'rxInfo', '[]'::jsonb)) = 'array';
+
+-- Redelivery from the outbox must not store a message twice. received_at is
+-- part of the key so the index survives partitioning by received_at.
+CREATE UNIQUE INDEX IF NOT EXISTS chirpstack_ingest_message_id_idx
+    ON chirpstack_ingest (message_id, received_at);
+CREATE INDEX IF NOT EXISTS chirpstack_ingest_dev_eui_time_idx
+    ON chirpstack_ingest (dev_eui, time DESC);
+CREATE INDEX IF NOT EXISTS chirpstack_ingest_time_idx
+    ON chirpstack_ingest (time);
+CREATE INDEX IF NOT EXISTS chirpstack_ingest_received_at_idx
+    ON chirpstack_ingest (received_at);
+CREATE INDEX IF NOT EXISTS chirpstack_ingest_application_time_idx
+    ON chirpstack_ingest (application_name, time DESC);
+CREATE INDEX IF NOT EXISTS chirpstack_ingest_deduplication_id_idx
+    ON chirpstack_ingest (deduplication_id);
+CREATE INDEX IF NOT EXISTS chirpstack_ingest_gateway_ids_idx
+    ON chirpstack_ingest USING GIN (gateway_ids);
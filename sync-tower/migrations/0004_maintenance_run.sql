@@ -0,0 +1,9 @@
+-- One row per run of the background maintenance job.
+CREATE TABLE IF NOT EXISTS maintenance_run (
+    id          BIGSERIAL PRIMARY KEY,
+    started_at  TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ NOT NULL,
+    actions     TEXT[] NOT NULL DEFAULT '{}',
+    error       TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS maintenance_run_started_at_idx ON maintenance_run (started_at DESC);
@@ -0,0 +1,41 @@
+-- Health monitor state, one row per configured target. Older hand-made
+-- APPLICATION_STATUS tables are extended in place.
+CREATE TABLE IF NOT EXISTS application_status (
+    application_id   SERIAL PRIMARY KEY,
+    application_name TEXT NOT NULL
+);
+
+ALTER TABLE application_status
+    ADD COLUMN IF NOT EXISTS application_address TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS status              TEXT NOT NULL DEFAULT 'unknown',
+    ADD COLUMN IF NOT EXISTS response_code       INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS latency_ms          INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS last_error          TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS last_checked        TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS status_since        TIMESTAMPTZ;
+
+-- last_seen used to be free text, it now holds the last successful probe.
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_name = 'application_status' AND column_name = 'last_seen'
+                 AND data_type <> 'timestamp with time zone') THEN
+        ALTER TABLE application_status RENAME COLUMN last_seen TO last_seen_legacy;
+    END IF;
+END $$;
+ALTER TABLE application_status ADD COLUMN IF NOT EXISTS last_seen TIMESTAMPTZ;
+
+CREATE UNIQUE INDEX IF NOT EXISTS application_status_name_idx ON application_status (application_name);
+
+CREATE TABLE IF NOT EXISTS application_status_history (
+    id               BIGSERIAL PRIMARY KEY,
+    application_name TEXT NOT NULL,
+    previous_status  TEXT NOT NULL,
+    status           TEXT NOT NULL,
+    response_code    INTEGER NOT NULL DEFAULT 0,
+    latency_ms       INTEGER NOT NULL DEFAULT 0,
+    error            TEXT NOT NULL DEFAULT '',
+    changed_at       TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS application_status_history_name_idx
+    ON application_status_history (application_name, changed_at DESC);
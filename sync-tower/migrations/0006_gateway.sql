@@ -0,0 +1,28 @@
+-- Latest reported state of every edge-vault that sent a heartbeat.
+CREATE TABLE IF NOT EXISTS gateway (
+    gateway_id                 TEXT PRIMARY KEY,
+    hostname                   TEXT NOT NULL DEFAULT '',
+    version                    TEXT NOT NULL DEFAULT '',
+    uptime_seconds             BIGINT NOT NULL DEFAULT 0,
+    queue_depth                BIGINT NOT NULL DEFAULT 0,
+    oldest_queued_age_seconds  BIGINT NOT NULL DEFAULT 0,
+    disk_free_bytes            BIGINT NOT NULL DEFAULT 0,
+    mqtt_state                 TEXT NOT NULL DEFAULT '',
+    heartbeat_interval_seconds INTEGER NOT NULL DEFAULT 0,
+    source_address             TEXT NOT NULL DEFAULT '',
+    first_seen                 TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_seen                  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Recent heartbeats, used to tell whether a backlog keeps growing.
+CREATE TABLE IF NOT EXISTS gateway_heartbeat (
+    id                        BIGSERIAL PRIMARY KEY,
+    gateway_id                TEXT NOT NULL REFERENCES gateway (gateway_id) ON DELETE CASCADE,
+    received_at               TIMESTAMPTZ NOT NULL DEFAULT now(),
+    queue_depth               BIGINT NOT NULL DEFAULT 0,
+    oldest_queued_age_seconds BIGINT NOT NULL DEFAULT 0,
+    disk_free_bytes           BIGINT NOT NULL DEFAULT 0,
+    mqtt_state                TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS gateway_heartbeat_gateway_idx ON gateway_heartbeat (gateway_id, received_at DESC);
+CREATE INDEX IF NOT EXISTS gateway_heartbeat_received_at_idx ON gateway_heartbeat (received_at);
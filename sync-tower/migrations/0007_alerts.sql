@@ -0,0 +1,34 @@
+-- One row per alert occurrence, from firing until resolved.
+CREATE TABLE IF NOT EXISTS alert (
+    id                 BIGSERIAL PRIMARY KEY,
+    rule_name          TEXT NOT NULL,
+    subject            TEXT NOT NULL,
+    severity           TEXT NOT NULL DEFAULT '',
+    state              TEXT NOT NULL DEFAULT 'firing',
+    message            TEXT NOT NULL DEFAULT '',
+    started_at         TIMESTAMPTZ NOT NULL DEFAULT now(),
+    resolved_at        TIMESTAMPTZ,
+    last_notified_at   TIMESTAMPTZ,
+    notification_count INTEGER NOT NULL DEFAULT 0,
+    acknowledged_at    TIMESTAMPTZ,
+    acknowledged_by    TEXT NOT NULL DEFAULT ''
+);
+-- At most one firing alert per rule and subject, this is what deduplicates.
+CREATE UNIQUE INDEX IF NOT EXISTS alert_firing_idx ON alert (rule_name, subject) WHERE state = 'firing';
+CREATE INDEX IF NOT EXISTS alert_started_at_idx ON alert (started_at DESC);
+
+-- Notifications are suppressed while a matching silence is active. An empty
+-- rule_name or subject matches everything.
+CREATE TABLE IF NOT EXISTS alert_silence (
+    id         BIGSERIAL PRIMARY KEY,
+    rule_name  TEXT NOT NULL DEFAULT '',
+    subject    TEXT NOT NULL DEFAULT '',
+    starts_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ends_at    TIMESTAMPTZ NOT NULL,
+    created_by TEXT NOT NULL DEFAULT '',
+    comment    TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- device_silent looks up the last uplink per device.
+CREATE INDEX IF NOT EXISTS uplink_message_dev_eui_received_at_idx ON uplink_message (dev_eui, received_at DESC);
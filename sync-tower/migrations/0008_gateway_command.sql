@@ -0,0 +1,19 @@
+-- Commands queued for a gateway, delivered in the uplink response or via
+-- long-poll and acknowledged by edge-vault with a result.
+CREATE TABLE IF NOT EXISTS gateway_command (
+    id           BIGSERIAL PRIMARY KEY,
+    gateway_id   TEXT NOT NULL,
+    type         TEXT NOT NULL,
+    payload      JSONB NOT NULL DEFAULT '{}',
+    status       TEXT NOT NULL DEFAULT 'pending',
+    attempts     INTEGER NOT NULL DEFAULT 0,
+    result       TEXT NOT NULL DEFAULT '',
+    created_by   TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at   TIMESTAMPTZ,
+    delivered_at TIMESTAMPTZ,
+    completed_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS gateway_command_pending_idx ON gateway_command (gateway_id, id)
+    WHERE status IN ('pending', 'delivered');
+CREATE INDEX IF NOT EXISTS gateway_command_created_at_idx ON gateway_command (created_at DESC);
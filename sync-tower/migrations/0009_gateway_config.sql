@@ -0,0 +1,17 @@
+-- Versioned per-gateway overrides of edge-vault's config.yaml. Each version
+-- records what the gateway reported after trying to apply it.
+CREATE TABLE IF NOT EXISTS gateway_config (
+    gateway_id  TEXT NOT NULL,
+    version     INTEGER NOT NULL,
+    config      JSONB NOT NULL,
+    comment     TEXT NOT NULL DEFAULT '',
+    created_by  TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    status      TEXT NOT NULL DEFAULT 'pending',
+    error       TEXT NOT NULL DEFAULT '',
+    reported_at TIMESTAMPTZ,
+    PRIMARY KEY (gateway_id, version)
+);
+
+-- The config version the gateway last reported as applied.
+ALTER TABLE gateway ADD COLUMN IF NOT EXISTS config_version INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,32 @@
+-- Administrative actions through the API, who did what, when and from
+-- where. Entries are never changed, and only removed by maintenance once
+-- they are older than audit_retention_days, never within a day.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id      BIGSERIAL PRIMARY KEY,
+    time    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    actor   TEXT NOT NULL DEFAULT '',
+    source  TEXT NOT NULL DEFAULT '',
+    action  TEXT NOT NULL,
+    target  TEXT NOT NULL DEFAULT '',
+    before  JSONB,
+    after   JSONB,
+    outcome TEXT NOT NULL,
+    error   TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS audit_log_time_idx ON audit_log (time DESC);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' THEN
+        RAISE EXCEPTION 'audit_log is append-only';
+    END IF;
+    IF OLD.time > now() - interval '1 day' THEN
+        RAISE EXCEPTION 'audit_log entries are kept for at least a day';
+    END IF;
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
@@ -0,0 +1,3 @@
+-- Queued messages the gateway expired since it started, as last reported.
+ALTER TABLE gateway ADD COLUMN IF NOT EXISTS expired_dropped BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE gateway ADD COLUMN IF NOT EXISTS expired_archived BIGINT NOT NULL DEFAULT 0;
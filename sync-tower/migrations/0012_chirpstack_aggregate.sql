@@ -0,0 +1,28 @@
+-- Uplinks a gateway compacted during a long outage, one row per device and
+-- window with min/max/mean/last of each numeric field of the readings it
+-- replaced. Kept apart from chirpstack_ingest so queries over raw readings
+-- never mistake a summary for one.
+CREATE TABLE IF NOT EXISTS chirpstack_aggregate (
+    id               BIGSERIAL PRIMARY KEY,
+    message_id       BIGINT NOT NULL,
+    received_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    dev_eui          TEXT,
+    device_name      TEXT,
+    tenant_name      TEXT,
+    application_name TEXT,
+    gateway_id       TEXT,
+    deduplication_id TEXT,
+    window_start     TIMESTAMPTZ NOT NULL,
+    window_end       TIMESTAMPTZ NOT NULL,
+    count            INTEGER NOT NULL,
+    first_time       TIMESTAMPTZ NOT NULL,
+    last_time        TIMESTAMPTZ NOT NULL,
+    fields           JSONB NOT NULL,
+    raw_payload      JSONB
+);
+CREATE UNIQUE INDEX IF NOT EXISTS chirpstack_aggregate_message_id_idx
+    ON chirpstack_aggregate (message_id);
+CREATE INDEX IF NOT EXISTS chirpstack_aggregate_dev_eui_window_idx
+    ON chirpstack_aggregate (dev_eui, window_start DESC);
+CREATE INDEX IF NOT EXISTS chirpstack_aggregate_received_at_idx
+    ON chirpstack_aggregate (received_at);
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := load_migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no embedded migrations")
+	}
+	for i, m := range migrations {
+		// Versions are applied in order and recorded once, a gap or a
+		// duplicate means a misnamed file.
+		if m.Version != i+1 {
+			t.Errorf("migration %s has version %d, want %d", m.Name, m.Version, i+1)
+		}
+		if !strings.HasSuffix(m.Name, ".sql") || strings.TrimSpace(m.Sql) == "" {
+			t.Errorf("migration %s is empty or not .sql", m.Name)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/yaml.v3"
+)
+
+// Notification is one message about an alert, sent when it fires, repeats
+// or resolves.
+type Notification struct {
+	Alert_Id   int64
+	Rule       string
+	Subject    string
+	Severity   string
+	State      string
+	Message    string
+	Started_At time.Time
+	Sent_At    time.Time
+}
+
+func (n Notification) Title() string {
+	return fmt.Sprintf("[%s] %s %s: %s", strings.ToUpper(n.State), n.Severity, n.Rule, n.Subject)
+}
+
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, n Notification) error
+	Close() error
+}
+
+type AlertChannelConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+
+	// At most this many notifications per hour, the rest are dropped.
+	RateLimitPerHour int `yaml:"rate_limit_per_hour"`
+
+	// smtp
+	SmtpHost     string   `yaml:"smtp_host"`
+	SmtpPort     int      `yaml:"smtp_port"` // 587
+	SmtpUser     string   `yaml:"smtp_user"`
+	SmtpPassword Secret   `yaml:"smtp_password"`
+	SmtpFrom     string   `yaml:"smtp_from"`
+	SmtpTo       []string `yaml:"smtp_to"`
+
+	// webhook
+	WebhookUrl     string            `yaml:"webhook_url"`
+	WebhookHeaders map[string]Secret `yaml:"webhook_headers"`
+
+	// mqtt
+	MqttBroker   string `yaml:"mqtt_broker"`
+	MqttUser     string `yaml:"mqtt_user"`
+	MqttPassword Secret `yaml:"mqtt_password"`
+	MqttTopic    string `yaml:"mqtt_topic"`
+}
+
+func (cc *AlertChannelConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain AlertChannelConfig
+	p := plain{SmtpPort: 587}
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	*cc = AlertChannelConfig(p)
+	return nil
+}
+
+func NewNotifier(cc AlertChannelConfig) (Notifier, error) {
+	switch cc.Type {
+	case "smtp":
+		if cc.SmtpHost == "" || cc.SmtpFrom == "" || len(cc.SmtpTo) == 0 {
+			return nil, fmt.Errorf("alert channel %s: smtp_host, smtp_from and smtp_to are required", cc.Name)
+		}
+		return &SmtpNotifier{config: cc}, nil
+	case "webhook":
+		if cc.WebhookUrl == "" {
+			return nil, fmt.Errorf("alert channel %s: webhook_url is required", cc.Name)
+		}
+		return &WebhookNotifier{config: cc, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "mqtt":
+		if cc.MqttBroker == "" || cc.MqttTopic == "" {
+			return nil, fmt.Errorf("alert channel %s: mqtt_broker and mqtt_topic are required", cc.Name)
+		}
+		client := new_mqtt_client("sync-tower-alert-"+cc.Name, cc.MqttBroker, cc.MqttUser, cc.MqttPassword)
+		return &MqttNotifier{config: cc, client: client}, nil
+	}
+	return nil, fmt.Errorf("alert channel %s: unknown type %q", cc.Name, cc.Type)
+}
+
+type SmtpNotifier struct {
+	config AlertChannelConfig
+}
+
+func (s *SmtpNotifier) Name() string { return s.config.Name }
+
+func (s *SmtpNotifier) Notify(ctx context.Context, n Notification) error {
+	var auth smtp.Auth
+	if s.config.SmtpUser != "" {
+		auth = smtp.PlainAuth("", s.config.SmtpUser, string(s.config.SmtpPassword), s.config.SmtpHost)
+	}
+
+	var body strings.Builder
+	body.WriteString("From: " + s.config.SmtpFrom + "\r\n")
+	body.WriteString("To: " + strings.Join(s.config.SmtpTo, ", ") + "\r\n")
+	body.WriteString("Subject: " + n.Title() + "\r\n")
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	body.WriteString(n.Message + "\r\n\r\n")
+	body.WriteString(fmt.Sprintf("Rule: %s\r\nSubject: %s\r\nSeverity: %s\r\nState: %s\r\nStarted: %s\r\nAlert: %d\r\n",
+		n.Rule, n.Subject, n.Severity, n.State, n.Started_At.Format(time.RFC3339), n.Alert_Id))
+
+	return smtp.SendMail(s.config.SmtpHost+":"+strconv.Itoa(s.config.SmtpPort), auth, s.config.SmtpFrom, s.config.SmtpTo, []byte(body.String()))
+}
+
+func (s *SmtpNotifier) Close() error { return nil }
+
+type WebhookNotifier struct {
+	config AlertChannelConfig
+	client *http.Client
+}
+
+func (s *WebhookNotifier) Name() string { return s.config.Name }
+
+func (s *WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.WebhookUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.config.WebhookHeaders {
+		req.Header.Set(key, string(value))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *WebhookNotifier) Close() error { return nil }
+
+type MqttNotifier struct {
+	config AlertChannelConfig
+	client mqtt.Client
+}
+
+func (s *MqttNotifier) Name() string { return s.config.Name }
+
+func (s *MqttNotifier) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	topic := strings.NewReplacer("{rule}", n.Rule, "{state}", n.State).Replace(s.config.MqttTopic)
+	token := s.client.Publish(topic, 1, false, body)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *MqttNotifier) Close() error {
+	s.client.Disconnect(250)
+	return nil
+}
+
+// Rate_Limited_Notifier drops notifications beyond limit per rolling hour so
+// a flapping rule cannot flood a mailbox.
+type Rate_Limited_Notifier struct {
+	Notifier
+	limit int
+
+	mu   sync.Mutex
+	sent []time.Time
+}
+
+func (r *Rate_Limited_Notifier) Allow() bool {
+	if r.limit <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cutoff := time.Now().Add(-time.Hour)
+	kept := r.sent[:0]
+	for _, t := range r.sent {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	r.sent = kept
+	if len(r.sent) >= r.limit {
+		return false
+	}
+	r.sent = append(r.sent, time.Now())
+	return true
+}
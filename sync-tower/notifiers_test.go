@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotificationTitle(t *testing.T) {
+	n := Notification{Rule: "gateway-down", Subject: "spectra-gw-01", Severity: "critical", State: alert_firing}
+	if got, want := n.Title(), "[FIRING] critical gateway-down: spectra-gw-01"; got != want {
+		t.Errorf("Title() = %s, want %s", got, want)
+	}
+}
+
+func TestRateLimitedNotifierAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		sends int
+		want  int
+	}{
+		{"unlimited", 0, 10, 10},
+		{"below limit", 5, 3, 3},
+		{"limited", 3, 10, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Rate_Limited_Notifier{limit: tt.limit}
+			allowed := 0
+			for range tt.sends {
+				if r.Allow() {
+					allowed++
+				}
+			}
+			if allowed != tt.want {
+				t.Errorf("allowed %d, want %d", allowed, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewNotifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  AlertChannelConfig
+		wantErr bool
+	}{
+		{"smtp", AlertChannelConfig{Name: "mail", Type: "smtp", SmtpHost: "mail", SmtpFrom: "a@example.com", SmtpTo: []string{"b@example.com"}}, false},
+		{"smtp without recipients", AlertChannelConfig{Name: "mail", Type: "smtp", SmtpHost: "mail", SmtpFrom: "a@example.com"}, true},
+		{"webhook", AlertChannelConfig{Name: "ops", Type: "webhook", WebhookUrl: "https://hooks.example.com"}, false},
+		{"webhook without url", AlertChannelConfig{Name: "ops", Type: "webhook"}, true},
+		{"mqtt without topic", AlertChannelConfig{Name: "bus", Type: "mqtt", MqttBroker: "tcp://broker:1883"}, true},
+		{"unknown", AlertChannelConfig{Name: "pager", Type: "sms"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := NewNotifier(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewNotifier() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if n != nil {
+				n.Close()
+			}
+		})
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    int
+		wantErr bool
+	}{
+		{"accepted", http.StatusNoContent, false},
+		{"rejected", http.StatusInternalServerError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Notification
+			var token string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				token = r.Header.Get("X-Token")
+				json.NewDecoder(r.Body).Decode(&got)
+				w.WriteHeader(tt.code)
+			}))
+			defer server.Close()
+			n, err := NewNotifier(AlertChannelConfig{Name: "ops", Type: "webhook", WebhookUrl: server.URL,
+				WebhookHeaders: map[string]Secret{"X-Token": "s3cret"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = n.Notify(context.Background(), Notification{Alert_Id: 7, Rule: "gateway-down", State: alert_firing})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Notify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.Alert_Id != 7 || got.Rule != "gateway-down" || token != "s3cret" {
+				t.Errorf("webhook received %+v with token %q", got, token)
+			}
+		})
+	}
+}
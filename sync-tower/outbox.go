@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var outbox_log = component_logger("outbox")
+
+// Outbox delivery states.
+const (
+	outbox_pending   = "pending"
+	outbox_delivered = "delivered"
+	outbox_failed    = "failed"
+)
+
+// How long a dispatcher owns a claimed row before another one may retry it.
+const outbox_lease = 2 * time.Minute
+
+// Longest wait between two delivery attempts of the same message.
+const outbox_max_backoff = 10 * time.Minute
+
+// Outbox persists every accepted uplink once in uplink_message and tracks
+// its delivery to each sink in sink_outbox. One dispatcher per sink drains
+// its own rows, so a sink that was down catches up without holding back
+// the others.
+type Outbox struct {
+	sinks         []Registered_Sink
+	poll_interval time.Duration
+	batch_size    int
+
+	wake map[string]chan bool
+	done chan bool
+	wg   sync.WaitGroup
+}
+
+func NewOutbox(sinks []Registered_Sink, appConfig *AppConfig) *Outbox {
+	o := &Outbox{
+		sinks:         sinks,
+		poll_interval: time.Duration(appConfig.OutboxPollInterval),
+		batch_size:    appConfig.OutboxBatchSize,
+		wake:          map[string]chan bool{},
+		done:          make(chan bool),
+	}
+	for _, s := range sinks {
+		o.wake[s.Name()] = make(chan bool, 1)
+	}
+	return o
+}
+
+// Accept stores msg and one outbox row per matching sink in a single
+// transaction. A message whose deduplicationId was already accepted is
+// acknowledged again without being stored twice.
+func (o *Outbox) Accept(ctx context.Context, msg *Uplink_Message) (duplicate bool, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO uplink_message (received_at, dev_eui, deduplication_id, source_address, gateway_id, payload)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (deduplication_id) WHERE deduplication_id <> '' DO NOTHING
+		RETURNING id;`,
+		msg.Received_At, msg.Dev_Eui, msg.Deduplication_Id, msg.Source_Address, msg.Gateway_Id, string(msg.Raw)).Scan(&msg.Id)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range o.sinks {
+		if !s.Config.Filter.Match(msg) {
+			continue
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO sink_outbox (message_id, sink_name) VALUES ($1, $2);`, msg.Id, s.Name())
+		if err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	// Let the dispatchers pick the message up now instead of on their next poll.
+	for _, ch := range o.wake {
+		select {
+		case ch <- true:
+		default:
+		}
+	}
+	return false, nil
+}
+
+func (o *Outbox) Start() {
+	for _, s := range o.sinks {
+		o.wg.Add(1)
+		go o.dispatch_worker(s)
+	}
+	outbox_log.Info("Successfully spawned dispatchers", "sinks", len(o.sinks))
+}
+
+func (o *Outbox) Stop() {
+	close(o.done)
+	o.wg.Wait()
+}
+
+func (o *Outbox) dispatch_worker(s Registered_Sink) {
+	defer o.wg.Done()
+	ticker := time.NewTicker(o.poll_interval)
+	defer ticker.Stop()
+
+	for {
+		// Keep going while full batches come back, there is more backlog.
+		for o.dispatch_batch(s) == o.batch_size {
+			select {
+			case <-o.done:
+				return
+			default:
+			}
+		}
+
+		select {
+		case <-o.done:
+			return
+		case <-ticker.C:
+		case <-o.wake[s.Name()]:
+		}
+	}
+}
+
+// dispatch_batch claims up to batch_size due rows for the sink, delivers
+// them and records the outcome. It returns how many rows it claimed.
+func (o *Outbox) dispatch_batch(s Registered_Sink) int {
+	ctx := context.Background()
+	rows, err := db.QueryContext(ctx, `
+		UPDATE sink_outbox o SET next_attempt_at = now() + $3 * interval '1 second'
+		FROM uplink_message m
+		WHERE m.id = o.message_id
+		  AND (o.message_id, o.sink_name) IN (
+			SELECT message_id, sink_name FROM sink_outbox
+			WHERE sink_name = $1 AND status = 'pending' AND next_attempt_at <= now()
+			ORDER BY message_id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED)
+		RETURNING o.message_id, o.attempts, m.received_at, m.source_address, m.gateway_id, m.payload;`,
+		s.Name(), o.batch_size, outbox_lease.Seconds())
+	if err != nil {
+		outbox_log.Warn("Failed to claim rows", "sink", s.Name(), "err", err)
+		return 0
+	}
+
+	type claimed struct {
+		msg      *Uplink_Message
+		attempts int
+	}
+	batch := []claimed{}
+	for rows.Next() {
+		var id int64
+		var attempts int
+		var received_at time.Time
+		var source_address string
+		var gateway_id string
+		var payload []byte
+		if err := rows.Scan(&id, &attempts, &received_at, &source_address, &gateway_id, &payload); err != nil {
+			outbox_log.Warn("Failed to read claimed row", "sink", s.Name(), "err", err)
+			continue
+		}
+		msg, err := NewUplinkMessage(payload)
+		if err != nil {
+			o.record_failure(s, id, attempts, err, true)
+			continue
+		}
+		msg.Id = id
+		msg.Received_At = received_at
+		msg.Source_Address = source_address
+		msg.Gateway_Id = gateway_id
+		batch = append(batch, claimed{msg: msg, attempts: attempts})
+	}
+	rows.Close()
+
+	for _, c := range batch {
+		write_ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := s.Write(write_ctx, c.msg)
+		cancel()
+		if err != nil {
+			o.record_failure(s, c.msg.Id, c.attempts, err, false)
+			continue
+		}
+		_, err = db.ExecContext(ctx, `
+			UPDATE sink_outbox SET status = $3, attempts = attempts + 1, last_error = '', delivered_at = now()
+			WHERE message_id = $1 AND sink_name = $2;`, c.msg.Id, s.Name(), outbox_delivered)
+		if err != nil {
+			outbox_log.Warn("Failed to mark delivery", "sink", s.Name(), "err", err)
+		}
+	}
+	return len(batch)
+}
+
+// record_failure schedules the next attempt with exponential backoff, or
+// gives up when the sink's policy or max_attempts says so.
+func (o *Outbox) record_failure(s Registered_Sink, id int64, attempts int, cause error, permanent bool) {
+	attempts++
+	outbox_log.Warn("Sink failed message", "sink", s.Name(), "id", id, "attempt", attempts, "err", cause)
+
+	status, backoff := next_attempt(s.Config, attempts, permanent)
+	_, err := db.Exec(`
+		UPDATE sink_outbox SET status = $3, attempts = $4, last_error = $5, next_attempt_at = now() + $6 * interval '1 second'
+		WHERE message_id = $1 AND sink_name = $2;`,
+		id, s.Name(), status, attempts, cause.Error(), backoff.Seconds())
+	if err != nil {
+		outbox_log.Warn("Failed to record failure", "sink", s.Name(), "id", id, "err", err)
+	}
+}
+
+// next_attempt is the status of a message after its attempts-th failed
+// delivery and how long to wait before the next one.
+func next_attempt(sc SinkConfig, attempts int, permanent bool) (string, time.Duration) {
+	status := outbox_pending
+	if permanent || sc.OnError == sink_on_error_ignore || (sc.MaxAttempts > 0 && attempts >= sc.MaxAttempts) {
+		status = outbox_failed
+	}
+	backoff := time.Second << min(attempts, 10)
+	return status, min(backoff, outbox_max_backoff)
+}
+
+type Sink_Lag struct {
+	Sink               string
+	Pending            int64
+	Failed             int64
+	Delivered_Last_1h  int64
+	Oldest_Pending_Age float64
+	Last_Error         string
+}
+
+func outbox_lag() ([]Sink_Lag, error) {
+	rows, err := db.Query(`
+		SELECT sink_name,
+			count(*) FILTER (WHERE status = 'pending'),
+			count(*) FILTER (WHERE status = 'failed'),
+			count(*) FILTER (WHERE status = 'delivered' AND delivered_at > now() - interval '1 hour'),
+			COALESCE(EXTRACT(EPOCH FROM now() - min(m.received_at) FILTER (WHERE status = 'pending')), 0)::float8,
+			COALESCE((array_agg(last_error ORDER BY message_id DESC) FILTER (WHERE last_error <> ''))[1], '')
+		FROM sink_outbox o JOIN uplink_message m ON m.id = o.message_id
+		GROUP BY sink_name
+		ORDER BY sink_name;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lags := []Sink_Lag{}
+	for rows.Next() {
+		var l Sink_Lag
+		if err := rows.Scan(&l.Sink, &l.Pending, &l.Failed, &l.Delivered_Last_1h, &l.Oldest_Pending_Age, &l.Last_Error); err != nil {
+			return nil, err
+		}
+		lags = append(lags, l)
+	}
+	return lags, rows.Err()
+}
+
+func sinkStatusHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	w.Header().Set("Content-Type", "application/json")
+
+	lags, err := outbox_lag()
+	if err != nil {
+		outbox_log.Warn("Failed to query outbox", "err", err)
+		write_json_error(w, http.StatusInternalServerError, "Failed to query outbox")
+		return
+	}
+	json.NewEncoder(w).Encode(lags)
+}
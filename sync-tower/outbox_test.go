@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextAttempt(t *testing.T) {
+	retry := SinkConfig{OnError: sink_on_error_retry}
+	tests := []struct {
+		name      string
+		config    SinkConfig
+		attempts  int
+		permanent bool
+		status    string
+		backoff   time.Duration
+	}{
+		{"first failure", retry, 1, false, outbox_pending, 2 * time.Second},
+		{"backoff doubles", retry, 3, false, outbox_pending, 8 * time.Second},
+		{"backoff capped", retry, 12, false, outbox_pending, outbox_max_backoff},
+		{"permanent error", retry, 1, true, outbox_failed, 2 * time.Second},
+		{"ignore gives up at once", SinkConfig{OnError: sink_on_error_ignore}, 1, false, outbox_failed, 2 * time.Second},
+		{"below max_attempts", SinkConfig{OnError: sink_on_error_retry, MaxAttempts: 3}, 2, false, outbox_pending, 4 * time.Second},
+		{"reached max_attempts", SinkConfig{OnError: sink_on_error_retry, MaxAttempts: 3}, 3, false, outbox_failed, 8 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, backoff := next_attempt(tt.config, tt.attempts, tt.permanent)
+			if status != tt.status || backoff != tt.backoff {
+				t.Errorf("next_attempt() = %s, %v, want %s, %v", status, backoff, tt.status, tt.backoff)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// app_config is the config in effect, swapped on reload.
+var app_config atomic.Pointer[AppConfig]
+
+func current_config() *AppConfig {
+	return app_config.Load()
+}
+
+// reload_mu is held for reading while a request hands a message to the
+// outbox and for writing while a reload swaps the outbox and sinks.
+var reload_mu sync.RWMutex
+
+// reload_config loads config.yaml again and rebuilds the sinks, outbox,
+// maintenance job, health monitor and alert engine from it. Everything is
+// built before anything running is touched, so a config that fails
+// validation is refused and the old one keeps running.
+func reload_config(mode string) error {
+	prev := current_config()
+	next, err := LoadConfig(mode)
+	if err != nil {
+		return err
+	}
+	for key, changed := range map[string]bool{
+		"listen_address": next.ListenAddress != prev.ListenAddress,
+		"listen_port":    next.ListenPort != prev.ListenPort,
+		"database_url":   next.DatabaseUrl != prev.DatabaseUrl,
+		"uplink_path":    next.UplinkPath != prev.UplinkPath,
+		"heartbeat_path": next.HeartbeatPath != prev.HeartbeatPath,
+	} {
+		if changed {
+			main_log.Warn("Setting changed, it only takes effect after a restart", "key", key)
+		}
+	}
+	// Settings that need a restart keep their running value.
+	next.ListenAddress, next.ListenPort, next.DatabaseUrl = prev.ListenAddress, prev.ListenPort, prev.DatabaseUrl
+	next.UplinkPath, next.HeartbeatPath = prev.UplinkPath, prev.HeartbeatPath
+
+	next_sinks, err := build_sinks(next)
+	if err != nil {
+		return err
+	}
+	next_maintenance, err := NewMaintenance(next)
+	if err != nil {
+		close_sinks(next_sinks)
+		return err
+	}
+	next_health_monitor, err := NewHealthMonitor(next)
+	if err != nil {
+		close_sinks(next_sinks)
+		return err
+	}
+	next_alert_engine, err := NewAlertEngine(next)
+	if err != nil {
+		close_sinks(next_sinks)
+		return err
+	}
+	next_outbox := NewOutbox(next_sinks, next)
+
+	reload_mu.Lock()
+	prev_outbox, prev_sinks := outbox, sinks
+	outbox, sinks = next_outbox, next_sinks
+	app_config.Store(next)
+	configure_logging(next)
+	reload_mu.Unlock()
+
+	// Messages accepted meanwhile wait in sink_outbox. The new sinks were
+	// built stopped and only start once the old ones are closed, so an
+	// InfluxDB spill directory is never used by two running writers.
+	prev_outbox.Stop()
+	close_sinks(prev_sinks)
+	start_sinks(next_sinks)
+	next_outbox.Start()
+
+	maintenance.Stop()
+	maintenance = next_maintenance
+	maintenance.Start()
+
+	health_monitor.Stop()
+	health_monitor = next_health_monitor
+	health_monitor.Start()
+
+	alert_engine.Stop()
+	alert_engine = next_alert_engine
+	alert_engine.Start()
+
+	main_log.Info("Successfully reloaded config", "sinks", len(next_sinks), "health_targets", len(next.HealthTargets), "alert_rules", len(next.AlertRules))
+	return nil
+}
+
+// watch_config_file asks for a reload whenever the modification time of
+// path changes. Polling keeps this working on filesystems without inotify.
+func watch_config_file(path string, interval time.Duration, reload chan<- bool) {
+	var last time.Time
+	if info, err := os.Stat(path); err == nil {
+		last = info.ModTime()
+	}
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(last) {
+			continue
+		}
+		last = info.ModTime()
+		main_log.Info("Config file changed, reloading", "file", path)
+		select {
+		case reload <- true:
+		default:
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReloadConfigRefused(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"unparsable", "test: ["},
+		{"missing environment", "prod:\n  database_url: postgres://localhost/cache-sync\n"},
+		{"missing database_url", "test:\n  listen_port: 8899\n"},
+		{"unknown sink type", "test:\n  database_url: postgres://localhost/cache-sync\n  sinks:\n    - name: archive\n      type: kafka\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			if err := os.WriteFile("config.yaml", []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			running := &AppConfig{DatabaseUrl: "postgres://localhost/cache-sync", ListenPort: 8899}
+			test_config(t, running)
+			if err := reload_config("test"); err == nil {
+				t.Fatal("reload_config() accepted the config")
+			}
+			if current_config() != running {
+				t.Error("a refused config replaced the running one")
+			}
+		})
+	}
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	path := t.TempDir() + "/config.yaml"
+	if err := os.WriteFile(path, []byte("test: {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reload := make(chan bool, 1)
+	go watch_config_file(path, 10*time.Millisecond, reload)
+
+	select {
+	case <-reload:
+		t.Fatal("reload asked for before the file changed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reload:
+	case <-time.After(time.Second):
+		t.Fatal("no reload after the file changed")
+	}
+}
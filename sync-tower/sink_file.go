@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileSink appends every uplink as one JSON line to file_path, rotating it
+// to file_path.<timestamp> once it grows past file_max_size_mb and keeping
+// at most file_max_files rotated files.
+type FileSink struct {
+	name      string
+	path      string
+	max_size  int64
+	max_files int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewFileSink(sc SinkConfig) (*FileSink, error) {
+	if sc.FilePath == "" {
+		return nil, fmt.Errorf("sink %s: file_path is required", sc.Name)
+	}
+	if err := os.MkdirAll(filepath.Dir(sc.FilePath), 0o755); err != nil {
+		return nil, err
+	}
+	s := &FileSink{
+		name:      sc.Name,
+		path:      sc.FilePath,
+		max_size:  int64(sc.FileMaxSize) * 1024 * 1024,
+		max_files: sc.FileMaxFiles,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) Name() string { return s.name }
+
+func (s *FileSink) Write(ctx context.Context, msg *Uplink_Message) error {
+	// Compact the payload so each uplink is exactly one line.
+	var line bytes.Buffer
+	if err := json.Compact(&line, msg.Raw); err != nil {
+		return err
+	}
+	line.WriteByte('\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.size > 0 && s.size+int64(line.Len()) > s.max_size {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line.Bytes())
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	s.file.Close()
+	s.file = nil
+
+	rotated := s.path + "." + time.Now().Format("20060102T150405.000")
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+
+	old, _ := filepath.Glob(s.path + ".*")
+	// Timestamps sort lexically, so the oldest files come first.
+	for len(old) > s.max_files {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+	return s.open()
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSinkWrite(t *testing.T) {
+	tests := []struct {
+		name      string
+		max_size  int64
+		max_files int
+		writes    int
+		current   int // lines left in file_path
+		rotated   int
+	}{
+		{"appends", 1 << 20, 2, 3, 3, 0},
+		{"rotates past max size", 40, 5, 3, 1, 2},
+		{"keeps max files", 40, 1, 4, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "uplinks.ndjson")
+			s, err := NewFileSink(SinkConfig{Name: "archive", FilePath: path, FileMaxSize: 1, FileMaxFiles: tt.max_files})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.max_size = tt.max_size
+			for range tt.writes {
+				if err := s.Write(context.Background(), &Uplink_Message{Raw: []byte(`{ "deviceInfo": { "devEui": "0004a30b001c0530" } }`)}); err != nil {
+					t.Fatal(err)
+				}
+				// Rotated files are named by the millisecond.
+				time.Sleep(2 * time.Millisecond)
+			}
+			s.Close()
+
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+			if len(lines) != tt.current {
+				t.Errorf("file_path holds %d lines, want %d", len(lines), tt.current)
+			}
+			if lines[0] != `{"deviceInfo":{"devEui":"0004a30b001c0530"}}` {
+				t.Errorf("line not compacted: %s", lines[0])
+			}
+			rotated, _ := filepath.Glob(path + ".*")
+			if len(rotated) != tt.rotated {
+				t.Errorf("%d rotated files, want %d", len(rotated), tt.rotated)
+			}
+		})
+	}
+}
+
+func TestFileSinkRejectsInvalidJson(t *testing.T) {
+	s, err := NewFileSink(SinkConfig{Name: "archive", FilePath: filepath.Join(t.TempDir(), "uplinks.ndjson"), FileMaxSize: 1, FileMaxFiles: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Write(context.Background(), &Uplink_Message{Raw: []byte(`{"devEui":`)}); err == nil {
+		t.Error("Write() accepted a truncated payload")
+	}
+}
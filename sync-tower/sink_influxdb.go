@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// InfluxdbSink turns the decoded "object" of an uplink into a point and
+// hands it to a buffered InfluxWriter. Aggregates become a point in the
+// measurement suffixed _aggregate, with a _min, _max, _mean and _last field
+// for each summed up field.
+type InfluxdbSink struct {
+	name        string
+	measurement string
+	client      influxdb2.Client
+	writer      *InfluxWriter
+}
+
+func NewInfluxdbSink(sc SinkConfig, appConfig *AppConfig) (*InfluxdbSink, error) {
+	// Unset sink fields fall back to the top level influxdb_* settings.
+	cfg := *appConfig
+	if sc.InfluxdbUrl != "" {
+		cfg.InfluxdbUrl = sc.InfluxdbUrl
+	}
+	if sc.InfluxdbToken != "" {
+		cfg.InfluxdbToken = sc.InfluxdbToken
+	}
+	if sc.InfluxdbOrg != "" {
+		cfg.InfluxdbOrg = sc.InfluxdbOrg
+	}
+	if sc.InfluxdbBucket != "" {
+		cfg.InfluxdbBucket = sc.InfluxdbBucket
+	}
+	if sc.InfluxdbMeasurement != "" {
+		cfg.InfluxdbMeasurement = sc.InfluxdbMeasurement
+	}
+	if cfg.InfluxdbSpillDir == "" {
+		cfg.InfluxdbSpillDir = "influx_spill"
+	}
+	// Each sink spills into its own directory so replays never cross buckets.
+	cfg.InfluxdbSpillDir = cfg.InfluxdbSpillDir + "/" + sc.Name
+
+	client := influxdb2.NewClient(cfg.InfluxdbUrl, string(cfg.InfluxdbToken))
+	writer, err := NewInfluxWriter(client, &cfg)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &InfluxdbSink{
+		name:        sc.Name,
+		measurement: cfg.InfluxdbMeasurement,
+		client:      client,
+		writer:      writer,
+	}, nil
+}
+
+func (s *InfluxdbSink) Name() string { return s.name }
+
+func (s *InfluxdbSink) Write(ctx context.Context, msg *Uplink_Message) error {
+	tags := map[string]string{
+		"dev_eui": msg.Dev_Eui,
+	}
+	if agg := msg.Aggregate; agg != nil {
+		fields := map[string]any{"count": agg.Count}
+		for path, f := range agg.Fields {
+			name := strings.TrimPrefix(path, "object.")
+			fields[name+"_min"] = f.Min
+			fields[name+"_max"] = f.Max
+			fields[name+"_mean"] = f.Mean
+			fields[name+"_last"] = f.Last
+		}
+		s.writer.Enqueue(write.NewPoint(s.measurement+"_aggregate", tags, fields, agg.Last_Time))
+		return nil
+	}
+	fields := map[string]any{}
+	if object, ok := msg.Parsed["object"].(map[string]any); ok {
+		fields = object
+		if msg.Dev_Eui == "009569060003e9be" {
+			if data, ok := object["data"].(map[string]any); ok {
+				fields = data
+			}
+		}
+	}
+
+	if len(fields) > 0 {
+		s.writer.Enqueue(write.NewPoint(s.measurement, tags, fields, msg.Time))
+	}
+	return nil
+}
+
+// Start starts the writer, which replays what earlier writers left in the
+// spill directory.
+func (s *InfluxdbSink) Start() { s.writer.Start() }
+
+func (s *InfluxdbSink) Close() error {
+	s.writer.Close()
+	s.client.Close()
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+func TestInfluxdbSinkWrite(t *testing.T) {
+	last := time.Date(2025, 1, 31, 13, 58, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		msg   *Uplink_Message
+		lines []string
+	}{
+		{"uplink", &Uplink_Message{Dev_Eui: "0004a30b001c0530", Time: last, Parsed: map[string]any{"object": map[string]any{"temperature": 21.5}}},
+			[]string{"uplink,dev_eui=0004a30b001c0530 temperature=21.5 1738331880000000000\n"}},
+		{"no object", &Uplink_Message{Dev_Eui: "0004a30b001c0530", Time: last, Parsed: map[string]any{"fCnt": 7.0}}, []string{}},
+		{"aggregate", &Uplink_Message{Dev_Eui: "0004a30b001c0530", Time: last.Add(time.Minute), Aggregate: &Aggregate{Count: 3, Last_Time: last,
+			Fields: map[string]Aggregate_Field{"object.sensor.humidity": {Min: 40, Max: 44, Mean: 42, Last: 42}}}},
+			[]string{"uplink_aggregate,dev_eui=0004a30b001c0530 count=3i,sensor.humidity_last=42,sensor.humidity_max=44," +
+				"sensor.humidity_mean=42,sensor.humidity_min=40 1738331880000000000\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := test_influx_writer(t, &fake_write_api{})
+			w.points = make(chan *write.Point, 4)
+			s := &InfluxdbSink{name: "influx", measurement: "uplink", writer: w}
+			if err := s.Write(context.Background(), tt.msg); err != nil {
+				t.Fatal(err)
+			}
+			close(w.points)
+			lines := []string{}
+			for p := range w.points {
+				lines = append(lines, write.PointToLineProtocol(p, time.Nanosecond))
+			}
+			if !slices.Equal(lines, tt.lines) {
+				t.Errorf("points %q, want %q", lines, tt.lines)
+			}
+		})
+	}
+}
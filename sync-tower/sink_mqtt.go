@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MqttSink republishes the raw uplink to another broker. mqtt_topic may
+// contain {dev_eui} and {application} placeholders.
+type MqttSink struct {
+	name   string
+	topic  string
+	qos    byte
+	retain bool
+	client mqtt.Client
+}
+
+func NewMqttSink(sc SinkConfig) (*MqttSink, error) {
+	if sc.MqttBroker == "" || sc.MqttTopic == "" {
+		return nil, fmt.Errorf("sink %s: mqtt_broker and mqtt_topic are required", sc.Name)
+	}
+	if sc.MqttQos < 0 || sc.MqttQos > 2 {
+		return nil, fmt.Errorf("sink %s: invalid mqtt_qos %d", sc.Name, sc.MqttQos)
+	}
+
+	client := new_mqtt_client("sync-tower-"+sc.Name, sc.MqttBroker, sc.MqttUser, sc.MqttPassword)
+
+	return &MqttSink{
+		name:   sc.Name,
+		topic:  sc.MqttTopic,
+		qos:    byte(sc.MqttQos),
+		retain: bool(sc.MqttRetain),
+		client: client,
+	}, nil
+}
+
+// new_mqtt_client connects to broker in the background. With connect retry
+// enabled Connect returns immediately, so a broker that is down does not
+// block startup.
+func new_mqtt_client(client_id string, broker string, user string, password Secret) mqtt.Client {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID(client_id)
+	opts.SetUsername(user)
+	opts.SetPassword(string(password))
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(30 * time.Second)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.OnConnectionLost = func(client mqtt.Client, err error) {
+		sink_log.Warn("MQTT client lost connection, reconnecting", "client_id", client_id, "err", err)
+	}
+
+	client := mqtt.NewClient(opts)
+	client.Connect()
+	return client
+}
+
+func (s *MqttSink) Name() string { return s.name }
+
+func (s *MqttSink) Write(ctx context.Context, msg *Uplink_Message) error {
+	topic := strings.NewReplacer(
+		"{dev_eui}", msg.Dev_Eui,
+		"{application}", msg.Application,
+	).Replace(s.topic)
+
+	token := s.client.Publish(topic, s.qos, s.retain, msg.Raw)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *MqttSink) Close() error {
+	s.client.Disconnect(250)
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+)
+
+// PostgresSink stores the uplink in the chirpstack_ingest table, with the
+// fields our dashboards query pulled out into typed columns. Aggregates go
+// to chirpstack_aggregate instead.
+type PostgresSink struct {
+	name             string
+	tenant_name      string
+	application_name string
+}
+
+func NewPostgresSink(sc SinkConfig) *PostgresSink {
+	s := &PostgresSink{
+		name:             sc.Name,
+		tenant_name:      sc.TenantName,
+		application_name: sc.ApplicationName,
+	}
+	if s.tenant_name == "" {
+		s.tenant_name = "cache-sync"
+	}
+	if s.application_name == "" {
+		s.application_name = "CSB-DEMO"
+	}
+	return s
+}
+
+func (s *PostgresSink) Name() string { return s.name }
+
+// Ingest_Row holds the typed columns of a chirpstack_ingest row. Pointers
+// are NULL when the payload does not carry the field.
+type Ingest_Row struct {
+	Device_Name *string
+	FCnt        *int64
+	FPort       *int64
+	Dr          *int64
+	Frequency   *int64
+	Rssi        *int64
+	Snr         *float64
+	Gateway_Ids []string
+}
+
+// NewIngestRow extracts the typed columns from a ChirpStack uplink event.
+// RSSI and SNR are the best values over all receiving gateways.
+func NewIngestRow(parsed map[string]any) Ingest_Row {
+	row := Ingest_Row{Gateway_Ids: []string{}}
+	if name, err := getNestedString(parsed, "deviceInfo", "deviceName"); err == nil {
+		row.Device_Name = &name
+	}
+	row.FCnt = json_int(parsed["fCnt"])
+	row.FPort = json_int(parsed["fPort"])
+	row.Dr = json_int(parsed["dr"])
+	if txInfo, ok := parsed["txInfo"].(map[string]any); ok {
+		row.Frequency = json_int(txInfo["frequency"])
+	}
+
+	rxInfo, _ := parsed["rxInfo"].([]any)
+	for _, item := range rxInfo {
+		rx, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		if rssi := json_int(rx["rssi"]); rssi != nil && (row.Rssi == nil || *rssi > *row.Rssi) {
+			row.Rssi = rssi
+		}
+		if snr, ok := rx["snr"].(float64); ok && (row.Snr == nil || snr > *row.Snr) {
+			row.Snr = &snr
+		}
+		if id, ok := rx["gatewayId"].(string); ok && !slices.Contains(row.Gateway_Ids, id) {
+			row.Gateway_Ids = append(row.Gateway_Ids, id)
+		}
+	}
+	return row
+}
+
+func json_int(val any) *int64 {
+	f, ok := val.(float64)
+	if !ok {
+		return nil
+	}
+	n := int64(f)
+	return &n
+}
+
+func (s *PostgresSink) Write(ctx context.Context, msg *Uplink_Message) error {
+	if msg.Aggregate != nil {
+		return s.write_aggregate(ctx, msg)
+	}
+	row := NewIngestRow(msg.Parsed)
+	sqlStatement := ` INSERT INTO chirpstack_ingest (message_id, received_at, time, dev_eui, device_name, tenant_name, application_name,
+							f_cnt, f_port, dr, frequency, rssi, snr, gateway_ids, deduplication_id, gateway_id, raw_payload)
+							VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+							ON CONFLICT (message_id, received_at) DO NOTHING;`
+	_, err := db.ExecContext(ctx, sqlStatement, msg.Id, msg.Received_At, msg.Time, msg.Dev_Eui, row.Device_Name,
+		s.tenant_name, s.application_name, row.FCnt, row.FPort, row.Dr, row.Frequency, row.Rssi, row.Snr,
+		row.Gateway_Ids, msg.Deduplication_Id, msg.Gateway_Id, string(msg.Raw))
+	return err
+}
+
+func (s *PostgresSink) write_aggregate(ctx context.Context, msg *Uplink_Message) error {
+	row := NewIngestRow(msg.Parsed)
+	agg := msg.Aggregate
+	fields, err := json.Marshal(agg.Fields)
+	if err != nil {
+		return err
+	}
+	sqlStatement := ` INSERT INTO chirpstack_aggregate (message_id, received_at, dev_eui, device_name, tenant_name, application_name,
+							gateway_id, deduplication_id, window_start, window_end, count, first_time, last_time, fields, raw_payload)
+							VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+							ON CONFLICT (message_id) DO NOTHING;`
+	_, err = db.ExecContext(ctx, sqlStatement, msg.Id, msg.Received_At, msg.Dev_Eui, row.Device_Name,
+		s.tenant_name, s.application_name, msg.Gateway_Id, msg.Deduplication_Id, agg.Window_Start, agg.Window_End,
+		agg.Count, agg.First_Time, agg.Last_Time, string(fields), string(msg.Raw))
+	return err
+}
+
+func (s *PostgresSink) Close() error { return nil }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestNewIngestRow(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		device   string
+		f_cnt    int64
+		rssi     int64
+		snr      float64
+		gateways []string
+	}{
+		{
+			name:     "single gateway",
+			payload:  `{"deviceInfo":{"deviceName":"tank-1"},"fCnt":42,"fPort":2,"dr":5,"txInfo":{"frequency":923200000},"rxInfo":[{"gatewayId":"a","rssi":-80,"snr":7.5}]}`,
+			device:   "tank-1",
+			f_cnt:    42,
+			rssi:     -80,
+			snr:      7.5,
+			gateways: []string{"a"},
+		},
+		{
+			name:     "best of several gateways",
+			payload:  `{"deviceInfo":{"deviceName":"tank-1"},"fCnt":1,"rxInfo":[{"gatewayId":"a","rssi":-110,"snr":9},{"gatewayId":"b","rssi":-90,"snr":-2},{"gatewayId":"a","rssi":-100,"snr":1}]}`,
+			device:   "tank-1",
+			f_cnt:    1,
+			rssi:     -90,
+			snr:      9,
+			gateways: []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var parsed map[string]any
+			if err := json.Unmarshal([]byte(tt.payload), &parsed); err != nil {
+				t.Fatal(err)
+			}
+			row := NewIngestRow(parsed)
+			if row.Device_Name == nil || *row.Device_Name != tt.device {
+				t.Errorf("Device_Name = %v, want %s", row.Device_Name, tt.device)
+			}
+			if row.FCnt == nil || *row.FCnt != tt.f_cnt {
+				t.Errorf("FCnt = %v, want %d", row.FCnt, tt.f_cnt)
+			}
+			if row.Rssi == nil || *row.Rssi != tt.rssi {
+				t.Errorf("Rssi = %v, want %d", row.Rssi, tt.rssi)
+			}
+			if row.Snr == nil || *row.Snr != tt.snr {
+				t.Errorf("Snr = %v, want %v", row.Snr, tt.snr)
+			}
+			if !slices.Equal(row.Gateway_Ids, tt.gateways) {
+				t.Errorf("Gateway_Ids = %v, want %v", row.Gateway_Ids, tt.gateways)
+			}
+		})
+	}
+}
+
+func TestNewIngestRowMissingFields(t *testing.T) {
+	row := NewIngestRow(map[string]any{"rxInfo": []any{"not an object"}})
+	if row.Device_Name != nil || row.FCnt != nil || row.FPort != nil || row.Dr != nil || row.Frequency != nil || row.Rssi != nil || row.Snr != nil {
+		t.Errorf("NewIngestRow() = %+v, want NULL columns", row)
+	}
+	if row.Gateway_Ids == nil || len(row.Gateway_Ids) != 0 {
+		t.Errorf("Gateway_Ids = %v, want an empty array", row.Gateway_Ids)
+	}
+}
+
+func TestJsonInt(t *testing.T) {
+	tests := []struct {
+		name string
+		val  any
+		want *int64
+	}{
+		{"number", float64(923200000), new_int64(923200000)},
+		{"negative", float64(-80), new_int64(-80)},
+		{"string", "42", nil},
+		{"missing", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := json_int(tt.val)
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("json_int(%v) = %v, want %v", tt.val, got, tt.want)
+			}
+		})
+	}
+}
+
+func new_int64(n int64) *int64 { return &n }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// WebhookSink POSTs the raw uplink JSON to an outbound URL.
+type WebhookSink struct {
+	name    string
+	url     string
+	headers map[string]Secret
+	client  *http.Client
+}
+
+func NewWebhookSink(sc SinkConfig) (*WebhookSink, error) {
+	if sc.WebhookUrl == "" {
+		return nil, fmt.Errorf("sink %s: webhook_url is required", sc.Name)
+	}
+	return &WebhookSink{
+		name:    sc.Name,
+		url:     sc.WebhookUrl,
+		headers: sc.WebhookHeaders,
+		client:  &http.Client{Timeout: time.Duration(sc.WebhookTimeout)},
+	}, nil
+}
+
+func (s *WebhookSink) Name() string { return s.name }
+
+func (s *WebhookSink) Write(ctx context.Context, msg *Uplink_Message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(msg.Raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.headers {
+		req.Header.Set(key, string(value))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *WebhookSink) Close() error { return nil }
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var sink_log = component_logger("sink")
+
+// Uplink_Message is a single uplink accepted by uplinkHandler. Id is its
+// row in uplink_message once the outbox has stored it. Aggregate is set
+// when a gateway compacted its queue and the payload sums up several
+// uplinks instead of carrying readings.
+type Uplink_Message struct {
+	Id               int64
+	Received_At      time.Time
+	Deduplication_Id string
+	Dev_Eui          string
+	Application      string
+	FPort            int
+	Time             time.Time
+	Raw              []byte
+	Parsed           map[string]any
+	Source_Address   string
+	Gateway_Id       string
+	Aggregate        *Aggregate
+}
+
+// Aggregate is the "aggregate" of a payload edge-vault compacted: the
+// numeric fields of Count uplinks of one device within the window, keyed by
+// their path such as object.temperature.
+type Aggregate struct {
+	Window_Start time.Time                  `json:"windowStart"`
+	Window_End   time.Time                  `json:"windowEnd"`
+	Count        int                        `json:"count"`
+	First_Time   time.Time                  `json:"firstTime"`
+	Last_Time    time.Time                  `json:"lastTime"`
+	Fields       map[string]Aggregate_Field `json:"fields"`
+}
+
+type Aggregate_Field struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+	Last float64 `json:"last"`
+}
+
+// Sink is a destination for ingested uplinks. Write must be safe to call
+// from concurrent goroutines.
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, msg *Uplink_Message) error
+	Close() error
+}
+
+type (
+	SinkConfig struct {
+		Name    string     `yaml:"name"`
+		Type    string     `yaml:"type"`
+		Enable  Bool       `yaml:"enable"`
+		OnError string     `yaml:"on_error"`
+		Filter  SinkFilter `yaml:"filter"`
+
+		// Give up on a message after this many failed deliveries, 0 retries forever.
+		MaxAttempts int `yaml:"max_attempts"`
+
+		// postgres
+		TenantName      string `yaml:"tenant_name"`
+		ApplicationName string `yaml:"application_name"`
+
+		// influxdb, falls back to the top level influxdb_* settings
+		InfluxdbUrl         string `yaml:"influxdb_url"`
+		InfluxdbToken       Secret `yaml:"influxdb_token"`
+		InfluxdbOrg         string `yaml:"influxdb_org"`
+		InfluxdbBucket      string `yaml:"influxdb_bucket"`
+		InfluxdbMeasurement string `yaml:"influxdb_measurement"`
+
+		// mqtt
+		MqttBroker   string `yaml:"mqtt_broker"`
+		MqttUser     string `yaml:"mqtt_user"`
+		MqttPassword Secret `yaml:"mqtt_password"`
+		MqttTopic    string `yaml:"mqtt_topic"`
+		MqttQos      int    `yaml:"mqtt_qos"`
+		MqttRetain   Bool   `yaml:"mqtt_retain"`
+
+		// webhook
+		WebhookUrl     string            `yaml:"webhook_url"`
+		WebhookHeaders map[string]Secret `yaml:"webhook_headers"`
+		WebhookTimeout Duration          `yaml:"webhook_timeout"` // 10s
+
+		// file
+		FilePath     string `yaml:"file_path"`
+		FileMaxSize  int    `yaml:"file_max_size_mb"` // 100
+		FileMaxFiles int    `yaml:"file_max_files"`   // 10
+	}
+
+	// SinkFilter limits which uplinks reach a sink. Empty lists match all.
+	SinkFilter struct {
+		DevEui        []string `yaml:"dev_eui"`
+		ExcludeDevEui []string `yaml:"exclude_dev_eui"`
+		Application   []string `yaml:"application"`
+		FPort         []int    `yaml:"f_port"`
+	}
+)
+
+func (sc *SinkConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain SinkConfig
+	p := plain{
+		WebhookTimeout: Duration(10 * time.Second),
+		FileMaxSize:    100,
+		FileMaxFiles:   10,
+	}
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	*sc = SinkConfig(p)
+	return nil
+}
+
+// Sink error policies. With "retry" the outbox keeps redelivering a failed
+// message with backoff, with "ignore" it is marked failed after one attempt.
+// "reject" is the older name for "retry".
+const (
+	sink_on_error_retry  = "retry"
+	sink_on_error_ignore = "ignore"
+	sink_on_error_reject = "reject"
+)
+
+// Registered_Sink is a sink together with the config that routes to it.
+type Registered_Sink struct {
+	Sink
+	Config SinkConfig
+}
+
+func (f SinkFilter) Match(msg *Uplink_Message) bool {
+	if len(f.DevEui) > 0 && !slices.Contains(f.DevEui, msg.Dev_Eui) {
+		return false
+	}
+	if slices.Contains(f.ExcludeDevEui, msg.Dev_Eui) {
+		return false
+	}
+	if len(f.Application) > 0 && !slices.Contains(f.Application, msg.Application) {
+		return false
+	}
+	if len(f.FPort) > 0 && !slices.Contains(f.FPort, msg.FPort) {
+		return false
+	}
+	return true
+}
+
+// sink_configs returns the configured sinks, or the historic Postgres plus
+// optional InfluxDB pair when config.yaml has no sinks section.
+func sink_configs(appConfig *AppConfig) []SinkConfig {
+	if len(appConfig.Sinks) > 0 {
+		return appConfig.Sinks
+	}
+	configs := []SinkConfig{{Name: "postgres", Type: "postgres", Enable: true}}
+	if appConfig.InfluxdbEnable {
+		configs = append(configs, SinkConfig{Name: "influxdb", Type: "influxdb", Enable: true})
+	}
+	return configs
+}
+
+func NewSink(sc SinkConfig, appConfig *AppConfig) (Sink, error) {
+	switch sc.Type {
+	case "postgres":
+		return NewPostgresSink(sc), nil
+	case "influxdb":
+		return NewInfluxdbSink(sc, appConfig)
+	case "mqtt":
+		return NewMqttSink(sc)
+	case "webhook":
+		return NewWebhookSink(sc)
+	case "file":
+		return NewFileSink(sc)
+	}
+	return nil, fmt.Errorf("sink %s: unknown type %q", sc.Name, sc.Type)
+}
+
+func build_sinks(appConfig *AppConfig) ([]Registered_Sink, error) {
+	sinks := []Registered_Sink{}
+	for _, sc := range sink_configs(appConfig) {
+		if sc.Name == "" {
+			sc.Name = sc.Type
+		}
+		if !sc.Enable {
+			sink_log.Info("Sink disabled", "sink", sc.Name)
+			continue
+		}
+		if sc.OnError == "" || sc.OnError == sink_on_error_reject {
+			sc.OnError = sink_on_error_retry
+		}
+		if sc.OnError != sink_on_error_retry && sc.OnError != sink_on_error_ignore {
+			close_sinks(sinks)
+			return nil, fmt.Errorf("sink %s: unknown on_error policy %q", sc.Name, sc.OnError)
+		}
+		s, err := NewSink(sc, appConfig)
+		if err != nil {
+			close_sinks(sinks)
+			return nil, err
+		}
+		sinks = append(sinks, Registered_Sink{Sink: s, Config: sc})
+		sink_log.Info("Successfully created sink", "sink", sc.Name, "type", sc.Type)
+	}
+	return sinks, nil
+}
+
+// start_sinks starts the background work of the sinks that have any. Sinks
+// are built stopped so ones replacing others on a reload, like two
+// InfluxDB writers on the same spill directory, never run side by side.
+func start_sinks(sinks []Registered_Sink) {
+	for _, s := range sinks {
+		if starter, ok := s.Sink.(interface{ Start() }); ok {
+			starter.Start()
+		}
+	}
+}
+
+func close_sinks(sinks []Registered_Sink) {
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			sink_log.Warn("Failed to close sink", "sink", s.Name(), "err", err)
+		}
+	}
+}
+
+// NewUplinkMessage decodes a ChirpStack uplink event body.
+func NewUplinkMessage(raw []byte) (*Uplink_Message, error) {
+	var parsed map[string]any
+	if err := json.Unmarshal(raw, &parsed); err != nil {
+		return nil, err
+	}
+
+	msg := &Uplink_Message{
+		Received_At: time.Now(),
+		Raw:         raw,
+		Parsed:      parsed,
+	}
+	msg.Dev_Eui, _ = getNestedString(parsed, "deviceInfo", "devEui")
+	msg.Application, _ = getNestedString(parsed, "deviceInfo", "applicationName")
+	msg.Deduplication_Id, _ = getNestedString(parsed, "deduplicationId")
+	if fport, ok := parsed["fPort"].(float64); ok {
+		msg.FPort = int(fport)
+	}
+	payload_time, _ := getNestedString(parsed, "time")
+	msg.Time, _ = time.Parse(time.RFC3339Nano, payload_time)
+	if msg.Time.IsZero() {
+		msg.Time = msg.Received_At
+	}
+	if _, ok := parsed["aggregate"]; ok {
+		var body struct {
+			Aggregate Aggregate `json:"aggregate"`
+		}
+		if err := json.Unmarshal(raw, &body); err != nil {
+			return nil, fmt.Errorf("aggregate: %w", err)
+		}
+		msg.Aggregate = &body.Aggregate
+	}
+	return msg, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestSinkFilterMatch(t *testing.T) {
+	msg := &Uplink_Message{Dev_Eui: "0004a30b001c0530", Application: "spectra", FPort: 2}
+	tests := []struct {
+		name   string
+		filter SinkFilter
+		want   bool
+	}{
+		{"empty matches all", SinkFilter{}, true},
+		{"dev_eui listed", SinkFilter{DevEui: []string{"0004a30b001c0530"}}, true},
+		{"dev_eui not listed", SinkFilter{DevEui: []string{"0004a30b001c0531"}}, false},
+		{"dev_eui excluded", SinkFilter{ExcludeDevEui: []string{"0004a30b001c0530"}}, false},
+		{"excluded wins over listed", SinkFilter{DevEui: []string{"0004a30b001c0530"}, ExcludeDevEui: []string{"0004a30b001c0530"}}, false},
+		{"application listed", SinkFilter{Application: []string{"other", "spectra"}}, true},
+		{"application not listed", SinkFilter{Application: []string{"other"}}, false},
+		{"f_port listed", SinkFilter{FPort: []int{1, 2}}, true},
+		{"f_port not listed", SinkFilter{FPort: []int{1}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(msg); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSinkConfigDefaults(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string
+		timeout   time.Duration
+		max_size  int
+		max_files int
+	}{
+		{"defaults", "name: archive\ntype: file", 10 * time.Second, 100, 10},
+		{"set", "name: archive\ntype: file\nwebhook_timeout: 3s\nfile_max_size_mb: 5\nfile_max_files: 2", 3 * time.Second, 5, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sc SinkConfig
+			if err := yaml.Unmarshal([]byte(tt.yaml), &sc); err != nil {
+				t.Fatal(err)
+			}
+			if time.Duration(sc.WebhookTimeout) != tt.timeout || sc.FileMaxSize != tt.max_size || sc.FileMaxFiles != tt.max_files {
+				t.Errorf("got %v, %d, %d, want %v, %d, %d", time.Duration(sc.WebhookTimeout), sc.FileMaxSize, sc.FileMaxFiles,
+					tt.timeout, tt.max_size, tt.max_files)
+			}
+		})
+	}
+}
+
+func TestBuildSinks(t *testing.T) {
+	file_sink := func(name string, on_error string, enable Bool) SinkConfig {
+		return SinkConfig{Name: name, Type: "file", Enable: enable, OnError: on_error,
+			FilePath: filepath.Join(t.TempDir(), name+".ndjson"), FileMaxSize: 1, FileMaxFiles: 1}
+	}
+	tests := []struct {
+		name     string
+		sinks    []SinkConfig
+		wantErr  bool
+		policies []string
+	}{
+		{"retry by default", []SinkConfig{file_sink("a", "", true)}, false, []string{sink_on_error_retry}},
+		{"reject is retry", []SinkConfig{file_sink("a", sink_on_error_reject, true)}, false, []string{sink_on_error_retry}},
+		{"ignore", []SinkConfig{file_sink("a", sink_on_error_ignore, true)}, false, []string{sink_on_error_ignore}},
+		{"disabled skipped", []SinkConfig{file_sink("a", "", false), file_sink("b", "", true)}, false, []string{sink_on_error_retry}},
+		{"unknown policy", []SinkConfig{file_sink("a", "drop", true)}, true, nil},
+		{"unknown type", []SinkConfig{{Name: "a", Type: "kafka", Enable: true}}, true, nil},
+		{"file without path", []SinkConfig{{Name: "a", Type: "file", Enable: true}}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sinks, err := build_sinks(&AppConfig{Sinks: tt.sinks})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("build_sinks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			defer close_sinks(sinks)
+			if len(sinks) != len(tt.policies) {
+				t.Fatalf("built %d sinks, want %d", len(sinks), len(tt.policies))
+			}
+			for i, s := range sinks {
+				if s.Config.OnError != tt.policies[i] {
+					t.Errorf("sink %s on_error = %s, want %s", s.Name(), s.Config.OnError, tt.policies[i])
+				}
+			}
+		})
+	}
+}
+
+type started_sink struct {
+	started bool
+}
+
+func (s *started_sink) Name() string                                         { return "started" }
+func (s *started_sink) Write(ctx context.Context, msg *Uplink_Message) error { return nil }
+func (s *started_sink) Close() error                                         { return nil }
+func (s *started_sink) Start()                                               { s.started = true }
+
+func TestStartSinks(t *testing.T) {
+	file_sinks, err := build_sinks(&AppConfig{Sinks: []SinkConfig{{Name: "file", Type: "file", Enable: true,
+		FilePath: filepath.Join(t.TempDir(), "file.ndjson"), FileMaxSize: 1, FileMaxFiles: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer close_sinks(file_sinks)
+	tests := []struct {
+		name    string
+		sinks   []Registered_Sink
+		started bool
+	}{
+		{"without start", file_sinks, false},
+		{"with start", []Registered_Sink{{Sink: &started_sink{}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start_sinks(tt.sinks)
+			for _, s := range tt.sinks {
+				if ss, ok := s.Sink.(*started_sink); ok != tt.started || (ok && !ss.started) {
+					t.Errorf("sink %s started = %v, want %v", s.Name(), ok, tt.started)
+				}
+			}
+		})
+	}
+}
+
+func TestSinkConfigsFallback(t *testing.T) {
+	tests := []struct {
+		name   string
+		config AppConfig
+		want   []string
+	}{
+		{"postgres only", AppConfig{}, []string{"postgres"}},
+		{"postgres and influxdb", AppConfig{InfluxdbEnable: true}, []string{"postgres", "influxdb"}},
+		{"configured sinks", AppConfig{InfluxdbEnable: true, Sinks: []SinkConfig{{Name: "archive", Type: "file"}}}, []string{"archive"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs := sink_configs(&tt.config)
+			names := []string{}
+			for _, sc := range configs {
+				names = append(names, sc.Name)
+			}
+			if len(names) != len(tt.want) {
+				t.Fatalf("sink_configs() = %v, want %v", names, tt.want)
+			}
+			for i := range names {
+				if names[i] != tt.want[i] {
+					t.Errorf("sink_configs() = %v, want %v", names, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewUplinkMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		want      Uplink_Message
+		aggregate *Aggregate
+		wantErr   bool
+	}{
+		{"uplink", `{"deduplicationId":"d1","time":"2025-01-31T13:45:00Z","deviceInfo":{"devEui":"0004a30b001c0530","applicationName":"spectra"},"fPort":2,"object":{"temperature":21.5}}`,
+			Uplink_Message{Dev_Eui: "0004a30b001c0530", Application: "spectra", Deduplication_Id: "d1", FPort: 2,
+				Time: time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC)}, nil, false},
+		{"aggregate", `{"deduplicationId":"a1","time":"2025-01-31T13:59:00Z","deviceInfo":{"devEui":"0004a30b001c0530"},"fPort":2,"aggregate":{` +
+			`"windowStart":"2025-01-31T13:45:00Z","windowEnd":"2025-01-31T14:00:00Z","count":3,"firstTime":"2025-01-31T13:46:00Z","lastTime":"2025-01-31T13:58:00Z",` +
+			`"fields":{"object.temperature":{"min":19.5,"max":21.5,"mean":20.5,"last":20.5}}}}`,
+			Uplink_Message{Dev_Eui: "0004a30b001c0530", Deduplication_Id: "a1", FPort: 2, Time: time.Date(2025, 1, 31, 13, 59, 0, 0, time.UTC)},
+			&Aggregate{Window_Start: time.Date(2025, 1, 31, 13, 45, 0, 0, time.UTC), Window_End: time.Date(2025, 1, 31, 14, 0, 0, 0, time.UTC), Count: 3,
+				First_Time: time.Date(2025, 1, 31, 13, 46, 0, 0, time.UTC), Last_Time: time.Date(2025, 1, 31, 13, 58, 0, 0, time.UTC),
+				Fields: map[string]Aggregate_Field{"object.temperature": {Min: 19.5, Max: 21.5, Mean: 20.5, Last: 20.5}}}, false},
+		{"broken aggregate", `{"aggregate":{"count":"three"}}`, Uplink_Message{}, nil, true},
+		{"not json", `{"deviceInfo":`, Uplink_Message{}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := NewUplinkMessage([]byte(tt.raw))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("NewUplinkMessage() = %+v, want an error", msg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Dev_Eui != tt.want.Dev_Eui || msg.Application != tt.want.Application || msg.Deduplication_Id != tt.want.Deduplication_Id ||
+				msg.FPort != tt.want.FPort || !msg.Time.Equal(tt.want.Time) {
+				t.Errorf("NewUplinkMessage() = %+v, want %+v", msg, tt.want)
+			}
+			if !reflect.DeepEqual(msg.Aggregate, tt.aggregate) {
+				t.Errorf("Aggregate = %+v, want %+v", msg.Aggregate, tt.aggregate)
+			}
+		})
+	}
+}
@@ -5,110 +5,107 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
-	"gopkg.in/yaml.v3"
-
-	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
-	"github.com/influxdata/influxdb-client-go/v2/api/write"
 )
 
-var Reset = "\033[0m"
-var Red = "\033[31m"
-var Green = "\033[32m"
-var Yellow = "\033[33m"
-var Blue = "\033[34m"
-var Magenta = "\033[35m"
-var Cyan = "\033[36m"
-var Gray = "\033[37m"
-var White = "\033[97m"
-
-var infoLog = log.New(os.Stdout, Green+"[INFO] "+Reset, log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
-var warnLog = log.New(os.Stdout, Yellow+"[WARN] "+Reset, log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+var main_log = component_logger("main")
+var inbound_log = component_logger("inbound")
 
 var db *sql.DB
-var influx_client influxdb2.Client
-
-type (
-	AppConfig struct {
-		ListenAddress       string `taml:"listen_address"`
-		ListenPort          string `yaml:"listen_port"`
-		UplinkPath          string `yaml:"uplink_path"`
-		DatabaseUrl         string `yaml:"database_url"`
-		InfluxdbEnable      string `yaml:"influxdb_enable"`
-		InfluxdbVersion     string `yaml:"influxdb_version"`
-		InfluxdbUrl         string `yaml:"influxdb_url"`
-		InfluxdbToken       string `yaml:"influxdb_token"`
-		InfluxdbOrg         string `yaml:"influxdb_org"`
-		InfluxdbBucket      string `yaml:"influxdb_bucket"`
-		InfluxdbMeasurement string `yaml:"influxdb_measurement"`
-	}
-
-	ConfigFile map[string]*AppConfig
-)
+var sinks []Registered_Sink
+var outbox *Outbox
+var maintenance *Maintenance
+var health_monitor *HealthMonitor
+var alert_engine *AlertEngine
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(check_config(os.Args[2:]))
+	}
+
+	mode := "dev"
 
-func LoadConfig(env string) (*AppConfig, error) {
-	configFile := ConfigFile{}
-	file, _ := os.Open("config.yaml")
-	defer file.Close()
-	decoder := yaml.NewDecoder(file)
+	main_log.Info("Sync Tower application is starting", "mode", mode)
 
-	// Always check for errors!
-	if err := decoder.Decode(&configFile); err != nil {
-		return nil, err
+	appConfig, err := LoadConfig(mode)
+	if err != nil {
+		panic(err)
 	}
+	app_config.Store(appConfig)
+	configure_logging(appConfig)
+	main_log.Info("Successfully loaded config.yaml", "log_format", appConfig.LogFormat, "log_level", slog.Level(appConfig.LogLevel))
 
-	appConfig, ok := configFile[env]
-	if !ok {
-		return nil, fmt.Errorf("no such environment: %s", env)
+	db, err = sql.Open("pgx", string(appConfig.DatabaseUrl))
+	if err != nil {
+		panic(err)
 	}
+	main_log.Info("Successfully connected to postgres database", "database_url", appConfig.DatabaseUrl)
 
-	return appConfig, nil
-}
+	if err := migrate(db); err != nil {
+		panic(err)
+	}
 
-func main() {
-	mode := "dev"
+	sinks, err = build_sinks(appConfig)
+	if err != nil {
+		panic(err)
+	}
+	start_sinks(sinks)
+	main_log.Info("Successfully created sinks", "sinks", len(sinks))
 
-	infoLog.Println("Sync Tower application is starting in " + Blue + mode + Reset + " mode")
+	outbox = NewOutbox(sinks, appConfig)
+	outbox.Start()
 
-	infoLog.Println("Loading " + Blue + "./config.yaml" + Reset + " configuration file...")
-	appConfig, err := LoadConfig(mode)
+	maintenance, err = NewMaintenance(appConfig)
 	if err != nil {
 		panic(err)
 	}
-	infoLog.Println(Green + "Successfully " + Reset + "loaded " + Blue + "config.yaml" + Reset + " configuration file!")
+	maintenance.Start()
 
-	infoLog.Println("Connecting to postgres database...")
-	db, err = sql.Open("pgx", appConfig.DatabaseUrl)
+	health_monitor, err = NewHealthMonitor(appConfig)
 	if err != nil {
 		panic(err)
 	}
-	infoLog.Println(Green + "Successfully " + Reset + "connected to postgres database!")
+	health_monitor.Start()
 
-	if appConfig.InfluxdbEnable == "y" {
-		infoLog.Println("Creating InfluxDB Client...")
-		influx_client = influxdb2.NewClient(appConfig.InfluxdbUrl, appConfig.InfluxdbToken)
-		infoLog.Print(Green + "Successfully " + Reset + "created InfluxDB Client Object!")
-	} else {
-		infoLog.Println("InfluxDB integration disabled")
+	alert_engine, err = NewAlertEngine(appConfig)
+	if err != nil {
+		panic(err)
 	}
+	alert_engine.Start()
+	main_log.Info("Successfully started alert engine", "rules", len(appConfig.AlertRules), "channels", len(appConfig.AlertChannels))
 
-	infoLog.Println("Starting http server configuration with " + Blue + "port:" + appConfig.ListenPort + " path:" + appConfig.UplinkPath + Reset + "...")
-
-	infoLog.Println("Configuring routes...")
 	http.HandleFunc(appConfig.UplinkPath, func(w http.ResponseWriter, r *http.Request) {
-		uplinkHandler(w, r, appConfig)
+		uplinkHandler(w, r, current_config())
 	})
-	infoLog.Println(Green + "Successfully " + Reset + "configured routes!")
+	http.HandleFunc("/cache-sync/status/sinks", sinkStatusHandler)
+	http.HandleFunc("/cache-sync/status/maintenance", maintenanceStatusHandler)
+	http.HandleFunc("/cache-sync/status/applications", applicationStatusHandler)
+	http.HandleFunc(appConfig.HeartbeatPath, heartbeatHandler)
+	http.HandleFunc("/cache-sync/gateways", func(w http.ResponseWriter, r *http.Request) {
+		gatewaysHandler(w, r, current_config())
+	})
+	http.HandleFunc("/cache-sync/gateways/config", gatewayConfigHandler)
+	http.HandleFunc("/cache-sync/gateways/config/current", gatewayConfigCurrentHandler)
+	http.HandleFunc("/cache-sync/gateways/config/report", gatewayConfigReportHandler)
+	http.HandleFunc("/cache-sync/commands", commandsHandler)
+	http.HandleFunc("/cache-sync/commands/poll", commandPollHandler)
+	http.HandleFunc("/cache-sync/commands/ack", commandAckHandler)
+	http.HandleFunc("/cache-sync/alerts", alertsHandler)
+	http.HandleFunc("/cache-sync/alerts/ack", alertAckHandler)
+	http.HandleFunc("/cache-sync/alerts/silences", alertSilencesHandler)
+	http.HandleFunc("/cache-sync/audit", auditHandler)
 
 	server := &http.Server{
-		Addr:         appConfig.ListenAddress + ":" + appConfig.ListenPort,
+		Addr:         appConfig.ListenAddress + ":" + strconv.Itoa(appConfig.ListenPort),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -120,17 +117,47 @@ func main() {
 
 	// Start server in a goroutine so it doesn't block
 	go func() {
-		infoLog.Printf(Green+"Server starting on %s"+Reset, server.Addr)
+		main_log.Info("Server starting", "address", server.Addr, "uplink_path", appConfig.UplinkPath)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			infoLog.Fatalf("Server failed: %v", err)
+			main_log.Error("Server failed", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Reload on SIGHUP, and on every change of config.yaml when config_watch
+	// is enabled. Reloads run here so they never overlap with each other or
+	// with the shutdown below.
+	reload := make(chan bool, 1)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			main_log.Info("Received SIGHUP, reloading")
+			select {
+			case reload <- true:
+			default:
+			}
 		}
 	}()
+	if appConfig.ConfigWatch {
+		go watch_config_file("config.yaml", 5*time.Second, reload)
+	}
 
 	// Wait for shutdown signal
 	// Reading from channel is a blocking operation
 	// Thread will stall here until a value because available in the channel
-	<-done
-	infoLog.Println("Server is shutting down...")
+wait:
+	for {
+		select {
+		case <-done:
+			break wait
+		case <-reload:
+			if err := reload_config(mode); err != nil {
+				main_log.Warn("Refused to reload config.yaml, keeping the running config", "err", err)
+			}
+		}
+	}
+	main_log.Info("Server is shutting down")
 
 	// Create a deadline to wait for existing connections to finish
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -138,11 +165,16 @@ func main() {
 
 	// Attempt graceful shutdown
 	if err := server.Shutdown(ctx); err != nil {
-		infoLog.Printf("Graceful shutdown failed: %v\n", err)
+		main_log.Warn("Graceful shutdown failed", "err", err)
 	} else {
-		infoLog.Println("Server stopped")
+		main_log.Info("Server stopped")
 	}
 
+	alert_engine.Stop()
+	health_monitor.Stop()
+	maintenance.Stop()
+	outbox.Stop()
+	close_sinks(sinks)
 }
 
 func enableCors(w *http.ResponseWriter) {
@@ -151,6 +183,14 @@ func enableCors(w *http.ResponseWriter) {
 	(*w).Header().Set("Access-Control-Allow-Headers", "Content-Type, Access-Control-Allow-Headers, Authorization, X-Requested-With")
 }
 
+func write_json_error(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": message,
+	})
+}
+
 func uplinkHandler(w http.ResponseWriter, r *http.Request, appConfig *AppConfig) {
 
 	enableCors(&w)
@@ -165,63 +205,80 @@ func uplinkHandler(w http.ResponseWriter, r *http.Request, appConfig *AppConfig)
 		return // Important: return to stop further execution
 	}
 
-	infoLog.Println(Magenta + "INBOUND : " + Reset + Blue + r.Method + " " + r.RequestURI + Reset + Magenta + " Source : " + Reset + Blue + r.RemoteAddr + Reset)
-
-	var parsed map[string]any
-	json.NewDecoder(r.Body).Decode(&parsed)
-
-	devEui, _ := getNestedString(parsed, "deviceInfo", "devEui")
-	payload_time, _ := getNestedString(parsed, "time")
-	print(payload_time)
-	parsedTime, _ := time.Parse("2006-01-02T15:04:05.999Z07:00", payload_time)
-
-	//Inbound processing Postgres here
-	sqlStatement := ` INSERT INTO chirpstack_ingest (dev_eui, tenant_name, application_name, raw_payload)
-							VALUES ($1, $2, $3, $4);`
-	_, err := db.Exec(sqlStatement, devEui, "cache-sync", "CSB-DEMO", parsed)
-
+	raw, err := io.ReadAll(r.Body)
 	if err != nil {
-		warnLog.Println(err)
+		inbound_log.Warn("Failed to read uplink", "source", r.RemoteAddr, "outcome", "rejected", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
+	msg, err := NewUplinkMessage(raw)
+	if err != nil {
+		inbound_log.Warn("Rejected malformed uplink", "source", r.RemoteAddr, "outcome", "rejected", "err", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Malformed JSON payload",
+		})
+		return
+	}
+	msg.Source_Address = r.RemoteAddr
+	msg.Gateway_Id = r.Header.Get("X-Gateway-Id")
 
-	//Inbound processinf InfluxDB here.
-	if appConfig.InfluxdbEnable == "y" {
-		writeAPI := influx_client.WriteAPIBlocking(appConfig.InfluxdbOrg, appConfig.InfluxdbBucket)
-
-		tags := map[string]string{
-			"dev_eui": devEui,
-		}
-		fields := map[string]any{}
-		for key, value := range parsed {
-			if key == "object" {
-				if devEui == "009569060003e9be" {
-					temp_val := value.(map[string]any)
-					fields = temp_val["data"].(map[string]any)
-				} else {
-					fields = value.(map[string]any)
-				}
-
-			}
-		}
+	reload_mu.RLock()
+	duplicate, err := outbox.Accept(r.Context(), msg)
+	reload_mu.RUnlock()
+	if err != nil {
+		// Not a 200, so edge-vault keeps the message queued and retries it.
+		inbound_log.Warn("Failed to store uplink", uplink_log_attrs(msg, "failed", "err", err)...)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to store message",
+		})
+		return
+	}
 
-		point := write.NewPoint(appConfig.InfluxdbMeasurement, tags, fields, parsedTime)
-		if err := writeAPI.WritePoint(context.Background(), point); err != nil {
-			log.Fatal(err)
+	// Hand pending commands back to the gateway with the acknowledgement, the
+	// message is stored already so a failure here only delays them. Uplinks
+	// are taken from any gateway, commands only go to one that authenticated.
+	commands := []Command{}
+	if gateway_authenticated(appConfig, r, msg.Gateway_Id) {
+		if commands, err = claim_commands(r.Context(), msg.Gateway_Id, 20); err != nil {
+			inbound_log.Warn("Failed to claim commands", "gateway_id", msg.Gateway_Id, "err", err)
 		}
 	}
+	outcome := "stored"
+	if duplicate {
+		outcome = "duplicate"
+	}
+	inbound_log.Info("Received uplink", uplink_log_attrs(msg, outcome, "commands", len(commands))...)
 
 	//Response prep
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	payload := struct {
-		Status string
+		Status   string
+		Commands []Command
 	}{
-		Status: "OK",
+		Status:   "OK",
+		Commands: commands,
 	}
 
 	json.NewEncoder(w).Encode(payload)
 }
 
+// uplink_log_attrs are the fields every uplink log line carries.
+func uplink_log_attrs(msg *Uplink_Message, outcome string, args ...any) []any {
+	return append([]any{
+		"msg_id", msg.Deduplication_Id,
+		"dev_eui", msg.Dev_Eui,
+		"application", msg.Application,
+		"gateway_id", msg.Gateway_Id,
+		"source", msg.Source_Address,
+		"outcome", outcome,
+	}, args...)
+}
+
 func getNestedString(m map[string]interface{}, keys ...string) (string, error) {
 	var val interface{} = m
 	for _, key := range keys {